@@ -0,0 +1,549 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	lineCommand  = "U_AT_CLIENT_TEST_REPLAY_COMMAND"
+	lineResponse = "U_AT_CLIENT_TEST_REPLAY_RESPONSE"
+	lineUrc      = "U_AT_CLIENT_TEST_REPLAY_URC"
+)
+
+// One line of the replay
+type replayLine struct {
+	lineType string
+	bytes    []byte
+	delayMs  int64
+}
+
+// Timestamps that may start a line of a trace: a time of day, e.g.
+// "12:34:56.789", or a number in square brackets, e.g. "[1234]",
+// which is taken as milliseconds unless it has a decimal point, in
+// which case it is taken as seconds
+var timeOfDay = regexp.MustCompile(`^\[?(\d{1,2}):(\d{2}):(\d{2})(?:[.,](\d{1,6}))?\]?\s*`)
+var bracketTime = regexp.MustCompile(`^\[\s*(\d+)(\.\d+)?\]\s*`)
+
+// Markers of direction, as written by most serial sniffers
+var direction = regexp.MustCompile(`^(>>|<<|->|<-|>|<|TX:|RX:|tx:|rx:)\s?`)
+
+// The lines of ubxlib's own logging, other than the AT traffic
+var logLine = regexp.MustCompile(`^U_[A-Z0-9_-]+: `)
+
+// The two-digit hex that the AT client prints for non-printable characters
+var hexEscape = regexp.MustCompile(`\[([0-9a-fA-F]{2})\]`)
+
+var urcPrefix = regexp.MustCompile(`^(\+[A-Z0-9]+):`)
+
+var finalResults = []string{"OK", "ERROR", "+CME ERROR:", "+CMS ERROR:", "ABORTED",
+	"NO CARRIER", "NO DIALTONE", "BUSY", "NO ANSWER", "CONNECT"}
+
+// Take any timestamp off the front of a line, returning it in milliseconds
+func parseTime(line string) (string, int64, bool) {
+	match := timeOfDay.FindStringSubmatch(line)
+	if match != nil {
+		hours, _ := strconv.ParseInt(match[1], 10, 64)
+		minutes, _ := strconv.ParseInt(match[2], 10, 64)
+		seconds, _ := strconv.ParseInt(match[3], 10, 64)
+		milliseconds := int64(0)
+		if match[4] != "" {
+			fraction, _ := strconv.ParseFloat("0."+match[4], 64)
+			milliseconds = int64(fraction * 1000)
+		}
+		return line[len(match[0]):], ((hours*60+minutes)*60+seconds)*1000 + milliseconds, true
+	}
+	match = bracketTime.FindStringSubmatch(line)
+	if match != nil {
+		whole, _ := strconv.ParseInt(match[1], 10, 64)
+		if match[2] == "" {
+			return line[len(match[0]):], whole, true
+		}
+		fraction, _ := strconv.ParseFloat("0"+match[2], 64)
+		return line[len(match[0]):], whole*1000 + int64(fraction*1000), true
+	}
+	return line, 0, false
+}
+
+// Turn the "[0d]" style escapes back into bytes
+func decode(text string) []byte {
+	return []byte(hexEscape.ReplaceAllStringFunc(text, func(match string) string {
+		value, _ := strconv.ParseUint(match[1:3], 16, 8)
+		return string([]byte{byte(value)})
+	}))
+}
+
+func isFinalResult(text string) bool {
+	for _, result := range finalResults {
+		if strings.HasPrefix(text, result) {
+			return true
+		}
+	}
+	return false
+}
+
+// The prefix that the response to a command is expected to
+// have, e.g. "+COPS" for "AT+COPS?", empty if there is none
+func commandPrefix(command string) string {
+	if len(command) < 3 || command[2] != '+' {
+		return ""
+	}
+	end := strings.IndexAny(command, "=?")
+	if end < 0 {
+		end = len(command)
+	}
+	return strings.ToUpper(command[2:end])
+}
+
+type converter struct {
+	urcs        []string
+	lines       []replayLine
+	inCommand   string
+	commandOpen bool
+	lastTime    int64
+	timed       bool
+	ignored     int
+}
+
+func (c *converter) isUrc(text string) bool {
+	for _, prefix := range c.urcs {
+		if strings.HasPrefix(text, prefix) {
+			return true
+		}
+	}
+	match := urcPrefix.FindStringSubmatch(text)
+	if match == nil {
+		return false
+	}
+	if !c.commandOpen {
+		return true
+	}
+	// During a command, a line with a prefix other than that of
+	// the command can only be a URC, unless the command has no
+	// prefix, e.g. ATI, in which case anything goes
+	prefix := commandPrefix(c.inCommand)
+	return prefix != "" && match[1] != prefix
+}
+
+func (c *converter) add(lineType string, bytes []byte, timestamp int64, hasTime bool) {
+	line := replayLine{lineType: lineType, bytes: bytes}
+	if hasTime {
+		if c.timed && timestamp >= c.lastTime {
+			line.delayMs = timestamp - c.lastTime
+		}
+		c.lastTime = timestamp
+		c.timed = true
+	}
+	c.lines = append(c.lines, line)
+}
+
+// Convert one line of a trace
+func (c *converter) convert(raw string) {
+	text, timestamp, hasTime := parseTime(strings.TrimRight(raw, "\r\n"))
+	toModule, fromModule := false, false
+	if match := direction.FindStringSubmatch(text); match != nil {
+		marker := strings.ToUpper(match[1])
+		toModule = marker == ">" || marker == ">>" || marker == "->" || marker == "TX:"
+		fromModule = !toModule
+		text = text[len(match[0]):]
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	if !toModule && !fromModule && logLine.MatchString(text) {
+		c.ignored++
+		return
+	}
+	isCommand := toModule || (!fromModule && strings.HasPrefix(strings.ToUpper(text), "AT"))
+	if isCommand {
+		c.inCommand = text
+		c.commandOpen = true
+		c.add(lineCommand, append(decode(text), '\r'), timestamp, hasTime)
+		return
+	}
+	if fromModule && c.commandOpen && text == c.inCommand {
+		// The module echoing the command
+		return
+	}
+	bytes := append(decode(text), '\r', '\n')
+	switch {
+	case c.isUrc(text):
+		c.add(lineUrc, bytes, timestamp, hasTime)
+	case c.commandOpen:
+		c.add(lineResponse, bytes, timestamp, hasTime)
+		if isFinalResult(text) {
+			c.commandOpen = false
+		}
+	case fromModule:
+		c.add(lineUrc, bytes, timestamp, hasTime)
+	default:
+		slog.Debug("Ignoring line.", "line", text)
+		c.ignored++
+	}
+}
+
+// Write a C string literal, escaping anything that isn't printable;
+// octal escapes are used since a hex escape would swallow any hex
+// digits that follow it
+func cString(bytes []byte) string {
+	var builder strings.Builder
+	builder.WriteByte('"')
+	for _, b := range bytes {
+		switch {
+		case b == '\r':
+			builder.WriteString(`\r`)
+		case b == '\n':
+			builder.WriteString(`\n`)
+		case b == '"' || b == '\\':
+			builder.WriteByte('\\')
+			builder.WriteByte(b)
+		case b == '?':
+			// Avoid trigraphs
+			builder.WriteString(`\?`)
+		case b < 0x20 || b > 0x7e:
+			builder.WriteString(fmt.Sprintf("\\%03o", b))
+		default:
+			builder.WriteByte(b)
+		}
+	}
+	builder.WriteByte('"')
+	return builder.String()
+}
+
+func writeC(writer io.Writer, lines []replayLine, name string, source string, maxDelayMs int64) {
+	variable := "gAtClientTestReplay" + name
+	fmt.Fprintf(writer, "/* Generated by at_trace_gen.go from %s on %s: do not edit. */\n\n",
+		filepath.Base(source), time.Now().UTC().Format("2006-01-02"))
+	fmt.Fprintf(writer, "#include \"stddef.h\"\n#include \"stdint.h\"\n\n")
+	fmt.Fprintf(writer, "#include \"u_at_client_test_replay.h\"\n\n")
+	fmt.Fprintf(writer, "/** The lines of the replay.\n */\n")
+	fmt.Fprintf(writer, "const uAtClientTestReplayLine_t %s[] = {\n", variable)
+	for _, line := range lines {
+		delay := line.delayMs
+		if maxDelayMs >= 0 && delay > maxDelayMs {
+			delay = maxDelayMs
+		}
+		fmt.Fprintf(writer, "    {%s, %s, %d, %d},\n", line.lineType, cString(line.bytes), len(line.bytes), delay)
+	}
+	fmt.Fprintf(writer, "};\n\n")
+	fmt.Fprintf(writer, "/** The number of lines in %s.\n */\n", variable)
+	fmt.Fprintf(writer, "const size_t %sCount = sizeof(%s) / sizeof(%s[0]);\n\n// End of file\n",
+		variable, variable, variable)
+}
+
+// Make a CamelCase name from, for instance, a file name
+func camelCase(text string) string {
+	var builder strings.Builder
+	for _, word := range regexp.MustCompile(`[^A-Za-z0-9]+`).Split(text, -1) {
+		if word != "" {
+			builder.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return builder.String()
+}
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"timing", "urc-detection", "direction-markers"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "at_trace_gen", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "at_trace_gen")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+func main() {
+	defer recoverPanic()
+
+	name := flag.String("name", "", "Name to put after gAtClientTestReplay in the C variable names, default from the input file name.")
+	output := flag.String("out", "", "File to write the C table to, default stdout.")
+	urcs := flag.String("urc", "", "Comma-separated prefixes of lines that are always URCs, e.g. \"+CEREG:,+UUSORD:\".")
+	maxDelayMs := flag.Int64("max_delay_ms", -1, "Limit the delay before any line to this many milliseconds, -1 for no limit.")
+	noTiming := flag.Bool("no_timing", false, "Ignore any timestamps in the trace.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] trace_file|-\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		exit(exitUsage)
+	}
+	source := flag.Arg(0)
+	reader := os.Stdin
+	if source != "-" {
+		file, err := os.Open(source)
+		if err != nil {
+			logFatal("Failed to open file.", "error", err)
+		}
+		defer file.Close()
+		reader = file
+	}
+	if *name == "" {
+		*name = camelCase(strings.TrimSuffix(filepath.Base(source), filepath.Ext(source)))
+		if *name == "" {
+			*name = "Trace"
+		}
+	}
+
+	c := &converter{}
+	for _, prefix := range strings.Split(*urcs, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			c.urcs = append(c.urcs, prefix)
+		}
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 65536), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if *noTiming {
+			line, _, _ = parseTime(line)
+		}
+		c.convert(line)
+	}
+	if err := scanner.Err(); err != nil {
+		logFatal("Failed to read trace.", "error", err)
+	}
+
+	writer := os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			logFatal("Failed to create file.", "error", err)
+		}
+		defer file.Close()
+		writer = file
+	}
+	writeC(writer, c.lines, *name, source, *maxDelayMs)
+
+	commands := 0
+	for _, line := range c.lines {
+		if line.lineType == lineCommand {
+			commands++
+		}
+	}
+	slog.Info("Converted.", "lines", len(c.lines), "commands", commands, "ignored", c.ignored, "timed", c.timed)
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Run with: go test at_trace_gen.go at_trace_gen_test.go
+// and fuzz with: go test -fuzz=FuzzConvert at_trace_gen.go at_trace_gen_test.go
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A trace as printed by ubxlib with AT printing on
+const ubxlibTrace = `[1000] U_CELL: initialising.
+[1010] AT+CEREG?
+[1025] +CREG: 0,5
+[1030] +CEREG: 0,5
+[1031] OK
+[2000] AT+USOWR=0,5,"68656c6c6f"
+[2040] +USOWR: 0,5
+[2041] OK
+[2500] +UUSORD: 0,5
+[3000] ATI
+[3010] SARA-R422M8S-00B
+[3011] ERROR
+`
+
+// A trace from a serial sniffer, with the module's echo
+const snifferTrace = `12:00:00.000 > AT+CSQ
+12:00:00.010 < AT+CSQ
+12:00:00.020 < +CSQ: 15,99
+12:00:00.021 < OK
+12:00:01.500 RX: +CEREG: 1[0d]
+`
+
+func convertTrace(trace string, urcs ...string) *converter {
+	c := &converter{urcs: urcs}
+	for _, line := range strings.Split(trace, "\n") {
+		c.convert(line)
+	}
+	return c
+}
+
+func TestConvert(t *testing.T) {
+	type line struct {
+		lineType string
+		text     string
+		delayMs  int64
+	}
+	tests := []struct {
+		name     string
+		trace    string
+		expected []line
+	}{
+		{"ubxlib", ubxlibTrace, []line{
+			{lineCommand, "AT+CEREG?\r", 0},
+			{lineUrc, "+CREG: 0,5\r\n", 15},
+			{lineResponse, "+CEREG: 0,5\r\n", 5},
+			{lineResponse, "OK\r\n", 1},
+			{lineCommand, "AT+USOWR=0,5,\"68656c6c6f\"\r", 969},
+			{lineResponse, "+USOWR: 0,5\r\n", 40},
+			{lineResponse, "OK\r\n", 1},
+			{lineUrc, "+UUSORD: 0,5\r\n", 459},
+			{lineCommand, "ATI\r", 500},
+			{lineResponse, "SARA-R422M8S-00B\r\n", 10},
+			{lineResponse, "ERROR\r\n", 1},
+		}},
+		{"sniffer", snifferTrace, []line{
+			{lineCommand, "AT+CSQ\r", 0},
+			{lineResponse, "+CSQ: 15,99\r\n", 20},
+			{lineResponse, "OK\r\n", 1},
+			{lineUrc, "+CEREG: 1\r\r\n", 1479},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := convertTrace(test.trace)
+			if len(c.lines) != len(test.expected) {
+				t.Fatalf("%d lines, expected %d: %+v", len(c.lines), len(test.expected), c.lines)
+			}
+			for x, expected := range test.expected {
+				l := c.lines[x]
+				if l.lineType != expected.lineType || string(l.bytes) != expected.text || l.delayMs != expected.delayMs {
+					t.Errorf("line %d is %s %q %d, expected %s %q %d", x, l.lineType, l.bytes, l.delayMs,
+						expected.lineType, expected.text, expected.delayMs)
+				}
+			}
+		})
+	}
+}
+
+// Undo the escaping of cString(), as a C compiler would
+func cUnquote(literal string) (string, bool) {
+	if len(literal) < 2 || literal[0] != '"' || literal[len(literal)-1] != '"' {
+		return "", false
+	}
+	var builder strings.Builder
+	for x := 1; x < len(literal)-1; x++ {
+		b := literal[x]
+		if b == '"' {
+			return "", false
+		}
+		if b != '\\' {
+			builder.WriteByte(b)
+			continue
+		}
+		x++
+		if x >= len(literal)-1 {
+			return "", false
+		}
+		switch literal[x] {
+		case 'r':
+			builder.WriteByte('\r')
+		case 'n':
+			builder.WriteByte('\n')
+		case '"', '\\', '?':
+			builder.WriteByte(literal[x])
+		default:
+			if x+3 > len(literal)-1 {
+				return "", false
+			}
+			value, err := strconv.ParseUint(literal[x:x+3], 8, 8)
+			if err != nil {
+				return "", false
+			}
+			builder.WriteByte(byte(value))
+			x += 2
+		}
+	}
+	return builder.String(), true
+}
+
+// Whatever the trace, conversion must not panic and every line must
+// come out of the C table as the bytes that went in
+func FuzzConvert(f *testing.F) {
+	f.Add(ubxlibTrace)
+	f.Add(snifferTrace)
+	f.Add("AT+UDCONF=1,\"??=\"[00][ff]\\\r\n[00:00:01] >> AT\n<< OK")
+	f.Add("[99999999999999999999] AT\n[1.5] OK\n[\n>")
+	f.Fuzz(func(t *testing.T, trace string) {
+		c := convertTrace(trace, "+UUSORD:")
+		var output bytes.Buffer
+		writeC(&output, c.lines, "Fuzz", "fuzz.log", 5000)
+		for _, l := range c.lines {
+			if l.delayMs < 0 {
+				t.Errorf("negative delay %d", l.delayMs)
+			}
+			literal := cString(l.bytes)
+			text, ok := cUnquote(literal)
+			if !ok || text != string(l.bytes) {
+				t.Errorf("%q written as %s", l.bytes, literal)
+			}
+			if !strings.Contains(output.String(), literal) {
+				t.Errorf("%s missing from the table", literal)
+			}
+		}
+	})
+}
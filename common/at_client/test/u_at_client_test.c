@@ -55,6 +55,7 @@
 #include "u_at_client.h"
 #include "u_at_client_test.h"
 #include "u_at_client_test_data.h"
+#include "u_at_client_test_replay.h"
 
 /* ----------------------------------------------------------------
  * COMPILE-TIME MACROS
@@ -88,6 +89,21 @@
  */
 #define U_AT_CLIENT_TEST_AT_TIMEOUT_TOLERANCE_MS 250
 
+/** The maximum number of different URC prefixes in a replay.
+ */
+#define U_AT_CLIENT_TEST_REPLAY_MAX_NUM_URC_PREFIXES 8
+
+/** The maximum length of a URC prefix in a replay, including
+ * the colon and the null terminator.
+ */
+#define U_AT_CLIENT_TEST_REPLAY_MAX_URC_PREFIX_LENGTH 16
+
+/** How long to wait at the end of a replay for any URCs
+ * that follow the last response; at_trace_gen is run with
+ * -max_delay_ms 1000 for gAtClientTestReplayExample[].
+ */
+#define U_AT_CLIENT_TEST_REPLAY_END_WAIT_MS 2000
+
 /* ----------------------------------------------------------------
  * TYPES
  * -------------------------------------------------------------- */
@@ -136,6 +152,17 @@ static char gAtServerBuffer[1024];
  */
 static const char *gpInterceptTxDataLast = NULL;
 
+/** The state of the AT server stub for atClientReplay.
+ */
+static uAtClientTestReplay_t gReplay;
+
+/** The prefixes of the URCs in a replay: the AT client keeps
+ * a pointer to the prefix of a URC handler so these have to
+ * stay put.
+ */
+static char gReplayUrcPrefix[U_AT_CLIENT_TEST_REPLAY_MAX_NUM_URC_PREFIXES]
+[U_AT_CLIENT_TEST_REPLAY_MAX_URC_PREFIX_LENGTH];
+
 # endif
 #endif
 
@@ -811,6 +838,88 @@ static char *pInterceptRx(uAtClientHandle_t atHandle,
     return pData;
 }
 
+// Get the "+XXX:" prefix of a line of a replay into pPrefix,
+// returning its length, zero if the line has no such prefix.
+static size_t replayLinePrefix(const uAtClientTestReplayLine_t *pLine,
+                               char *pPrefix, size_t prefixLength)
+{
+    size_t length = 0;
+
+    if ((pLine->length > 0) && (*(pLine->pBytes) == '+')) {
+        for (size_t x = 1; (x < pLine->length) && (x + 1 < prefixLength) &&
+             (length == 0) && isprint((int32_t) pLine->pBytes[x]); x++) {
+            if (pLine->pBytes[x] == ':') {
+                length = x + 1;
+                memcpy(pPrefix, pLine->pBytes, length);
+                *(pPrefix + length) = 0;
+            }
+        }
+    }
+
+    return length;
+}
+
+// The URC handler for atClientReplay: just count the URCs.
+static void replayUrcHandler(uAtClientHandle_t atClientHandle,
+                             void *pParameters)
+{
+    (void) atClientHandle;
+
+    (*((size_t *) pParameters))++;
+}
+
+// Send a command of a replay from the AT client and read its
+// response, one information response for each line of response
+// before the final result, returning the error code from
+// uAtClientUnlock().
+static int32_t replayCommand(uAtClientHandle_t atClientHandle,
+                             const uAtClientTestReplayLine_t *pCommand,
+                             const uAtClientTestReplayLine_t *pEnd)
+{
+    const uAtClientTestReplayLine_t *pLine;
+    const uAtClientTestReplayLine_t *pFinal = pCommand;
+    char prefix[U_AT_CLIENT_TEST_REPLAY_MAX_URC_PREFIX_LENGTH];
+    size_t length = pCommand->length;
+    bool responseStarted = false;
+
+    // The final result is the last line of response before
+    // the next command
+    for (pLine = pCommand + 1; (pLine < pEnd) &&
+         (pLine->type != U_AT_CLIENT_TEST_REPLAY_COMMAND); pLine++) {
+        if (pLine->type == U_AT_CLIENT_TEST_REPLAY_RESPONSE) {
+            pFinal = pLine;
+        }
+    }
+
+    uAtClientLock(atClientHandle);
+    // As in atClientCommandSet2, since the command may contain
+    // NULLs put a NULL string in uAtClientCommandStart() and send
+    // the command directly to the UART, leaving the command
+    // terminator to uAtClientCommandStop()
+    if ((length > 0) && (*(pCommand->pBytes + length - 1) == '\r')) {
+        length--;
+    }
+    uAtClientCommandStart(atClientHandle, NULL);
+    uPortUartWrite(gUartAHandle, pCommand->pBytes, length);
+    uAtClientCommandStop(atClientHandle);
+    for (pLine = pCommand + 1; pLine < pFinal; pLine++) {
+        if (pLine->type == U_AT_CLIENT_TEST_REPLAY_RESPONSE) {
+            if (replayLinePrefix(pLine, prefix, sizeof(prefix)) > 0) {
+                uAtClientResponseStart(atClientHandle, prefix);
+            } else {
+                uAtClientResponseStart(atClientHandle, NULL);
+            }
+            responseStarted = true;
+        }
+    }
+    if (!responseStarted) {
+        uAtClientResponseStart(atClientHandle, NULL);
+    }
+    uAtClientResponseStop(atClientHandle);
+
+    return uAtClientUnlock(atClientHandle);
+}
+
 # endif
 #endif
 
@@ -1687,6 +1796,162 @@ U_PORT_TEST_FUNCTION("[atClient]", "atClientCommandSet2")
                        (heapUsed <= ((int32_t) gSystemHeapLost) - heapClibLossOffset));
 }
 
+/** Add an AT client and replay to it, from an AT server stub,
+ * gAtClientTestReplayExample[], generated by at_trace_gen from
+ * a recorded trace, checking that the AT client sends the
+ * recorded commands, gets the recorded outcomes and receives
+ * the recorded URCs.  Requires two UARTs wired back-to-back.
+ */
+U_PORT_TEST_FUNCTION("[atClient]", "atClientReplay")
+{
+    uAtClientHandle_t atClientHandle;
+    const uAtClientTestReplayLine_t *pLines = gAtClientTestReplayExample;
+    size_t numLines = gAtClientTestReplayExampleCount;
+    const uAtClientTestReplayLine_t *pFinal = NULL;
+    char prefix[U_AT_CLIENT_TEST_REPLAY_MAX_URC_PREFIX_LENGTH];
+    size_t numUrcPrefixes = 0;
+    size_t numCommands = 0;
+    size_t numLinesToSend = 0;
+    size_t numUrcs = 0;
+    size_t urcCount = 0;
+    bool found;
+    int32_t lastError = 0;
+    int32_t y;
+    int32_t heapUsed;
+    int32_t heapClibLossOffset = (int32_t) gSystemHeapLost;
+
+    // Whatever called us likely initialised the
+    // port so deinitialise it here to obtain the
+    // correct initial heap size
+    uPortDeinit();
+    heapUsed = uPortGetHeapFree();
+    U_PORT_TEST_ASSERT(uPortInit() == 0);
+
+    // Set up everything with the two UARTs
+    twoUartsPreamble();
+
+    U_PORT_TEST_ASSERT(uAtClientInit() == 0);
+
+    uPortLog("U_AT_CLIENT_TEST: adding an AT client on UART %d...\n",
+             U_CFG_TEST_UART_A);
+    atClientHandle = uAtClientAdd(gUartAHandle, U_AT_CLIENT_STREAM_TYPE_UART,
+                                  NULL, U_AT_CLIENT_BUFFER_LENGTH_BYTES);
+    U_PORT_TEST_ASSERT(atClientHandle != NULL);
+    uAtClientTimeoutSet(atClientHandle, U_AT_CLIENT_TEST_AT_TIMEOUT_MS);
+
+    // Count what's in the replay and install a handler
+    // for each of the different URC prefixes
+    for (size_t x = 0; x < numLines; x++) {
+        if (pLines[x].type == U_AT_CLIENT_TEST_REPLAY_COMMAND) {
+            numCommands++;
+        } else {
+            numLinesToSend++;
+            if ((pLines[x].type == U_AT_CLIENT_TEST_REPLAY_URC) &&
+                (replayLinePrefix(&(pLines[x]), prefix, sizeof(prefix)) > 0)) {
+                numUrcs++;
+                found = false;
+                for (size_t z = 0; (z < numUrcPrefixes) && !found; z++) {
+                    found = (strcmp(gReplayUrcPrefix[z], prefix) == 0);
+                }
+                if (!found) {
+                    U_PORT_TEST_ASSERT(numUrcPrefixes < U_AT_CLIENT_TEST_REPLAY_MAX_NUM_URC_PREFIXES);
+                    strncpy(gReplayUrcPrefix[numUrcPrefixes], prefix,
+                            sizeof(gReplayUrcPrefix[numUrcPrefixes]));
+                    U_PORT_TEST_ASSERT(uAtClientSetUrcHandler(atClientHandle,
+                                                              gReplayUrcPrefix[numUrcPrefixes],
+                                                              replayUrcHandler,
+                                                              (void *) &urcCount) == 0);
+                    numUrcPrefixes++;
+                }
+            }
+        }
+    }
+    uPortLog("U_AT_CLIENT_TEST: replaying %d line(s), %d command(s)"
+             " and %d URC(s).\n", numLines, numCommands, numUrcs);
+
+    // Set up the AT server stub on UART B
+    U_PORT_TEST_ASSERT(uAtClientTestReplayStart(gUartBHandle, &gReplay,
+                                                pLines, numLines) == 0);
+
+    // Send each command and check that the outcome is that
+    // of the final result in the replay
+    for (size_t x = 0; (x < numLines) && (lastError == 0); x++) {
+        if (pLines[x].type == U_AT_CLIENT_TEST_REPLAY_COMMAND) {
+            pFinal = NULL;
+            for (size_t z = x + 1; (z < numLines) &&
+                 (pLines[z].type != U_AT_CLIENT_TEST_REPLAY_COMMAND); z++) {
+                if (pLines[z].type == U_AT_CLIENT_TEST_REPLAY_RESPONSE) {
+                    pFinal = &(pLines[z]);
+                }
+            }
+            uPortLog("U_AT_CLIENT_TEST_%d: sending \"", x + 1);
+            uAtClientTestPrint(pLines[x].pBytes, pLines[x].length);
+            uPortLog("\"...\n");
+            y = replayCommand(atClientHandle, &(pLines[x]), pLines + numLines);
+            if ((pFinal != NULL) && (pFinal->length >= 2) &&
+                (memcmp(pFinal->pBytes, "OK", 2) == 0)) {
+                if (y != 0) {
+                    uPortLog("U_AT_CLIENT_TEST_%d: unlock returned %d"
+                             " when 0 was expected.\n", x + 1, y);
+                    lastError = -1;
+                }
+            } else if (y == 0) {
+                uPortLog("U_AT_CLIENT_TEST_%d: unlock returned 0"
+                         " when an error was expected.\n", x + 1);
+                lastError = -2;
+            }
+            if (gReplay.lastError != 0) {
+                lastError = gReplay.lastError;
+            }
+        }
+    }
+
+    // Give any URCs on the end of the replay time to arrive
+    uPortTaskBlock(U_AT_CLIENT_TEST_REPLAY_END_WAIT_MS);
+
+    uPortLog("U_AT_CLIENT_TEST: %d out of %d command(s) received"
+             " as expected, %d out of %d line(s) sent and %d out"
+             " of %d URC(s) arrived.\n", gReplay.commandPassIndex,
+             numCommands, gReplay.linesSent, numLinesToSend,
+             urcCount, numUrcs);
+
+    uAtClientTestReplayStop(gUartBHandle);
+
+    // Check the stack extents for the URC and callbacks tasks
+    checkStackExtents(atClientHandle);
+
+    uPortLog("U_AT_CLIENT_TEST: removing AT client...\n");
+    uAtClientRemove(atClientHandle);
+    uAtClientDeinit();
+
+    uPortUartClose(gUartBHandle);
+    gUartBHandle = -1;
+    uPortUartClose(gUartAHandle);
+    gUartAHandle = -1;
+    uPortDeinit();
+
+    // Fail the test if an error occurred: doing this here
+    // rather than asserting above so that clean-up happens
+    // and hence we don't end up with mutexes left locked
+    U_PORT_TEST_ASSERT(lastError == 0);
+    U_PORT_TEST_ASSERT(gReplay.lastError == 0);
+    U_PORT_TEST_ASSERT(gReplay.commandPassIndex == numCommands);
+    U_PORT_TEST_ASSERT(gReplay.linesSent == numLinesToSend);
+    U_PORT_TEST_ASSERT(urcCount == numUrcs);
+
+    // Check for memory leaks
+    heapUsed -= uPortGetHeapFree();
+    uPortLog("U_AT_CLIENT_TEST: %d byte(s) of heap were lost to"
+             " the C library during this test and we have"
+             " leaked %d byte(s).\n",
+             gSystemHeapLost - heapClibLossOffset,
+             heapUsed - (gSystemHeapLost - heapClibLossOffset));
+    // heapUsed < 0 for the Zephyr case where the heap can look
+    // like it increases (negative leak)
+    U_PORT_TEST_ASSERT((heapUsed < 0) ||
+                       (heapUsed <= ((int32_t) gSystemHeapLost) - heapClibLossOffset));
+}
+
 # endif
 #endif
 
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/* Only #includes of u_* and the C standard library are allowed here,
+ * no platform stuff and no OS stuff.  Anything required from
+ * the platform/OS must be brought in through u_port* to maintain
+ * portability.
+ */
+
+/** @file
+ * @brief An AT server stub for testing the AT client which replays
+ * a table of commands, responses and URCs, as generated from a
+ * recorded trace by at_trace_gen: the stub runs on a UART
+ * cross-wired to that of the AT client, checks each command that
+ * arrives and sends back what the module sent when the trace was
+ * recorded, with the same timing.
+ */
+
+#ifdef U_CFG_OVERRIDE
+# include "u_cfg_override.h" // For a customer's configuration override
+#endif
+
+#include "stddef.h"    // NULL, size_t etc.
+#include "stdint.h"    // int32_t etc.
+#include "stdbool.h"
+#include "string.h"    // memcmp(), memmove(), memset()
+
+#include "u_cfg_sw.h"
+#include "u_cfg_os_platform_specific.h"
+
+#include "u_error_common.h"
+
+#include "u_port_clib_platform_specific.h" /* Integer stdio, must be included
+                                              before the other port files if
+                                              any print or scan function is used. */
+#include "u_port.h"
+#include "u_port_debug.h"
+#include "u_port_os.h"
+#include "u_port_uart.h"
+
+#include "u_at_client.h"
+#include "u_at_client_test.h"
+#include "u_at_client_test_replay.h"
+
+/* ----------------------------------------------------------------
+ * COMPILE-TIME MACROS
+ * -------------------------------------------------------------- */
+
+/* ----------------------------------------------------------------
+ * TYPES
+ * -------------------------------------------------------------- */
+
+/* ----------------------------------------------------------------
+ * VARIABLES
+ * -------------------------------------------------------------- */
+
+/* ----------------------------------------------------------------
+ * STATIC FUNCTIONS
+ * -------------------------------------------------------------- */
+
+// Send the response and URC lines from pReplay->index up to the
+// next command or the end of the replay, each after its delay.
+static void sendLines(int32_t uartHandle, uAtClientTestReplay_t *pReplay)
+{
+    const uAtClientTestReplayLine_t *pLine;
+
+    while ((pReplay->index < pReplay->numLines) &&
+           (pReplay->pLines[pReplay->index].type != U_AT_CLIENT_TEST_REPLAY_COMMAND)) {
+        pLine = &(pReplay->pLines[pReplay->index]);
+        if (pLine->delayMs > 0) {
+            uPortTaskBlock(pLine->delayMs);
+        }
+        if (uPortUartWrite(uartHandle, pLine->pBytes,
+                           pLine->length) == (int32_t) pLine->length) {
+            pReplay->linesSent++;
+        } else {
+            pReplay->lastError = (int32_t) U_ERROR_COMMON_PLATFORM;
+        }
+        pReplay->index++;
+    }
+}
+
+// Callback to receive the output of the AT client through
+// the cross-wired UART and replay what follows each command.
+static void replayCallback(int32_t uartHandle, uint32_t eventBitmask,
+                           void *pParameters)
+{
+    uAtClientTestReplay_t *pReplay = (uAtClientTestReplay_t *) pParameters;
+    const uAtClientTestReplayLine_t *pCommand;
+    int32_t sizeOrError = 0;
+    size_t length;
+
+    if ((eventBitmask & U_PORT_UART_EVENT_BITMASK_DATA_RECEIVED) &&
+        (pReplay != NULL)) {
+        // Loop until no received characters left to process
+        while ((uPortUartGetReceiveSize(uartHandle) > 0) &&
+               (sizeOrError >= 0) && (pReplay->lastError == 0)) {
+            sizeOrError = uPortUartRead(uartHandle,
+                                        pReplay->buffer + pReplay->bufferLength,
+                                        sizeof(pReplay->buffer) - pReplay->bufferLength);
+            if (sizeOrError > 0) {
+                pReplay->bufferLength += sizeOrError;
+            }
+            // Deal with as many complete commands as there are
+            while ((pReplay->bufferLength > 0) && (pReplay->lastError == 0)) {
+                if (pReplay->index >= pReplay->numLines) {
+                    uPortLog("U_AT_CLIENT_TEST_REPLAY: received \"");
+                    uAtClientTestPrint(pReplay->buffer, pReplay->bufferLength);
+                    uPortLog("\" after the end of the replay.\n");
+                    pReplay->lastError = (int32_t) U_ERROR_COMMON_NOT_FOUND;
+                } else {
+                    pCommand = &(pReplay->pLines[pReplay->index]);
+                    length = pCommand->length;
+                    if (length > pReplay->bufferLength) {
+                        length = pReplay->bufferLength;
+                    }
+                    if (memcmp(pCommand->pBytes, pReplay->buffer, length) != 0) {
+                        uPortLog("U_AT_CLIENT_TEST_REPLAY: line %d, expected \"",
+                                 pReplay->index + 1);
+                        uAtClientTestPrint(pCommand->pBytes, pCommand->length);
+                        uPortLog("\" but received \"");
+                        uAtClientTestPrint(pReplay->buffer, pReplay->bufferLength);
+                        uPortLog("\".\n");
+                        pReplay->lastError = (int32_t) U_ERROR_COMMON_INVALID_PARAMETER;
+                    } else if (length < pCommand->length) {
+                        // The rest of the command is yet to come
+                        if (pReplay->bufferLength >= sizeof(pReplay->buffer)) {
+                            pReplay->lastError = (int32_t) U_ERROR_COMMON_NO_MEMORY;
+                        }
+                        break;
+                    } else {
+                        // A whole command: move on and send what followed it
+                        pReplay->bufferLength -= length;
+                        memmove(pReplay->buffer, pReplay->buffer + length,
+                                pReplay->bufferLength);
+                        pReplay->commandPassIndex++;
+                        pReplay->index++;
+                        sendLines(uartHandle, pReplay);
+                    }
+                }
+            }
+        }
+    }
+}
+
+/* ----------------------------------------------------------------
+ * PUBLIC FUNCTIONS
+ * -------------------------------------------------------------- */
+
+// Start replaying.
+int32_t uAtClientTestReplayStart(int32_t uartHandle,
+                                 uAtClientTestReplay_t *pReplay,
+                                 const uAtClientTestReplayLine_t *pLines,
+                                 size_t numLines)
+{
+    int32_t errorCode = (int32_t) U_ERROR_COMMON_INVALID_PARAMETER;
+
+    if ((pReplay != NULL) && ((pLines != NULL) || (numLines == 0))) {
+        memset(pReplay, 0, sizeof(*pReplay));
+        pReplay->pLines = pLines;
+        pReplay->numLines = numLines;
+        // Anything before the first command is sent straight away
+        sendLines(uartHandle, pReplay);
+        errorCode = uPortUartEventCallbackSet(uartHandle,
+                                              U_PORT_UART_EVENT_BITMASK_DATA_RECEIVED,
+                                              replayCallback, (void *) pReplay,
+                                              U_AT_CLIENT_URC_TASK_STACK_SIZE_BYTES,
+                                              U_AT_CLIENT_URC_TASK_PRIORITY);
+    }
+
+    return errorCode;
+}
+
+// Stop replaying.
+void uAtClientTestReplayStop(int32_t uartHandle)
+{
+    uPortUartEventCallbackRemove(uartHandle);
+}
+
+// End of file
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+#ifndef _U_AT_CLIENT_TEST_REPLAY_H_
+#define _U_AT_CLIENT_TEST_REPLAY_H_
+
+/* No #includes allowed here */
+
+/** @file
+ * @brief Types for replaying a recorded AT transcript, as generated
+ * from a trace by common/at_client/test/at_trace_gen, from the AT
+ * server side of a test.
+ */
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* ----------------------------------------------------------------
+ * COMPILE-TIME MACROS
+ * -------------------------------------------------------------- */
+
+#ifndef U_AT_CLIENT_TEST_REPLAY_BUFFER_LENGTH_BYTES
+/** The size of the buffer the AT server stub of a replay uses
+ * to collect a command from the AT client: must be longer than
+ * the longest command in the replay.
+ */
+# define U_AT_CLIENT_TEST_REPLAY_BUFFER_LENGTH_BYTES 256
+#endif
+
+/* ----------------------------------------------------------------
+ * TYPES
+ * -------------------------------------------------------------- */
+
+/** The types of line in a replay.
+ */
+typedef enum {
+    /** A command that the AT client is expected to send, including
+     * the command terminator. */
+    U_AT_CLIENT_TEST_REPLAY_COMMAND,
+    /** A line of response that the AT server should send, including
+     * the response terminator. */
+    U_AT_CLIENT_TEST_REPLAY_RESPONSE,
+    /** A URC that the AT server should send, including the response
+     * terminator. */
+    U_AT_CLIENT_TEST_REPLAY_URC
+} uAtClientTestReplayType_t;
+
+/** One line of a replay: an AT server stub should, on receiving a
+ * U_AT_CLIENT_TEST_REPLAY_COMMAND line, send each of the
+ * U_AT_CLIENT_TEST_REPLAY_RESPONSE and U_AT_CLIENT_TEST_REPLAY_URC
+ * lines that follow it, up to the next command, each delayMs after
+ * the previous line, exactly as the module did when the trace was
+ * recorded.
+ */
+typedef struct {
+    uAtClientTestReplayType_t type;
+    const char *pBytes; /**< The bytes of the line, may include NULLs. */
+    size_t length; /**< The number of bytes at pBytes. */
+    int32_t delayMs; /**< The time since the previous line, zero if the trace had no timing. */
+} uAtClientTestReplayLine_t;
+
+/** Data structure to keep track of a replay, filled in by
+ * uAtClientTestReplayStart() and updated by the AT server stub.
+ */
+typedef struct {
+    const uAtClientTestReplayLine_t *pLines;
+    size_t numLines;
+    size_t index; /**< The next line of pLines to be dealt with. */
+    size_t commandPassIndex; /**< The number of commands received as expected. */
+    size_t linesSent; /**< The number of response and URC lines sent. */
+    int32_t lastError; /**< Zero unless something unexpected was received. */
+    char buffer[U_AT_CLIENT_TEST_REPLAY_BUFFER_LENGTH_BYTES];
+    size_t bufferLength;
+} uAtClientTestReplay_t;
+
+/* ----------------------------------------------------------------
+ * VARIABLES
+ * -------------------------------------------------------------- */
+
+/** An example replay, generated by at_trace_gen from
+ * at_trace_gen/example_trace.txt.
+ */
+extern const uAtClientTestReplayLine_t gAtClientTestReplayExample[];
+
+/** The number of lines in gAtClientTestReplayExample.
+ */
+extern const size_t gAtClientTestReplayExampleCount;
+
+/* ----------------------------------------------------------------
+ * FUNCTIONS
+ * -------------------------------------------------------------- */
+
+/** Start an AT server stub on a UART, the one cross-wired to that
+ * of the AT client, which replays pLines: any response or URC
+ * lines before the first command are sent immediately, then, as
+ * each command arrives from the AT client, it is checked against
+ * the next command of pLines and the response and URC lines that
+ * follow it are sent back, each after its delayMs.  Progress is
+ * recorded in *pReplay, which must remain valid until
+ * uAtClientTestReplayStop() is called.
+ *
+ * @param uartHandle the handle of the UART for the AT server side.
+ * @param pReplay    storage for the state of the replay.
+ * @param pLines     the lines to replay, e.g. as generated by
+ *                   at_trace_gen.
+ * @param numLines   the number of lines at pLines.
+ * @return           zero on success else negative error code.
+ */
+int32_t uAtClientTestReplayStart(int32_t uartHandle,
+                                 uAtClientTestReplay_t *pReplay,
+                                 const uAtClientTestReplayLine_t *pLines,
+                                 size_t numLines);
+
+/** Stop the AT server stub started by uAtClientTestReplayStart().
+ *
+ * @param uartHandle the handle of the UART for the AT server side.
+ */
+void uAtClientTestReplayStop(int32_t uartHandle);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif // _U_AT_CLIENT_TEST_REPLAY_H_
+
+// End of file
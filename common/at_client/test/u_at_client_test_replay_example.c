@@ -0,0 +1,34 @@
+/* Generated by at_trace_gen.go from example_trace.txt on 2026-10-17: do not edit. */
+
+#include "stddef.h"
+#include "stdint.h"
+
+#include "u_at_client_test_replay.h"
+
+/** The lines of the replay.
+ */
+const uAtClientTestReplayLine_t gAtClientTestReplayExample[] = {
+    {U_AT_CLIENT_TEST_REPLAY_COMMAND, "ATE0\r", 5, 0},
+    {U_AT_CLIENT_TEST_REPLAY_RESPONSE, "OK\r\n", 4, 10},
+    {U_AT_CLIENT_TEST_REPLAY_COMMAND, "AT+CMEE=2\r", 10, 290},
+    {U_AT_CLIENT_TEST_REPLAY_RESPONSE, "OK\r\n", 4, 10},
+    {U_AT_CLIENT_TEST_REPLAY_COMMAND, "AT+CEREG\?\r", 10, 490},
+    {U_AT_CLIENT_TEST_REPLAY_URC, "+CREG: 0,5\r\n", 12, 15},
+    {U_AT_CLIENT_TEST_REPLAY_RESPONSE, "+CEREG: 0,5\r\n", 13, 5},
+    {U_AT_CLIENT_TEST_REPLAY_RESPONSE, "OK\r\n", 4, 1},
+    {U_AT_CLIENT_TEST_REPLAY_COMMAND, "AT+USOCR=6\r", 11, 579},
+    {U_AT_CLIENT_TEST_REPLAY_RESPONSE, "+USOCR: 0\r\n", 11, 40},
+    {U_AT_CLIENT_TEST_REPLAY_RESPONSE, "OK\r\n", 4, 1},
+    {U_AT_CLIENT_TEST_REPLAY_COMMAND, "AT+USOWR=0,5,\"68656c6c6f\"\r", 26, 359},
+    {U_AT_CLIENT_TEST_REPLAY_RESPONSE, "+USOWR: 0,5\r\n", 13, 40},
+    {U_AT_CLIENT_TEST_REPLAY_RESPONSE, "OK\r\n", 4, 1},
+    {U_AT_CLIENT_TEST_REPLAY_URC, "+UUSORD: 0,5\r\n", 14, 459},
+    {U_AT_CLIENT_TEST_REPLAY_COMMAND, "AT+UPSV=9\r", 10, 500},
+    {U_AT_CLIENT_TEST_REPLAY_RESPONSE, "+CME ERROR: operation not supported\r\n", 37, 10},
+};
+
+/** The number of lines in gAtClientTestReplayExample.
+ */
+const size_t gAtClientTestReplayExampleCount = sizeof(gAtClientTestReplayExample) / sizeof(gAtClientTestReplayExample[0]);
+
+// End of file
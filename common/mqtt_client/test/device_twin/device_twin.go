@@ -0,0 +1,1431 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const mqttKeepAliveSecond = 60
+const mqttTimeoutSecond = 10
+const maxReconnectDelaySecond = 60
+const vaultTimeoutSecond = 30
+const vaultAttempts = 3
+const rateLimitForgetSecond = 600
+
+// Mqtt struct for JSON configuration
+type Mqtt struct {
+	Broker      string `json:"broker"`
+	ClientId    string `json:"client-id"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	TopicPrefix string `json:"topic-prefix"`
+}
+
+// Argument struct for JSON configuration
+type Argument struct {
+	HttpPort    string      `json:"http-port"`
+	HttpOptions HttpOptions `json:"http-options"`
+	StateFile   string      `json:"state-file"`
+	Mqtt        *Mqtt       `json:"mqtt"`
+}
+
+// Twin is the state of one device: what it has been asked to be
+// (desired) and what it says it is (reported)
+type Twin struct {
+	Desired         map[string]interface{} `json:"desired"`
+	DesiredVersion  int                    `json:"desired-version"`
+	Reported        map[string]interface{} `json:"reported"`
+	ReportedVersion int                    `json:"reported-version"`
+	Updated         time.Time              `json:"updated"`
+}
+
+type twinStore struct {
+	mutex     sync.Mutex
+	twins     map[string]*Twin
+	stateFile string
+	// Called, without mutex but with publishMutex, when the desired
+	// state of a device changes or a device is removed, desired then
+	// being nil; publishMutex, always taken before mutex, keeps the
+	// calls in the order of the changes, so that what is left
+	// retained on the broker is the latest
+	publishMutex sync.Mutex
+	onDesired    func(device string, desired map[string]interface{})
+	onRemoved    func(device string)
+}
+
+// Apply a JSON merge patch (RFC 7386): a null removes a field, an
+// object is merged recursively and anything else replaces the field
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{})
+	}
+	for key, value := range patch {
+		switch v := value.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			existing, _ := target[key].(map[string]interface{})
+			target[key] = mergePatch(existing, v)
+		default:
+			target[key] = v
+		}
+	}
+	return target
+}
+
+// The fields of desired that reported doesn't yet match
+func delta(desired map[string]interface{}, reported map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, value := range desired {
+		desiredObject, isObject := value.(map[string]interface{})
+		reportedObject, reportedIsObject := reported[key].(map[string]interface{})
+		if isObject && reportedIsObject {
+			inner := delta(desiredObject, reportedObject)
+			if len(inner) > 0 {
+				result[key] = inner
+			}
+		} else if !reflect.DeepEqual(value, reported[key]) {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+func (s *twinStore) load() {
+	if s.stateFile != "" {
+		contents, err := ioutil.ReadFile(s.stateFile)
+		if err == nil {
+			err = json.Unmarshal(contents, &s.twins)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("Unable to read state file, starting empty.", "file", s.stateFile, "error", err)
+		}
+	}
+	if s.twins == nil {
+		s.twins = make(map[string]*Twin)
+	}
+	for device := range s.twins {
+		if !validDevice(device) {
+			slog.Warn("Ignoring device with an ID that can't be an MQTT topic level.", "file", s.stateFile, "device", device)
+			delete(s.twins, device)
+		}
+	}
+}
+
+// Save the state, with the lock held
+func (s *twinStore) save() {
+	if s.stateFile == "" {
+		return
+	}
+	contents, _ := json.MarshalIndent(s.twins, "", "    ")
+	temporary := s.stateFile + ".tmp"
+	err := ioutil.WriteFile(temporary, contents, 0644)
+	if err == nil {
+		err = os.Rename(temporary, s.stateFile)
+	}
+	if err != nil {
+		slog.Error("Unable to write state file.", "file", s.stateFile, "error", err)
+	}
+}
+
+func copyTwin(twin *Twin) Twin {
+	contents, _ := json.Marshal(twin)
+	var copied Twin
+	json.Unmarshal(contents, &copied)
+	return copied
+}
+
+// Update the desired or reported state of a device, replacing it or
+// merging in a patch, creating the device if it doesn't exist
+func (s *twinStore) update(device string, reported bool, patch map[string]interface{}, replace bool) Twin {
+	if !reported {
+		s.publishMutex.Lock()
+		defer s.publishMutex.Unlock()
+	}
+	s.mutex.Lock()
+	twin, ok := s.twins[device]
+	if !ok {
+		twin = &Twin{}
+		s.twins[device] = twin
+		slog.Info("New device.", "device", device)
+	}
+	if reported {
+		if replace {
+			twin.Reported = nil
+		}
+		twin.Reported = mergePatch(twin.Reported, patch)
+		twin.ReportedVersion++
+	} else {
+		if replace {
+			twin.Desired = nil
+		}
+		twin.Desired = mergePatch(twin.Desired, patch)
+		twin.DesiredVersion++
+	}
+	twin.Updated = time.Now().UTC()
+	copied := copyTwin(twin)
+	s.save()
+	s.mutex.Unlock()
+	slog.Debug("Twin updated.", "device", device, "reported", reported, "desired-version", copied.DesiredVersion,
+		"reported-version", copied.ReportedVersion)
+	if reported {
+		eventPublish("twin-reported", "", "device", device, "version", copied.ReportedVersion)
+	} else {
+		eventPublish("twin-desired", "", "device", device, "version", copied.DesiredVersion)
+	}
+	if !reported && s.onDesired != nil {
+		s.onDesired(device, copied.Desired)
+	}
+	return copied
+}
+
+func (s *twinStore) get(device string) (Twin, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	twin, ok := s.twins[device]
+	if !ok {
+		return Twin{}, false
+	}
+	return copyTwin(twin), true
+}
+
+func (s *twinStore) remove(device string) bool {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	s.mutex.Lock()
+	_, ok := s.twins[device]
+	delete(s.twins, device)
+	s.save()
+	s.mutex.Unlock()
+	if ok && s.onRemoved != nil {
+		s.onRemoved(device)
+	}
+	return ok
+}
+
+// Call onDesired for every device, e.g. on reconnection to the broker
+func (s *twinStore) republish() {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	s.mutex.Lock()
+	desired := make(map[string]map[string]interface{})
+	for device, twin := range s.twins {
+		desired[device] = copyTwin(twin).Desired
+	}
+	s.mutex.Unlock()
+	for device, state := range desired {
+		s.onDesired(device, state)
+	}
+}
+
+func (s *twinStore) devices() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var names []string
+	for name := range s.twins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// BEGIN SHARED BLOCK middleware, see port/platform/common/automation/go_shared
+// HttpOptions struct for JSON configuration: what the HTTP APIs of
+// the test tools have in common
+type HttpOptions struct {
+	// If present, the bearer token that every request must carry;
+	// may be env:NAME, vault:PATH#FIELD or file:PATH, see readSecret()
+	Token string `json:"token"`
+	// If non-zero, the requests per second allowed from any one
+	// client address, in bursts of up to Burst
+	RatePerSecond float64 `json:"rate-per-second"`
+	Burst         int     `json:"burst"`
+	// If true, every request is logged, otherwise only failed ones
+	AccessLog bool `json:"access-log"`
+}
+
+// Records the status of a response, for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+// A token bucket per client address
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Whether a request from the client is allowed now and, if not, how
+// long until it would be
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > rateLimitForgetSecond*time.Second {
+		for name, bucket := range l.clients {
+			if now.Sub(bucket.updated) > rateLimitForgetSecond*time.Second {
+				delete(l.clients, name)
+			}
+		}
+		l.swept = now
+	}
+	bucket, ok := l.clients[client]
+	if !ok {
+		bucket = &rateBucket{tokens: l.burst, updated: now}
+		l.clients[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Wrap the handler of an HTTP API in what the HTTP APIs of the test
+// tools have in common, outermost first: the access log, which
+// includes any test session ID given by the client in the header
+// X-Session-Id, then the rate limit, then the bearer token
+func httpMiddleware(handler http.Handler, options HttpOptions) (http.Handler, error) {
+	if options.Token != "" {
+		token, err := readSecret(options.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token: %w", err)
+		}
+		expected := []byte("Bearer " + strings.TrimSpace(string(token)))
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	if options.RatePerSecond > 0 {
+		limiter := &rateLimiter{rate: options.RatePerSecond, burst: float64(options.Burst),
+			clients: make(map[string]*rateBucket)}
+		if limiter.burst < 1 {
+			limiter.burst = 1
+		}
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			allowed, wait := limiter.allow(client)
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	inner := handler
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		inner.ServeHTTP(recorder, r)
+		level := slog.LevelDebug
+		if options.AccessLog {
+			level = slog.LevelInfo
+		}
+		if recorder.status >= 400 {
+			level = slog.LevelWarn
+		}
+		args := []any{"method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "status", recorder.status,
+			"bytes", recorder.bytes, "duration-ms", time.Since(started).Milliseconds()}
+		if session := r.Header.Get("X-Session-Id"); session != "" {
+			args = append(args, "client-session", session)
+		}
+		slog.Log(r.Context(), level, "Request.", args...)
+	})
+	return handler, nil
+}
+
+// END SHARED BLOCK middleware
+
+// A device ID is a level of the MQTT topics of the device, so it
+// can't be empty or contain a wildcard, a level separator or a NUL,
+// any of which would have the broker disconnect us
+func validDevice(device string) bool {
+	return device != "" && !strings.ContainsAny(device, "+#/\x00")
+}
+
+// Serve the REST API:
+//
+//	GET    /devices                      list the devices
+//	GET    /devices/<id>                 the twin of a device
+//	DELETE /devices/<id>                 forget a device
+//	GET    /devices/<id>/delta           desired fields not yet reported
+//	PUT    /devices/<id>/desired         replace the desired state
+//	PATCH  /devices/<id>/desired         merge into the desired state
+//	PUT    /devices/<id>/reported        replace the reported state
+//	PATCH  /devices/<id>/reported        merge into the reported state
+func serveHttp(port string, options HttpOptions, store *twinStore) error {
+	http.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, store.devices())
+	})
+	http.HandleFunc("/devices/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices/"), "/"), "/")
+		device := parts[0]
+		if device == "" || len(parts) > 2 {
+			http.NotFound(w, r)
+			return
+		}
+		if !validDevice(device) {
+			http.Error(w, "device ID can't contain +, #, / or NUL", http.StatusBadRequest)
+			return
+		}
+		slog.Debug("Request.", "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		if len(parts) == 1 {
+			switch r.Method {
+			case http.MethodGet:
+				twin, ok := store.get(device)
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				writeJson(w, http.StatusOK, twin)
+			case http.MethodDelete:
+				if !store.remove(device) {
+					http.NotFound(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		switch parts[1] {
+		case "delta":
+			twin, ok := store.get(device)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJson(w, http.StatusOK, delta(twin.Desired, twin.Reported))
+		case "desired", "reported":
+			if r.Method == http.MethodGet {
+				twin, ok := store.get(device)
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				if parts[1] == "desired" {
+					writeJson(w, http.StatusOK, twin.Desired)
+				} else {
+					writeJson(w, http.StatusOK, twin.Reported)
+				}
+				return
+			}
+			if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var patch map[string]interface{}
+			err := json.NewDecoder(r.Body).Decode(&patch)
+			if err != nil {
+				http.Error(w, "body must be a JSON object: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJson(w, http.StatusOK, store.update(device, parts[1] == "reported", patch, r.Method == http.MethodPut))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	handler, err := httpMiddleware(http.DefaultServeMux, options)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: ":" + port, Handler: handler}
+	// Requests in progress are allowed to finish when stopping
+	onShutdown("http server", func(ctx context.Context) {
+		server.Shutdown(ctx)
+	})
+	slog.Info("HTTP listening.", "port", port)
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return err
+}
+
+// A minimal MQTT 3.1.1 client, QoS 0 only, which is all that is
+// needed to exchange twin state with devices through a broker
+type mqttClient struct {
+	config     Mqtt
+	password   string
+	mutex      sync.Mutex
+	connection net.Conn
+}
+
+func mqttString(text string) []byte {
+	b := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(b, uint16(len(text)))
+	return append(b, text...)
+}
+
+func mqttPacket(packetType byte, body []byte) []byte {
+	packet := []byte{packetType}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func readMqttPacket(reader *bufio.Reader) (byte, []byte, error) {
+	packetType, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	// The remaining length is at most four bytes
+	length := 0
+	for multiplier := 1; ; multiplier *= 128 {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		if multiplier == 128*128*128 {
+			return 0, nil, errors.New("bad MQTT remaining length")
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader, body)
+	return packetType, body, err
+}
+
+func (c *mqttClient) write(packet []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.connection == nil {
+		return errors.New("not connected to the MQTT broker")
+	}
+	c.connection.SetWriteDeadline(time.Now().Add(mqttTimeoutSecond * time.Second))
+	_, err := c.connection.Write(packet)
+	return err
+}
+
+func (c *mqttClient) publish(topic string, payload []byte, retain bool) error {
+	packetType := byte(0x30)
+	if retain {
+		packetType |= 0x01
+	}
+	return c.write(mqttPacket(packetType, append(mqttString(topic), payload...)))
+}
+
+// Connect, subscribe and handle incoming messages until the
+// connection is lost
+func (c *mqttClient) session(onMessage func(topic string, payload []byte), onConnect func()) error {
+	connection, err := net.DialTimeout("tcp", c.config.Broker, mqttTimeoutSecond*time.Second)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	reader := bufio.NewReader(connection)
+
+	flags := byte(0x02) // Clean session
+	body := append(mqttString("MQTT"), 4, 0, 0, 0)
+	payload := mqttString(c.config.ClientId)
+	if c.config.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(c.config.Username)...)
+		if c.password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(c.password)...)
+		}
+	}
+	body[7] = flags
+	binary.BigEndian.PutUint16(body[8:], mqttKeepAliveSecond)
+	connection.SetDeadline(time.Now().Add(mqttTimeoutSecond * time.Second))
+	_, err = connection.Write(mqttPacket(0x10, append(body, payload...)))
+	if err != nil {
+		return err
+	}
+	packetType, response, err := readMqttPacket(reader)
+	if err != nil {
+		return err
+	}
+	if packetType != 0x20 || len(response) != 2 || response[1] != 0 {
+		return fmt.Errorf("connection refused by broker (CONNACK %x)", response)
+	}
+	topic := c.config.TopicPrefix + "/+/reported"
+	subscribe := []byte{0, 1}
+	subscribe = append(append(subscribe, mqttString(topic)...), 0)
+	_, err = connection.Write(mqttPacket(0x82, subscribe))
+	if err != nil {
+		return err
+	}
+	connection.SetDeadline(time.Time{})
+	c.mutex.Lock()
+	c.connection = connection
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.connection = nil
+		c.mutex.Unlock()
+	}()
+	slog.Info("Connected to MQTT broker.", "broker", c.config.Broker, "subscribed", topic)
+	go onConnect()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(mqttKeepAliveSecond / 2 * time.Second):
+				c.write([]byte{0xc0, 0})
+			}
+		}
+	}()
+	for {
+		connection.SetReadDeadline(time.Now().Add(mqttKeepAliveSecond * 2 * time.Second))
+		packetType, body, err := readMqttPacket(reader)
+		if err != nil {
+			return err
+		}
+		if packetType&0xf0 == 0x30 && len(body) >= 2 {
+			topicLength := int(binary.BigEndian.Uint16(body))
+			if 2+topicLength > len(body) {
+				continue
+			}
+			payload := body[2+topicLength:]
+			if (packetType>>1)&0x03 > 0 {
+				// QoS 1 or 2 from a broker that ignored our QoS 0
+				// subscription: skip the packet ID
+				if len(payload) < 2 {
+					continue
+				}
+				payload = payload[2:]
+			}
+			onMessage(string(body[2:2+topicLength]), payload)
+		}
+	}
+}
+
+// Disconnect cleanly, so that the broker doesn't see a lost connection
+func (c *mqttClient) disconnect() {
+	c.write(mqttPacket(0xe0, nil))
+	c.mutex.Lock()
+	if c.connection != nil {
+		c.connection.Close()
+	}
+	c.mutex.Unlock()
+}
+
+func (c *mqttClient) run(onMessage func(topic string, payload []byte), onConnect func()) {
+	b := newBackoff(time.Second, maxReconnectDelaySecond*time.Second)
+	for {
+		started := time.Now()
+		err := c.session(onMessage, onConnect)
+		if runContext().Err() != nil {
+			return
+		}
+		if time.Since(started) > maxReconnectDelaySecond*time.Second {
+			b.reset()
+		}
+		slog.Error("MQTT connection lost, reconnecting.", "broker", c.config.Broker, "error", err)
+		if !b.wait() {
+			return
+		}
+	}
+}
+
+// BEGIN SHARED BLOCK secret, see port/platform/common/automation/go_shared
+// Fetch a secret, e.g. a private key or a password, from where the
+// reference says it is, so that secrets need not be kept in files on
+// the machines of the test farm: "env:NAME" is the value of the
+// environment variable NAME, "vault:PATH#FIELD" is FIELD of the secret
+// at API path PATH (e.g. "secret/data/ubxlib/x" for a KV version 2
+// secrets engine mounted at "secret") in HashiCorp Vault, using
+// VAULT_ADDR, VAULT_TOKEN and, if set, VAULT_NAMESPACE from the
+// environment, and "file:PATH", or anything else, is a file
+func readSecret(reference string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(reference, "env:"):
+		value, ok := os.LookupEnv(reference[4:])
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", reference[4:])
+		}
+		return []byte(value), nil
+	case strings.HasPrefix(reference, "vault:"):
+		return readVaultSecret(reference[6:])
+	}
+	return ioutil.ReadFile(strings.TrimPrefix(reference, "file:"))
+}
+
+func readVaultSecret(reference string) ([]byte, error) {
+	x := strings.LastIndex(reference, "#")
+	if x < 0 {
+		return nil, fmt.Errorf("vault secret \"%s\" has no #field", reference)
+	}
+	secretPath, field := strings.Trim(reference[:x], "/"), reference[x+1:]
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	var value []byte
+	err := retry("vault "+secretPath, vaultAttempts, vaultTimeoutSecond*time.Second, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(address, "/")+"/v1/"+secretPath, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		request.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+		if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+			request.Header.Set("X-Vault-Namespace", namespace)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("vault returned HTTP status %d for %s", response.StatusCode, secretPath)
+			if response.StatusCode < http.StatusInternalServerError {
+				// e.g. a bad token or path, which won't get better
+				err = permanent(err)
+			}
+			return err
+		}
+		// KV version 1 has the fields in "data", version 2 in "data.data"
+		var secret struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&secret)
+		if err != nil {
+			return err
+		}
+		fields := secret.Data
+		if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+			if _, isV1Field := secret.Data[field]; !isV1Field {
+				fields = inner
+			}
+		}
+		text, ok := fields[field].(string)
+		if !ok {
+			return permanent(fmt.Errorf("vault secret %s has no string field \"%s\"", secretPath, field))
+		}
+		value = []byte(text)
+		return nil
+	})
+	return value, err
+}
+
+// END SHARED BLOCK secret
+
+// BEGIN SHARED BLOCK event, see port/platform/common/automation/go_shared
+// Events, e.g. a connection being opened or a fault being injected,
+// are published to port/platform/common/automation/event_bus if the
+// environment variable UBXLIB_EVENT_BUS is set to its URL, so that a
+// test can wait for, or check the timing of, what a server saw; they
+// are sent straight away, batched if they come faster than they can
+// be sent
+const eventQueueSize = 4096
+const eventBatchSize = 256
+const eventTimeoutSecond = 5
+
+// Event is as published to the event bus
+type Event struct {
+	Time       time.Time              `json:"time"`
+	Source     string                 `json:"source"`
+	Type       string                 `json:"type"`
+	Session    string                 `json:"session,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+var eventBus = strings.TrimRight(os.Getenv("UBXLIB_EVENT_BUS"), "/")
+var eventSource string
+var eventQueue = make(chan Event, eventQueueSize)
+var eventFlushes = make(chan chan struct{})
+
+// Publish an event, the attributes given as name/value pairs, as for
+// slog; does nothing if there is no event bus and never blocks, the
+// event being dropped if the queue is full
+func eventPublish(eventType string, session string, args ...any) {
+	if eventBus == "" {
+		return
+	}
+	e := Event{Time: time.Now().UTC(), Source: eventSource, Type: eventType, Session: session}
+	if len(args) > 1 {
+		e.Attributes = make(map[string]interface{})
+		for x := 0; x+1 < len(args); x += 2 {
+			name, _ := args[x].(string)
+			e.Attributes[name] = args[x+1]
+		}
+	}
+	select {
+	case eventQueue <- e:
+	default:
+	}
+}
+
+func eventExport() {
+	if eventBus == "" {
+		return
+	}
+	// Where more than one instance of a tool runs, e.g. the plain
+	// and the secure echo servers, UBXLIB_EVENT_SOURCE tells them apart
+	eventSource = os.Getenv("UBXLIB_EVENT_SOURCE")
+	if eventSource == "" {
+		eventSource = versionInfo().Tool
+	}
+	onShutdown("event publishing", func(ctx context.Context) {
+		flushed := make(chan struct{})
+		select {
+		case eventFlushes <- flushed:
+			select {
+			case <-flushed:
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	})
+	go eventSend()
+}
+
+func eventSend() {
+	slog.Info("Publishing events.", "endpoint", eventBus, "source", eventSource)
+	client := &http.Client{Timeout: eventTimeoutSecond * time.Second}
+	token := os.Getenv("UBXLIB_HTTP_TOKEN")
+	for {
+		var batch []Event
+		var flushed chan struct{}
+		select {
+		case e := <-eventQueue:
+			batch = append(batch, e)
+		case flushed = <-eventFlushes:
+		}
+		for len(batch) < eventBatchSize && len(eventQueue) > 0 {
+			batch = append(batch, <-eventQueue)
+		}
+		if len(batch) > 0 {
+			body, _ := json.Marshal(batch)
+			request, err := http.NewRequest(http.MethodPost, eventBus+"/events", bytes.NewReader(body))
+			if err == nil {
+				request.Header.Set("Content-Type", "application/json")
+				if token != "" {
+					request.Header.Set("Authorization", "Bearer "+token)
+				}
+				var response *http.Response
+				response, err = client.Do(request)
+				if err == nil {
+					response.Body.Close()
+					if response.StatusCode/100 != 2 {
+						err = fmt.Errorf("event bus returned %s", response.Status)
+					}
+				}
+			}
+			if err != nil {
+				slog.Warn("Unable to publish events.", "endpoint", eventBus, "events", len(batch), "error", err)
+			}
+		}
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// END SHARED BLOCK event
+
+// BEGIN SHARED BLOCK config, see port/platform/common/automation/go_shared
+// Overrides of fields of the configuration given with -set
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("must be of the form name=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// Add the line and column to an error from decoding the JSON
+// configuration, since a byte offset isn't much help to anyone
+func configError(contents []byte, err error) error {
+	var offset int64 = -1
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+		err = fmt.Errorf("%q must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	if offset < 0 || offset > int64(len(contents)) {
+		return err
+	}
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(contents[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// Set a field of the configuration from text, finding it by its
+// JSON name, with a "." between the names of nested fields; the
+// case of a name, and "_" rather than "-", don't matter, so that
+// the names can come from environment variables
+func configSet(config interface{}, name string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s: %q is not an object", name, part)
+		}
+		found := false
+		for x := 0; !found && x < field.NumField(); x++ {
+			tag := strings.Split(field.Type().Field(x).Tag.Get("json"), ",")[0]
+			if tag != "" && strings.EqualFold(strings.ReplaceAll(tag, "-", "_"), strings.ReplaceAll(part, "-", "_")) {
+				field = field.Field(x)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: there is no field %q in the configuration", name, part)
+		}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	// Anything else, numbers, booleans, lists or objects, as JSON,
+	// into a fresh value so that nothing of the old one is kept
+	fresh := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), fresh.Interface())
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(fresh.Elem())
+	return nil
+}
+
+// Load the JSON configuration and then apply overrides, first from
+// environment variables named UBXLIB_<TOOL>_<FIELD>, with "__" between
+// the names of nested fields, e.g. UBXLIB_DEVICE_TWIN_MQTT__BROKER,
+// then from -set name=value, so that a deployment need only record
+// how it differs from the checked-in configuration
+func configLoad(contents []byte, config interface{}, overrides []string) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		// Most likely a typo or a field from a newer version of the
+		// tool: worth knowing about but not worth stopping for
+		slog.Warn("Unknown field in the configuration, ignored.", "error", err)
+		err = json.Unmarshal(contents, config)
+	}
+	if err != nil {
+		return configError(contents, err)
+	}
+	prefix := "UBXLIB_" + strings.ToUpper(versionInfo().Tool) + "_"
+	var environment []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			environment = append(environment, strings.TrimPrefix(variable, prefix))
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		nameValue := strings.SplitN(variable, "=", 2)
+		// Only the name is logged since the value may be a secret
+		err = configSet(config, strings.ReplaceAll(nameValue[0], "__", "."), nameValue[1])
+		if err != nil {
+			// Could be meant for another tool with a longer name
+			slog.Warn("Environment variable not applied to the configuration.", "variable", prefix+nameValue[0], "error", err)
+		} else {
+			slog.Info("Configuration overridden from the environment.", "variable", prefix+nameValue[0])
+		}
+	}
+	for _, override := range overrides {
+		nameValue := strings.SplitN(override, "=", 2)
+		err = configSet(config, nameValue[0], nameValue[1])
+		if err != nil {
+			return fmt.Errorf("-set %w", err)
+		}
+		slog.Info("Configuration overridden.", "field", nameValue[0])
+	}
+	return nil
+}
+
+// END SHARED BLOCK config
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"rest", "mqtt", "merge-patch", "events"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "device_twin", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "device_twin")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+// BEGIN SHARED BLOCK retry, see port/platform/common/automation/go_shared
+// Retries, the same in all of the test tools, in place of fixed
+// sleeps: each delay is double the one before, up to a maximum, less
+// up to a half at random so that many clients don't retry in step
+const retryInitialMs = 500
+const retryMaxMs = 30000
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Start again from the initial delay, e.g. once a connection has
+// stayed up for a while
+func (b *backoff) reset() {
+	b.next = b.initial
+}
+
+// Wait for the next delay, returning false if the tool is asked to
+// stop in the meantime
+func (b *backoff) wait() bool {
+	timer := time.NewTimer(b.delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+// An error that trying again won't fix, e.g. a refusal rather than a
+// failure to connect
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// Call operation up to attempts times, backing off between attempts,
+// each attempt being given a context that is done after timeout or
+// when the tool is asked to stop; a permanent error isn't retried
+func retry(name string, attempts int, timeout time.Duration, operation func(ctx context.Context) error) error {
+	b := newBackoff(retryInitialMs*time.Millisecond, retryMaxMs*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(runContext(), timeout)
+		err := operation(ctx)
+		cancel()
+		var isPermanent permanentError
+		if err == nil || errors.As(err, &isPermanent) || attempt >= attempts {
+			return err
+		}
+		slog.Warn("Failed, trying again.", "operation", name, "attempt", attempt, "error", err)
+		if !b.wait() {
+			return err
+		}
+	}
+}
+
+// END SHARED BLOCK retry
+
+func main() {
+	defer recoverPanic()
+
+	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration.")
+	var overrides configOverrides
+	flag.Var(&overrides, "set", "Override a field of the configuration with name=value, name being the JSON name, with . between nested names; may be repeated.")
+	printConfig := flag.Bool("print_config", false, "Print the configuration, with any overrides applied, and exit.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	byteValue, err := ioutil.ReadFile(*configLocation)
+	if err != nil {
+		logFatal("Failed to open file.", "error", err)
+	}
+
+	var config Argument
+	err = configLoad(byteValue, &config, overrides)
+	if err != nil {
+		logFatal("Invalid configuration.", "file", *configLocation, "error", err)
+	}
+	if *printConfig {
+		contents, _ := json.MarshalIndent(config, "", "    ")
+		fmt.Println(string(contents))
+		return
+	}
+	if config.HttpPort == "" {
+		config.HttpPort = "8097"
+	}
+	eventExport()
+
+	store := &twinStore{stateFile: config.StateFile}
+	store.load()
+
+	if config.Mqtt != nil && config.Mqtt.Broker != "" {
+		if config.Mqtt.TopicPrefix == "" {
+			config.Mqtt.TopicPrefix = "ubxlib/twin"
+		}
+		if config.Mqtt.ClientId == "" {
+			config.Mqtt.ClientId = "ubxlib_device_twin"
+		}
+		client := &mqttClient{config: *config.Mqtt}
+		if config.Mqtt.Password != "" {
+			password, err := readSecret(config.Mqtt.Password)
+			if err != nil {
+				logFatal("Unable to read MQTT password.", "error", err)
+			}
+			client.password = strings.TrimSpace(string(password))
+		}
+		publishDesired := func(device string, desired map[string]interface{}) {
+			if desired == nil {
+				desired = make(map[string]interface{})
+			}
+			payload, _ := json.Marshal(desired)
+			err := client.publish(config.Mqtt.TopicPrefix+"/"+device+"/desired", payload, true)
+			if err != nil {
+				slog.Warn("Unable to publish desired state, will publish on reconnection.", "device", device, "error", err)
+			}
+		}
+		store.onDesired = publishDesired
+		store.onRemoved = func(device string) {
+			// An empty retained message clears the retained one
+			err := client.publish(config.Mqtt.TopicPrefix+"/"+device+"/desired", nil, true)
+			if err != nil {
+				slog.Warn("Unable to clear retained desired state.", "device", device, "error", err)
+			}
+		}
+		onMessage := func(topic string, payload []byte) {
+			parts := strings.Split(strings.TrimPrefix(topic, config.Mqtt.TopicPrefix+"/"), "/")
+			if len(parts) != 2 || parts[1] != "reported" || !validDevice(parts[0]) {
+				return
+			}
+			var patch map[string]interface{}
+			err := json.Unmarshal(payload, &patch)
+			if err != nil {
+				slog.Warn("Reported state is not a JSON object.", "device", parts[0], "error", err)
+				return
+			}
+			store.update(parts[0], true, patch, false)
+		}
+		onConnect := func() {
+			store.republish()
+		}
+		onShutdown("mqtt", func(ctx context.Context) {
+			client.disconnect()
+		})
+		go client.run(onMessage, onConnect)
+	}
+
+	go func() {
+		defer recoverPanic()
+		err := serveHttp(config.HttpPort, config.HttpOptions, store)
+		if err != nil {
+			logFatal("HTTP server failed.", "error", err)
+		}
+	}()
+
+	<-runContext().Done()
+	exit(exitOk)
+}
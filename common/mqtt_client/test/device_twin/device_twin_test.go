@@ -0,0 +1,329 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Run with: go test device_twin.go device_twin_test.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The middleware is a shared block, the same in all of the tools
+// with an HTTP API, so it is tested here only
+
+func TestHttpMiddlewareToken(t *testing.T) {
+	t.Setenv("DEVICE_TWIN_TEST_TOKEN", " s3cret\n")
+	handler, err := httpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), HttpOptions{Token: "env:DEVICE_TWIN_TEST_TOKEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "Bearer s3cre7", http.StatusUnauthorized},
+		{"untrimmed", "Bearer  s3cret\n", http.StatusUnauthorized},
+		{"not bearer", "Basic s3cret", http.StatusUnauthorized},
+		{"correct", "Bearer s3cret", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/twins", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			if response.Code != test.status {
+				t.Errorf("status %d, expected %d", response.Code, test.status)
+			}
+			challenge := response.Header().Get("WWW-Authenticate")
+			if (test.status == http.StatusUnauthorized) != (challenge == "Bearer") {
+				t.Errorf("WWW-Authenticate is %q with status %d", challenge, response.Code)
+			}
+		})
+	}
+
+	if _, err := httpMiddleware(http.NotFoundHandler(), HttpOptions{Token: "env:DEVICE_TWIN_TEST_UNSET"}); err == nil {
+		t.Error("no error for a token that can't be read")
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	type step struct {
+		// How far to move the last update of the bucket of
+		// the client back in time before the request
+		elapsed time.Duration
+		client  string
+		allowed bool
+		// The least and most that the wait may be when not allowed
+		waitMin time.Duration
+		waitMax time.Duration
+	}
+	second := time.Second
+	tests := []struct {
+		name  string
+		rate  float64
+		burst float64
+		steps []step
+	}{
+		{"burst", 2, 3, []step{
+			{0, "a", true, 0, 0},
+			{0, "a", true, 0, 0},
+			{0, "a", true, 0, 0},
+			{0, "a", false, 490 * time.Millisecond, 500 * time.Millisecond},
+			{0, "b", true, 0, 0},
+		}},
+		{"refill", 2, 3, []step{
+			{0, "a", true, 0, 0},
+			{0, "a", true, 0, 0},
+			{0, "a", true, 0, 0},
+			{0, "a", false, 490 * time.Millisecond, 500 * time.Millisecond},
+			{second / 2, "a", true, 0, 0},
+			{0, "a", false, 490 * time.Millisecond, 500 * time.Millisecond},
+			{second, "a", true, 0, 0},
+			{0, "a", true, 0, 0},
+			{0, "a", false, 490 * time.Millisecond, 500 * time.Millisecond},
+		}},
+		{"refill limited to burst", 2, 2, []step{
+			{0, "a", true, 0, 0},
+			{0, "a", true, 0, 0},
+			{time.Hour, "a", true, 0, 0},
+			{0, "a", true, 0, 0},
+			{0, "a", false, 490 * time.Millisecond, 500 * time.Millisecond},
+		}},
+		{"slow", 0.25, 1, []step{
+			{0, "a", true, 0, 0},
+			{0, "a", false, 3990 * time.Millisecond, 4 * time.Second},
+			{second, "a", false, 2990 * time.Millisecond, 3 * time.Second},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := &rateLimiter{rate: test.rate, burst: test.burst, clients: make(map[string]*rateBucket),
+				swept: time.Now()}
+			for x, s := range test.steps {
+				if bucket, ok := limiter.clients[s.client]; ok {
+					bucket.updated = bucket.updated.Add(-s.elapsed)
+				}
+				allowed, wait := limiter.allow(s.client)
+				if allowed != s.allowed || wait < s.waitMin || wait > s.waitMax {
+					t.Errorf("step %d: allowed %t, wait %v, expected %t, wait %v to %v", x, allowed, wait,
+						s.allowed, s.waitMin, s.waitMax)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterForget(t *testing.T) {
+	limiter := &rateLimiter{rate: 1, burst: 1, clients: make(map[string]*rateBucket), swept: time.Now()}
+	limiter.allow("a")
+	limiter.allow("b")
+	limiter.clients["a"].updated = time.Now().Add(-(rateLimitForgetSecond + 1) * time.Second)
+	limiter.swept = time.Now().Add(-(rateLimitForgetSecond + 1) * time.Second)
+	limiter.allow("b")
+	if _, ok := limiter.clients["a"]; ok {
+		t.Error("idle client not forgotten")
+	}
+	if _, ok := limiter.clients["b"]; !ok {
+		t.Error("active client forgotten")
+	}
+}
+
+func TestHttpMiddlewareRetryAfter(t *testing.T) {
+	handler, err := httpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		HttpOptions{RatePerSecond: 0.4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote     string
+		status     int
+		retryAfter string
+	}{
+		// A burst of zero is taken as one
+		{"192.0.2.1:1000", http.StatusOK, ""},
+		{"192.0.2.1:1001", http.StatusTooManyRequests, "3"},
+		{"192.0.2.2:1000", http.StatusOK, ""},
+		// Without a port the whole address is the client
+		{"192.0.2.3", http.StatusOK, ""},
+		{"192.0.2.3", http.StatusTooManyRequests, "3"},
+	}
+	for x, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = test.remote
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		if response.Code != test.status || response.Header().Get("Retry-After") != test.retryAfter {
+			t.Errorf("request %d from %s: status %d, Retry-After %q, expected %d, %q", x, test.remote,
+				response.Code, response.Header().Get("Retry-After"), test.status, test.retryAfter)
+		}
+	}
+}
+
+func TestHttpMiddlewareAccessLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		accessLog bool
+		session   string
+		status    int
+		bytes     int
+		level     string
+	}{
+		{"implicit ok", func(w http.ResponseWriter, r *http.Request) {}, true, "", 200, 0, "INFO"},
+		{"write", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+			w.Write([]byte(" world"))
+		}, true, "", 200, 11, "INFO"},
+		{"created", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		}, false, "", 201, 2, "DEBUG"},
+		{"error", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "teapot", http.StatusTeapot)
+		}, false, "", 418, 7, "WARN"},
+		{"session", func(w http.ResponseWriter, r *http.Request) {}, true, "run-42", 200, 0, "INFO"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var output bytes.Buffer
+			previous := slog.Default()
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{Level: slog.LevelDebug})))
+			defer slog.SetDefault(previous)
+			handler, err := httpMiddleware(test.handler, HttpOptions{AccessLog: test.accessLog})
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := httptest.NewRequest(http.MethodPut, "/twins/thing_1", nil)
+			if test.session != "" {
+				request.Header.Set("X-Session-Id", test.session)
+			}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			if response.Code != test.status {
+				t.Errorf("status %d passed on as %d", test.status, response.Code)
+			}
+			var record struct {
+				Level         string `json:"level"`
+				Method        string `json:"method"`
+				Path          string `json:"path"`
+				Status        int    `json:"status"`
+				Bytes         int    `json:"bytes"`
+				ClientSession string `json:"client-session"`
+			}
+			if err := json.Unmarshal(output.Bytes(), &record); err != nil {
+				t.Fatalf("%v in %q", err, output.String())
+			}
+			if record.Level != test.level || record.Method != http.MethodPut || record.Path != "/twins/thing_1" ||
+				record.Status != test.status || record.Bytes != test.bytes || record.ClientSession != test.session {
+				t.Errorf("logged %+v, expected level %s, status %d, bytes %d, session %q", record, test.level,
+					test.status, test.bytes, test.session)
+			}
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// The examples of RFC 7396, plus a patch to no state
+	tests := []struct {
+		target   string
+		patch    string
+		expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`{"a":"foo"}`, `{"a":{"bar":"baz"}}`, `{"a":{"bar":"baz"}}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{`null`, `{"a":1,"b":null}`, `{"a":1}`},
+	}
+	for _, test := range tests {
+		var target, patch, expected map[string]interface{}
+		for _, value := range []struct {
+			text   string
+			object *map[string]interface{}
+		}{{test.target, &target}, {test.patch, &patch}, {test.expected, &expected}} {
+			if err := json.Unmarshal([]byte(value.text), value.object); err != nil {
+				t.Fatal(err)
+			}
+		}
+		result := mergePatch(target, patch)
+		if !reflect.DeepEqual(result, expected) {
+			text, _ := json.Marshal(result)
+			t.Errorf("%s patched with %s is %s, expected %s", test.target, test.patch, text, test.expected)
+		}
+	}
+}
+
+func TestReadMqttPacket(t *testing.T) {
+	// Lengths either side of each extra byte of remaining length
+	for _, length := range []int{0, 1, 127, 128, 16383, 16384, 2097151, 2097152} {
+		body := bytes.Repeat([]byte{0x5a}, length)
+		packet := mqttPacket(0x30, body)
+		packetType, read, err := readMqttPacket(bufio.NewReader(bytes.NewReader(append(packet, 0xe0, 0x00))))
+		if err != nil || packetType != 0x30 || !bytes.Equal(read, body) {
+			t.Errorf("length %d: read type 0x%02x, %d byte(s), error %v", length, packetType, len(read), err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		bytes []byte
+		err   error
+	}{
+		{"empty", []byte{}, io.EOF},
+		{"no length", []byte{0x20}, io.EOF},
+		{"length cut short", []byte{0x30, 0x80}, io.EOF},
+		{"length too long", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, nil},
+		{"body cut short", []byte{0x30, 0x05, 0x00, 0x01}, io.ErrUnexpectedEOF},
+		{"no body", []byte{0x30, 0x05}, io.EOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := readMqttPacket(bufio.NewReader(bytes.NewReader(test.bytes)))
+			if err == nil || (test.err != nil && !errors.Is(err, test.err)) {
+				t.Errorf("error %v, expected %v", err, test.err)
+			}
+			if test.err == nil && err != nil && !strings.Contains(err.Error(), "remaining length") {
+				t.Errorf("error %v, expected a bad remaining length", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,716 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const pskSize = 16
+
+// The files written by generate, in the order they are written
+var generatedFiles = []string{"ca_cert.pem", "ca_key.pem", "server_cert.pem", "server_key.pem",
+	"client_cert.pem", "client_key.pem", "psk.txt"}
+
+func newKey(keyType string) (crypto.Signer, []byte, error) {
+	var key crypto.Signer
+	var err error
+	var der []byte
+	blockType := ""
+	switch keyType {
+	case "rsa":
+		var rsaKey *rsa.PrivateKey
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err == nil {
+			// PKCS#1, the form that all u-blox modules accept
+			der = x509.MarshalPKCS1PrivateKey(rsaKey)
+			blockType = "RSA PRIVATE KEY"
+			key = rsaKey
+		}
+	case "ec":
+		var ecKey *ecdsa.PrivateKey
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err == nil {
+			der, err = x509.MarshalECPrivateKey(ecKey)
+			blockType = "EC PRIVATE KEY"
+			key = ecKey
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown key type %q, must be rsa or ec", keyType)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), nil
+}
+
+func newCertificate(template *x509.Certificate, parent *x509.Certificate, key crypto.Signer,
+	parentKey crypto.Signer) (*x509.Certificate, []byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	return certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), err
+}
+
+// Generate a CA, a server certificate and key signed by it, a client
+// certificate and key signed by it and a PSK, everything that a test
+// server and the device talking to it need
+func generate(args []string) error {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	out := flags.String("out", ".", "Directory to write the credentials to.")
+	hosts := flags.String("hosts", "localhost,127.0.0.1", "Comma-separated host names and IP addresses for the server certificate.")
+	clientName := flags.String("client_name", "ubxlib client", "Common name of the client certificate.")
+	days := flags.Int("days", 365, "How many days the certificates are valid for.")
+	keyType := flags.String("key_type", "rsa", "Type of key: rsa (2048 bit) or ec (P-256).")
+	pskIdentity := flags.String("psk_identity", "ubxlib", "The identity to go with the PSK.")
+	force := flags.Bool("force", false, "Overwrite existing files.")
+	flags.Parse(args)
+
+	if !*force {
+		for _, name := range generatedFiles {
+			if _, err := os.Stat(filepath.Join(*out, name)); err == nil {
+				return fmt.Errorf("%s already exists, use -force to overwrite it", filepath.Join(*out, name))
+			}
+		}
+	}
+	err := os.MkdirAll(*out, 0755)
+	if err != nil {
+		return err
+	}
+	notBefore := time.Now().Add(-time.Hour).UTC()
+	notAfter := notBefore.Add(time.Duration(*days) * 24 * time.Hour)
+	subject := func(name string) pkix.Name {
+		return pkix.Name{CommonName: name, Organization: []string{"u-blox"}, OrganizationalUnit: []string{"ubxlib test"}}
+	}
+	contents := make(map[string][]byte)
+
+	caKey, caKeyPem, err := newKey(*keyType)
+	if err != nil {
+		return err
+	}
+	ca, caPem, err := newCertificate(&x509.Certificate{Subject: subject("ubxlib test CA"),
+		NotBefore: notBefore, NotAfter: notAfter, IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign}, nil, caKey, nil)
+	if err != nil {
+		return err
+	}
+	contents["ca_cert.pem"] = caPem
+	contents["ca_key.pem"] = caKeyPem
+
+	serverKey, serverKeyPem, err := newKey(*keyType)
+	if err != nil {
+		return err
+	}
+	server := &x509.Certificate{NotBefore: notBefore, NotAfter: notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	for _, host := range strings.Split(*hosts, ",") {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else if host != "" {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+	if len(server.DNSNames) > 0 {
+		server.Subject = subject(server.DNSNames[0])
+	} else {
+		server.Subject = subject("ubxlib test server")
+	}
+	_, contents["server_cert.pem"], err = newCertificate(server, ca, serverKey, caKey)
+	if err != nil {
+		return err
+	}
+	contents["server_key.pem"] = serverKeyPem
+
+	clientKey, clientKeyPem, err := newKey(*keyType)
+	if err != nil {
+		return err
+	}
+	_, contents["client_cert.pem"], err = newCertificate(&x509.Certificate{Subject: subject(*clientName),
+		NotBefore: notBefore, NotAfter: notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca, clientKey, caKey)
+	if err != nil {
+		return err
+	}
+	contents["client_key.pem"] = clientKeyPem
+
+	psk := make([]byte, pskSize)
+	_, err = rand.Read(psk)
+	if err != nil {
+		return err
+	}
+	contents["psk.txt"] = []byte(*pskIdentity + ":" + hex.EncodeToString(psk) + "\n")
+
+	for _, name := range generatedFiles {
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, "_key.pem") || name == "psk.txt" {
+			mode = 0600
+		}
+		err = writeAtomically(filepath.Join(*out, name), contents[name], mode)
+		if err != nil {
+			return err
+		}
+	}
+	slog.Info("Credentials written.", "directory", *out, "key-type", *keyType, "hosts", *hosts,
+		"expires", notAfter.Format(time.RFC3339))
+	return nil
+}
+
+func writeAtomically(fileName string, contents []byte, mode os.FileMode) error {
+	temporary := fileName + ".tmp"
+	err := ioutil.WriteFile(temporary, contents, mode)
+	if err == nil {
+		err = os.Rename(temporary, fileName)
+	}
+	return err
+}
+
+// Read all of the PEM blocks of a given type from a file
+func readPem(fileName string, typeSuffix string) ([]*pem.Block, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			break
+		}
+		if strings.HasSuffix(block.Type, typeSuffix) {
+			blocks = append(blocks, block)
+		}
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("no %s found in %s", typeSuffix, fileName)
+	}
+	return blocks, nil
+}
+
+// Read a PSK file of the form identity:hex-key
+func readPsk(fileName string) (string, []byte, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", nil, err
+	}
+	identityKey := strings.SplitN(strings.TrimSpace(string(contents)), ":", 2)
+	if len(identityKey) != 2 {
+		return "", nil, fmt.Errorf("%s must contain identity:key, the key in hex", fileName)
+	}
+	key, err := hex.DecodeString(identityKey[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: key is not hex: %w", fileName, err)
+	}
+	return identityKey[0], key, nil
+}
+
+// Check that a certificate and key go together, that the certificate
+// chains to the CA, is valid for the host and isn't about to expire
+func validate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	certFile := flags.String("cert", "", "Certificate file (PEM); any further certificates in it are taken as intermediates.")
+	keyFile := flags.String("key", "", "Private key file (PEM) that should go with the certificate.")
+	caFile := flags.String("ca", "", "CA certificate file (PEM) that the certificate should chain to.")
+	host := flags.String("host", "", "Host name or IP address that the certificate should be valid for.")
+	warnDays := flags.Int("warn_days", 30, "Warn if the certificate expires within this many days.")
+	flags.Parse(args)
+	if *certFile == "" {
+		return errors.New("usage: validate -cert <file> [-key <file>] [-ca <file>] [-host <name>] [-warn_days <days>]")
+	}
+
+	blocks, err := readPem(*certFile, "CERTIFICATE")
+	if err != nil {
+		return err
+	}
+	var chain []*x509.Certificate
+	for _, block := range blocks {
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s: %w", *certFile, err)
+		}
+		chain = append(chain, certificate)
+	}
+	leaf := chain[0]
+	var problems []string
+	slog.Info("Certificate.", "subject", leaf.Subject.String(), "issuer", leaf.Issuer.String(),
+		"not-before", leaf.NotBefore.Format(time.RFC3339), "not-after", leaf.NotAfter.Format(time.RFC3339))
+
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		problems = append(problems, "the certificate is not yet valid")
+	} else if now.After(leaf.NotAfter) {
+		problems = append(problems, "the certificate has expired")
+	} else if now.Add(time.Duration(*warnDays) * 24 * time.Hour).After(leaf.NotAfter) {
+		slog.Warn("Certificate expires soon.", "days", int(time.Until(leaf.NotAfter).Hours()/24))
+	}
+	if *keyFile != "" {
+		certPem, _ := ioutil.ReadFile(*certFile)
+		keyPem, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		_, err = tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			problems = append(problems, "the key does not go with the certificate: "+err.Error())
+		}
+	}
+	if *caFile != "" {
+		roots := x509.NewCertPool()
+		caBlocks, err := readPem(*caFile, "CERTIFICATE")
+		if err != nil {
+			return err
+		}
+		for _, block := range caBlocks {
+			ca, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("%s: %w", *caFile, err)
+			}
+			roots.AddCert(ca)
+		}
+		intermediates := x509.NewCertPool()
+		for _, certificate := range chain[1:] {
+			intermediates.AddCert(certificate)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+		if err != nil {
+			problems = append(problems, "the certificate does not chain to the CA: "+err.Error())
+		}
+	}
+	if *host != "" {
+		err = leaf.VerifyHostname(*host)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	slog.Info("Certificate is valid.", "file", *certFile)
+	return nil
+}
+
+// Write bytes as a C string literal the way the ubxlib test and
+// example credentials are written: one line of the PEM per line
+// of source, without the line endings
+func cPemString(name string, pemContents []byte) string {
+	var text strings.Builder
+	prefix := fmt.Sprintf("static const char *const %s = ", name)
+	for x, line := range strings.Split(strings.TrimSpace(string(pemContents)), "\n") {
+		if x == 0 {
+			text.WriteString(prefix)
+		} else {
+			text.WriteString("\n" + strings.Repeat(" ", len(prefix)))
+		}
+		text.WriteString("\"" + strings.TrimSpace(line) + "\"")
+	}
+	text.WriteString(";\n")
+	return text.String()
+}
+
+func cByteArray(name string, contents []byte) string {
+	var text strings.Builder
+	prefix := fmt.Sprintf("static const char %s[] = {", name)
+	text.WriteString(prefix)
+	for x, b := range contents {
+		if x > 0 {
+			text.WriteString(",")
+			if x%12 == 0 {
+				text.WriteString("\n" + strings.Repeat(" ", len(prefix)))
+			} else {
+				text.WriteString(" ")
+			}
+		}
+		text.WriteString(fmt.Sprintf("0x%02x", b))
+	}
+	text.WriteString("};\n")
+	return text.String()
+}
+
+// Export credentials for the device side, as a PEM bundle, as DER
+// files or as a C header that a test or example can include
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	certFile := flags.String("cert", "", "Certificate file (PEM), e.g. client_cert.pem.")
+	keyFile := flags.String("key", "", "Private key file (PEM), e.g. client_key.pem.")
+	caFile := flags.String("ca", "", "CA certificate file (PEM), e.g. ca_cert.pem.")
+	pskFile := flags.String("psk", "", "PSK file, identity:key with the key in hex, e.g. psk.txt.")
+	format := flags.String("format", "c", "Format: pem (one bundle), der (one file per item) or c (a header).")
+	out := flags.String("out", "credentials", "Output file name without extension.")
+	name := flags.String("name", "UTestCredentials", "For the c format, the name to put in the variable names.")
+	flags.Parse(args)
+
+	type item struct {
+		name        string
+		description string
+		block       *pem.Block
+	}
+	var items []item
+	for _, source := range []struct{ name, description, file, suffix string }{
+		{"Ca", "The CA certificate", *caFile, "CERTIFICATE"},
+		{"Cert", "The certificate", *certFile, "CERTIFICATE"},
+		{"Key", "The private key", *keyFile, "PRIVATE KEY"}} {
+		if source.file == "" {
+			continue
+		}
+		blocks, err := readPem(source.file, source.suffix)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(blocks[0].Type, "ENCRYPTED") || blocks[0].Headers["Proc-Type"] != "" {
+			return fmt.Errorf("%s is encrypted, decrypt it first", source.file)
+		}
+		items = append(items, item{source.name, source.description, blocks[0]})
+	}
+	pskIdentity := ""
+	var psk []byte
+	if *pskFile != "" {
+		var err error
+		pskIdentity, psk, err = readPsk(*pskFile)
+		if err != nil {
+			return err
+		}
+	}
+	if len(items) == 0 && psk == nil {
+		return errors.New("nothing to export: give one or more of -cert, -key, -ca and -psk")
+	}
+
+	var written []string
+	switch *format {
+	case "pem":
+		var bundle bytes.Buffer
+		for _, i := range items {
+			pem.Encode(&bundle, i.block)
+		}
+		if psk != nil {
+			slog.Warn("A PSK can't be put into a PEM bundle, it is not exported.")
+		}
+		err := writeAtomically(*out+".pem", bundle.Bytes(), 0600)
+		if err != nil {
+			return err
+		}
+		written = append(written, *out+".pem")
+	case "der":
+		for _, i := range items {
+			fileName := *out + "_" + strings.ToLower(i.name) + ".der"
+			err := writeAtomically(fileName, i.block.Bytes, 0600)
+			if err != nil {
+				return err
+			}
+			written = append(written, fileName)
+		}
+		if psk != nil {
+			fileName := *out + "_psk.bin"
+			err := writeAtomically(fileName, psk, 0600)
+			if err != nil {
+				return err
+			}
+			written = append(written, fileName)
+		}
+	case "c":
+		guard := "_" + strings.ToUpper(filepath.Base(*out)) + "_H_"
+		var header strings.Builder
+		header.WriteString("/* Generated by credentials.go: test credentials, NOT for production use. */\n\n")
+		header.WriteString("#ifndef " + guard + "\n#define " + guard + "\n\n")
+		for _, i := range items {
+			header.WriteString("/** " + i.description + ", PEM. */\n")
+			header.WriteString(cPemString("gp"+*name+i.name+"Pem", pem.EncodeToMemory(i.block)))
+			header.WriteString("\n/** " + i.description + ", DER, for modules that need binary. */\n")
+			header.WriteString(cByteArray("g"+*name+i.name+"Der", i.block.Bytes))
+			header.WriteString("\n")
+		}
+		if psk != nil {
+			header.WriteString("/** The PSK identity. */\n")
+			header.WriteString(fmt.Sprintf("static const char *const gp%sPskId = \"%s\";\n\n", *name, pskIdentity))
+			header.WriteString("/** The PSK. */\n")
+			header.WriteString(cByteArray("g"+*name+"Psk", psk))
+			header.WriteString("\n")
+		}
+		header.WriteString("#endif // " + guard + "\n\n// End of file\n")
+		err := writeAtomically(*out+".h", []byte(header.String()), 0600)
+		if err != nil {
+			return err
+		}
+		written = append(written, *out+".h")
+	default:
+		return fmt.Errorf("unknown format %q, must be pem, der or c", *format)
+	}
+	slog.Info("Credentials exported.", "files", strings.Join(written, ","))
+	return nil
+}
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"rsa", "ec", "psk", "export-c"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "credentials", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "credentials")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+func main() {
+	defer recoverPanic()
+
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] generate|validate|export [command options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	commands := map[string]func([]string) error{"generate": generate, "validate": validate, "export": export}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		flag.Usage()
+		exit(exitUsage)
+	}
+	err := command(flag.Args()[1:])
+	if err != nil {
+		logFatal("Command failed.", "command", flag.Arg(0), "error", err)
+	}
+}
@@ -0,0 +1,1059 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The largest frame taken from a capture, that being the largest
+// snapshot length of tcpdump and Wireshark, and the largest pcapng
+// block, which also carries a header and options, so that a corrupt
+// length in a capture file can't ask for any amount of memory
+const maxCaptureLength = 262144
+const maxBlockLength = maxCaptureLength + 65536
+
+// TLS/DTLS record content types
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+)
+
+// TLS/DTLS handshake message types
+const (
+	handshakeClientHello        = 1
+	handshakeServerHello        = 2
+	handshakeHelloVerifyRequest = 3
+	handshakeNewSessionTicket   = 4
+	handshakeCertificate        = 11
+)
+
+// TLS extension types
+const (
+	extensionServerName        = 0
+	extensionAlpn              = 16
+	extensionSessionTicket     = 35
+	extensionPreSharedKey      = 41
+	extensionSupportedVersions = 43
+)
+
+// Direction of a flow relative to the connection
+const (
+	fromClient = 0
+	fromServer = 1
+)
+
+// Certificate in the chain presented by the server
+type Certificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not-before"`
+	NotAfter  time.Time `json:"not-after"`
+}
+
+// Connection holds everything learnt about one TLS or DTLS connection
+type Connection struct {
+	Protocol           string        `json:"protocol"`
+	Client             string        `json:"client"`
+	Server             string        `json:"server"`
+	Start              time.Time     `json:"start"`
+	OfferedVersions    []string      `json:"offered-versions,omitempty"`
+	Version            string        `json:"version,omitempty"`
+	OfferedCiphers     int           `json:"offered-cipher-suites,omitempty"`
+	CipherSuite        string        `json:"cipher-suite,omitempty"`
+	Sni                string        `json:"sni,omitempty"`
+	OfferedAlpn        []string      `json:"offered-alpn,omitempty"`
+	Alpn               string        `json:"alpn,omitempty"`
+	CertificateChain   []Certificate `json:"certificate-chain,omitempty"`
+	CertificatesHidden bool          `json:"certificates-encrypted,omitempty"`
+	Resumed            bool          `json:"resumed"`
+	ResumptionOffered  bool          `json:"resumption-offered"`
+	HelloVerify        bool          `json:"hello-verify-request,omitempty"`
+	NewSessionTicket   bool          `json:"new-session-ticket,omitempty"`
+	Alert              string        `json:"alert,omitempty"`
+	Errors             []string      `json:"errors,omitempty"`
+	// Working state
+	clientHelloSeen bool
+	reported        bool
+	clientSessionId []byte
+	serverHelloSeen bool
+	certificateSeen bool
+	changeCipher    [2]bool
+	streams         [2]*stream
+	dtlsFragments   map[uint16][]byte
+}
+
+// A TCP byte stream in one direction, reassembled in order
+type stream struct {
+	nextSeq  uint32
+	started  bool
+	buffer   []byte
+	finished bool
+	pending  []byte
+}
+
+// One packet from the capture, reduced to the transport layer
+type packet struct {
+	timestamp time.Time
+	transport string
+	srcAddr   string
+	dstAddr   string
+	tcpSeq    uint32
+	tcpSyn    bool
+	payload   []byte
+}
+
+// Read a classic libpcap file or a pcapng file, calling back
+// with the link type and data of each captured frame
+func readCapture(reader io.Reader, callback func(linkType uint32, timestamp time.Time, data []byte)) error {
+	header := make([]byte, 24)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return err
+	}
+	magic := binary.LittleEndian.Uint32(header[0:4])
+	switch magic {
+	case 0xa1b2c3d4, 0xa1b23c4d, 0xd4c3b2a1, 0x4d3cb2a1:
+		return readPcap(header, reader, callback)
+	case 0x0a0d0d0a:
+		return readPcapng(header, reader, callback)
+	}
+	return errors.New("not a pcap or pcapng file")
+}
+
+func readPcap(header []byte, reader io.Reader, callback func(uint32, time.Time, []byte)) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(header[0:4])
+	if magic == 0xd4c3b2a1 || magic == 0x4d3cb2a1 {
+		order = binary.BigEndian
+		magic = order.Uint32(header[0:4])
+	}
+	nanoseconds := magic == 0xa1b23c4d
+	linkType := order.Uint32(header[20:24])
+	recordHeader := make([]byte, 16)
+	for {
+		_, err := io.ReadFull(reader, recordHeader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seconds := int64(order.Uint32(recordHeader[0:4]))
+		fraction := int64(order.Uint32(recordHeader[4:8]))
+		if !nanoseconds {
+			fraction *= 1000
+		}
+		captured := order.Uint32(recordHeader[8:12])
+		if captured > maxCaptureLength {
+			return fmt.Errorf("corrupt pcap record, %d bytes captured", captured)
+		}
+		data := make([]byte, captured)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return err
+		}
+		callback(linkType, time.Unix(seconds, fraction), data)
+	}
+}
+
+func readPcapng(header []byte, reader io.Reader, callback func(uint32, time.Time, []byte)) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var linkTypes []uint32
+	var block []byte
+	// The first 24 bytes of the section header block are already in header
+	block = header
+	for {
+		if order.Uint32(block[0:4]) == 0x0a0d0d0a {
+			// Section header block: determine the byte order
+			if len(block) < 12 {
+				magic := make([]byte, 12-len(block))
+				_, err := io.ReadFull(reader, magic)
+				if err != nil {
+					return err
+				}
+				block = append(block, magic...)
+			}
+			if binary.BigEndian.Uint32(block[8:12]) == 0x1a2b3c4d {
+				order = binary.BigEndian
+			} else {
+				order = binary.LittleEndian
+			}
+			linkTypes = nil
+		}
+		length := order.Uint32(block[4:8])
+		if length < 12 || length < uint32(len(block)) || length > maxBlockLength {
+			return errors.New("corrupt pcapng block")
+		}
+		rest := make([]byte, int(length)-len(block))
+		_, err := io.ReadFull(reader, rest)
+		if err != nil {
+			return err
+		}
+		block = append(block, rest...)
+		switch order.Uint32(block[0:4]) {
+		case 1:
+			// Interface description block
+			linkTypes = append(linkTypes, uint32(order.Uint16(block[8:10])))
+		case 6:
+			// Enhanced packet block, assume the default microsecond resolution
+			if len(block) >= 28 {
+				interfaceId := order.Uint32(block[8:12])
+				timestamp := uint64(order.Uint32(block[12:16]))<<32 | uint64(order.Uint32(block[16:20]))
+				captured := order.Uint32(block[20:24])
+				if interfaceId < uint32(len(linkTypes)) && captured <= uint32(len(block))-28 {
+					callback(linkTypes[interfaceId],
+						time.Unix(int64(timestamp/1000000), int64(timestamp%1000000)*1000),
+						block[28:28+captured])
+				}
+			}
+		}
+		block = make([]byte, 8)
+		_, err = io.ReadFull(reader, block)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Strip the link and network layers from a frame
+func decodeFrame(linkType uint32, timestamp time.Time, data []byte) (*packet, bool) {
+	switch linkType {
+	case 0:
+		// BSD loopback: 4 byte address family
+		if len(data) < 4 {
+			return nil, false
+		}
+		data = data[4:]
+	case 1:
+		// Ethernet, skipping any VLAN tags
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for etherType == 0x8100 && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+	case 101:
+		// Raw IP
+	case 113:
+		// Linux cooked capture
+		if len(data) < 16 {
+			return nil, false
+		}
+		data = data[16:]
+	default:
+		return nil, false
+	}
+	if len(data) < 1 {
+		return nil, false
+	}
+	var protocol byte
+	var src, dst net.IP
+	switch data[0] >> 4 {
+	case 4:
+		// A header length under 20, or a total length under the
+		// header length, is corruption rather than anything to decode
+		headerLength := int(data[0]&0x0f) * 4
+		if headerLength < 20 || len(data) < headerLength {
+			return nil, false
+		}
+		totalLength := int(binary.BigEndian.Uint16(data[2:4]))
+		if totalLength >= headerLength && totalLength < len(data) {
+			data = data[:totalLength]
+		}
+		protocol = data[9]
+		src, dst = net.IP(data[12:16]), net.IP(data[16:20])
+		data = data[headerLength:]
+	case 6:
+		if len(data) < 40 {
+			return nil, false
+		}
+		protocol = data[6]
+		src, dst = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40:]
+	default:
+		return nil, false
+	}
+	p := &packet{timestamp: timestamp}
+	switch protocol {
+	case 6:
+		if len(data) < 20 {
+			return nil, false
+		}
+		headerLength := int(data[12]>>4) * 4
+		if headerLength < 20 || len(data) < headerLength {
+			return nil, false
+		}
+		p.transport = "tcp"
+		p.tcpSeq = binary.BigEndian.Uint32(data[4:8])
+		p.tcpSyn = data[13]&0x02 != 0
+		p.srcAddr = net.JoinHostPort(src.String(), fmt.Sprint(binary.BigEndian.Uint16(data[0:2])))
+		p.dstAddr = net.JoinHostPort(dst.String(), fmt.Sprint(binary.BigEndian.Uint16(data[2:4])))
+		p.payload = data[headerLength:]
+	case 17:
+		if len(data) < 8 {
+			return nil, false
+		}
+		p.transport = "udp"
+		p.srcAddr = net.JoinHostPort(src.String(), fmt.Sprint(binary.BigEndian.Uint16(data[0:2])))
+		p.dstAddr = net.JoinHostPort(dst.String(), fmt.Sprint(binary.BigEndian.Uint16(data[2:4])))
+		p.payload = data[8:]
+	default:
+		return nil, false
+	}
+	return p, true
+}
+
+func versionName(version uint16) string {
+	switch version {
+	case 0xfeff:
+		return "DTLS 1.0"
+	case 0xfefd:
+		return "DTLS 1.2"
+	case 0xfefc:
+		return "DTLS 1.3"
+	case 0x0300:
+		return "SSL 3.0"
+	}
+	return tls.VersionName(version)
+}
+
+var alertNames = map[byte]string{
+	0: "close_notify", 10: "unexpected_message", 20: "bad_record_mac",
+	40: "handshake_failure", 42: "bad_certificate", 43: "unsupported_certificate",
+	44: "certificate_revoked", 45: "certificate_expired", 46: "certificate_unknown",
+	47: "illegal_parameter", 48: "unknown_ca", 50: "decode_error", 51: "decrypt_error",
+	70: "protocol_version", 71: "insufficient_security", 80: "internal_error",
+	86: "inappropriate_fallback", 90: "user_canceled", 109: "missing_extension",
+	110: "unsupported_extension", 112: "unrecognized_name", 115: "unknown_psk_identity",
+	116: "certificate_required", 120: "no_application_protocol",
+}
+
+// Minimal big-endian reader for handshake message bodies
+type parser struct {
+	data []byte
+	err  bool
+}
+
+func (p *parser) bytes(n int) []byte {
+	if p.err || n > len(p.data) {
+		p.err = true
+		return nil
+	}
+	b := p.data[:n]
+	p.data = p.data[n:]
+	return b
+}
+
+func (p *parser) uint(n int) int {
+	value := 0
+	for _, b := range p.bytes(n) {
+		value = value<<8 | int(b)
+	}
+	return value
+}
+
+func (p *parser) vector(lengthBytes int) []byte {
+	return p.bytes(p.uint(lengthBytes))
+}
+
+func parseExtensions(p *parser) map[int][]byte {
+	extensions := make(map[int][]byte)
+	if len(p.data) == 0 {
+		return extensions
+	}
+	e := &parser{data: p.vector(2)}
+	for len(e.data) > 0 && !e.err {
+		extensionType := e.uint(2)
+		extensions[extensionType] = e.vector(2)
+	}
+	if e.err {
+		p.err = true
+	}
+	return extensions
+}
+
+func parseAlpnList(data []byte) []string {
+	var protocols []string
+	p := &parser{data: data}
+	list := &parser{data: p.vector(2)}
+	for len(list.data) > 0 && !list.err {
+		protocols = append(protocols, string(list.vector(1)))
+	}
+	return protocols
+}
+
+func (c *Connection) addError(format string, args ...interface{}) {
+	c.Errors = append(c.Errors, fmt.Sprintf(format, args...))
+}
+
+func (c *Connection) clientHello(body []byte, dtls bool) {
+	c.clientHelloSeen = true
+	p := &parser{data: body}
+	legacyVersion := uint16(p.uint(2))
+	p.bytes(32)
+	c.clientSessionId = p.vector(1)
+	if dtls {
+		p.vector(1)
+	}
+	c.OfferedCiphers = len(p.vector(2)) / 2
+	p.vector(1)
+	extensions := parseExtensions(p)
+	if p.err {
+		c.addError("truncated ClientHello")
+		return
+	}
+	c.OfferedVersions = []string{versionName(legacyVersion)}
+	if data, ok := extensions[extensionSupportedVersions]; ok {
+		v := &parser{data: data}
+		list := &parser{data: v.vector(1)}
+		c.OfferedVersions = nil
+		for len(list.data) > 0 && !list.err {
+			version := uint16(list.uint(2))
+			// Skip GREASE values
+			if version&0x0f0f != 0x0a0a {
+				c.OfferedVersions = append(c.OfferedVersions, versionName(version))
+			}
+		}
+	}
+	if data, ok := extensions[extensionServerName]; ok {
+		s := &parser{data: data}
+		list := &parser{data: s.vector(2)}
+		for len(list.data) > 0 && !list.err {
+			nameType := list.uint(1)
+			name := list.vector(2)
+			if nameType == 0 {
+				c.Sni = string(name)
+			}
+		}
+	}
+	if data, ok := extensions[extensionAlpn]; ok {
+		c.OfferedAlpn = parseAlpnList(data)
+	}
+	ticket, ticketOffered := extensions[extensionSessionTicket]
+	_, pskOffered := extensions[extensionPreSharedKey]
+	c.ResumptionOffered = (len(c.clientSessionId) > 0 && !c.tls13Offered()) ||
+		(ticketOffered && len(ticket) > 0) || pskOffered
+}
+
+func (c *Connection) tls13Offered() bool {
+	for _, version := range c.OfferedVersions {
+		if strings.HasSuffix(version, "1.3") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Connection) serverHello(body []byte) {
+	p := &parser{data: body}
+	version := uint16(p.uint(2))
+	p.bytes(32)
+	sessionId := p.vector(1)
+	cipherSuite := uint16(p.uint(2))
+	p.uint(1)
+	extensions := parseExtensions(p)
+	if p.err {
+		c.addError("truncated ServerHello")
+		return
+	}
+	c.serverHelloSeen = true
+	if data, ok := extensions[extensionSupportedVersions]; ok && len(data) == 2 {
+		version = binary.BigEndian.Uint16(data)
+	}
+	c.Version = versionName(version)
+	c.CipherSuite = tls.CipherSuiteName(cipherSuite)
+	if data, ok := extensions[extensionAlpn]; ok {
+		protocols := parseAlpnList(data)
+		if len(protocols) > 0 {
+			c.Alpn = protocols[0]
+		}
+	}
+	if version == tls.VersionTLS13 || version == 0xfefc {
+		// Certificates are encrypted in TLS 1.3: resumption is
+		// indicated by the server accepting a pre-shared key
+		_, c.Resumed = extensions[extensionPreSharedKey]
+		c.CertificatesHidden = !c.Resumed
+	} else if len(sessionId) > 0 && bytes.Equal(sessionId, c.clientSessionId) {
+		c.Resumed = true
+	}
+}
+
+func (c *Connection) certificate(body []byte) {
+	p := &parser{data: body}
+	list := &parser{data: p.vector(3)}
+	c.certificateSeen = true
+	for len(list.data) > 0 && !list.err {
+		der := list.vector(3)
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			c.addError("unable to parse certificate: %s", err)
+			continue
+		}
+		c.CertificateChain = append(c.CertificateChain, Certificate{
+			Subject:   certificate.Subject.String(),
+			Issuer:    certificate.Issuer.String(),
+			NotBefore: certificate.NotBefore,
+			NotAfter:  certificate.NotAfter,
+		})
+	}
+}
+
+func (c *Connection) handshakeMessage(direction int, messageType byte, body []byte, dtls bool) {
+	switch {
+	case messageType == handshakeClientHello && direction == fromClient:
+		c.clientHello(body, dtls)
+	case messageType == handshakeServerHello && direction == fromServer:
+		c.serverHello(body)
+	case messageType == handshakeHelloVerifyRequest && direction == fromServer:
+		c.HelloVerify = true
+	case messageType == handshakeCertificate && direction == fromServer:
+		c.certificate(body)
+	case messageType == handshakeNewSessionTicket && direction == fromServer:
+		c.NewSessionTicket = true
+	}
+}
+
+func (c *Connection) changeCipherSpec(direction int) {
+	c.changeCipher[direction] = true
+	// A TLS 1.2 server that changes cipher spec without first sending
+	// a certificate is completing an abbreviated (resumed) handshake
+	if direction == fromServer && c.serverHelloSeen && !c.certificateSeen &&
+		!strings.HasSuffix(c.Version, "1.3") {
+		c.Resumed = true
+	}
+}
+
+// Process the complete TLS records at the start of a stream,
+// returning what is left over
+func (c *Connection) tlsRecords(direction int, data []byte, handshake *[]byte) []byte {
+	for len(data) >= 5 {
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			break
+		}
+		contentType := data[0]
+		fragment := data[5 : 5+length]
+		data = data[5+length:]
+		switch contentType {
+		case recordHandshake:
+			if c.changeCipher[direction] {
+				// Encrypted from here on
+				continue
+			}
+			*handshake = append(*handshake, fragment...)
+			for len(*handshake) >= 4 {
+				messageLength := int((*handshake)[1])<<16 | int((*handshake)[2])<<8 | int((*handshake)[3])
+				if len(*handshake) < 4+messageLength {
+					break
+				}
+				c.handshakeMessage(direction, (*handshake)[0], (*handshake)[4:4+messageLength], false)
+				*handshake = (*handshake)[4+messageLength:]
+			}
+		case recordChangeCipherSpec:
+			c.changeCipherSpec(direction)
+		case recordAlert:
+			if length == 2 && !c.changeCipher[direction] {
+				c.alert(direction, fragment)
+			}
+		case recordApplicationData:
+		default:
+			c.addError("unexpected record type %d", contentType)
+			return nil
+		}
+	}
+	return data
+}
+
+func (c *Connection) alert(direction int, fragment []byte) {
+	name, ok := alertNames[fragment[1]]
+	if !ok {
+		name = fmt.Sprintf("alert %d", fragment[1])
+	}
+	level := "warning"
+	if fragment[0] == 2 {
+		level = "fatal"
+	}
+	from := "client"
+	if direction == fromServer {
+		from = "server"
+	}
+	c.Alert = fmt.Sprintf("%s %s from %s", level, name, from)
+}
+
+// Process the DTLS records in one datagram
+func (c *Connection) dtlsRecords(direction int, data []byte) {
+	for len(data) >= 13 {
+		contentType := data[0]
+		epoch := binary.BigEndian.Uint16(data[3:5])
+		length := int(binary.BigEndian.Uint16(data[11:13]))
+		if len(data) < 13+length {
+			c.addError("truncated DTLS record")
+			return
+		}
+		fragment := data[13 : 13+length]
+		data = data[13+length:]
+		if epoch > 0 {
+			// Encrypted
+			continue
+		}
+		switch contentType {
+		case recordHandshake:
+			for len(fragment) >= 12 {
+				messageType := fragment[0]
+				messageLength := int(fragment[1])<<16 | int(fragment[2])<<8 | int(fragment[3])
+				messageSeq := binary.BigEndian.Uint16(fragment[4:6])
+				offset := int(fragment[6])<<16 | int(fragment[7])<<8 | int(fragment[8])
+				fragmentLength := int(fragment[9])<<16 | int(fragment[10])<<8 | int(fragment[11])
+				if len(fragment) < 12+fragmentLength || offset+fragmentLength > messageLength {
+					c.addError("bad DTLS handshake fragment")
+					return
+				}
+				key := messageSeq | uint16(direction)<<15
+				message, ok := c.dtlsFragments[key]
+				if !ok {
+					message = make([]byte, 0, messageLength)
+				}
+				if offset == len(message) {
+					message = append(message, fragment[12:12+fragmentLength]...)
+				}
+				if len(message) == messageLength {
+					delete(c.dtlsFragments, key)
+					c.handshakeMessage(direction, messageType, message, true)
+				} else {
+					c.dtlsFragments[key] = message
+				}
+				fragment = fragment[12+fragmentLength:]
+			}
+		case recordChangeCipherSpec:
+			c.changeCipherSpec(direction)
+		case recordAlert:
+			if length == 2 {
+				c.alert(direction, fragment)
+			}
+		}
+	}
+}
+
+func looksLikeTls(payload []byte) bool {
+	return len(payload) >= 5 && payload[0] == recordHandshake && payload[1] == 3
+}
+
+func looksLikeDtls(payload []byte) bool {
+	return len(payload) >= 13 && payload[0] == recordHandshake && payload[1] == 0xfe
+}
+
+type analyzer struct {
+	connections map[string]*Connection
+	order       []*Connection
+	ports       map[string]bool
+}
+
+func (a *analyzer) process(p *packet) {
+	if len(a.ports) > 0 {
+		_, srcPort, _ := net.SplitHostPort(p.srcAddr)
+		_, dstPort, _ := net.SplitHostPort(p.dstAddr)
+		if !a.ports[srcPort] && !a.ports[dstPort] {
+			return
+		}
+	}
+	direction := fromClient
+	connection, ok := a.connections[p.transport+p.srcAddr+p.dstAddr]
+	if !ok {
+		connection, ok = a.connections[p.transport+p.dstAddr+p.srcAddr]
+		direction = fromServer
+	}
+	if !ok {
+		// A new connection can only be recognised by a ClientHello
+		if p.transport == "tcp" && !p.tcpSyn && !looksLikeTls(p.payload) {
+			return
+		}
+		if p.transport == "udp" && !looksLikeDtls(p.payload) {
+			return
+		}
+		connection = &Connection{Client: p.srcAddr, Server: p.dstAddr, Start: p.timestamp,
+			dtlsFragments: make(map[uint16][]byte)}
+		connection.Protocol = "TLS"
+		if p.transport == "udp" {
+			connection.Protocol = "DTLS"
+		}
+		direction = fromClient
+		a.connections[p.transport+p.srcAddr+p.dstAddr] = connection
+	}
+	// A connection is only reported once a ClientHello has been
+	// seen on it, which a connection begun by a SYN may never have
+	defer func() {
+		if connection.clientHelloSeen && !connection.reported {
+			connection.reported = true
+			a.order = append(a.order, connection)
+		}
+	}()
+	if p.transport == "udp" {
+		connection.dtlsRecords(direction, p.payload)
+		return
+	}
+	s := connection.streams[direction]
+	if s == nil {
+		s = &stream{}
+		connection.streams[direction] = s
+	}
+	if p.tcpSyn {
+		s.nextSeq = p.tcpSeq + 1
+		s.started = true
+		return
+	}
+	if len(p.payload) == 0 || s.finished {
+		return
+	}
+	if !s.started {
+		// Capture began mid-connection: take the first segment as in order
+		s.nextSeq = p.tcpSeq
+		s.started = true
+	}
+	if p.tcpSeq != s.nextSeq {
+		// Retransmission or out of order: only in-order data is used
+		return
+	}
+	if direction == fromClient && !connection.clientHelloSeen && len(s.buffer) == 0 && !looksLikeTls(p.payload) {
+		// Begun by a SYN but not TLS, e.g. plain HTTP: forget it
+		delete(a.connections, p.transport+connection.Client+connection.Server)
+		return
+	}
+	s.nextSeq += uint32(len(p.payload))
+	s.buffer = append(s.buffer, p.payload...)
+	s.buffer = connection.tlsRecords(direction, s.buffer, &s.pending)
+	if connection.changeCipher[fromClient] && connection.changeCipher[fromServer] {
+		// Nothing more to learn from this direction
+		s.finished = true
+		s.buffer = nil
+	}
+}
+
+func printReport(connections []*Connection) {
+	for _, c := range connections {
+		fmt.Printf("%s %s %s -> %s\n", c.Start.Format("2006-01-02 15:04:05.000"), c.Protocol, c.Client, c.Server)
+		fmt.Printf("  offered:  %s, %d cipher suite(s)", strings.Join(c.OfferedVersions, "/"), c.OfferedCiphers)
+		if len(c.OfferedAlpn) > 0 {
+			fmt.Printf(", ALPN %s", strings.Join(c.OfferedAlpn, ","))
+		}
+		fmt.Printf(", resumption %v\n", c.ResumptionOffered)
+		if c.Sni != "" {
+			fmt.Printf("  SNI:      %s\n", c.Sni)
+		}
+		if c.Version != "" {
+			fmt.Printf("  agreed:   %s, %s", c.Version, c.CipherSuite)
+			if c.Alpn != "" {
+				fmt.Printf(", ALPN %s", c.Alpn)
+			}
+			fmt.Printf(", resumed %v\n", c.Resumed)
+		} else {
+			fmt.Printf("  agreed:   no ServerHello seen\n")
+		}
+		if c.HelloVerify {
+			fmt.Printf("  HelloVerifyRequest sent by server\n")
+		}
+		for x, certificate := range c.CertificateChain {
+			fmt.Printf("  cert %d:   %s (issuer %s, valid %s to %s)\n", x, certificate.Subject, certificate.Issuer,
+				certificate.NotBefore.Format("2006-01-02"), certificate.NotAfter.Format("2006-01-02"))
+		}
+		if c.CertificatesHidden {
+			fmt.Printf("  certificates encrypted (TLS 1.3)\n")
+		}
+		if c.Alert != "" {
+			fmt.Printf("  alert:    %s\n", c.Alert)
+		}
+		for _, e := range c.Errors {
+			fmt.Printf("  error:    %s\n", e)
+		}
+	}
+}
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"pcap", "pcapng", "tls", "dtls"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "tls_analyzer", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "tls_analyzer")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+func main() {
+	defer recoverPanic()
+
+	jsonOutput := flag.Bool("json", false, "Write the report as JSON.")
+	portList := flag.String("ports", "", "Comma-separated list of server ports to analyse, default all.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] capture.pcap [capture.pcapng...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		exit(exitUsage)
+	}
+
+	a := &analyzer{connections: make(map[string]*Connection), ports: make(map[string]bool)}
+	for _, port := range strings.Split(*portList, ",") {
+		if port != "" {
+			a.ports[strings.TrimSpace(port)] = true
+		}
+	}
+	for _, fileName := range flag.Args() {
+		captureFile, err := os.Open(fileName)
+		if err != nil {
+			logFatal("Failed to open file.", "error", err)
+		}
+		err = readCapture(captureFile, func(linkType uint32, timestamp time.Time, data []byte) {
+			p, ok := decodeFrame(linkType, timestamp, data)
+			if ok {
+				a.process(p)
+			}
+		})
+		captureFile.Close()
+		if err != nil {
+			logFatal("Error while reading capture.", "file", fileName, "error", err)
+		}
+	}
+
+	sort.SliceStable(a.order, func(i, j int) bool { return a.order[i].Start.Before(a.order[j].Start) })
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+		encoder.Encode(a.order)
+	} else {
+		printReport(a.order)
+	}
+}
@@ -0,0 +1,312 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Run with: go test tls_analyzer.go tls_analyzer_test.go
+// and fuzz with, e.g.: go test -fuzz=FuzzReadCapture tls_analyzer.go tls_analyzer_test.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A raw IPv4 frame carrying a TCP segment
+func tcpFrame(src, dst string, srcPort, dstPort uint16, seq uint32, flags byte, payload []byte) []byte {
+	frame := []byte{
+		0x45, 0, 0, 0, 0, 0, 0, 0, 64, 6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x50, flags, 0, 0, 0, 0, 0, 0,
+	}
+	copy(frame[12:16], net.ParseIP(src).To4())
+	copy(frame[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(frame[20:22], srcPort)
+	binary.BigEndian.PutUint16(frame[22:24], dstPort)
+	binary.BigEndian.PutUint32(frame[24:28], seq)
+	frame = append(frame, payload...)
+	binary.BigEndian.PutUint16(frame[2:4], uint16(len(frame)))
+	return frame
+}
+
+func ipv4TcpFrame(payload []byte) []byte {
+	return tcpFrame("10.0.0.1", "10.0.0.2", 1234, 443, 1, 0x18, payload)
+}
+
+// A classic pcap file of raw IP frames
+func pcapFile(frames [][]byte) []byte {
+	file := make([]byte, 24)
+	binary.LittleEndian.PutUint32(file[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(file[4:6], 2)
+	binary.LittleEndian.PutUint16(file[6:8], 4)
+	binary.LittleEndian.PutUint32(file[16:20], 65535)
+	binary.LittleEndian.PutUint32(file[20:24], 101)
+	for x, frame := range frames {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:4], uint32(1700000000+x))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(len(frame)))
+		file = append(append(file, record...), frame...)
+	}
+	return file
+}
+
+// The same frames as a pcapng file: a section header, one interface
+// and an enhanced packet block per frame
+func pcapngFile(frames [][]byte) []byte {
+	block := func(blockType uint32, body []byte) []byte {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		b := make([]byte, 8, 12+len(body))
+		binary.LittleEndian.PutUint32(b[0:4], blockType)
+		binary.LittleEndian.PutUint32(b[4:8], uint32(12+len(body)))
+		b = append(b, body...)
+		return binary.LittleEndian.AppendUint32(b, uint32(12+len(body)))
+	}
+	file := block(0x0a0d0d0a, []byte{0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	file = append(file, block(1, []byte{101, 0, 0, 0, 0xff, 0xff, 0, 0})...)
+	for x, frame := range frames {
+		body := make([]byte, 20, 20+len(frame))
+		timestamp := uint64(1700000000+x) * 1000000
+		binary.LittleEndian.PutUint32(body[4:8], uint32(timestamp>>32))
+		binary.LittleEndian.PutUint32(body[8:12], uint32(timestamp))
+		binary.LittleEndian.PutUint32(body[12:16], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(body[16:20], uint32(len(frame)))
+		file = append(file, block(6, append(body, frame...))...)
+	}
+	return file
+}
+
+// Records what each end of a connection writes, in order
+type recorder struct {
+	mutex  sync.Mutex
+	writes []recordedWrite
+}
+
+type recordedWrite struct {
+	fromServer bool
+	data       []byte
+}
+
+type recordingConn struct {
+	net.Conn
+	fromServer bool
+	recorder   *recorder
+}
+
+func (c *recordingConn) Write(data []byte) (int, error) {
+	c.recorder.mutex.Lock()
+	c.recorder.writes = append(c.recorder.writes, recordedWrite{c.fromServer, append([]byte(nil), data...)})
+	c.recorder.mutex.Unlock()
+	return c.Conn.Write(data)
+}
+
+// Run a real TLS handshake, with the given maximum version, and
+// return it as the frames a capture of it would contain
+func handshakeFrames(t testing.TB, maxVersion uint16, clientPort uint16) [][]byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "echo.ubxlib.test"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), DNSNames: []string{"echo.ubxlib.test"}}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	clientEnd, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverEnd, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &recorder{}
+	server := tls.Server(&recordingConn{serverEnd, true, r},
+		&tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}, MaxVersion: maxVersion})
+	client := tls.Client(&recordingConn{clientEnd, false, r},
+		&tls.Config{ServerName: "echo.ubxlib.test", InsecureSkipVerify: true, NextProtos: []string{"mqtt"}})
+	done := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err == nil {
+			// Read what the client sends after the handshake so
+			// that all of the handshake has been written
+			_, err = server.Read(make([]byte, 16))
+		}
+		done <- err
+	}()
+	err = client.Handshake()
+	if err == nil {
+		_, err = client.Write([]byte("hello"))
+	}
+	if err == nil {
+		err = <-done
+	}
+	client.Close()
+	server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := [2]uint32{1000, 5000}
+	frames := [][]byte{
+		tcpFrame("10.0.0.1", "10.0.0.2", clientPort, 443, seq[0]-1, 0x02, nil),
+		tcpFrame("10.0.0.2", "10.0.0.1", 443, clientPort, seq[1]-1, 0x12, nil),
+	}
+	for _, w := range r.writes {
+		if w.fromServer {
+			frames = append(frames, tcpFrame("10.0.0.2", "10.0.0.1", 443, clientPort, seq[1], 0x18, w.data))
+			seq[1] += uint32(len(w.data))
+		} else {
+			frames = append(frames, tcpFrame("10.0.0.1", "10.0.0.2", clientPort, 443, seq[0], 0x18, w.data))
+			seq[0] += uint32(len(w.data))
+		}
+	}
+	return frames
+}
+
+// Analyze a capture as main() does
+func analyze(capture []byte) ([]*Connection, error) {
+	a := &analyzer{connections: make(map[string]*Connection), ports: make(map[string]bool)}
+	err := readCapture(bytes.NewReader(capture), func(linkType uint32, timestamp time.Time, data []byte) {
+		p, ok := decodeFrame(linkType, timestamp, data)
+		if ok {
+			a.process(p)
+		}
+	})
+	return a.order, err
+}
+
+func TestDecodeFrameCorrupt(t *testing.T) {
+	pad := make([]byte, 40)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"IHL 1, total length 5", append([]byte{0x41, 0, 0, 5}, pad...)},
+		{"IHL 0, total length 0", append([]byte{0x40, 0, 0, 0}, pad...)},
+		{"IHL 4, total length 9", append([]byte{0x44, 0, 0, 9}, pad...)},
+		{"IHL beyond the data", []byte{0x4f, 0, 0, 20, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}},
+		{"short IPv6", []byte{0x60, 0, 0, 0}},
+		{"TCP data offset 0", func() []byte {
+			frame := ipv4TcpFrame(nil)
+			frame[32] = 0x00
+			return frame
+		}()},
+		{"TCP data offset beyond the data", func() []byte {
+			frame := ipv4TcpFrame(nil)
+			frame[32] = 0xf0
+			return frame
+		}()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, ok := decodeFrame(101, time.Time{}, test.data)
+			if ok {
+				t.Errorf("decoded %+v from a corrupt frame", p)
+			}
+		})
+	}
+}
+
+func TestDecodeFrameTcp(t *testing.T) {
+	p, ok := decodeFrame(101, time.Time{}, ipv4TcpFrame([]byte{0x16, 0x03, 0x01}))
+	if !ok {
+		t.Fatal("failed to decode a valid frame")
+	}
+	if p.transport != "tcp" || p.srcAddr != "10.0.0.1:1234" || p.dstAddr != "10.0.0.2:443" ||
+		p.tcpSeq != 1 || string(p.payload) != "\x16\x03\x01" {
+		t.Errorf("decoded %+v", p)
+	}
+}
+
+func TestAnalyzeHandshake(t *testing.T) {
+	frames := append(handshakeFrames(t, tls.VersionTLS12, 50001), handshakeFrames(t, tls.VersionTLS13, 50002)...)
+	for _, capture := range [][]byte{pcapFile(frames), pcapngFile(frames)} {
+		connections, err := analyze(capture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(connections) != 2 {
+			t.Fatalf("%d connections found, expected 2", len(connections))
+		}
+		for x, version := range []string{"TLS 1.2", "TLS 1.3"} {
+			c := connections[x]
+			if c.Version != version || c.Sni != "echo.ubxlib.test" || c.Alpn != "" ||
+				len(c.OfferedAlpn) != 1 || c.OfferedAlpn[0] != "mqtt" || len(c.Errors) > 0 {
+				t.Errorf("connection %d: %+v", x, c)
+			}
+		}
+		if len(connections[0].CertificateChain) != 1 || connections[0].CertificateChain[0].Subject != "CN=echo.ubxlib.test" {
+			t.Errorf("TLS 1.2 certificate chain %+v", connections[0].CertificateChain)
+		}
+		if !connections[1].CertificatesHidden {
+			t.Error("TLS 1.3 certificates not reported as encrypted")
+		}
+	}
+}
+
+// A capture, however corrupt, must give an error or a report, never
+// a panic; the seeds are captures of real handshakes and the usual
+// ways in which a capture is damaged
+func FuzzReadCapture(f *testing.F) {
+	frames := append(handshakeFrames(f, tls.VersionTLS12, 50001), handshakeFrames(f, tls.VersionTLS13, 50002)...)
+	pcap := pcapFile(frames)
+	pcapng := pcapngFile(frames)
+	f.Add(pcap)
+	f.Add(pcapng)
+	f.Add(pcap[:len(pcap)/2])
+	f.Add(pcapng[:len(pcapng)/3])
+	f.Add(pcapFile([][]byte{append([]byte{0x41, 0, 0, 5}, make([]byte, 40)...)}))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, capture []byte) {
+		analyze(capture)
+	})
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	for _, frame := range handshakeFrames(f, tls.VersionTLS12, 50001)[:4] {
+		f.Add(uint32(101), frame)
+	}
+	f.Add(uint32(101), append([]byte{0x41, 0, 0, 5}, make([]byte, 40)...))
+	f.Add(uint32(1), append(make([]byte, 12), 0x08, 0x00, 0x45, 0, 0, 20))
+	f.Add(uint32(113), make([]byte, 16))
+	f.Add(uint32(0), []byte{2, 0, 0, 0, 0x60})
+	f.Fuzz(func(t *testing.T, linkType uint32, data []byte) {
+		p, ok := decodeFrame(linkType, time.Time{}, data)
+		if ok {
+			a := &analyzer{connections: make(map[string]*Connection), ports: make(map[string]bool)}
+			a.process(p)
+		}
+	})
+}
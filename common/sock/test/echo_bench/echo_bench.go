@@ -0,0 +1,896 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const dialTimeoutSecond = 10
+const udpReplyTimeoutMs = 1000
+
+// A time must be worse than the baseline by at least this much to be
+// a regression, since sub-millisecond times, e.g. on localhost, vary
+// by more than any sensible percentage from one run to the next
+const latencySlackMs = 0.1
+
+// Result is one measurement, e.g. the 99th percentile of round-trip time
+type Result struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+	// True for a rate, false for a time
+	HigherIsBetter bool `json:"higher-is-better"`
+}
+
+// Baseline is what is saved with -save and compared against with
+// -baseline
+type Baseline struct {
+	Recorded time.Time         `json:"recorded"`
+	Tool     VersionInfo       `json:"tool"`
+	Results  map[string]Result `json:"results"`
+}
+
+// BEGIN SHARED BLOCK payload, see port/platform/common/automation/go_shared
+// Deterministic test payloads, the same in all of the tools that
+// send test data, so that a corrupted byte can be traced to its
+// offset in the payload of a type and seed, which payload_gen can
+// then regenerate
+
+// A generator produces a deterministic byte sequence from a seed;
+// the same type, seed and size always give the same bytes
+type generator interface {
+	next() byte
+}
+
+// xorshift32, chosen because it is trivial to reproduce in C
+type xorshift struct {
+	state uint32
+}
+
+func newXorshift(seed uint32) *xorshift {
+	if seed == 0 {
+		seed = 0x2545f491
+	}
+	return &xorshift{state: seed}
+}
+
+func (x *xorshift) uint32() uint32 {
+	x.state ^= x.state << 13
+	x.state ^= x.state >> 17
+	x.state ^= x.state << 5
+	return x.state
+}
+
+// PRBS from a Fibonacci LFSR, bits packed MSB first
+type prbsGenerator struct {
+	state uint32
+	order uint
+	tap   uint
+}
+
+func newPrbs(order uint, seed uint32) *prbsGenerator {
+	taps := map[uint]uint{7: 6, 9: 5, 15: 14, 23: 18, 31: 28}
+	state := seed & (1<<order - 1)
+	if state == 0 {
+		state = 1<<order - 1
+	}
+	return &prbsGenerator{state: state, order: order, tap: taps[order]}
+}
+
+func (p *prbsGenerator) next() byte {
+	var b byte
+	for x := 0; x < 8; x++ {
+		bit := ((p.state >> (p.order - 1)) ^ (p.state >> (p.tap - 1))) & 1
+		p.state = (p.state<<1 | bit) & (1<<p.order - 1)
+		b = b<<1 | byte(bit)
+	}
+	return b
+}
+
+// Generator that feeds out records built one at a time
+type recordGenerator struct {
+	random *xorshift
+	buffer []byte
+	build  func(g *recordGenerator) []byte
+	count  int
+}
+
+func (r *recordGenerator) next() byte {
+	for len(r.buffer) == 0 {
+		r.buffer = r.build(r)
+		r.count++
+	}
+	b := r.buffer[0]
+	r.buffer = r.buffer[1:]
+	return b
+}
+
+// One line of JSON per record, fields drawn from the seed
+func buildJson(r *recordGenerator) []byte {
+	words := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"}
+	value := r.random.uint32()
+	return []byte(fmt.Sprintf("{\"seq\":%d,\"id\":\"%08x\",\"name\":\"%s\",\"value\":%d,\"flag\":%t}\n",
+		r.count, r.random.uint32(), words[value%uint32(len(words))], int32(value), value&0x100 != 0))
+}
+
+// A UBX-style frame: 0xB5 0x62, class, ID, little-endian length,
+// payload and 8-bit Fletcher checksum over class to end of payload
+func buildUbx(r *recordGenerator) []byte {
+	length := int(r.random.uint32() % 128)
+	frame := []byte{0xb5, 0x62, byte(r.random.uint32() % 0x30), byte(r.random.uint32()),
+		byte(length), byte(length >> 8)}
+	for x := 0; x < length; x++ {
+		frame = append(frame, byte(r.random.uint32()))
+	}
+	var ckA, ckB byte
+	for _, b := range frame[2:] {
+		ckA += b
+		ckB += ckA
+	}
+	return append(frame, ckA, ckB)
+}
+
+// Repeating printable pattern that shows its own offset, handy
+// when reading a corrupted capture by eye; the offset wraps at
+// 10^8 so that every record stays nine bytes long
+func buildCounter(r *recordGenerator) []byte {
+	return []byte(fmt.Sprintf("%08d|", (int64(r.count)*9)%100000000))
+}
+
+type randomGenerator struct {
+	random *xorshift
+}
+
+func (g *randomGenerator) next() byte {
+	return byte(g.random.uint32() >> 24)
+}
+
+func newGenerator(payloadType string, seed uint32) (generator, error) {
+	switch payloadType {
+	case "prbs7":
+		return newPrbs(7, seed), nil
+	case "prbs9":
+		return newPrbs(9, seed), nil
+	case "prbs15":
+		return newPrbs(15, seed), nil
+	case "prbs23":
+		return newPrbs(23, seed), nil
+	case "prbs31":
+		return newPrbs(31, seed), nil
+	case "random":
+		return &randomGenerator{random: newXorshift(seed)}, nil
+	case "json":
+		return &recordGenerator{random: newXorshift(seed), build: buildJson}, nil
+	case "ubx":
+		return &recordGenerator{random: newXorshift(seed), build: buildUbx}, nil
+	case "counter":
+		return &recordGenerator{random: newXorshift(seed), build: buildCounter}, nil
+	}
+	return nil, fmt.Errorf("unknown payload type \"%s\"", payloadType)
+}
+
+// END SHARED BLOCK payload
+
+// What is sent: the start of the payload of -type and -seed, which
+// payload_gen can regenerate, and what comes back is checked against
+// it, so that a server which corrupts data fails rather than just
+// being measured
+var payloadType = "prbs15"
+var payloadSeed uint32 = 1
+
+func payload(size int) []byte {
+	g, _ := newGenerator(payloadType, payloadSeed)
+	data := make([]byte, size)
+	for x := range data {
+		data[x] = g.next()
+	}
+	return data
+}
+
+// The offset of the first byte of data that differs from a stream in
+// which pattern repeats, data starting at offset in that stream; -1
+// if there is none
+func firstDifference(pattern []byte, offset int64, data []byte) int64 {
+	for x := 0; x < len(data); {
+		start := int((offset + int64(x)) % int64(len(pattern)))
+		length := min(len(pattern)-start, len(data)-x)
+		if !bytes.Equal(data[x:x+length], pattern[start:start+length]) {
+			for y := 0; y < length; y++ {
+				if data[x+y] != pattern[start+y] {
+					return offset + int64(x+y)
+				}
+			}
+		}
+		x += length
+	}
+	return -1
+}
+
+func corruptionError(offset int64, repeat int) error {
+	return fmt.Errorf("echo differs from the %s payload of seed %d, repeating every %d bytes, at offset %d (0x%x)",
+		payloadType, payloadSeed, repeat, offset, offset)
+}
+
+func dial(network string, address string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeoutSecond * time.Second}
+	if tlsConfig != nil {
+		return tls.DialWithDialer(dialer, network, address, tlsConfig)
+	}
+	return dialer.DialContext(runContext(), network, address)
+}
+
+// The value at percentile p of durations, which must be sorted, in
+// milliseconds
+func percentileMs(durations []time.Duration, p float64) float64 {
+	if len(durations) == 0 {
+		return 0
+	}
+	index := int(float64(len(durations)-1) * p / 100)
+	return float64(durations[index].Microseconds()) / 1000
+}
+
+// Stop when the duration is up or the tool is asked to stop
+func until(duration time.Duration) func() bool {
+	end := time.Now().Add(duration)
+	return func() bool {
+		return time.Now().After(end) || runContext().Err() != nil
+	}
+}
+
+// Round trips of a small message, one at a time on one connection,
+// giving the latency of the server itself (plus the network)
+func tcpLatency(address string, tlsConfig *tls.Config, size int, duration time.Duration, results map[string]Result) error {
+	connection, err := dial("tcp", address, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	message := payload(size)
+	reply := make([]byte, size)
+	var durations []time.Duration
+	for done := until(duration); !done(); {
+		start := time.Now()
+		_, err = connection.Write(message)
+		if err == nil {
+			_, err = io.ReadFull(connection, reply)
+		}
+		if err != nil {
+			return err
+		}
+		if offset := firstDifference(message, 0, reply); offset >= 0 {
+			return corruptionError(offset, size)
+		}
+		durations = append(durations, time.Since(start))
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	prefix := "tcp"
+	if tlsConfig != nil {
+		prefix = "tls"
+	}
+	results[prefix+"-latency-p50"] = Result{Value: percentileMs(durations, 50), Unit: "ms"}
+	results[prefix+"-latency-p99"] = Result{Value: percentileMs(durations, 99), Unit: "ms"}
+	slog.Info("Latency measured.", "protocol", prefix, "round-trips", len(durations))
+	return nil
+}
+
+// Data echoed per second over a number of connections, each sending
+// as fast as the server will take it
+func tcpThroughput(address string, tlsConfig *tls.Config, connections int, block int, duration time.Duration,
+	results map[string]Result) error {
+	var echoed int64
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	data := payload(block)
+	start := time.Now()
+	for x := 0; x < connections; x++ {
+		connection, err := dial("tcp", address, tlsConfig)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func(connection net.Conn) {
+			defer recoverPanic()
+			defer wg.Done()
+			defer connection.Close()
+			done := until(duration)
+			go func() {
+				defer recoverPanic()
+				for !done() {
+					if _, err := connection.Write(data); err != nil {
+						return
+					}
+				}
+			}()
+			buffer := make([]byte, block)
+			var count int64
+			for !done() {
+				connection.SetReadDeadline(time.Now().Add(time.Second))
+				length, err := connection.Read(buffer)
+				if offset := firstDifference(data, count, buffer[:length]); offset >= 0 {
+					err = corruptionError(offset, block)
+				}
+				count += int64(length)
+				if err != nil {
+					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+						continue
+					}
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+					break
+				}
+			}
+			mutex.Lock()
+			echoed += count
+			mutex.Unlock()
+		}(connection)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	prefix := "tcp"
+	if tlsConfig != nil {
+		prefix = "tls"
+	}
+	results[prefix+"-throughput"] = Result{Value: float64(echoed) * 8 / 1e6 / time.Since(start).Seconds(),
+		Unit: "Mbit/s", HigherIsBetter: true}
+	slog.Info("Throughput measured.", "protocol", prefix, "bytes", echoed)
+	return nil
+}
+
+// TLS handshakes completed per second, over a number of connections
+// at a time
+func tlsHandshakes(address string, tlsConfig *tls.Config, connections int, duration time.Duration,
+	results map[string]Result) error {
+	var handshakes int64
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	start := time.Now()
+	for x := 0; x < connections; x++ {
+		wg.Add(1)
+		go func() {
+			defer recoverPanic()
+			defer wg.Done()
+			for done := until(duration); !done(); {
+				connection, err := dial("tcp", address, tlsConfig)
+				if err == nil {
+					// The server only does the handshake once it has
+					// something to read, so make sure it is complete
+					err = connection.(*tls.Conn).Handshake()
+					connection.Close()
+				}
+				mutex.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+					return
+				}
+				handshakes++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	results["tls-handshakes"] = Result{Value: float64(handshakes) / time.Since(start).Seconds(), Unit: "/s",
+		HigherIsBetter: true}
+	slog.Info("Handshakes measured.", "handshakes", handshakes)
+	return nil
+}
+
+// Requests to an HTTP server, a number at a time, giving the latency of
+// each request under that load and the rate of requests; the value of
+// the environment variable UBXLIB_HTTP_TOKEN, if set, is sent as a
+// bearer token, as the tools do to each other
+func httpLatency(url string, connections int, duration time.Duration, results map[string]Result) error {
+	client := &http.Client{Timeout: dialTimeoutSecond * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: connections}}
+	token := os.Getenv("UBXLIB_HTTP_TOKEN")
+	var durations []time.Duration
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	start := time.Now()
+	for x := 0; x < connections; x++ {
+		wg.Add(1)
+		go func() {
+			defer recoverPanic()
+			defer wg.Done()
+			for done := until(duration); !done(); {
+				requestStart := time.Now()
+				request, err := http.NewRequestWithContext(runContext(), http.MethodGet, url, nil)
+				if err == nil {
+					if token != "" {
+						request.Header.Set("Authorization", "Bearer "+token)
+					}
+					var response *http.Response
+					response, err = client.Do(request)
+					if err == nil {
+						// The whole body, so that the connection is reused
+						io.Copy(io.Discard, response.Body)
+						response.Body.Close()
+						if response.StatusCode/100 != 2 {
+							err = fmt.Errorf("%s returned %s", url, response.Status)
+						}
+					}
+				}
+				mutex.Lock()
+				if err != nil {
+					if firstErr == nil && runContext().Err() == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+					return
+				}
+				durations = append(durations, time.Since(requestStart))
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	results["http-latency-p50"] = Result{Value: percentileMs(durations, 50), Unit: "ms"}
+	results["http-latency-p99"] = Result{Value: percentileMs(durations, 99), Unit: "ms"}
+	results["http-requests"] = Result{Value: float64(len(durations)) / time.Since(start).Seconds(), Unit: "/s",
+		HigherIsBetter: true}
+	slog.Info("Latency measured.", "protocol", "http", "requests", len(durations))
+	return nil
+}
+
+// Round trips of a datagram, one at a time, and the percentage lost
+func udpLatency(address string, size int, duration time.Duration, results map[string]Result) error {
+	connection, err := dial("udp", address, nil)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	message := payload(size)
+	reply := make([]byte, size+1)
+	var durations []time.Duration
+	sent := 0
+	for done := until(duration); !done(); {
+		// A sequence number so that a late reply to an earlier
+		// datagram isn't taken for this one
+		sent++
+		copy(message, fmt.Sprintf("%08d", sent))
+		start := time.Now()
+		_, err = connection.Write(message)
+		if err != nil {
+			return err
+		}
+		for {
+			connection.SetReadDeadline(start.Add(udpReplyTimeoutMs * time.Millisecond))
+			length, err := connection.Read(reply)
+			if err != nil {
+				break
+			}
+			if length == size && string(reply[:8]) == string(message[:8]) {
+				// A corrupted datagram is as good as lost
+				if offset := firstDifference(message, 0, reply[:length]); offset >= 0 {
+					slog.Warn("Corrupt echo.", "protocol", "udp", "error", corruptionError(offset, size))
+				} else {
+					durations = append(durations, time.Since(start))
+				}
+				break
+			}
+		}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	results["udp-latency-p50"] = Result{Value: percentileMs(durations, 50), Unit: "ms"}
+	results["udp-latency-p99"] = Result{Value: percentileMs(durations, 99), Unit: "ms"}
+	if sent > 0 {
+		results["udp-loss"] = Result{Value: float64(sent-len(durations)) * 100 / float64(sent), Unit: "%"}
+	}
+	slog.Info("Latency measured.", "protocol", "udp", "sent", sent, "received", len(durations))
+	return nil
+}
+
+// Compare the results with a baseline, printing a line for each and
+// returning the number of regressions: a result worse than the baseline
+// by more than tolerancePercent, or, for a result that is a percentage,
+// e.g. loss, by more than tolerancePercent percentage points (and, for
+// a time, by more than latencySlackMs)
+func compare(results map[string]Result, baseline *Baseline, tolerancePercent float64, writer io.Writer) int {
+	var names []string
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	regressions := 0
+	for _, name := range names {
+		result := results[name]
+		line := fmt.Sprintf("%-18s %12.3f %-7s", name, result.Value, result.Unit)
+		if baseline != nil {
+			if before, ok := baseline.Results[name]; ok {
+				worse := result.Value - before.Value
+				if result.HigherIsBetter {
+					worse = -worse
+				}
+				limit := before.Value * tolerancePercent / 100
+				if result.Unit == "%" {
+					limit = tolerancePercent
+				}
+				if result.Unit == "ms" && limit < latencySlackMs {
+					limit = latencySlackMs
+				}
+				verdict := "ok"
+				if worse > limit {
+					verdict = "REGRESSION"
+					regressions++
+				}
+				change := 0.0
+				if before.Value != 0 {
+					change = (result.Value - before.Value) * 100 / before.Value
+				}
+				line += fmt.Sprintf(" baseline %12.3f %+7.1f%% %s", before.Value, change, verdict)
+			} else {
+				line += " (not in baseline)"
+			}
+		}
+		fmt.Fprintln(writer, strings.TrimRight(line, " "))
+	}
+	return regressions
+}
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"tcp", "udp", "tls", "http", "baseline"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "echo_bench", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "echo_bench")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+func main() {
+	defer recoverPanic()
+
+	tcpAddress := flag.String("tcp", "", "Address of a TCP echo server to measure, e.g. localhost:5055.")
+	udpAddress := flag.String("udp", "", "Address of a UDP echo server to measure, e.g. localhost:5050.")
+	tlsAddress := flag.String("tls", "", "Address of a secure TCP echo server to measure, e.g. localhost:5060.")
+	httpUrl := flag.String("http", "", "URL to GET from an HTTP server to measure its request latency under load, e.g. http://localhost:8097/devices.")
+	caFile := flag.String("ca", "", "CA certificate to check the secure echo server against; if not given the server is not checked.")
+	durationSecond := flag.Int("duration_s", 10, "How long to run each measurement for, in seconds.")
+	connections := flag.Int("connections", 4, "Number of connections at a time for throughput, handshake rate and HTTP requests.")
+	messageSize := flag.Int("message", 64, "Size of the message used to measure latency.")
+	blockSize := flag.Int("block", 16384, "Size of the writes used to measure throughput.")
+	typeName := flag.String("type", payloadType, "Type of payload to send, as for payload_gen: "+
+		"prbs7, prbs9, prbs15, prbs23, prbs31, random, json, ubx or counter.")
+	seed := flag.Uint("seed", uint(payloadSeed), "Seed for the payload, as for payload_gen.")
+	baselineFile := flag.String("baseline", "", "Baseline to compare the results with; any regression is a failure.")
+	tolerancePercent := flag.Float64("tolerance", 20, "How much worse than the baseline, in percent, a result may be before it is a regression.")
+	saveFile := flag.String("save", "", "Save the results as a baseline to this file.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	if *tcpAddress == "" && *udpAddress == "" && *tlsAddress == "" && *httpUrl == "" {
+		fmt.Fprintln(flag.CommandLine.Output(), "At least one of -tcp, -udp, -tls or -http must be given.")
+		flag.Usage()
+		exit(exitUsage)
+	}
+	if *messageSize < 8 {
+		*messageSize = 8
+	}
+	if *blockSize < 1 {
+		*blockSize = 1
+	}
+	payloadType, payloadSeed = strings.ToLower(*typeName), uint32(*seed)
+	if _, err := newGenerator(payloadType, payloadSeed); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		exit(exitUsage)
+	}
+
+	var baseline *Baseline
+	if *baselineFile != "" {
+		contents, err := os.ReadFile(*baselineFile)
+		if err != nil {
+			logFatal("Failed to open file.", "error", err)
+		}
+		baseline = &Baseline{}
+		err = json.Unmarshal(contents, baseline)
+		if err != nil {
+			logFatal("Invalid baseline.", "file", *baselineFile, "error", err)
+		}
+	}
+
+	duration := time.Duration(*durationSecond) * time.Second
+	results := make(map[string]Result)
+	if *tcpAddress != "" {
+		err := tcpLatency(*tcpAddress, nil, *messageSize, duration, results)
+		if err == nil {
+			err = tcpThroughput(*tcpAddress, nil, *connections, *blockSize, duration, results)
+		}
+		if err != nil {
+			logFatal("TCP measurement failed.", "address", *tcpAddress, "error", err)
+		}
+	}
+	if *udpAddress != "" {
+		err := udpLatency(*udpAddress, *messageSize, duration, results)
+		if err != nil {
+			logFatal("UDP measurement failed.", "address", *udpAddress, "error", err)
+		}
+	}
+	if *tlsAddress != "" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if *caFile != "" {
+			contents, err := os.ReadFile(*caFile)
+			if err != nil {
+				logFatal("Failed to open file.", "error", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(contents) {
+				logFatal("No certificate found.", "file", *caFile)
+			}
+			tlsConfig = &tls.Config{RootCAs: pool}
+		}
+		err := tlsHandshakes(*tlsAddress, tlsConfig, *connections, duration, results)
+		if err == nil {
+			err = tcpLatency(*tlsAddress, tlsConfig, *messageSize, duration, results)
+		}
+		if err == nil {
+			err = tcpThroughput(*tlsAddress, tlsConfig, *connections, *blockSize, duration, results)
+		}
+		if err != nil {
+			logFatal("TLS measurement failed.", "address", *tlsAddress, "error", err)
+		}
+	}
+	if *httpUrl != "" {
+		err := httpLatency(*httpUrl, *connections, duration, results)
+		if err != nil {
+			logFatal("HTTP measurement failed.", "url", *httpUrl, "error", err)
+		}
+	}
+	if runContext().Err() != nil {
+		exit(exitInterrupted)
+	}
+
+	regressions := compare(results, baseline, *tolerancePercent, os.Stdout)
+
+	if *saveFile != "" {
+		contents, _ := json.MarshalIndent(Baseline{Recorded: time.Now().UTC(), Tool: versionInfo(), Results: results}, "", "    ")
+		err := os.WriteFile(*saveFile, append(contents, '\n'), 0644)
+		if err != nil {
+			logFatal("Failed to write file.", "error", err)
+		}
+		slog.Info("Baseline saved.", "file", *saveFile)
+	}
+	if regressions > 0 {
+		logFatal("Performance has regressed.", "regressions", regressions, "baseline", *baselineFile)
+	}
+	exit(exitOk)
+}
@@ -26,20 +26,55 @@
 package main
 
 import (
-	"crypto/rand"
+	"bytes"
+	"context"
+	crand "crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 const readTimeoutSecond = 300
+const watchdogTimeoutSecond = 10
+const vaultTimeoutSecond = 30
+const vaultAttempts = 3
+const certificateCheckSecond = 10
+const certificateWarnDays = 30
+const handlersCheckSecond = 10
+const traceQueueSize = 4096
+const traceBatchSize = 256
+const traceFlushSecond = 5
+
+// Default configurations and certificates built into the binary,
+// used when the file named in the configuration is not on disk
+//
+//go:embed config.json config_secure.json certs/server_cert.pem certs/server_key.pem
+var defaultAssets embed.FS
 
 // Argument struct for JSON configuration
 type Argument struct {
@@ -49,133 +84,1501 @@ type Argument struct {
 	ServerPort string `json:"server-port"`
 	ServerCert string `json:"server-certificate-location"`
 	ServerKey  string `json:"server-key-location"`
+	Handlers   string `json:"handlers-location"`
 }
 
-func secureEcho(certPath string, keyPath string, port string, verbose bool) {
+// BEGIN SHARED BLOCK asset, see port/platform/common/automation/go_shared
+// Read a file from disk or, if it does not exist there, from the
+// copy built into the binary
+func readAsset(filePath string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		builtIn, embeddedErr := defaultAssets.ReadFile(path.Clean(filepath.ToSlash(filePath)))
+		if embeddedErr == nil {
+			slog.Info("File not found, using built-in copy.", "file", filePath)
+			return builtIn, nil
+		}
+	}
+	return contents, err
+}
+
+// END SHARED BLOCK asset
+
+// BEGIN SHARED BLOCK secret, see port/platform/common/automation/go_shared
+// Fetch a secret, e.g. a private key or a password, from where the
+// reference says it is, so that secrets need not be kept in files on
+// the machines of the test farm: "env:NAME" is the value of the
+// environment variable NAME, "vault:PATH#FIELD" is FIELD of the secret
+// at API path PATH (e.g. "secret/data/ubxlib/x" for a KV version 2
+// secrets engine mounted at "secret") in HashiCorp Vault, using
+// VAULT_ADDR, VAULT_TOKEN and, if set, VAULT_NAMESPACE from the
+// environment, and "file:PATH", or anything else, is a file
+func readSecret(reference string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(reference, "env:"):
+		value, ok := os.LookupEnv(reference[4:])
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", reference[4:])
+		}
+		return []byte(value), nil
+	case strings.HasPrefix(reference, "vault:"):
+		return readVaultSecret(reference[6:])
+	}
+	return ioutil.ReadFile(strings.TrimPrefix(reference, "file:"))
+}
+
+func readVaultSecret(reference string) ([]byte, error) {
+	x := strings.LastIndex(reference, "#")
+	if x < 0 {
+		return nil, fmt.Errorf("vault secret \"%s\" has no #field", reference)
+	}
+	secretPath, field := strings.Trim(reference[:x], "/"), reference[x+1:]
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	var value []byte
+	err := retry("vault "+secretPath, vaultAttempts, vaultTimeoutSecond*time.Second, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(address, "/")+"/v1/"+secretPath, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		request.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+		if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+			request.Header.Set("X-Vault-Namespace", namespace)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("vault returned HTTP status %d for %s", response.StatusCode, secretPath)
+			if response.StatusCode < http.StatusInternalServerError {
+				// e.g. a bad token or path, which won't get better
+				err = permanent(err)
+			}
+			return err
+		}
+		// KV version 1 has the fields in "data", version 2 in "data.data"
+		var secret struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&secret)
+		if err != nil {
+			return err
+		}
+		fields := secret.Data
+		if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+			if _, isV1Field := secret.Data[field]; !isV1Field {
+				fields = inner
+			}
+		}
+		text, ok := fields[field].(string)
+		if !ok {
+			return permanent(fmt.Errorf("vault secret %s has no string field \"%s\"", secretPath, field))
+		}
+		value = []byte(text)
+		return nil
+	})
+	return value, err
+}
+
+// END SHARED BLOCK secret
+
+func isSecretReference(reference string) bool {
+	return strings.HasPrefix(reference, "env:") || strings.HasPrefix(reference, "vault:") ||
+		strings.HasPrefix(reference, "file:")
+}
 
-	// load certificates
-	serverCert, err := tls.LoadX509KeyPair(certPath, keyPath)
+// Write the built-in files to a directory so that they can be edited
+func extractAssets(directory string) {
+	for _, name := range []string{"config.json", "config_secure.json", "certs/server_cert.pem", "certs/server_key.pem"} {
+		contents, _ := defaultAssets.ReadFile(name)
+		filePath := filepath.Join(directory, filepath.FromSlash(name))
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, "_key.pem") {
+			mode = 0600
+		}
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filePath, contents, mode)
+		}
+		if err != nil {
+			logFatal("Error while writing file.", "file", filePath, "error", err)
+		}
+		slog.Info("Wrote file.", "file", filePath)
+	}
+}
+
+// Keeps a server certificate and key up to date: when they come from
+// files, the files are checked for a change, at most every
+// certificateCheckSecond, when a client connects, so that renewed
+// credentials are picked up without restarting the server
+type certificateReloader struct {
+	certLocation string
+	keyLocation  string
+	read         func(location string) ([]byte, error)
+	mutex        sync.Mutex
+	certificate  *tls.Certificate
+	modified     time.Time
+	checked      time.Time
+}
+
+// The latest modification time of the certificate and key files,
+// zero if they aren't files
+func (c *certificateReloader) modTime() time.Time {
+	var latest time.Time
+	for _, location := range []string{c.certLocation, c.keyLocation} {
+		info, err := os.Stat(location)
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (c *certificateReloader) load() error {
+	modified := c.modTime()
+	certPem, err := c.read(c.certLocation)
+	if err != nil {
+		return err
+	}
+	keyPem, err := c.read(c.keyLocation)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
 	if err != nil {
-		log.Fatalf("Error %s while loading server certificates", err)
+		return err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		slog.Error("Server certificate has expired.", "subject", leaf.Subject.String(),
+			"not-after", leaf.NotAfter.Format(time.RFC3339))
+	} else if time.Now().Add(certificateWarnDays * 24 * time.Hour).After(leaf.NotAfter) {
+		slog.Warn("Server certificate expires soon.", "subject", leaf.Subject.String(),
+			"not-after", leaf.NotAfter.Format(time.RFC3339))
+	}
+	c.certificate = &certificate
+	c.modified = modified
+	return nil
+}
+
+func (c *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if time.Since(c.checked) > certificateCheckSecond*time.Second {
+		c.checked = time.Now()
+		modified := c.modTime()
+		if !modified.IsZero() && !modified.Equal(c.modified) {
+			err := c.load()
+			if err != nil {
+				// Keep going with what we had, the files may be
+				// part way through being replaced
+				slog.Error("Unable to reload server certificate, keeping the previous one.", "error", err)
+			} else {
+				slog.Info("Server certificate reloaded.", "certificate", c.certLocation)
+			}
+		}
 	}
+	return c.certificate, nil
+}
+
+func secureEcho(certPath string, keyPath string, port string, verbose bool) {
 
-	serverCA, err := ioutil.ReadFile(certPath)
+	// load certificates, which may be secrets rather than files
+	reloader := &certificateReloader{certLocation: certPath, keyLocation: keyPath,
+		read: func(location string) ([]byte, error) {
+			if isSecretReference(location) {
+				return readSecret(location)
+			}
+			return readAsset(location)
+		}}
+	err := reloader.load()
 	if err != nil {
-		log.Fatalf("Error %s while reading server certificates", err)
+		logFatal("Error while loading server certificates.", "error", err)
 	}
 
 	serverCAPool := x509.NewCertPool()
-	serverCAPool.AppendCertsFromPEM(serverCA)
+	for _, der := range reloader.certificate.Certificate {
+		certificate, err := x509.ParseCertificate(der)
+		if err == nil {
+			serverCAPool.AddCert(certificate)
+		}
+	}
 
 	//Configure TLS
 	tlsConfig := tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		RootCAs:    serverCAPool,
+		GetCertificate: reloader.getCertificate,
+		RootCAs:        serverCAPool,
 	}
 
-	tlsConfig.Rand = rand.Reader
+	tlsConfig.Rand = crand.Reader
 	echoServerThread(port, &tlsConfig, verbose)
 }
 
+// BEGIN SHARED BLOCK systemd, see port/platform/common/automation/go_shared
+// Tell systemd about a change of state, see sd_notify(3); does
+// nothing if the server was not started by systemd
+func sdNotify(state string) {
+	socketName := os.Getenv("NOTIFY_SOCKET")
+	if socketName == "" {
+		return
+	}
+	if socketName[0] == '@' {
+		// Abstract socket
+		socketName = "\x00" + socketName[1:]
+	}
+	connection, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		slog.Error("Unable to notify systemd.", "error", err)
+		return
+	}
+	defer connection.Close()
+	_, err = connection.Write([]byte(state))
+	if err != nil {
+		slog.Error("Unable to notify systemd.", "error", err)
+	}
+}
+
+// If systemd has a watchdog set for this service, check at half the
+// watchdog interval that the server still echoes and only then tell
+// systemd that all is well, so that a hung server is restarted
+func watchdog(check func() error) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	slog.Info("Watchdog enabled.", "interval", interval.String())
+	for {
+		time.Sleep(interval)
+		err := check()
+		if err == nil {
+			sdNotify("WATCHDOG=1")
+		} else {
+			slog.Error("Watchdog self-check failed.", "error", err)
+		}
+	}
+}
+
+// What selfCheck() sends: it is echoed without trying the handlers,
+// so that a handler which drops or changes data, e.g. one matching
+// everything, can't make systemd restart a server that is working,
+// and it is random so that no client sends it by chance
+var watchdogProbe = newWatchdogProbe()
+
+func newWatchdogProbe() []byte {
+	random := make([]byte, 8)
+	crand.Read(random)
+	return []byte("ubxlib-watchdog-" + hex.EncodeToString(random))
+}
+
+// END SHARED BLOCK systemd
+
+// Check that the server is echoing by sending it something
+func selfCheck(port string, tlsConfig *tls.Config) error {
+	address := net.JoinHostPort("localhost", port)
+	dialer := &net.Dialer{Timeout: watchdogTimeoutSecond * time.Second}
+	var connection net.Conn
+	var err error
+	if tlsConfig != nil {
+		connection, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		connection, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(watchdogTimeoutSecond * time.Second))
+	probe := watchdogProbe
+	_, err = connection.Write(probe)
+	if err != nil {
+		return err
+	}
+	echo := make([]byte, len(probe))
+	_, err = io.ReadFull(connection, echo)
+	if err == nil && string(echo) != string(probe) {
+		err = fmt.Errorf("echo was \"%s\"", echo)
+	}
+	return err
+}
+
 func echoServerThread(port string, tlsConfig *tls.Config, verbose bool) {
 	// listen on all interfaces
 	var echoServer net.Listener
 	var err error
 	if tlsConfig != nil {
 		echoServer, err = tls.Listen("tcp", ":"+port, tlsConfig)
-		log.Println("Opening secure TCP server listening to port " + port)
+		slog.Info("Opening secure TCP server.", "port", port)
 	} else {
 		echoServer, err = net.Listen("tcp", ":"+port)
-		log.Println("Opening unsecure TCP server listening to port " + port)
+		slog.Info("Opening unsecure TCP server.", "port", port)
 	}
 
 	if err != nil {
-		log.Fatalf("While trying to listen for a connection an error occurred %s.", err)
+		logFatal("Error while trying to listen for a connection.", "port", port, "error", err)
 	} else {
 		defer echoServer.Close()
+		sdNotify("READY=1\nSTATUS=Listening on port " + port)
+		go watchdog(func() error { return selfCheck(port, tlsConfig) })
+		onShutdown("listener", func(ctx context.Context) {
+			sdNotify("STOPPING=1")
+			echoServer.Close()
+			closeConnections(ctx)
+		})
 	}
 
 	for {
 		connection, err := echoServer.Accept()
 
 		if err != nil {
-			log.Printf("Error %s while trying to connect.", err)
+			if runContext().Err() != nil {
+				return
+			}
+			slog.Error("Error while trying to connect.", "error", err)
 		} else {
+			slog.Info("Connection opened.", "remote", connection.RemoteAddr().String())
 			go readWrite(connection, verbose)
 		}
 	}
 }
 
+// Connections that are open, so that they can be closed on shutdown
+var connections = make(map[net.Conn]bool)
+var connectionsMutex sync.Mutex
+var connectionsOpen sync.WaitGroup
+
+// Stop all connections at their next read, so that an echo that is
+// under way is finished but nothing more is read, and wait for them
+func closeConnections(ctx context.Context) {
+	connectionsMutex.Lock()
+	for connection := range connections {
+		connection.SetReadDeadline(time.Now())
+	}
+	connectionsMutex.Unlock()
+	closed := make(chan struct{})
+	go func() {
+		connectionsOpen.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+	}
+}
+
+// BEGIN SHARED BLOCK trace, see port/platform/common/automation/go_shared
+// A minimal OpenTelemetry trace exporter, OTLP/HTTP with JSON encoding,
+// so that no third-party packages are needed: spans are sent to the
+// collector given by the standard environment variable
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (the full URL) or
+// OTEL_EXPORTER_OTLP_ENDPOINT (the base URL, to which /v1/traces is
+// added); if neither is set tracing is off and costs nothing
+type span struct {
+	traceId    string
+	spanId     string
+	parentId   string
+	name       string
+	kind       int
+	start      time.Time
+	attributes map[string]interface{}
+	events     []spanEvent
+	err        error
+	finish     time.Time
+	mutex      sync.Mutex
+}
+
+type spanEvent struct {
+	name string
+	time time.Time
+}
+
+// OpenTelemetry span kinds
+const spanKindInternal = 1
+const spanKindServer = 2
+
+var traceEndpoint = traceEndpointFromEnvironment()
+var traceSpans = make(chan *span, traceQueueSize)
+var traceFlushes = make(chan chan struct{})
+
+func traceEndpointFromEnvironment() string {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		endpoint = strings.TrimRight(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	}
+	return endpoint
+}
+
+func traceRandomId(size int) string {
+	id := make([]byte, size)
+	crand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Start a span, a child of parent if that isn't nil; returns nil,
+// which all of the span methods accept, if tracing is off
+func traceStart(name string, kind int, parent *span) *span {
+	if traceEndpoint == "" {
+		return nil
+	}
+	s := &span{spanId: traceRandomId(8), name: name, kind: kind, start: time.Now(),
+		attributes: make(map[string]interface{})}
+	if parent != nil {
+		s.traceId = parent.traceId
+		s.parentId = parent.spanId
+	} else {
+		s.traceId = traceRandomId(16)
+	}
+	return s
+}
+
+// Start a span as a child of the one given by a W3C traceparent header,
+// "00-<trace ID>-<parent span ID>-<flags>", so that the span joins the
+// trace of whoever made the request; a new trace if there is none
+func traceStartRemote(name string, kind int, traceparent string) *span {
+	s := traceStart(name, kind, nil)
+	parts := strings.Split(traceparent, "-")
+	if s != nil && len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		s.traceId = parts[1]
+		s.parentId = parts[2]
+	}
+	return s
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.mutex.Lock()
+		s.attributes[key] = value
+		s.mutex.Unlock()
+	}
+}
+
+func (s *span) event(name string) {
+	if s != nil {
+		s.mutex.Lock()
+		s.events = append(s.events, spanEvent{name, time.Now()})
+		s.mutex.Unlock()
+	}
+}
+
+// The trace ID, for log records, so that logs and traces can be matched
+func (s *span) trace() string {
+	if s == nil {
+		return ""
+	}
+	return s.traceId
+}
+
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.err = err
+	s.finish = time.Now()
+	s.mutex.Unlock()
+	select {
+	case traceSpans <- s:
+	default:
+		// Never hold up the server for the sake of tracing
+		slog.Debug("Trace queue full, span dropped.", "span", s.name)
+	}
+}
+
+func traceAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	var result []map[string]interface{}
+	for key, value := range attributes {
+		var typed map[string]interface{}
+		switch v := value.(type) {
+		case string:
+			typed = map[string]interface{}{"stringValue": v}
+		case bool:
+			typed = map[string]interface{}{"boolValue": v}
+		case int:
+			typed = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			typed = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			typed = map[string]interface{}{"doubleValue": v}
+		default:
+			typed = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]interface{}{"key": key, "value": typed})
+	}
+	return result
+}
+
+// A span in the form of OTLP/JSON
+func traceOtlp(s *span) map[string]interface{} {
+	otlp := map[string]interface{}{"traceId": s.traceId, "spanId": s.spanId, "name": s.name,
+		"kind": s.kind, "startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano": strconv.FormatInt(s.finish.UnixNano(), 10),
+		"attributes":      traceAttributes(s.attributes), "status": map[string]interface{}{"code": 1}}
+	if s.parentId != "" {
+		otlp["parentSpanId"] = s.parentId
+	}
+	if s.err != nil {
+		otlp["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+	}
+	var events []map[string]interface{}
+	for _, e := range s.events {
+		events = append(events, map[string]interface{}{"name": e.name,
+			"timeUnixNano": strconv.FormatInt(e.time.UnixNano(), 10)})
+	}
+	if events != nil {
+		otlp["events"] = events
+	}
+	return otlp
+}
+
+// Start sending spans to the collector in batches, every
+// traceFlushSecond or when a batch is full, for as long as the program
+// runs; whatever is left is sent when the program stops
+func traceExport() {
+	if traceEndpoint == "" {
+		return
+	}
+	onShutdown("trace export", func(ctx context.Context) {
+		flushed := make(chan struct{})
+		select {
+		case traceFlushes <- flushed:
+			select {
+			case <-flushed:
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	})
+	go traceSend()
+}
+
+func traceSend() {
+	slog.Info("Exporting traces.", "endpoint", traceEndpoint)
+	client := &http.Client{Timeout: traceFlushSecond * time.Second}
+	resource := map[string]interface{}{"attributes": traceAttributes(map[string]interface{}{
+		"service.name": versionInfo().Tool, "service.version": versionInfo().Version})}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		resource["attributes"] = traceAttributes(map[string]interface{}{
+			"service.name": name, "service.version": versionInfo().Version})
+	}
+	var batch []map[string]interface{}
+	ticker := time.NewTicker(traceFlushSecond * time.Second)
+	for {
+		var flushed chan struct{}
+		select {
+		case s := <-traceSpans:
+			batch = append(batch, traceOtlp(s))
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case flushed = <-traceFlushes:
+			for len(traceSpans) > 0 {
+				batch = append(batch, traceOtlp(<-traceSpans))
+			}
+			if len(batch) == 0 {
+				close(flushed)
+				continue
+			}
+		}
+		body, _ := json.Marshal(map[string]interface{}{"resourceSpans": []interface{}{
+			map[string]interface{}{"resource": resource, "scopeSpans": []interface{}{
+				map[string]interface{}{"scope": map[string]interface{}{"name": versionInfo().Tool,
+					"version": versionInfo().Version}, "spans": batch}}}}})
+		batch = nil
+		response, err := client.Post(traceEndpoint, "application/json", bytes.NewReader(body))
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode/100 != 2 {
+				err = fmt.Errorf("collector returned %s", response.Status)
+			}
+		}
+		if err != nil {
+			slog.Warn("Unable to export spans.", "endpoint", traceEndpoint, "error", err)
+		}
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// END SHARED BLOCK trace
+
+// BEGIN SHARED BLOCK event, see port/platform/common/automation/go_shared
+// Events, e.g. a connection being opened or a fault being injected,
+// are published to port/platform/common/automation/event_bus if the
+// environment variable UBXLIB_EVENT_BUS is set to its URL, so that a
+// test can wait for, or check the timing of, what a server saw; they
+// are sent straight away, batched if they come faster than they can
+// be sent
+const eventQueueSize = 4096
+const eventBatchSize = 256
+const eventTimeoutSecond = 5
+
+// Event is as published to the event bus
+type Event struct {
+	Time       time.Time              `json:"time"`
+	Source     string                 `json:"source"`
+	Type       string                 `json:"type"`
+	Session    string                 `json:"session,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+var eventBus = strings.TrimRight(os.Getenv("UBXLIB_EVENT_BUS"), "/")
+var eventSource string
+var eventQueue = make(chan Event, eventQueueSize)
+var eventFlushes = make(chan chan struct{})
+
+// Publish an event, the attributes given as name/value pairs, as for
+// slog; does nothing if there is no event bus and never blocks, the
+// event being dropped if the queue is full
+func eventPublish(eventType string, session string, args ...any) {
+	if eventBus == "" {
+		return
+	}
+	e := Event{Time: time.Now().UTC(), Source: eventSource, Type: eventType, Session: session}
+	if len(args) > 1 {
+		e.Attributes = make(map[string]interface{})
+		for x := 0; x+1 < len(args); x += 2 {
+			name, _ := args[x].(string)
+			e.Attributes[name] = args[x+1]
+		}
+	}
+	select {
+	case eventQueue <- e:
+	default:
+	}
+}
+
+func eventExport() {
+	if eventBus == "" {
+		return
+	}
+	// Where more than one instance of a tool runs, e.g. the plain
+	// and the secure echo servers, UBXLIB_EVENT_SOURCE tells them apart
+	eventSource = os.Getenv("UBXLIB_EVENT_SOURCE")
+	if eventSource == "" {
+		eventSource = versionInfo().Tool
+	}
+	onShutdown("event publishing", func(ctx context.Context) {
+		flushed := make(chan struct{})
+		select {
+		case eventFlushes <- flushed:
+			select {
+			case <-flushed:
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	})
+	go eventSend()
+}
+
+func eventSend() {
+	slog.Info("Publishing events.", "endpoint", eventBus, "source", eventSource)
+	client := &http.Client{Timeout: eventTimeoutSecond * time.Second}
+	token := os.Getenv("UBXLIB_HTTP_TOKEN")
+	for {
+		var batch []Event
+		var flushed chan struct{}
+		select {
+		case e := <-eventQueue:
+			batch = append(batch, e)
+		case flushed = <-eventFlushes:
+		}
+		for len(batch) < eventBatchSize && len(eventQueue) > 0 {
+			batch = append(batch, <-eventQueue)
+		}
+		if len(batch) > 0 {
+			body, _ := json.Marshal(batch)
+			request, err := http.NewRequest(http.MethodPost, eventBus+"/events", bytes.NewReader(body))
+			if err == nil {
+				request.Header.Set("Content-Type", "application/json")
+				if token != "" {
+					request.Header.Set("Authorization", "Bearer "+token)
+				}
+				var response *http.Response
+				response, err = client.Do(request)
+				if err == nil {
+					response.Body.Close()
+					if response.StatusCode/100 != 2 {
+						err = fmt.Errorf("event bus returned %s", response.Status)
+					}
+				}
+			}
+			if err != nil {
+				slog.Warn("Unable to publish events.", "endpoint", eventBus, "events", len(batch), "error", err)
+			}
+		}
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// END SHARED BLOCK event
+
+// BEGIN SHARED BLOCK handlers, see port/platform/common/automation/go_shared
+// A handler, for JSON configuration, that replaces the echo for data
+// that matches it, so that a test engineer can make the server
+// respond like a real one, or misbehave, without rebuilding it
+type Handler struct {
+	Name    string `json:"name"`
+	Match   string `json:"match"`    // Regular expression, tried against the data of each read
+	Reply   string `json:"reply"`    // Sent instead of the data, with $0 the whole match and $1 etc. its groups; empty to echo
+	DelayMs int    `json:"delay-ms"` // Wait this long before replying
+	Drop    bool   `json:"drop"`     // Send nothing
+	Close   bool   `json:"close"`    // Close the connection after any reply (TCP only)
+}
+
+type compiledHandler struct {
+	Handler
+	pattern *regexp.Regexp
+}
+
+// The handlers in use, read from a JSON file that is checked for a
+// change, at most every handlersCheckSecond, as data arrives, so
+// that they can be edited while the server is running
+type handlerSet struct {
+	location string
+	mutex    sync.Mutex
+	handlers []compiledHandler
+	modified time.Time
+	checked  time.Time
+}
+
+var handlers *handlerSet
+
+func (h *handlerSet) load() error {
+	info, err := os.Stat(h.location)
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(h.location)
+	if err != nil {
+		return err
+	}
+	var loaded []Handler
+	err = json.Unmarshal(contents, &loaded)
+	if err != nil {
+		return configError(contents, err)
+	}
+	compiled := make([]compiledHandler, 0, len(loaded))
+	for x, handler := range loaded {
+		pattern, err := regexp.Compile(handler.Match)
+		if err != nil {
+			return fmt.Errorf("handler %d (%q): %w", x, handler.Name, err)
+		}
+		compiled = append(compiled, compiledHandler{Handler: handler, pattern: pattern})
+	}
+	h.handlers = compiled
+	h.modified = info.ModTime()
+	return nil
+}
+
+// The first handler that matches the data, nil if there is none and
+// the data should simply be echoed
+func (h *handlerSet) find(data []byte) *compiledHandler {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if time.Since(h.checked) > handlersCheckSecond*time.Second {
+		h.checked = time.Now()
+		info, err := os.Stat(h.location)
+		if err == nil && !info.ModTime().Equal(h.modified) {
+			err = h.load()
+			if err != nil {
+				// Keep going with what we had, the file may be
+				// part way through being edited
+				slog.Error("Unable to reload handlers, keeping the previous ones.", "file", h.location, "error", err)
+			} else {
+				slog.Info("Handlers reloaded.", "file", h.location, "handlers", len(h.handlers))
+			}
+		}
+	}
+	for x := range h.handlers {
+		if h.handlers[x].pattern.Match(data) {
+			return &h.handlers[x]
+		}
+	}
+	return nil
+}
+
+// What to send in response to the data, nil for nothing
+func (c *compiledHandler) reply(data []byte) []byte {
+	if c.Drop {
+		return nil
+	}
+	if c.Reply == "" {
+		return data
+	}
+	return c.pattern.Expand(nil, []byte(c.Reply), data, c.pattern.FindSubmatchIndex(data))
+}
+
+// Wait for the delay of a handler, returning false if the server
+// is stopping
+func (c *compiledHandler) delay() bool {
+	if c.DelayMs <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(time.Duration(c.DelayMs) * time.Millisecond):
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+func handlersLoad(location string) {
+	if location == "" {
+		return
+	}
+	handlers = &handlerSet{location: location, checked: time.Now()}
+	err := handlers.load()
+	if err != nil {
+		logFatal("Unable to load handlers.", "file", location, "error", err)
+	}
+	slog.Info("Handlers loaded.", "file", location, "handlers", len(handlers.handlers))
+}
+
+// END SHARED BLOCK handlers
+
+// BEGIN SHARED BLOCK session, see port/platform/common/automation/go_shared
+// A device may tag the data it sends with its test session ID, e.g.
+// "UBXLIB_SESSION=1234", so that what is logged here can be matched
+// up with the test that sent it, as X-Session-Id does for HTTP
+var sessionTag = regexp.MustCompile(`UBXLIB_SESSION=([A-Za-z0-9_.:-]{1,64})`)
+
+// The test session ID that the data is tagged with, empty if none
+func clientSession(data []byte) string {
+	match := sessionTag.FindSubmatch(data)
+	if match == nil {
+		return ""
+	}
+	return string(match[1])
+}
+
+// END SHARED BLOCK session
+
 func readWrite(connection net.Conn, verbose bool) {
+	defer recoverPanic()
 	defer connection.Close()
+	connectionsMutex.Lock()
+	if runContext().Err() != nil {
+		connectionsMutex.Unlock()
+		return
+	}
+	connections[connection] = true
+	connectionsOpen.Add(1)
+	connectionsMutex.Unlock()
+	defer func() {
+		connectionsMutex.Lock()
+		delete(connections, connection)
+		connectionsMutex.Unlock()
+		connectionsOpen.Done()
+	}()
+	remote := connection.RemoteAddr().String()
+	connectionSpan := traceStart("connection", spanKindServer, nil)
+	connectionSpan.set("network.peer.address", remote)
+	var connectionErr error
+	var session string
+	total := 0
+	eventPublish("connection-opened", "", "remote", remote)
+	defer func() {
+		connectionSpan.set("bytes", total)
+		connectionSpan.end(connectionErr)
+		if connectionErr != nil {
+			eventPublish("connection-closed", session, "remote", remote, "bytes", total, "error", connectionErr.Error())
+		} else {
+			eventPublish("connection-closed", session, "remote", remote, "bytes", total)
+		}
+	}()
+	if connectionSpan != nil {
+		slog.Debug("Connection traced.", "remote", remote, "trace", connectionSpan.trace())
+	}
+	if tlsConnection, ok := connection.(*tls.Conn); ok {
+		// Do the handshake here, rather than as part of the first
+		// read, so that it can be timed on its own
+		handshakeSpan := traceStart("tls handshake", spanKindInternal, connectionSpan)
+		tlsConnection.SetDeadline(time.Now().Add(readTimeoutSecond * time.Second))
+		connectionErr = tlsConnection.Handshake()
+		state := tlsConnection.ConnectionState()
+		handshakeSpan.set("tls.protocol.version", tls.VersionName(state.Version))
+		handshakeSpan.set("tls.cipher", tls.CipherSuiteName(state.CipherSuite))
+		handshakeSpan.set("tls.server_name", state.ServerName)
+		handshakeSpan.end(connectionErr)
+		if connectionErr != nil {
+			slog.Error("TLS handshake failed.", "remote", remote, "error", connectionErr)
+			eventPublish("handshake-failed", "", "remote", remote, "error", connectionErr.Error())
+			return
+		}
+	}
 	buffer := make([]byte, 4096)
 	for {
 		connection.SetReadDeadline(time.Now().Add(readTimeoutSecond * time.Second))
 		readBytes, err := connection.Read(buffer)
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error %s while reading data. Expected an EOF to signal end of connection", err)
+			if err != io.EOF && runContext().Err() == nil {
+				slog.Error("Error while reading data, expected an EOF to signal end of connection.",
+					"remote", remote, "error", err)
+				connectionErr = err
 			}
+			slog.Info("Connection closed.", "remote", remote)
 			break
 		} else {
-			log.Printf("Read %d bytes.", readBytes)
+			slog.Info("Read data.", "remote", remote, "bytes", readBytes)
 			if verbose {
-				log.Printf("Message:\n %s", buffer)
+				slog.Debug("Message.", "remote", remote, "data", string(buffer[:readBytes]))
+			}
+			if session == "" {
+				session = clientSession(buffer[:readBytes])
+				if session != "" {
+					slog.Info("Client session.", "remote", remote, "client-session", session)
+					connectionSpan.set("client.session", session)
+				}
 			}
 		}
-		writeBytes, err := connection.Write(buffer[:readBytes])
+		echoSpan := traceStart("echo", spanKindInternal, connectionSpan)
+		echoSpan.set("bytes", readBytes)
+		reply := buffer[:readBytes]
+		var handler *compiledHandler
+		if !bytes.Equal(reply, watchdogProbe) {
+			handler = handlers.find(reply)
+		}
+		if handler != nil {
+			slog.Debug("Handler matched.", "remote", remote, "handler", handler.Name)
+			eventPublish("handler-matched", session, "remote", remote, "handler", handler.Name)
+			echoSpan.set("handler", handler.Name)
+			if !handler.delay() {
+				echoSpan.end(nil)
+				break
+			}
+			reply = handler.reply(reply)
+		}
+		writeBytes := 0
+		if len(reply) > 0 {
+			writeBytes, err = connection.Write(reply)
+		}
+		echoSpan.end(err)
+		total += writeBytes
 		if err != nil {
-			log.Printf("Failed to send data with error: %s ", err)
+			slog.Error("Failed to send data.", "remote", remote, "error", err)
+			connectionErr = err
 			break
 		}
 
 		if writeBytes != 0 {
-			log.Printf("Succesfully echoed back %d bytes.", writeBytes)
+			slog.Info("Successfully echoed back data.", "remote", remote, "bytes", writeBytes)
+		}
+		if handler != nil && handler.Close {
+			slog.Info("Connection closed by handler.", "remote", remote, "handler", handler.Name)
+			break
 		}
 	}
 }
 
 func startup(config Argument) {
-	log.Println("Starting TCP Echo application...")
+	slog.Info("Starting TCP Echo application...")
+	traceExport()
+	eventExport()
+	handlersLoad(config.Handlers)
 	if config.Secure {
 		secureEcho(config.ServerCert, config.ServerKey, config.ServerPort, config.Verbose)
+	} else {
+		echoServerThread(config.ServerPort, nil, config.Verbose)
+	}
+}
+
+// BEGIN SHARED BLOCK config, see port/platform/common/automation/go_shared
+// Overrides of fields of the configuration given with -set
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("must be of the form name=value")
 	}
-	echoServerThread(config.ServerPort, nil, config.Verbose)
+	*o = append(*o, value)
+	return nil
 }
 
-func logSetup() {
-	echoLogFile, e := os.OpenFile("echo_server.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if e != nil {
-		log.Fatal("Failed to open log file.")
+// Add the line and column to an error from decoding the JSON
+// configuration, since a byte offset isn't much help to anyone
+func configError(contents []byte, err error) error {
+	var offset int64 = -1
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+		err = fmt.Errorf("%q must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	if offset < 0 || offset > int64(len(contents)) {
+		return err
 	}
-	//defer echoLogFile.Close()
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(contents[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
 
-	multi := io.MultiWriter(echoLogFile, os.Stdout)
-	log.SetOutput(multi)
+// Set a field of the configuration from text, finding it by its
+// JSON name, with a "." between the names of nested fields; the
+// case of a name, and "_" rather than "-", don't matter, so that
+// the names can come from environment variables
+func configSet(config interface{}, name string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s: %q is not an object", name, part)
+		}
+		found := false
+		for x := 0; !found && x < field.NumField(); x++ {
+			tag := strings.Split(field.Type().Field(x).Tag.Get("json"), ",")[0]
+			if tag != "" && strings.EqualFold(strings.ReplaceAll(tag, "-", "_"), strings.ReplaceAll(part, "-", "_")) {
+				field = field.Field(x)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: there is no field %q in the configuration", name, part)
+		}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	// Anything else, numbers, booleans, lists or objects, as JSON,
+	// into a fresh value so that nothing of the old one is kept
+	fresh := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), fresh.Interface())
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(fresh.Elem())
+	return nil
 }
 
+// Load the JSON configuration and then apply overrides, first from
+// environment variables named UBXLIB_<TOOL>_<FIELD>, with "__" between
+// the names of nested fields, e.g. UBXLIB_DEVICE_TWIN_MQTT__BROKER,
+// then from -set name=value, so that a deployment need only record
+// how it differs from the checked-in configuration
+func configLoad(contents []byte, config interface{}, overrides []string) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		// Most likely a typo or a field from a newer version of the
+		// tool: worth knowing about but not worth stopping for
+		slog.Warn("Unknown field in the configuration, ignored.", "error", err)
+		err = json.Unmarshal(contents, config)
+	}
+	if err != nil {
+		return configError(contents, err)
+	}
+	prefix := "UBXLIB_" + strings.ToUpper(versionInfo().Tool) + "_"
+	var environment []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			environment = append(environment, strings.TrimPrefix(variable, prefix))
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		nameValue := strings.SplitN(variable, "=", 2)
+		// Only the name is logged since the value may be a secret
+		err = configSet(config, strings.ReplaceAll(nameValue[0], "__", "."), nameValue[1])
+		if err != nil {
+			// Could be meant for another tool with a longer name
+			slog.Warn("Environment variable not applied to the configuration.", "variable", prefix+nameValue[0], "error", err)
+		} else {
+			slog.Info("Configuration overridden from the environment.", "variable", prefix+nameValue[0])
+		}
+	}
+	for _, override := range overrides {
+		nameValue := strings.SplitN(override, "=", 2)
+		err = configSet(config, nameValue[0], nameValue[1])
+		if err != nil {
+			return fmt.Errorf("-set %w", err)
+		}
+		slog.Info("Configuration overridden.", "field", nameValue[0])
+	}
+	return nil
+}
+
+// END SHARED BLOCK config
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"tcp", "tls", "embedded-assets", "systemd-notify", "handlers", "events"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "echo_server", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stdout and, if fileName is not empty,
+// also to that file; timestamps are UTC with milliseconds and every
+// record carries the tool name and any session ID so that the logs
+// of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string, fileName string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	writer := io.Writer(os.Stdout)
+	if fileName != "" {
+		echoLogFile, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			logFatal("Failed to open log file.", "file", fileName, "error", err)
+		}
+		writer = io.MultiWriter(echoLogFile, writer)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(writer, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(writer, options)
+	}
+	logger := slog.New(handler).With("tool", "echo_server")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+// BEGIN SHARED BLOCK retry, see port/platform/common/automation/go_shared
+// Retries, the same in all of the test tools, in place of fixed
+// sleeps: each delay is double the one before, up to a maximum, less
+// up to a half at random so that many clients don't retry in step
+const retryInitialMs = 500
+const retryMaxMs = 30000
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Start again from the initial delay, e.g. once a connection has
+// stayed up for a while
+func (b *backoff) reset() {
+	b.next = b.initial
+}
+
+// Wait for the next delay, returning false if the tool is asked to
+// stop in the meantime
+func (b *backoff) wait() bool {
+	timer := time.NewTimer(b.delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+// An error that trying again won't fix, e.g. a refusal rather than a
+// failure to connect
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// Call operation up to attempts times, backing off between attempts,
+// each attempt being given a context that is done after timeout or
+// when the tool is asked to stop; a permanent error isn't retried
+func retry(name string, attempts int, timeout time.Duration, operation func(ctx context.Context) error) error {
+	b := newBackoff(retryInitialMs*time.Millisecond, retryMaxMs*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(runContext(), timeout)
+		err := operation(ctx)
+		cancel()
+		var isPermanent permanentError
+		if err == nil || errors.As(err, &isPermanent) || attempt >= attempts {
+			return err
+		}
+		slog.Warn("Failed, trying again.", "operation", name, "attempt", attempt, "error", err)
+		if !b.wait() {
+			return err
+		}
+	}
+}
+
+// END SHARED BLOCK retry
+
 func main() {
+	defer recoverPanic()
 
-	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration.")
+	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration; config.json and config_secure.json are built in.")
+	var overrides configOverrides
+	flag.Var(&overrides, "set", "Override a field of the configuration with name=value, name being the JSON name, with . between nested names; may be repeated.")
+	printConfig := flag.Bool("print_config", false, "Print the configuration, with any overrides applied, and exit.")
+	extractLocation := flag.String("extract", "", "Write the built-in configurations and certificates to this directory and exit.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "", "Log level: debug, info, warn or error; default debug if verbose is set in the configuration, else info.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
 	flag.Parse()
-	jsonFile, err := os.Open(*configLocation)
 
-	if err != nil {
-		log.Fatalf("Failed to open file with error: %s", err)
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
 	}
-	defer jsonFile.Close()
 
-	byteValue, _ := ioutil.ReadAll(jsonFile)
+	logSetup("info", *logJson, *sessionId, "")
+
+	if *extractLocation != "" {
+		extractAssets(*extractLocation)
+		return
+	}
+
+	byteValue, err := readAsset(*configLocation)
+	if err != nil {
+		logFatal("Failed to open file.", "error", err)
+	}
 
 	var config Argument
-	err = json.Unmarshal(byteValue, &config)
+	err = configLoad(byteValue, &config, overrides)
 	if err != nil {
-		log.Fatalf("Failed to unmarshal json with error: %s", err)
+		logFatal("Invalid configuration.", "file", *configLocation, "error", err)
+	}
+	if *printConfig {
+		contents, _ := json.MarshalIndent(config, "", "    ")
+		fmt.Println(string(contents))
+		return
 	}
 
+	if *logLevel == "" {
+		*logLevel = "info"
+		if config.Verbose {
+			*logLevel = "debug"
+		}
+	}
+	logFile := ""
 	if config.Logging {
-		logSetup()
+		logFile = "echo_server.log"
+	}
+	logSetup(*logLevel, *logJson, *sessionId, logFile)
+	logVersion()
+	if os.Geteuid() == 0 {
+		// Only ever true on Unix-like systems, os.Geteuid() is -1 on Windows
+		slog.Warn("Running as root, which the echo server does not need; see systemd/ for running it as an unprivileged user while still using a port below 1024.")
 	}
 
-	startup(config)
+	ctx := runContext()
+	go func() {
+		defer recoverPanic()
+		startup(config)
+	}()
+	<-ctx.Done()
+	exit(exitOk)
 }
@@ -26,57 +26,483 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+const watchdogTimeoutSecond = 10
+const handlersCheckSecond = 10
+
+// Default configuration built into the binary, used when the
+// configuration file is not on disk
+//
+//go:embed config_udp.json
+var defaultAssets embed.FS
+
 // Argument struct for JSON configuration
 type Argument struct {
 	Verbose    bool   `json:"verbose"`
 	Logging    bool   `json:"logging"`
 	ServerPort string `json:"server-port"`
+	Handlers   string `json:"handlers-location"`
+}
+
+// BEGIN SHARED BLOCK asset, see port/platform/common/automation/go_shared
+// Read a file from disk or, if it does not exist there, from the
+// copy built into the binary
+func readAsset(filePath string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		builtIn, embeddedErr := defaultAssets.ReadFile(path.Clean(filepath.ToSlash(filePath)))
+		if embeddedErr == nil {
+			slog.Info("File not found, using built-in copy.", "file", filePath)
+			return builtIn, nil
+		}
+	}
+	return contents, err
+}
+
+// END SHARED BLOCK asset
+
+// BEGIN SHARED BLOCK systemd, see port/platform/common/automation/go_shared
+// Tell systemd about a change of state, see sd_notify(3); does
+// nothing if the server was not started by systemd
+func sdNotify(state string) {
+	socketName := os.Getenv("NOTIFY_SOCKET")
+	if socketName == "" {
+		return
+	}
+	if socketName[0] == '@' {
+		// Abstract socket
+		socketName = "\x00" + socketName[1:]
+	}
+	connection, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		slog.Error("Unable to notify systemd.", "error", err)
+		return
+	}
+	defer connection.Close()
+	_, err = connection.Write([]byte(state))
+	if err != nil {
+		slog.Error("Unable to notify systemd.", "error", err)
+	}
+}
+
+// If systemd has a watchdog set for this service, check at half the
+// watchdog interval that the server still echoes and only then tell
+// systemd that all is well, so that a hung server is restarted
+func watchdog(check func() error) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	slog.Info("Watchdog enabled.", "interval", interval.String())
+	for {
+		time.Sleep(interval)
+		err := check()
+		if err == nil {
+			sdNotify("WATCHDOG=1")
+		} else {
+			slog.Error("Watchdog self-check failed.", "error", err)
+		}
+	}
+}
+
+// What selfCheck() sends: it is echoed without trying the handlers,
+// so that a handler which drops or changes data, e.g. one matching
+// everything, can't make systemd restart a server that is working,
+// and it is random so that no client sends it by chance
+var watchdogProbe = newWatchdogProbe()
+
+func newWatchdogProbe() []byte {
+	random := make([]byte, 8)
+	crand.Read(random)
+	return []byte("ubxlib-watchdog-" + hex.EncodeToString(random))
+}
+
+// END SHARED BLOCK systemd
+
+// Check that the server is echoing by sending it something
+func selfCheck(port string) error {
+	connection, err := net.Dial("udp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(watchdogTimeoutSecond * time.Second))
+	probe := watchdogProbe
+	_, err = connection.Write(probe)
+	if err != nil {
+		return err
+	}
+	echo := make([]byte, len(probe)+1)
+	readBytes, err := connection.Read(echo)
+	if err == nil && string(echo[:readBytes]) != string(probe) {
+		err = fmt.Errorf("echo was \"%s\"", echo[:readBytes])
+	}
+	return err
+}
+
+// BEGIN SHARED BLOCK event, see port/platform/common/automation/go_shared
+// Events, e.g. a connection being opened or a fault being injected,
+// are published to port/platform/common/automation/event_bus if the
+// environment variable UBXLIB_EVENT_BUS is set to its URL, so that a
+// test can wait for, or check the timing of, what a server saw; they
+// are sent straight away, batched if they come faster than they can
+// be sent
+const eventQueueSize = 4096
+const eventBatchSize = 256
+const eventTimeoutSecond = 5
+
+// Event is as published to the event bus
+type Event struct {
+	Time       time.Time              `json:"time"`
+	Source     string                 `json:"source"`
+	Type       string                 `json:"type"`
+	Session    string                 `json:"session,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+var eventBus = strings.TrimRight(os.Getenv("UBXLIB_EVENT_BUS"), "/")
+var eventSource string
+var eventQueue = make(chan Event, eventQueueSize)
+var eventFlushes = make(chan chan struct{})
+
+// Publish an event, the attributes given as name/value pairs, as for
+// slog; does nothing if there is no event bus and never blocks, the
+// event being dropped if the queue is full
+func eventPublish(eventType string, session string, args ...any) {
+	if eventBus == "" {
+		return
+	}
+	e := Event{Time: time.Now().UTC(), Source: eventSource, Type: eventType, Session: session}
+	if len(args) > 1 {
+		e.Attributes = make(map[string]interface{})
+		for x := 0; x+1 < len(args); x += 2 {
+			name, _ := args[x].(string)
+			e.Attributes[name] = args[x+1]
+		}
+	}
+	select {
+	case eventQueue <- e:
+	default:
+	}
+}
+
+func eventExport() {
+	if eventBus == "" {
+		return
+	}
+	// Where more than one instance of a tool runs, e.g. the plain
+	// and the secure echo servers, UBXLIB_EVENT_SOURCE tells them apart
+	eventSource = os.Getenv("UBXLIB_EVENT_SOURCE")
+	if eventSource == "" {
+		eventSource = versionInfo().Tool
+	}
+	onShutdown("event publishing", func(ctx context.Context) {
+		flushed := make(chan struct{})
+		select {
+		case eventFlushes <- flushed:
+			select {
+			case <-flushed:
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	})
+	go eventSend()
+}
+
+func eventSend() {
+	slog.Info("Publishing events.", "endpoint", eventBus, "source", eventSource)
+	client := &http.Client{Timeout: eventTimeoutSecond * time.Second}
+	token := os.Getenv("UBXLIB_HTTP_TOKEN")
+	for {
+		var batch []Event
+		var flushed chan struct{}
+		select {
+		case e := <-eventQueue:
+			batch = append(batch, e)
+		case flushed = <-eventFlushes:
+		}
+		for len(batch) < eventBatchSize && len(eventQueue) > 0 {
+			batch = append(batch, <-eventQueue)
+		}
+		if len(batch) > 0 {
+			body, _ := json.Marshal(batch)
+			request, err := http.NewRequest(http.MethodPost, eventBus+"/events", bytes.NewReader(body))
+			if err == nil {
+				request.Header.Set("Content-Type", "application/json")
+				if token != "" {
+					request.Header.Set("Authorization", "Bearer "+token)
+				}
+				var response *http.Response
+				response, err = client.Do(request)
+				if err == nil {
+					response.Body.Close()
+					if response.StatusCode/100 != 2 {
+						err = fmt.Errorf("event bus returned %s", response.Status)
+					}
+				}
+			}
+			if err != nil {
+				slog.Warn("Unable to publish events.", "endpoint", eventBus, "events", len(batch), "error", err)
+			}
+		}
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// END SHARED BLOCK event
+
+// BEGIN SHARED BLOCK handlers, see port/platform/common/automation/go_shared
+// A handler, for JSON configuration, that replaces the echo for data
+// that matches it, so that a test engineer can make the server
+// respond like a real one, or misbehave, without rebuilding it
+type Handler struct {
+	Name    string `json:"name"`
+	Match   string `json:"match"`    // Regular expression, tried against the data of each read
+	Reply   string `json:"reply"`    // Sent instead of the data, with $0 the whole match and $1 etc. its groups; empty to echo
+	DelayMs int    `json:"delay-ms"` // Wait this long before replying
+	Drop    bool   `json:"drop"`     // Send nothing
+	Close   bool   `json:"close"`    // Close the connection after any reply (TCP only)
+}
+
+type compiledHandler struct {
+	Handler
+	pattern *regexp.Regexp
+}
+
+// The handlers in use, read from a JSON file that is checked for a
+// change, at most every handlersCheckSecond, as data arrives, so
+// that they can be edited while the server is running
+type handlerSet struct {
+	location string
+	mutex    sync.Mutex
+	handlers []compiledHandler
+	modified time.Time
+	checked  time.Time
+}
+
+var handlers *handlerSet
+
+func (h *handlerSet) load() error {
+	info, err := os.Stat(h.location)
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(h.location)
+	if err != nil {
+		return err
+	}
+	var loaded []Handler
+	err = json.Unmarshal(contents, &loaded)
+	if err != nil {
+		return configError(contents, err)
+	}
+	compiled := make([]compiledHandler, 0, len(loaded))
+	for x, handler := range loaded {
+		pattern, err := regexp.Compile(handler.Match)
+		if err != nil {
+			return fmt.Errorf("handler %d (%q): %w", x, handler.Name, err)
+		}
+		compiled = append(compiled, compiledHandler{Handler: handler, pattern: pattern})
+	}
+	h.handlers = compiled
+	h.modified = info.ModTime()
+	return nil
+}
+
+// The first handler that matches the data, nil if there is none and
+// the data should simply be echoed
+func (h *handlerSet) find(data []byte) *compiledHandler {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if time.Since(h.checked) > handlersCheckSecond*time.Second {
+		h.checked = time.Now()
+		info, err := os.Stat(h.location)
+		if err == nil && !info.ModTime().Equal(h.modified) {
+			err = h.load()
+			if err != nil {
+				// Keep going with what we had, the file may be
+				// part way through being edited
+				slog.Error("Unable to reload handlers, keeping the previous ones.", "file", h.location, "error", err)
+			} else {
+				slog.Info("Handlers reloaded.", "file", h.location, "handlers", len(h.handlers))
+			}
+		}
+	}
+	for x := range h.handlers {
+		if h.handlers[x].pattern.Match(data) {
+			return &h.handlers[x]
+		}
+	}
+	return nil
+}
+
+// What to send in response to the data, nil for nothing
+func (c *compiledHandler) reply(data []byte) []byte {
+	if c.Drop {
+		return nil
+	}
+	if c.Reply == "" {
+		return data
+	}
+	return c.pattern.Expand(nil, []byte(c.Reply), data, c.pattern.FindSubmatchIndex(data))
+}
+
+// Wait for the delay of a handler, returning false if the server
+// is stopping
+func (c *compiledHandler) delay() bool {
+	if c.DelayMs <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(time.Duration(c.DelayMs) * time.Millisecond):
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+func handlersLoad(location string) {
+	if location == "" {
+		return
+	}
+	handlers = &handlerSet{location: location, checked: time.Now()}
+	err := handlers.load()
+	if err != nil {
+		logFatal("Unable to load handlers.", "file", location, "error", err)
+	}
+	slog.Info("Handlers loaded.", "file", location, "handlers", len(handlers.handlers))
+}
+
+// END SHARED BLOCK handlers
+
+// BEGIN SHARED BLOCK session, see port/platform/common/automation/go_shared
+// A device may tag the data it sends with its test session ID, e.g.
+// "UBXLIB_SESSION=1234", so that what is logged here can be matched
+// up with the test that sent it, as X-Session-Id does for HTTP
+var sessionTag = regexp.MustCompile(`UBXLIB_SESSION=([A-Za-z0-9_.:-]{1,64})`)
+
+// The test session ID that the data is tagged with, empty if none
+func clientSession(data []byte) string {
+	match := sessionTag.FindSubmatch(data)
+	if match == nil {
+		return ""
+	}
+	return string(match[1])
 }
 
+// END SHARED BLOCK session
+
 func echoServerThread(port string, verbose bool) {
 	var err error
-	log.Println("Opening UDP server listening to port " + port)
+	slog.Info("Opening UDP server.", "port", port)
 
-	serverAddr, err := net.ResolveUDPAddr("udp", ":" + port)
+	serverAddr, err := net.ResolveUDPAddr("udp", ":"+port)
 	if err != nil {
-		log.Fatalf("While trying to resolve the port an error occurred %s.", err)
+		logFatal("Error while trying to resolve the port.", "port", port, "error", err)
 	} else {
 		connection, err := net.ListenUDP("udp", serverAddr)
 		if err != nil {
-			log.Fatalf("While trying to listen for a connection an error occurred %s.", err)
+			logFatal("Error while trying to listen for a connection.", "port", port, "error", err)
 		} else {
 			defer connection.Close()
+			sdNotify("READY=1\nSTATUS=Listening on port " + port)
+			go watchdog(func() error { return selfCheck(port) })
+			onShutdown("listener", func(ctx context.Context) {
+				sdNotify("STOPPING=1")
+				connection.Close()
+			})
 			buffer := make([]byte, 4096)
 			for {
 				readBytes, addr, err := connection.ReadFromUDP(buffer)
 				if err != nil {
-					if err != io.EOF {
-						log.Printf("Error %s while reading data. Expected an EOF to signal end of connection", err)
+					if err != io.EOF && runContext().Err() == nil {
+						slog.Error("Error while reading data, expected an EOF to signal end of connection.",
+							"error", err)
 					}
 					break
-				} else {
-					log.Printf("Read %d bytes.", readBytes)
-					if verbose {
-						log.Printf("Message:\n %s\n from %s", buffer, addr)
+				}
+				slog.Info("Read data.", "remote", addr.String(), "bytes", readBytes)
+				if verbose {
+					slog.Debug("Message.", "remote", addr.String(), "data", string(buffer[:readBytes]))
+				}
+				session := clientSession(buffer[:readBytes])
+				if session != "" {
+					slog.Info("Client session.", "remote", addr.String(), "client-session", session)
+				}
+				eventPublish("datagram-received", session, "remote", addr.String(), "bytes", readBytes)
+				reply := buffer[:readBytes]
+				var handler *compiledHandler
+				if !bytes.Equal(reply, watchdogProbe) {
+					handler = handlers.find(reply)
+				}
+				if handler != nil {
+					slog.Debug("Handler matched.", "remote", addr.String(), "handler", handler.Name)
+					eventPublish("handler-matched", session, "remote", addr.String(), "handler", handler.Name)
+					reply = handler.reply(reply)
+					if len(reply) > 0 && handler.DelayMs > 0 {
+						// Reply later, without holding up datagrams
+						// from anyone else
+						delayed := append([]byte(nil), reply...)
+						go func() {
+							defer recoverPanic()
+							if handler.delay() {
+								connection.WriteTo(delayed, addr)
+							}
+						}()
+						continue
 					}
 				}
-				writeBytes, err := connection.WriteTo(buffer[:readBytes], addr)
+				if len(reply) == 0 {
+					continue
+				}
+				writeBytes, err := connection.WriteTo(reply, addr)
 				if err != nil {
-					log.Printf("Failed to send data with error: %s ", err)
+					slog.Error("Failed to send data.", "remote", addr.String(), "error", err)
 					break
 				}
 
 				if writeBytes != 0 {
-					log.Printf("Succesfully echoed back %d bytes.", writeBytes)
+					slog.Info("Successfully echoed back data.", "remote", addr.String(), "bytes", writeBytes)
 				}
 			}
 		}
@@ -84,43 +510,408 @@ func echoServerThread(port string, verbose bool) {
 }
 
 func startup(config Argument) {
-	log.Println("Starting UDP Echo application...")
+	slog.Info("Starting UDP Echo application...")
+	eventExport()
+	handlersLoad(config.Handlers)
 	echoServerThread(config.ServerPort, config.Verbose)
 }
 
-func logSetup() {
-	echoLogFile, e := os.OpenFile("echo_server.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if e != nil {
-		log.Fatal("Failed to open log file.")
+// BEGIN SHARED BLOCK config, see port/platform/common/automation/go_shared
+// Overrides of fields of the configuration given with -set
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("must be of the form name=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// Add the line and column to an error from decoding the JSON
+// configuration, since a byte offset isn't much help to anyone
+func configError(contents []byte, err error) error {
+	var offset int64 = -1
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+		err = fmt.Errorf("%q must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	if offset < 0 || offset > int64(len(contents)) {
+		return err
+	}
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(contents[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// Set a field of the configuration from text, finding it by its
+// JSON name, with a "." between the names of nested fields; the
+// case of a name, and "_" rather than "-", don't matter, so that
+// the names can come from environment variables
+func configSet(config interface{}, name string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s: %q is not an object", name, part)
+		}
+		found := false
+		for x := 0; !found && x < field.NumField(); x++ {
+			tag := strings.Split(field.Type().Field(x).Tag.Get("json"), ",")[0]
+			if tag != "" && strings.EqualFold(strings.ReplaceAll(tag, "-", "_"), strings.ReplaceAll(part, "-", "_")) {
+				field = field.Field(x)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: there is no field %q in the configuration", name, part)
+		}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	// Anything else, numbers, booleans, lists or objects, as JSON,
+	// into a fresh value so that nothing of the old one is kept
+	fresh := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), fresh.Interface())
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(fresh.Elem())
+	return nil
+}
+
+// Load the JSON configuration and then apply overrides, first from
+// environment variables named UBXLIB_<TOOL>_<FIELD>, with "__" between
+// the names of nested fields, e.g. UBXLIB_DEVICE_TWIN_MQTT__BROKER,
+// then from -set name=value, so that a deployment need only record
+// how it differs from the checked-in configuration
+func configLoad(contents []byte, config interface{}, overrides []string) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		// Most likely a typo or a field from a newer version of the
+		// tool: worth knowing about but not worth stopping for
+		slog.Warn("Unknown field in the configuration, ignored.", "error", err)
+		err = json.Unmarshal(contents, config)
+	}
+	if err != nil {
+		return configError(contents, err)
+	}
+	prefix := "UBXLIB_" + strings.ToUpper(versionInfo().Tool) + "_"
+	var environment []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			environment = append(environment, strings.TrimPrefix(variable, prefix))
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		nameValue := strings.SplitN(variable, "=", 2)
+		// Only the name is logged since the value may be a secret
+		err = configSet(config, strings.ReplaceAll(nameValue[0], "__", "."), nameValue[1])
+		if err != nil {
+			// Could be meant for another tool with a longer name
+			slog.Warn("Environment variable not applied to the configuration.", "variable", prefix+nameValue[0], "error", err)
+		} else {
+			slog.Info("Configuration overridden from the environment.", "variable", prefix+nameValue[0])
+		}
 	}
-	//defer echoLogFile.Close()
+	for _, override := range overrides {
+		nameValue := strings.SplitN(override, "=", 2)
+		err = configSet(config, nameValue[0], nameValue[1])
+		if err != nil {
+			return fmt.Errorf("-set %w", err)
+		}
+		slog.Info("Configuration overridden.", "field", nameValue[0])
+	}
+	return nil
+}
+
+// END SHARED BLOCK config
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"udp", "embedded-assets", "systemd-notify", "handlers", "events"}
 
-	multi := io.MultiWriter(echoLogFile, os.Stdout)
-	log.SetOutput(multi)
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
 }
 
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "echo_server_udp", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stdout and, if fileName is not empty,
+// also to that file; timestamps are UTC with milliseconds and every
+// record carries the tool name and any session ID so that the logs
+// of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string, fileName string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	writer := io.Writer(os.Stdout)
+	if fileName != "" {
+		echoLogFile, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			logFatal("Failed to open log file.", "file", fileName, "error", err)
+		}
+		writer = io.MultiWriter(echoLogFile, writer)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(writer, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(writer, options)
+	}
+	logger := slog.New(handler).With("tool", "echo_server_udp")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
 func main() {
+	defer recoverPanic()
 
-	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration.")
+	configLocation := flag.String("config", "./config_udp.json", "Path to a JSON configuration; config_udp.json is built in.")
+	var overrides configOverrides
+	flag.Var(&overrides, "set", "Override a field of the configuration with name=value, name being the JSON name, with . between nested names; may be repeated.")
+	printConfig := flag.Bool("print_config", false, "Print the configuration, with any overrides applied, and exit.")
+	extractLocation := flag.String("extract", "", "Write the built-in configuration to this directory and exit.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "", "Log level: debug, info, warn or error; default debug if verbose is set in the configuration, else info.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
 	flag.Parse()
-	jsonFile, err := os.Open(*configLocation)
 
-	if err != nil {
-		log.Fatalf("Failed to open file with error: %s", err)
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup("info", *logJson, *sessionId, "")
+
+	if *extractLocation != "" {
+		contents, _ := defaultAssets.ReadFile("config_udp.json")
+		err := ioutil.WriteFile(filepath.Join(*extractLocation, "config_udp.json"), contents, 0644)
+		if err != nil {
+			logFatal("Failed to write file.", "error", err)
+		}
+		return
 	}
-	defer jsonFile.Close()
 
-	byteValue, _ := ioutil.ReadAll(jsonFile)
+	byteValue, err := readAsset(*configLocation)
+	if err != nil {
+		logFatal("Failed to open file.", "error", err)
+	}
 
 	var config Argument
-	err = json.Unmarshal(byteValue, &config)
+	err = configLoad(byteValue, &config, overrides)
 	if err != nil {
-		log.Fatalf("Failed to unmarshal json with error: %s", err)
+		logFatal("Invalid configuration.", "file", *configLocation, "error", err)
+	}
+	if *printConfig {
+		contents, _ := json.MarshalIndent(config, "", "    ")
+		fmt.Println(string(contents))
+		return
 	}
 
+	if *logLevel == "" {
+		*logLevel = "info"
+		if config.Verbose {
+			*logLevel = "debug"
+		}
+	}
+	logFile := ""
 	if config.Logging {
-		logSetup()
+		logFile = "echo_server.log"
+	}
+	logSetup(*logLevel, *logJson, *sessionId, logFile)
+	logVersion()
+	if os.Geteuid() == 0 {
+		// Only ever true on Unix-like systems, os.Geteuid() is -1 on Windows
+		slog.Warn("Running as root, which the echo server does not need; see systemd/ for running it as an unprivileged user while still using a port below 1024.")
 	}
 
-	startup(config)
+	ctx := runContext()
+	go func() {
+		defer recoverPanic()
+		startup(config)
+		// Only returns of its own accord if the server has failed
+		exit(exitFailure)
+	}()
+	<-ctx.Done()
+	exit(exitOk)
 }
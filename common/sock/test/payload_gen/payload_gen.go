@@ -0,0 +1,561 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BEGIN SHARED BLOCK payload, see port/platform/common/automation/go_shared
+// Deterministic test payloads, the same in all of the tools that
+// send test data, so that a corrupted byte can be traced to its
+// offset in the payload of a type and seed, which payload_gen can
+// then regenerate
+
+// A generator produces a deterministic byte sequence from a seed;
+// the same type, seed and size always give the same bytes
+type generator interface {
+	next() byte
+}
+
+// xorshift32, chosen because it is trivial to reproduce in C
+type xorshift struct {
+	state uint32
+}
+
+func newXorshift(seed uint32) *xorshift {
+	if seed == 0 {
+		seed = 0x2545f491
+	}
+	return &xorshift{state: seed}
+}
+
+func (x *xorshift) uint32() uint32 {
+	x.state ^= x.state << 13
+	x.state ^= x.state >> 17
+	x.state ^= x.state << 5
+	return x.state
+}
+
+// PRBS from a Fibonacci LFSR, bits packed MSB first
+type prbsGenerator struct {
+	state uint32
+	order uint
+	tap   uint
+}
+
+func newPrbs(order uint, seed uint32) *prbsGenerator {
+	taps := map[uint]uint{7: 6, 9: 5, 15: 14, 23: 18, 31: 28}
+	state := seed & (1<<order - 1)
+	if state == 0 {
+		state = 1<<order - 1
+	}
+	return &prbsGenerator{state: state, order: order, tap: taps[order]}
+}
+
+func (p *prbsGenerator) next() byte {
+	var b byte
+	for x := 0; x < 8; x++ {
+		bit := ((p.state >> (p.order - 1)) ^ (p.state >> (p.tap - 1))) & 1
+		p.state = (p.state<<1 | bit) & (1<<p.order - 1)
+		b = b<<1 | byte(bit)
+	}
+	return b
+}
+
+// Generator that feeds out records built one at a time
+type recordGenerator struct {
+	random *xorshift
+	buffer []byte
+	build  func(g *recordGenerator) []byte
+	count  int
+}
+
+func (r *recordGenerator) next() byte {
+	for len(r.buffer) == 0 {
+		r.buffer = r.build(r)
+		r.count++
+	}
+	b := r.buffer[0]
+	r.buffer = r.buffer[1:]
+	return b
+}
+
+// One line of JSON per record, fields drawn from the seed
+func buildJson(r *recordGenerator) []byte {
+	words := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"}
+	value := r.random.uint32()
+	return []byte(fmt.Sprintf("{\"seq\":%d,\"id\":\"%08x\",\"name\":\"%s\",\"value\":%d,\"flag\":%t}\n",
+		r.count, r.random.uint32(), words[value%uint32(len(words))], int32(value), value&0x100 != 0))
+}
+
+// A UBX-style frame: 0xB5 0x62, class, ID, little-endian length,
+// payload and 8-bit Fletcher checksum over class to end of payload
+func buildUbx(r *recordGenerator) []byte {
+	length := int(r.random.uint32() % 128)
+	frame := []byte{0xb5, 0x62, byte(r.random.uint32() % 0x30), byte(r.random.uint32()),
+		byte(length), byte(length >> 8)}
+	for x := 0; x < length; x++ {
+		frame = append(frame, byte(r.random.uint32()))
+	}
+	var ckA, ckB byte
+	for _, b := range frame[2:] {
+		ckA += b
+		ckB += ckA
+	}
+	return append(frame, ckA, ckB)
+}
+
+// Repeating printable pattern that shows its own offset, handy
+// when reading a corrupted capture by eye; the offset wraps at
+// 10^8 so that every record stays nine bytes long
+func buildCounter(r *recordGenerator) []byte {
+	return []byte(fmt.Sprintf("%08d|", (int64(r.count)*9)%100000000))
+}
+
+type randomGenerator struct {
+	random *xorshift
+}
+
+func (g *randomGenerator) next() byte {
+	return byte(g.random.uint32() >> 24)
+}
+
+func newGenerator(payloadType string, seed uint32) (generator, error) {
+	switch payloadType {
+	case "prbs7":
+		return newPrbs(7, seed), nil
+	case "prbs9":
+		return newPrbs(9, seed), nil
+	case "prbs15":
+		return newPrbs(15, seed), nil
+	case "prbs23":
+		return newPrbs(23, seed), nil
+	case "prbs31":
+		return newPrbs(31, seed), nil
+	case "random":
+		return &randomGenerator{random: newXorshift(seed)}, nil
+	case "json":
+		return &recordGenerator{random: newXorshift(seed), build: buildJson}, nil
+	case "ubx":
+		return &recordGenerator{random: newXorshift(seed), build: buildUbx}, nil
+	case "counter":
+		return &recordGenerator{random: newXorshift(seed), build: buildCounter}, nil
+	}
+	return nil, fmt.Errorf("unknown payload type \"%s\"", payloadType)
+}
+
+// END SHARED BLOCK payload
+
+// Write size bytes of the payload as binary, hex or a C array,
+// stopping at the first write that fails, e.g. because the disk is
+// full or the other end has gone, so that a payload is never
+// silently cut short
+func generate(g generator, size int64, format string, name string, writer io.Writer) error {
+	if size < 0 {
+		return fmt.Errorf("size must be given when generating, %d is not a size", size)
+	}
+	output := bufio.NewWriter(writer)
+	var err error
+	switch format {
+	case "c":
+		if size == 0 {
+			return errors.New("a C array can't be empty, the size must be at least 1")
+		}
+		_, err = fmt.Fprintf(output, "static const unsigned char %s[%d] = {", name, size)
+	case "bin", "hex":
+	default:
+		return fmt.Errorf("unknown format \"%s\"", format)
+	}
+	for x := int64(0); x < size && err == nil; x++ {
+		b := g.next()
+		switch format {
+		case "bin":
+			err = output.WriteByte(b)
+		case "hex":
+			_, err = fmt.Fprintf(output, "%02x", b)
+			if err == nil && (x%32 == 31 || x == size-1) {
+				err = output.WriteByte('\n')
+			}
+		case "c":
+			if x%16 == 0 {
+				_, err = output.WriteString("\n   ")
+			}
+			if err == nil {
+				_, err = fmt.Fprintf(output, " 0x%02x", b)
+			}
+			if err == nil && x < size-1 {
+				err = output.WriteByte(',')
+			}
+		}
+	}
+	if err == nil && format == "c" {
+		_, err = output.WriteString("\n};\n")
+	}
+	if err != nil {
+		return err
+	}
+	return output.Flush()
+}
+
+// A connection on which each read or write must make progress
+// within the timeout
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c idleTimeoutConn) Read(data []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(data)
+}
+
+func (c idleTimeoutConn) Write(data []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(data)
+}
+
+// Compare what was received against the payload, reporting the
+// offset of the first difference; returns the number of bytes
+// that matched
+func verify(g generator, size int64, reader io.Reader) (int64, error) {
+	input := bufio.NewReader(reader)
+	offset := int64(0)
+	for size < 0 || offset < size {
+		b, err := input.ReadByte()
+		if err == io.EOF {
+			if size >= 0 {
+				return offset, fmt.Errorf("data ends at offset %d, expected %d bytes", offset, size)
+			}
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		expected := g.next()
+		if b != expected {
+			return offset, fmt.Errorf("mismatch at offset %d (0x%x): expected 0x%02x, received 0x%02x",
+				offset, offset, expected, b)
+		}
+		offset++
+	}
+	_, err := input.ReadByte()
+	if err == nil {
+		return offset, fmt.Errorf("more than the expected %d bytes received", size)
+	}
+	return offset, nil
+}
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"prbs", "random", "json", "ubx", "counter", "echo"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "payload_gen", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "payload_gen")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+func main() {
+	defer recoverPanic()
+
+	payloadType := flag.String("type", "prbs15", "Payload type: "+
+		"prbs7, prbs9, prbs15, prbs23, prbs31, random, json, ubx or counter.")
+	seed := flag.Uint("seed", 1, "Seed for the payload; the same seed always gives the same payload.")
+	size := flag.Int64("size", 1024, "Number of bytes to generate or verify (-1 when verifying means all of the input).")
+	format := flag.String("format", "bin", "Output format: bin, hex or c.")
+	name := flag.String("name", "gPayload", "Variable name when the output format is c.")
+	output := flag.String("out", "", "File to write to, default stdout.")
+	verifyFile := flag.String("verify", "", "Instead of generating, check this file (\"-\" for stdin) against the payload.")
+	echoAddress := flag.String("echo", "", "Instead of generating, send the payload to this TCP echo server and verify what comes back.")
+	timeoutSecond := flag.Int("timeout_s", 10, "With -echo, how long the echo server may take to accept or return data before it has failed, in seconds.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	g, err := newGenerator(strings.ToLower(*payloadType), uint32(*seed))
+	if err != nil {
+		logFatal("Bad payload type.", "error", err)
+	}
+
+	if *verifyFile != "" {
+		reader := os.Stdin
+		if *verifyFile != "-" {
+			reader, err = os.Open(*verifyFile)
+			if err != nil {
+				logFatal("Failed to open file.", "error", err)
+			}
+			defer reader.Close()
+		}
+		matched, err := verify(g, *size, reader)
+		if err != nil {
+			logFatal("Verify failed.", "type", *payloadType, "seed", *seed, "error", err)
+		}
+		slog.Info("Verified.", "type", *payloadType, "seed", *seed, "bytes", matched)
+		return
+	}
+
+	if *size < 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-size -1 only applies to -verify; generating or echoing needs a size.")
+		flag.Usage()
+		exit(exitUsage)
+	}
+
+	if *echoAddress != "" {
+		timeout := time.Duration(*timeoutSecond) * time.Second
+		dialed, err := net.DialTimeout("tcp", *echoAddress, timeout)
+		if err != nil {
+			logFatal("Failed to connect.", "address", *echoAddress, "error", err)
+		}
+		defer dialed.Close()
+		connection := idleTimeoutConn{dialed, timeout}
+		go func() {
+			err := generate(g, *size, "bin", "", connection)
+			if err != nil {
+				// Stop the verification too, rather than leave it
+				// waiting for data that will never come
+				slog.Error("Failed to send data.", "error", err)
+				dialed.Close()
+			}
+		}()
+		check, _ := newGenerator(strings.ToLower(*payloadType), uint32(*seed))
+		matched, err := verify(check, *size, io.LimitReader(connection, *size))
+		if err != nil {
+			logFatal("Echo failed.", "type", *payloadType, "seed", *seed, "error", err)
+		}
+		slog.Info("Echoed.", "type", *payloadType, "seed", *seed, "bytes", matched)
+		return
+	}
+
+	writer := os.Stdout
+	if *output != "" {
+		writer, err = os.Create(*output)
+		if err != nil {
+			logFatal("Failed to create file.", "error", err)
+		}
+	}
+	err = generate(g, *size, *format, *name, writer)
+	if err == nil && *output != "" {
+		err = writer.Close()
+	}
+	if err != nil {
+		logFatal("Failed to generate payload.", "error", err)
+	}
+}
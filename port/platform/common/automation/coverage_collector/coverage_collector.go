@@ -0,0 +1,646 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The markers of the lines that carry coverage data from the
+// target, which may appear anywhere in a line so that they
+// survive being prefixed by timestamps or logging
+const (
+	markerFile = "U_GCOV_FILE "
+	markerData = "U_GCOV_DATA "
+	markerEnd  = "U_GCOV_END "
+)
+
+// The most coverage data held for one file and for one run: a .gcda
+// file is typically a few kilobytes, these only stop whatever is
+// connected from using up all of the memory of this machine
+const maxFileBytes = 16 * 1024 * 1024
+const maxRunBytes = 256 * 1024 * 1024
+
+// Returned by read() when a run has been dropped for being too large
+var errRunTooLarge = errors.New("too much coverage data")
+
+// A run is all of the coverage data from one execution of the
+// target: if a file is dumped more than once in a run the last
+// dump wins, since the counters on the target only ever go up;
+// files is guarded by mutex since a run read from a serial port
+// is committed while the read may still be going on
+type run struct {
+	source   string
+	mutex    sync.Mutex
+	files    map[string][]byte
+	fileName string
+	data     []byte
+	size     int // Of files, guarded by mutex
+	errors   int
+}
+
+func newRun(source string) *run {
+	return &run{source: source, files: make(map[string][]byte)}
+}
+
+// Process a line from the target, ignoring anything that isn't
+// coverage data; an error means that the run must be dropped
+func (r *run) line(text string) error {
+	if x := strings.Index(text, markerFile); x >= 0 {
+		r.fileName = strings.TrimSpace(text[x+len(markerFile):])
+		r.data = nil
+		return nil
+	}
+	if r.fileName == "" {
+		return nil
+	}
+	if x := strings.Index(text, markerData); x >= 0 {
+		bytes, err := hex.DecodeString(strings.TrimSpace(text[x+len(markerData):]))
+		if err != nil {
+			slog.Error("Bad coverage data, file discarded.", "source", r.source, "file", r.fileName, "error", err)
+			r.mutex.Lock()
+			r.errors++
+			r.mutex.Unlock()
+			r.fileName = ""
+			return nil
+		}
+		if len(r.data)+len(bytes) > maxFileBytes {
+			return fmt.Errorf("%w, more than %d bytes for %s", errRunTooLarge, maxFileBytes, r.fileName)
+		}
+		r.data = append(r.data, bytes...)
+		return nil
+	}
+	if x := strings.Index(text, markerEnd); x >= 0 {
+		fields := strings.Fields(text[x+len(markerEnd):])
+		var length int
+		var crc uint64
+		var err error
+		if len(fields) != 2 {
+			err = fmt.Errorf("expected length and CRC, got \"%s\"", strings.Join(fields, " "))
+		} else {
+			length, err = strconv.Atoi(fields[0])
+			if err == nil {
+				crc, err = strconv.ParseUint(fields[1], 16, 32)
+			}
+		}
+		if err == nil && length != len(r.data) {
+			err = fmt.Errorf("expected %d bytes, received %d", length, len(r.data))
+		}
+		if err == nil && uint32(crc) != crc32.ChecksumIEEE(r.data) {
+			err = fmt.Errorf("CRC mismatch")
+		}
+		if err != nil {
+			slog.Error("Bad coverage data, file discarded.", "source", r.source, "file", r.fileName, "error", err)
+			r.mutex.Lock()
+			r.errors++
+			r.mutex.Unlock()
+		} else {
+			slog.Debug("Coverage data received.", "source", r.source, "file", r.fileName, "bytes", len(r.data))
+			r.mutex.Lock()
+			r.size += len(r.data) - len(r.files[r.fileName])
+			r.files[r.fileName] = r.data
+			size := r.size
+			r.mutex.Unlock()
+			if size > maxRunBytes {
+				return fmt.Errorf("%w, more than %d bytes in all", errRunTooLarge, maxRunBytes)
+			}
+		}
+		r.fileName = ""
+		r.data = nil
+	}
+	return nil
+}
+
+// The files completed so far, and the number of errors
+func (r *run) completed() (map[string][]byte, int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	files := make(map[string][]byte, len(r.files))
+	for fileName, data := range r.files {
+		files[fileName] = data
+	}
+	return files, r.errors
+}
+
+func (r *run) read(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 65536), 1024*1024)
+	for scanner.Scan() {
+		err := r.line(scanner.Text())
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Where a .gcda file from the target goes on this machine: the
+// target knows it by the path of the object file on the build
+// machine, which may need mapping, and a relative path is put
+// under the output directory; since the name comes from whatever
+// is connected, only .gcda files are written and only under the
+// output directory or the new path of a mapping
+type pathMap struct {
+	from []string
+	to   []string
+}
+
+func (m *pathMap) String() string {
+	return fmt.Sprint(m.from)
+}
+
+func (m *pathMap) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected old=new, got \"%s\"", value)
+	}
+	m.from = append(m.from, parts[0])
+	m.to = append(m.to, parts[1])
+	return nil
+}
+
+func (m *pathMap) destination(fileName string, outputDirectory string) (string, error) {
+	if filepath.Ext(fileName) != ".gcda" {
+		return "", fmt.Errorf("not a .gcda file")
+	}
+	for x, from := range m.from {
+		if strings.HasPrefix(fileName, from) {
+			fileName = m.to[x] + fileName[len(from):]
+			break
+		}
+	}
+	if !filepath.IsAbs(fileName) {
+		fileName = filepath.Join(outputDirectory, fileName)
+	}
+	fileName = filepath.Clean(fileName)
+	for _, directory := range append([]string{outputDirectory}, m.to...) {
+		if within(fileName, directory) {
+			return fileName, nil
+		}
+	}
+	return "", fmt.Errorf("outside of the output directory and of the mapped paths")
+}
+
+// True if fileName is in directory or below it
+func within(fileName string, directory string) bool {
+	if directory == "" {
+		return false
+	}
+	fileNameAbs, err := filepath.Abs(fileName)
+	if err != nil {
+		return false
+	}
+	directoryAbs, err := filepath.Abs(directory)
+	if err != nil {
+		return false
+	}
+	relative, err := filepath.Rel(directoryAbs, fileNameAbs)
+	return err == nil && relative != "." && relative != ".." &&
+		!strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+type collector struct {
+	mutex           sync.Mutex
+	paths           pathMap
+	outputDirectory string
+	gcovTool        string
+	runs            int
+}
+
+// Merge one .gcda file into another, using gcov-tool since the
+// ways in which the different types of counter are combined are
+// best left to the compiler that made them
+func (c *collector) merge(existing string, data []byte) error {
+	directory, err := ioutil.TempDir("", "coverage_collector")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(directory)
+	name := filepath.Base(existing)
+	for _, subdirectory := range []string{"a", "b", "out"} {
+		os.Mkdir(filepath.Join(directory, subdirectory), 0755)
+	}
+	old, err := ioutil.ReadFile(existing)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(directory, "a", name), old, 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(directory, "b", name), data, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command(c.gcovTool, "merge", "-o", filepath.Join(directory, "out"),
+		filepath.Join(directory, "a"), filepath.Join(directory, "b")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s merge failed: %v %s", c.gcovTool, err, strings.TrimSpace(string(output)))
+	}
+	merged, err := ioutil.ReadFile(filepath.Join(directory, "out", name))
+	if err != nil {
+		return err
+	}
+	return writeAtomically(existing, merged)
+}
+
+func writeAtomically(fileName string, contents []byte) error {
+	temporary := fileName + ".tmp"
+	err := ioutil.WriteFile(temporary, contents, 0644)
+	if err == nil {
+		err = os.Rename(temporary, fileName)
+	}
+	return err
+}
+
+// Add the files of a completed run to those already collected,
+// merging with any from earlier runs
+func (c *collector) commit(r *run) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	files, errors := r.completed()
+	if len(files) == 0 {
+		slog.Warn("No coverage data in run.", "source", r.source, "errors", errors)
+		return
+	}
+	merged := 0
+	for fileName, data := range files {
+		destination, err := c.paths.destination(fileName, c.outputDirectory)
+		if err != nil {
+			slog.Error("Coverage data refused.", "source", r.source, "file", fileName, "error", err)
+			errors++
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(destination), 0755)
+		if err == nil {
+			if _, statErr := os.Stat(destination); statErr == nil {
+				err = c.merge(destination, data)
+				merged++
+			} else {
+				err = writeAtomically(destination, data)
+			}
+		}
+		if err != nil {
+			slog.Error("Unable to write coverage data.", "source", r.source, "file", destination, "error", err)
+		}
+	}
+	c.runs++
+	slog.Info("Run collected.", "source", r.source, "files", len(files), "merged", merged,
+		"errors", errors, "runs", c.runs)
+}
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"serial", "tcp", "gcov-tool-merge"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "coverage_collector", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "coverage_collector")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+func main() {
+	defer recoverPanic()
+
+	var paths pathMap
+	input := flag.String("in", "", "File or serial device to read coverage data from (\"-\" for stdin).")
+	port := flag.String("listen", "", "Port, or address:port, on which to accept TCP connections from targets, each connection being a run; a port alone is on 127.0.0.1 only.")
+	outputDirectory := flag.String("out", "coverage", "Directory for .gcda files whose path from the target is relative.")
+	gcovTool := flag.String("gcov_tool", "gcov-tool", "The gcov-tool matching the compiler of the target build, used to merge runs.")
+	flag.Var(&paths, "path_map", "Map the start of the paths of .gcda files from the target, old=new; may be repeated.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	if (*input == "") == (*port == "") {
+		logFatal("Give one of -in or -listen.")
+	}
+	c := &collector{paths: paths, outputDirectory: *outputDirectory, gcovTool: *gcovTool}
+
+	if *input != "" {
+		reader := os.Stdin
+		if *input != "-" {
+			file, err := os.Open(*input)
+			if err != nil {
+				logFatal("Failed to open file.", "error", err)
+			}
+			defer file.Close()
+			reader = file
+		}
+		// A serial port never ends, so also finish the run
+		// when told to stop
+		r := newRun(*input)
+		done := make(chan error, 1)
+		go func() {
+			done <- r.read(reader)
+		}()
+		select {
+		case err := <-done:
+			if errors.Is(err, errRunTooLarge) {
+				logFatal("Run dropped.", "source", r.source, "error", err)
+			}
+			if err != nil {
+				slog.Error("Read failed.", "error", err)
+			}
+		case <-runContext().Done():
+		}
+		c.commit(r)
+		return
+	}
+
+	address := *port
+	if !strings.Contains(address, ":") {
+		address = net.JoinHostPort("127.0.0.1", address)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		logFatal("Unable to listen.", "error", err)
+	}
+	slog.Info("Listening.", "address", address)
+	// When stopping, whatever has been received from targets still
+	// connected is written, as it would be on the end of a connection
+	var connectionsMutex sync.Mutex
+	connections := make(map[net.Conn]bool)
+	var connectionsOpen sync.WaitGroup
+	onShutdown("listener", func(ctx context.Context) {
+		listener.Close()
+		connectionsMutex.Lock()
+		for connection := range connections {
+			connection.Close()
+		}
+		connectionsMutex.Unlock()
+		closed := make(chan struct{})
+		go func() {
+			connectionsOpen.Wait()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-ctx.Done():
+		}
+	})
+	go func() {
+		<-runContext().Done()
+		exit(exitOk)
+	}()
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			if runContext().Err() != nil {
+				// Stopping, exit() is under way
+				select {}
+			}
+			logFatal("Accept failed.", "error", err)
+		}
+		connectionsMutex.Lock()
+		if runContext().Err() != nil {
+			connectionsMutex.Unlock()
+			connection.Close()
+			continue
+		}
+		connections[connection] = true
+		connectionsOpen.Add(1)
+		connectionsMutex.Unlock()
+		go func(connection net.Conn) {
+			defer recoverPanic()
+			defer connectionsOpen.Done()
+			defer connection.Close()
+			r := newRun(connection.RemoteAddr().String())
+			err := r.read(connection)
+			if errors.Is(err, errRunTooLarge) {
+				// Nothing from this connection is written, it
+				// isn't behaving like a target
+				slog.Error("Run dropped, closing the connection.", "source", r.source, "error", err)
+			} else {
+				if err != nil && runContext().Err() == nil {
+					slog.Error("Read failed.", "source", r.source, "error", err)
+				}
+				c.commit(r)
+			}
+			connectionsMutex.Lock()
+			delete(connections, connection)
+			connectionsMutex.Unlock()
+		}(connection)
+	}
+}
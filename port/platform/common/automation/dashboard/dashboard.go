@@ -0,0 +1,842 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const httpTimeoutSecond = 2
+const logTailBytes = 65536
+const logTailLines = 40
+const recentErrors = 8
+
+// Port and Endpoint are as written to the manifest by ../supervisor
+type Port struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+type Endpoint struct {
+	Status   string          `json:"status"`
+	Pid      int             `json:"pid"`
+	Restarts int             `json:"restarts"`
+	Started  time.Time       `json:"started"`
+	Version  string          `json:"version,omitempty"`
+	Log      string          `json:"log,omitempty"`
+	Ports    map[string]Port `json:"ports"`
+}
+
+type Manifest struct {
+	Host       string               `json:"host"`
+	Supervisor string               `json:"supervisor"`
+	Updated    time.Time            `json:"updated"`
+	Services   map[string]*Endpoint `json:"services"`
+}
+
+// RouteStatus is as returned by the control port of ../impair_proxy;
+// the impairment is kept as raw JSON so that it can be put back
+// exactly as it was
+type RouteStatus struct {
+	Route struct {
+		Name       string                 `json:"name"`
+		Protocol   string                 `json:"protocol"`
+		Impairment map[string]interface{} `json:"impairment"`
+	} `json:"route"`
+	Connections int   `json:"connections"`
+	Bytes       int64 `json:"bytes"`
+	Dropped     int64 `json:"dropped"`
+	Resets      int64 `json:"resets"`
+}
+
+// A route of an impairment proxy, as shown on the dashboard
+type route struct {
+	service     string
+	controlPort int
+	status      RouteStatus
+}
+
+// A TCP connection to one of our ports
+type connection struct {
+	localPort int
+	remote    string
+}
+
+type dashboard struct {
+	mutex        sync.Mutex
+	manifestFile string
+	manifest     Manifest
+	manifestErr  error
+	services     []string
+	routes       []route
+	connections  []connection
+	// Connection counting is only possible on Linux
+	connectionsOk bool
+	// The impairments switched off by the user, to put back on a toggle
+	saved map[string]map[string]interface{}
+	// Which pane has the selection: 0 services, 1 routes
+	pane      int
+	selection [2]int
+	// The service whose log is being shown, empty for the main view
+	tailing string
+	message string
+}
+
+// Decode an address from /proc/net/tcp[6]: hex, in host (little
+// endian) order per 32-bit word, followed by a hex port
+func decodeProcAddress(text string) (string, int) {
+	parts := strings.Split(text, ":")
+	if len(parts) != 2 {
+		return "", 0
+	}
+	port, _ := strconv.ParseInt(parts[1], 16, 32)
+	var ip net.IP
+	for x := 0; x+8 <= len(parts[0]); x += 8 {
+		word, _ := strconv.ParseUint(parts[0][x:x+8], 16, 32)
+		ip = append(ip, byte(word), byte(word>>8), byte(word>>16), byte(word>>24))
+	}
+	return ip.String(), int(port)
+}
+
+// Read the established TCP connections from /proc/net, returning
+// false if that isn't possible (i.e. not on Linux)
+func readConnections() ([]connection, bool) {
+	var connections []connection
+	ok := false
+	for _, fileName := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		contents, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			continue
+		}
+		ok = true
+		for _, line := range strings.Split(string(contents), "\n")[1:] {
+			fields := strings.Fields(line)
+			// State 01 is ESTABLISHED
+			if len(fields) < 4 || fields[3] != "01" {
+				continue
+			}
+			_, localPort := decodeProcAddress(fields[1])
+			remoteIp, remotePort := decodeProcAddress(fields[2])
+			connections = append(connections, connection{localPort: localPort,
+				remote: net.JoinHostPort(strings.TrimPrefix(remoteIp, "::ffff:"), strconv.Itoa(remotePort))})
+		}
+	}
+	return connections, ok
+}
+
+// Read the end of a log file as lines
+func tailFile(fileName string, size int64) []string {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+	offset := info.Size() - size
+	if offset < 0 {
+		offset = 0
+	}
+	buffer := make([]byte, info.Size()-offset)
+	n, _ := file.ReadAt(buffer, offset)
+	lines := strings.Split(strings.TrimRight(string(buffer[:n]), "\n"), "\n")
+	if offset > 0 && len(lines) > 0 {
+		// The first line is probably partial
+		lines = lines[1:]
+	}
+	return lines
+}
+
+// Whether a log line is an error record, as written by the go test
+// tools in either text or JSON form
+func isError(line string) bool {
+	return strings.Contains(line, "level=ERROR") || strings.Contains(line, `"level":"ERROR"`)
+}
+
+// No keep-alives, so that the dashboard doesn't itself show up as a
+// connection to the control ports
+var httpClient = http.Client{Timeout: httpTimeoutSecond * time.Second,
+	Transport: &http.Transport{DisableKeepAlives: true}}
+
+// A request to a control port, with the bearer token from the
+// environment variable UBXLIB_HTTP_TOKEN if the port needs one
+func controlRequest(method string, url string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("UBXLIB_HTTP_TOKEN"); token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return httpClient.Do(request)
+}
+
+func getRoutes(controlPort int) ([]RouteStatus, error) {
+	response, err := controlRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d/routes", controlPort), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var statuses []RouteStatus
+	err = json.NewDecoder(response.Body).Decode(&statuses)
+	return statuses, err
+}
+
+func putImpairment(controlPort int, name string, impairment map[string]interface{}) error {
+	body, _ := json.Marshal(impairment)
+	response, err := controlRequest(http.MethodPut, fmt.Sprintf("http://localhost:%d/routes/%s", controlPort, name),
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("control port returned %s", response.Status)
+	}
+	return nil
+}
+
+// Re-read the manifest, the connections and, from any service with a
+// port named "control", the routes of the impairment proxies
+func (d *dashboard) refresh() {
+	var manifest Manifest
+	contents, err := ioutil.ReadFile(d.manifestFile)
+	if err == nil {
+		err = json.Unmarshal(contents, &manifest)
+	}
+	var services []string
+	var routes []route
+	if err == nil {
+		for name := range manifest.Services {
+			services = append(services, name)
+		}
+		sort.Strings(services)
+		for _, name := range services {
+			control, ok := manifest.Services[name].Ports["control"]
+			if !ok || manifest.Services[name].Status != "running" {
+				continue
+			}
+			statuses, err := getRoutes(control.Port)
+			if err != nil {
+				slog.Debug("Unable to read routes.", "service", name, "error", err)
+				continue
+			}
+			for _, status := range statuses {
+				routes = append(routes, route{service: name, controlPort: control.Port, status: status})
+			}
+		}
+	}
+	connections, connectionsOk := readConnections()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.manifestErr = err
+	if err == nil {
+		d.manifest = manifest
+		d.services = services
+		d.routes = routes
+	}
+	d.connections = connections
+	d.connectionsOk = connectionsOk
+	for pane, length := range []int{len(d.services), len(d.routes)} {
+		if d.selection[pane] >= length {
+			d.selection[pane] = length - 1
+		}
+		if d.selection[pane] < 0 {
+			d.selection[pane] = 0
+		}
+	}
+}
+
+// Switch the impairment of the selected route off, remembering it,
+// or back on again
+func (d *dashboard) toggle() {
+	d.mutex.Lock()
+	if d.selection[1] >= len(d.routes) {
+		d.mutex.Unlock()
+		return
+	}
+	r := d.routes[d.selection[1]]
+	key := r.service + "/" + r.status.Route.Name
+	impairment := map[string]interface{}{}
+	on := false
+	for _, value := range r.status.Route.Impairment {
+		if number, ok := value.(float64); !ok || number != 0 {
+			on = true
+		}
+	}
+	if on {
+		d.saved[key] = r.status.Route.Impairment
+	} else if saved, ok := d.saved[key]; ok {
+		impairment = saved
+	} else {
+		d.message = "No impairment to restore for " + key + "."
+		d.mutex.Unlock()
+		return
+	}
+	d.mutex.Unlock()
+	err := putImpairment(r.controlPort, r.status.Route.Name, impairment)
+	d.mutex.Lock()
+	if err != nil {
+		d.message = "Unable to change the impairment of " + key + ": " + err.Error()
+		slog.Error("Unable to change impairment.", "route", key, "error", err)
+	} else if on {
+		d.message = "Impairment of " + key + " switched off."
+	} else {
+		d.message = "Impairment of " + key + " restored."
+	}
+	d.mutex.Unlock()
+	d.refresh()
+}
+
+// Describe an impairment briefly, leaving out the zero fields
+func describeImpairment(impairment map[string]interface{}) string {
+	var fields []string
+	for key, value := range impairment {
+		if number, ok := value.(float64); ok && number == 0 {
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s=%v", key, value))
+	}
+	if len(fields) == 0 {
+		return "none"
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, " ")
+}
+
+func clip(text string, width int) string {
+	if width > 0 && len(text) > width {
+		return text[:width]
+	}
+	return text
+}
+
+// Draw the whole screen
+func (d *dashboard) draw(width int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var screen strings.Builder
+	line := func(format string, args ...interface{}) {
+		screen.WriteString(clip(fmt.Sprintf(format, args...), width))
+		screen.WriteString("\x1b[0m\x1b[K\r\n")
+	}
+	// Home the cursor and redraw over the top, rather than clearing,
+	// so that the screen doesn't flicker
+	screen.WriteString("\x1b[H")
+	line("ubxlib test environment: %s, manifest %s updated %s", d.manifest.Host, d.manifestFile,
+		d.manifest.Updated.Local().Format("15:04:05"))
+	if d.manifestErr != nil {
+		line("\x1b[31mUnable to read the manifest: %s", d.manifestErr)
+	}
+	line("")
+
+	if d.tailing != "" {
+		endpoint := d.manifest.Services[d.tailing]
+		if endpoint == nil || endpoint.Log == "" {
+			line("No log file for %s: set log-directory in the configuration of the supervisor.", d.tailing)
+		} else {
+			line("Log of %s (%s), any key to go back:", d.tailing, endpoint.Log)
+			for _, text := range lastLines(tailFile(endpoint.Log, logTailBytes), logTailLines) {
+				if isError(text) {
+					line("\x1b[31m%s", text)
+				} else {
+					line("%s", text)
+				}
+			}
+		}
+	} else {
+		counts := make(map[int]int)
+		for _, c := range d.connections {
+			counts[c.localPort]++
+		}
+		var errors []string
+		marker := func(pane int, index int) string {
+			if d.pane == pane && d.selection[pane] == index {
+				return "\x1b[7m>"
+			}
+			return " "
+		}
+		line("   %-20s %-10s %7s %8s %-30s %5s %6s", "SERVICE", "STATUS", "PID", "RESTARTS", "PORTS", "CONNS", "ERRORS")
+		for index, name := range d.services {
+			endpoint := d.manifest.Services[name]
+			var ports []string
+			connections := 0
+			for portName, port := range endpoint.Ports {
+				ports = append(ports, fmt.Sprintf("%s:%d/%s", portName, port.Port, port.Protocol))
+				connections += counts[port.Port]
+			}
+			sort.Strings(ports)
+			connectionsText := "-"
+			if d.connectionsOk {
+				connectionsText = strconv.Itoa(connections)
+			}
+			errorCount := 0
+			if endpoint.Log != "" {
+				for _, text := range tailFile(endpoint.Log, logTailBytes) {
+					if isError(text) {
+						errorCount++
+						errors = append(errors, name+": "+text)
+					}
+				}
+			}
+			colour := ""
+			if endpoint.Status != "running" {
+				colour = "\x1b[31m"
+			}
+			line("%s%s %-20s %-10s %7d %8d %-30s %5s %6d", marker(0, index), colour, name, endpoint.Status,
+				endpoint.Pid, endpoint.Restarts, strings.Join(ports, " "), connectionsText, errorCount)
+		}
+		line("")
+
+		line("   %-20s %-20s %-50s %6s %10s %8s %7s", "PROXY", "ROUTE", "IMPAIRMENT", "CONNS", "BYTES", "DROPPED", "RESETS")
+		if len(d.routes) == 0 {
+			line("   none: an impairment proxy needs a port named \"control\" to be shown here")
+		}
+		for index, r := range d.routes {
+			line("%s %-20s %-20s %-50s %6d %10d %8d %7d", marker(1, index), r.service, r.status.Route.Name,
+				clip(describeImpairment(r.status.Route.Impairment), 50), r.status.Connections, r.status.Bytes,
+				r.status.Dropped, r.status.Resets)
+		}
+		line("")
+
+		line("DEVICE SESSIONS")
+		if !d.connectionsOk {
+			line("   not available on this platform")
+		} else {
+			sessions := 0
+			for _, name := range d.services {
+				for portName, port := range d.manifest.Services[name].Ports {
+					if port.Protocol == "udp" || portName == "control" {
+						continue
+					}
+					for _, c := range d.connections {
+						if c.localPort == port.Port {
+							line("   %-30s -> %s.%s", c.remote, name, portName)
+							sessions++
+						}
+					}
+				}
+			}
+			if sessions == 0 {
+				line("   none")
+			}
+		}
+		line("")
+
+		line("RECENT ERRORS")
+		if len(errors) == 0 {
+			line("   none")
+		}
+		for _, text := range lastLines(errors, recentErrors) {
+			line("\x1b[31m   %s", text)
+		}
+		line("")
+		line("Tab: switch between services and routes, up/down or j/k: select, l or Enter: tail the log of a service,")
+		line("i or space: toggle the impairment of a route, r: refresh, q: quit.")
+	}
+	line("%s", d.message)
+	// Clear whatever is left below from a previous, longer, screen
+	screen.WriteString("\x1b[J")
+	os.Stdout.WriteString(screen.String())
+}
+
+func lastLines(lines []string, count int) []string {
+	if len(lines) > count {
+		return lines[len(lines)-count:]
+	}
+	return lines
+}
+
+// Handle a key, returning false if it is time to quit
+func (d *dashboard) key(key string) bool {
+	d.mutex.Lock()
+	d.message = ""
+	if d.tailing != "" {
+		d.tailing = ""
+		d.mutex.Unlock()
+		return key != "q"
+	}
+	lengths := []int{len(d.services), len(d.routes)}
+	switch key {
+	case "q", "\x03":
+		d.mutex.Unlock()
+		return false
+	case "\t":
+		d.pane = 1 - d.pane
+	case "k", "\x1b[A":
+		if d.selection[d.pane] > 0 {
+			d.selection[d.pane]--
+		}
+	case "j", "\x1b[B":
+		if d.selection[d.pane] < lengths[d.pane]-1 {
+			d.selection[d.pane]++
+		}
+	case "l", "\r", "\n":
+		if d.pane == 0 && d.selection[0] < len(d.services) {
+			d.tailing = d.services[d.selection[0]]
+		}
+	case "i", " ":
+		if d.pane == 1 {
+			d.mutex.Unlock()
+			d.toggle()
+			return true
+		}
+	case "r":
+		d.mutex.Unlock()
+		d.refresh()
+		return true
+	}
+	d.mutex.Unlock()
+	return true
+}
+
+// Read keys from the terminal; an escape sequence (e.g. an arrow key)
+// arrives in one read and is returned as one key
+func readKeys(keys chan<- string) {
+	reader := bufio.NewReader(os.Stdin)
+	buffer := make([]byte, 16)
+	for {
+		n, err := reader.Read(buffer)
+		if err != nil {
+			close(keys)
+			return
+		}
+		if n > 1 && buffer[0] == 0x1b {
+			keys <- string(buffer[:n])
+			continue
+		}
+		for _, b := range buffer[:n] {
+			keys <- string(b)
+		}
+	}
+}
+
+// Put the terminal into character-at-a-time mode with stty, returning
+// a function that puts it back; if that isn't possible (e.g. on
+// Windows) keys will only arrive when Enter is pressed
+func rawTerminal() func() {
+	command := exec.Command("stty", "-g")
+	command.Stdin = os.Stdin
+	saved, err := command.Output()
+	if err == nil {
+		command = exec.Command("stty", "-icanon", "-echo", "min", "1")
+		command.Stdin = os.Stdin
+		err = command.Run()
+	}
+	if err != nil {
+		slog.Warn("Unable to set the terminal mode: press Enter after each key.", "error", err)
+		return func() {}
+	}
+	return func() {
+		command := exec.Command("stty", strings.TrimSpace(string(saved)))
+		command.Stdin = os.Stdin
+		command.Run()
+	}
+}
+
+// The width of the terminal, from stty if possible
+func terminalWidth() int {
+	command := exec.Command("stty", "size")
+	command.Stdin = os.Stdin
+	output, err := command.Output()
+	if err == nil {
+		fields := strings.Fields(string(output))
+		if len(fields) == 2 {
+			width, err := strconv.Atoi(fields[1])
+			if err == nil && width > 0 {
+				return width
+			}
+		}
+	}
+	width, _ := strconv.Atoi(os.Getenv("COLUMNS"))
+	if width <= 0 {
+		width = 132
+	}
+	return width
+}
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"manifest", "impair-proxy", "service-logs"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "dashboard", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "dashboard")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+func main() {
+	defer recoverPanic()
+
+	manifestFile := flag.String("manifest", "../supervisor/endpoints.json", "The manifest written by the supervisor.")
+	refreshMs := flag.Int("refresh_ms", 1000, "How often to refresh the screen in milliseconds.")
+	once := flag.Bool("once", false, "Draw the screen once and exit, e.g. for a report.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "warn", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	d := &dashboard{manifestFile: *manifestFile, saved: make(map[string]map[string]interface{})}
+	d.refresh()
+	if *once {
+		os.Stdout.WriteString("\x1b[H\x1b[2J")
+		d.draw(terminalWidth())
+		return
+	}
+
+	// Hooks, rather than defer, so that the terminal is put back
+	// however the dashboard stops, e.g. by logFatal() or a panic
+	restore := rawTerminal()
+	onShutdown("terminal", func(ctx context.Context) {
+		restore()
+	})
+	// Switch to the alternate screen and hide the cursor, undoing
+	// both on the way out
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l\x1b[2J")
+	onShutdown("screen", func(ctx context.Context) {
+		os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+	})
+
+	keys := make(chan string)
+	go readKeys(keys)
+	ctx := runContext()
+	ticker := time.NewTicker(time.Duration(*refreshMs) * time.Millisecond)
+	for {
+		d.draw(terminalWidth())
+		select {
+		case key, ok := <-keys:
+			if !ok || !d.key(key) {
+				exit(exitOk)
+			}
+		case <-ticker.C:
+			d.refresh()
+		case <-ctx.Done():
+			exit(exitOk)
+		}
+	}
+}
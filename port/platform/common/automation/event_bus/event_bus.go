@@ -0,0 +1,941 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultHistory = 10000
+const maxPublishBytes = 1048576
+const maxWaitMs = 60000
+const vaultTimeoutSecond = 30
+const vaultAttempts = 3
+const rateLimitForgetSecond = 600
+
+// Event is something that one of the test tools saw, e.g. a connection
+// being opened or a fault being injected; Sequence and Received are
+// filled in here, Time by the tool that saw it
+type Event struct {
+	Sequence   int64                  `json:"sequence"`
+	Time       time.Time              `json:"time"`
+	Received   time.Time              `json:"received"`
+	Source     string                 `json:"source"`
+	Type       string                 `json:"type"`
+	Session    string                 `json:"session,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// Argument struct for JSON configuration
+type Argument struct {
+	HttpPort    string      `json:"http-port"`
+	HttpOptions HttpOptions `json:"http-options"`
+	History     int         `json:"history"`
+	LogEvents   bool        `json:"log-events"`
+}
+
+// Which events a subscriber is interested in
+type filter struct {
+	after   int64
+	types   map[string]bool
+	source  string
+	session string
+}
+
+// A filter from the query of a request: after=<sequence>, type=<type>
+// (may be repeated or comma-separated), source=<source> and
+// session=<session>
+func filterFromQuery(query url.Values) (filter, error) {
+	var f filter
+	var err error
+	if query.Get("after") != "" {
+		f.after, err = strconv.ParseInt(query.Get("after"), 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("after must be a sequence number: %w", err)
+		}
+	}
+	for _, value := range query["type"] {
+		for _, eventType := range strings.Split(value, ",") {
+			if f.types == nil {
+				f.types = make(map[string]bool)
+			}
+			f.types[strings.TrimSpace(eventType)] = true
+		}
+	}
+	f.source = query.Get("source")
+	f.session = query.Get("session")
+	return f, nil
+}
+
+func (f filter) matches(e *Event) bool {
+	return e.Sequence > f.after && (f.types == nil || f.types[e.Type]) &&
+		(f.source == "" || e.Source == f.source) && (f.session == "" || e.Session == f.session)
+}
+
+type bus struct {
+	mutex    sync.Mutex
+	config   Argument
+	events   []Event
+	sequence int64
+	// Closed, and replaced, whenever events are published, to wake up
+	// everyone waiting for them
+	published chan struct{}
+}
+
+func (b *bus) publish(events []Event) {
+	now := time.Now().UTC()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, e := range events {
+		b.sequence++
+		e.Sequence = b.sequence
+		e.Received = now
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		b.events = append(b.events, e)
+		level := slog.LevelDebug
+		if b.config.LogEvents {
+			level = slog.LevelInfo
+		}
+		slog.Log(context.Background(), level, "Event.", "sequence", e.Sequence, "source", e.Source,
+			"type", e.Type, "client-session", e.Session)
+	}
+	// Only the newest are kept, dropping the oldest in blocks so that
+	// it isn't done on every publish
+	if len(b.events) > b.config.History*5/4 {
+		b.events = append([]Event(nil), b.events[len(b.events)-b.config.History:]...)
+	}
+	close(b.published)
+	b.published = make(chan struct{})
+}
+
+// The events that match the filter, oldest first, and a channel
+// that is closed when there are more events
+func (b *bus) find(f filter) ([]Event, <-chan struct{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	found := []Event{}
+	start := sort.Search(len(b.events), func(x int) bool { return b.events[x].Sequence > f.after })
+	for x := start; x < len(b.events); x++ {
+		if f.matches(&b.events[x]) {
+			found = append(found, b.events[x])
+		}
+	}
+	return found, b.published
+}
+
+// Events are published as a single JSON object or as an array of them
+func decodeEvents(body io.Reader) ([]Event, error) {
+	contents, err := ioutil.ReadAll(io.LimitReader(body, maxPublishBytes))
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	contents = bytes.TrimSpace(contents)
+	if bytes.HasPrefix(contents, []byte("[")) {
+		err = json.Unmarshal(contents, &events)
+	} else {
+		var e Event
+		err = json.Unmarshal(contents, &e)
+		events = append(events, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		if e.Type == "" || e.Source == "" {
+			return nil, errors.New("every event must have a type and a source")
+		}
+	}
+	return events, nil
+}
+
+// Serve:
+//
+//	POST /events   an event, or an array of events, as JSON
+//	GET  /events   the events after=<sequence>, optionally only those
+//	               of type=<type>, source=<source> or session=<session>;
+//	               with wait-ms=<ms> waits up to that long for at least
+//	               one if there are none yet
+func (b *bus) serve() error {
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			events, err := decodeEvents(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			b.publish(events)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f, err := filterFromQuery(r.URL.Query())
+		var waitMs int
+		if err == nil && r.URL.Query().Get("wait-ms") != "" {
+			waitMs, err = strconv.Atoi(r.URL.Query().Get("wait-ms"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if waitMs > maxWaitMs {
+			waitMs = maxWaitMs
+		}
+		timeout := time.NewTimer(time.Duration(waitMs) * time.Millisecond)
+		defer timeout.Stop()
+		events, published := b.find(f)
+		for waiting := waitMs > 0; len(events) == 0 && waiting; {
+			select {
+			case <-published:
+				events, published = b.find(f)
+			case <-timeout.C:
+				waiting = false
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	})
+	handler, err := httpMiddleware(http.DefaultServeMux, b.config.HttpOptions)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: ":" + b.config.HttpPort, Handler: handler}
+	onShutdown("http server", func(ctx context.Context) {
+		server.Shutdown(ctx)
+	})
+	slog.Info("HTTP listening.", "port", b.config.HttpPort)
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return err
+}
+
+// BEGIN SHARED BLOCK secret, see port/platform/common/automation/go_shared
+// Fetch a secret, e.g. a private key or a password, from where the
+// reference says it is, so that secrets need not be kept in files on
+// the machines of the test farm: "env:NAME" is the value of the
+// environment variable NAME, "vault:PATH#FIELD" is FIELD of the secret
+// at API path PATH (e.g. "secret/data/ubxlib/x" for a KV version 2
+// secrets engine mounted at "secret") in HashiCorp Vault, using
+// VAULT_ADDR, VAULT_TOKEN and, if set, VAULT_NAMESPACE from the
+// environment, and "file:PATH", or anything else, is a file
+func readSecret(reference string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(reference, "env:"):
+		value, ok := os.LookupEnv(reference[4:])
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", reference[4:])
+		}
+		return []byte(value), nil
+	case strings.HasPrefix(reference, "vault:"):
+		return readVaultSecret(reference[6:])
+	}
+	return ioutil.ReadFile(strings.TrimPrefix(reference, "file:"))
+}
+
+func readVaultSecret(reference string) ([]byte, error) {
+	x := strings.LastIndex(reference, "#")
+	if x < 0 {
+		return nil, fmt.Errorf("vault secret \"%s\" has no #field", reference)
+	}
+	secretPath, field := strings.Trim(reference[:x], "/"), reference[x+1:]
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	var value []byte
+	err := retry("vault "+secretPath, vaultAttempts, vaultTimeoutSecond*time.Second, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(address, "/")+"/v1/"+secretPath, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		request.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+		if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+			request.Header.Set("X-Vault-Namespace", namespace)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("vault returned HTTP status %d for %s", response.StatusCode, secretPath)
+			if response.StatusCode < http.StatusInternalServerError {
+				// e.g. a bad token or path, which won't get better
+				err = permanent(err)
+			}
+			return err
+		}
+		// KV version 1 has the fields in "data", version 2 in "data.data"
+		var secret struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&secret)
+		if err != nil {
+			return err
+		}
+		fields := secret.Data
+		if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+			if _, isV1Field := secret.Data[field]; !isV1Field {
+				fields = inner
+			}
+		}
+		text, ok := fields[field].(string)
+		if !ok {
+			return permanent(fmt.Errorf("vault secret %s has no string field \"%s\"", secretPath, field))
+		}
+		value = []byte(text)
+		return nil
+	})
+	return value, err
+}
+
+// END SHARED BLOCK secret
+
+// BEGIN SHARED BLOCK middleware, see port/platform/common/automation/go_shared
+// HttpOptions struct for JSON configuration: what the HTTP APIs of
+// the test tools have in common
+type HttpOptions struct {
+	// If present, the bearer token that every request must carry;
+	// may be env:NAME, vault:PATH#FIELD or file:PATH, see readSecret()
+	Token string `json:"token"`
+	// If non-zero, the requests per second allowed from any one
+	// client address, in bursts of up to Burst
+	RatePerSecond float64 `json:"rate-per-second"`
+	Burst         int     `json:"burst"`
+	// If true, every request is logged, otherwise only failed ones
+	AccessLog bool `json:"access-log"`
+}
+
+// Records the status of a response, for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+// A token bucket per client address
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Whether a request from the client is allowed now and, if not, how
+// long until it would be
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > rateLimitForgetSecond*time.Second {
+		for name, bucket := range l.clients {
+			if now.Sub(bucket.updated) > rateLimitForgetSecond*time.Second {
+				delete(l.clients, name)
+			}
+		}
+		l.swept = now
+	}
+	bucket, ok := l.clients[client]
+	if !ok {
+		bucket = &rateBucket{tokens: l.burst, updated: now}
+		l.clients[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Wrap the handler of an HTTP API in what the HTTP APIs of the test
+// tools have in common, outermost first: the access log, which
+// includes any test session ID given by the client in the header
+// X-Session-Id, then the rate limit, then the bearer token
+func httpMiddleware(handler http.Handler, options HttpOptions) (http.Handler, error) {
+	if options.Token != "" {
+		token, err := readSecret(options.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token: %w", err)
+		}
+		expected := []byte("Bearer " + strings.TrimSpace(string(token)))
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	if options.RatePerSecond > 0 {
+		limiter := &rateLimiter{rate: options.RatePerSecond, burst: float64(options.Burst),
+			clients: make(map[string]*rateBucket)}
+		if limiter.burst < 1 {
+			limiter.burst = 1
+		}
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			allowed, wait := limiter.allow(client)
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	inner := handler
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		inner.ServeHTTP(recorder, r)
+		level := slog.LevelDebug
+		if options.AccessLog {
+			level = slog.LevelInfo
+		}
+		if recorder.status >= 400 {
+			level = slog.LevelWarn
+		}
+		args := []any{"method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "status", recorder.status,
+			"bytes", recorder.bytes, "duration-ms", time.Since(started).Milliseconds()}
+		if session := r.Header.Get("X-Session-Id"); session != "" {
+			args = append(args, "client-session", session)
+		}
+		slog.Log(r.Context(), level, "Request.", args...)
+	})
+	return handler, nil
+}
+
+// END SHARED BLOCK middleware
+
+// BEGIN SHARED BLOCK config, see port/platform/common/automation/go_shared
+// Overrides of fields of the configuration given with -set
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("must be of the form name=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// Add the line and column to an error from decoding the JSON
+// configuration, since a byte offset isn't much help to anyone
+func configError(contents []byte, err error) error {
+	var offset int64 = -1
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+		err = fmt.Errorf("%q must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	if offset < 0 || offset > int64(len(contents)) {
+		return err
+	}
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(contents[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// Set a field of the configuration from text, finding it by its
+// JSON name, with a "." between the names of nested fields; the
+// case of a name, and "_" rather than "-", don't matter, so that
+// the names can come from environment variables
+func configSet(config interface{}, name string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s: %q is not an object", name, part)
+		}
+		found := false
+		for x := 0; !found && x < field.NumField(); x++ {
+			tag := strings.Split(field.Type().Field(x).Tag.Get("json"), ",")[0]
+			if tag != "" && strings.EqualFold(strings.ReplaceAll(tag, "-", "_"), strings.ReplaceAll(part, "-", "_")) {
+				field = field.Field(x)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: there is no field %q in the configuration", name, part)
+		}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	// Anything else, numbers, booleans, lists or objects, as JSON,
+	// into a fresh value so that nothing of the old one is kept
+	fresh := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), fresh.Interface())
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(fresh.Elem())
+	return nil
+}
+
+// Load the JSON configuration and then apply overrides, first from
+// environment variables named UBXLIB_<TOOL>_<FIELD>, with "__" between
+// the names of nested fields, e.g. UBXLIB_DEVICE_TWIN_MQTT__BROKER,
+// then from -set name=value, so that a deployment need only record
+// how it differs from the checked-in configuration
+func configLoad(contents []byte, config interface{}, overrides []string) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		// Most likely a typo or a field from a newer version of the
+		// tool: worth knowing about but not worth stopping for
+		slog.Warn("Unknown field in the configuration, ignored.", "error", err)
+		err = json.Unmarshal(contents, config)
+	}
+	if err != nil {
+		return configError(contents, err)
+	}
+	prefix := "UBXLIB_" + strings.ToUpper(versionInfo().Tool) + "_"
+	var environment []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			environment = append(environment, strings.TrimPrefix(variable, prefix))
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		nameValue := strings.SplitN(variable, "=", 2)
+		// Only the name is logged since the value may be a secret
+		err = configSet(config, strings.ReplaceAll(nameValue[0], "__", "."), nameValue[1])
+		if err != nil {
+			// Could be meant for another tool with a longer name
+			slog.Warn("Environment variable not applied to the configuration.", "variable", prefix+nameValue[0], "error", err)
+		} else {
+			slog.Info("Configuration overridden from the environment.", "variable", prefix+nameValue[0])
+		}
+	}
+	for _, override := range overrides {
+		nameValue := strings.SplitN(override, "=", 2)
+		err = configSet(config, nameValue[0], nameValue[1])
+		if err != nil {
+			return fmt.Errorf("-set %w", err)
+		}
+		slog.Info("Configuration overridden.", "field", nameValue[0])
+	}
+	return nil
+}
+
+// END SHARED BLOCK config
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"publish", "subscribe", "long-poll"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "event_bus", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "event_bus")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+// BEGIN SHARED BLOCK retry, see port/platform/common/automation/go_shared
+// Retries, the same in all of the test tools, in place of fixed
+// sleeps: each delay is double the one before, up to a maximum, less
+// up to a half at random so that many clients don't retry in step
+const retryInitialMs = 500
+const retryMaxMs = 30000
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Start again from the initial delay, e.g. once a connection has
+// stayed up for a while
+func (b *backoff) reset() {
+	b.next = b.initial
+}
+
+// Wait for the next delay, returning false if the tool is asked to
+// stop in the meantime
+func (b *backoff) wait() bool {
+	timer := time.NewTimer(b.delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+// An error that trying again won't fix, e.g. a refusal rather than a
+// failure to connect
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// Call operation up to attempts times, backing off between attempts,
+// each attempt being given a context that is done after timeout or
+// when the tool is asked to stop; a permanent error isn't retried
+func retry(name string, attempts int, timeout time.Duration, operation func(ctx context.Context) error) error {
+	b := newBackoff(retryInitialMs*time.Millisecond, retryMaxMs*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(runContext(), timeout)
+		err := operation(ctx)
+		cancel()
+		var isPermanent permanentError
+		if err == nil || errors.As(err, &isPermanent) || attempt >= attempts {
+			return err
+		}
+		slog.Warn("Failed, trying again.", "operation", name, "attempt", attempt, "error", err)
+		if !b.wait() {
+			return err
+		}
+	}
+}
+
+// END SHARED BLOCK retry
+
+func main() {
+	defer recoverPanic()
+
+	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration.")
+	var overrides configOverrides
+	flag.Var(&overrides, "set", "Override a field of the configuration with name=value, name being the JSON name, with . between nested names; may be repeated.")
+	printConfig := flag.Bool("print_config", false, "Print the configuration, with any overrides applied, and exit.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	byteValue, err := ioutil.ReadFile(*configLocation)
+	if err != nil {
+		logFatal("Failed to open file.", "error", err)
+	}
+
+	var config Argument
+	err = configLoad(byteValue, &config, overrides)
+	if err != nil {
+		logFatal("Invalid configuration.", "file", *configLocation, "error", err)
+	}
+	if *printConfig {
+		contents, _ := json.MarshalIndent(config, "", "    ")
+		fmt.Println(string(contents))
+		return
+	}
+	if config.HttpPort == "" {
+		config.HttpPort = "8098"
+	}
+	if config.History <= 0 {
+		config.History = defaultHistory
+	}
+
+	b := &bus{config: config, published: make(chan struct{})}
+	go func() {
+		defer recoverPanic()
+		err := b.serve()
+		if err != nil {
+			logFatal("HTTP server failed.", "error", err)
+		}
+	}()
+
+	<-runContext().Done()
+	exit(exitOk)
+}
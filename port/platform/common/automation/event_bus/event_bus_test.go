@@ -0,0 +1,89 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Run with: go test event_bus.go event_bus_test.go
+
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestFilterFromQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected filter
+		err      bool
+	}{
+		{"", filter{}, false},
+		{"after=42", filter{after: 42}, false},
+		{"after=", filter{}, false},
+		{"after=forty-two", filter{}, true},
+		{"after=1.5", filter{}, true},
+		{"type=test-start", filter{types: map[string]bool{"test-start": true}}, false},
+		{"type=test-start,%20test-end&type=twin-desired",
+			filter{types: map[string]bool{"test-start": true, "test-end": true, "twin-desired": true}}, false},
+		{"source=impair_proxy&session=run-7", filter{source: "impair_proxy", session: "run-7"}, false},
+		{"session=run-7&session=run-8", filter{session: "run-7"}, false},
+		{"after=10&type=a&source=b&session=c&unknown=d",
+			filter{after: 10, types: map[string]bool{"a": true}, source: "b", session: "c"}, false},
+	}
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := filterFromQuery(query)
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v", test.query, err)
+		}
+		if err == nil && !reflect.DeepEqual(f, test.expected) {
+			t.Errorf("%q gives %+v, expected %+v", test.query, f, test.expected)
+		}
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	event := &Event{Sequence: 5, Source: "device_twin", Type: "twin-desired", Session: "run-7"}
+	tests := []struct {
+		query   string
+		matches bool
+	}{
+		{"", true},
+		{"after=4", true},
+		{"after=5", false},
+		{"type=twin-reported,twin-desired", true},
+		{"type=twin-reported", false},
+		{"source=device_twin", true},
+		{"source=impair_proxy", false},
+		{"session=run-7", true},
+		{"session=run-8", false},
+		{"after=4&type=twin-desired&source=device_twin&session=run-7", true},
+		{"after=4&type=twin-desired&source=device_twin&session=run-8", false},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		f, err := filterFromQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.matches(event) != test.matches {
+			t.Errorf("%q: matches %t, expected %t", test.query, !test.matches, test.matches)
+		}
+	}
+}
@@ -0,0 +1,569 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Size is the footprint of one module
+type Size struct {
+	Flash int64 `json:"flash"`
+	Ram   int64 `json:"ram"`
+}
+
+// Record is the footprint of one build, as kept in the history
+type Record struct {
+	Platform string          `json:"platform"`
+	Label    string          `json:"label,omitempty"`
+	Date     time.Time       `json:"date"`
+	MapFile  string          `json:"map-file"`
+	Total    Size            `json:"total"`
+	Modules  map[string]Size `json:"modules"`
+}
+
+// Regression is a module that has grown by more than the threshold
+type Regression struct {
+	Module   string `json:"module"`
+	Memory   string `json:"memory"`
+	Previous int64  `json:"previous"`
+	Current  int64  `json:"current"`
+}
+
+// Input section lines of a GNU ld map file, either all on one line
+// or, where the section name is long, with the name on a line of
+// its own followed by the address, size and object file
+var sectionLine = regexp.MustCompile(`^ ([.A-Za-z_][^\s]*)\s+0x([0-9a-fA-F]+)\s+0x([0-9a-fA-F]+)\s+(.+)$`)
+var sectionName = regexp.MustCompile(`^ ([.A-Za-z_][^\s]*)$`)
+var sectionContinued = regexp.MustCompile(`^\s+0x([0-9a-fA-F]+)\s+0x([0-9a-fA-F]+)\s+(.+)$`)
+
+// Work out whether an input section occupies flash, RAM or both
+// (initialised data, or code copied to RAM, e.g. .iram1 on ESP32)
+func sectionMemory(name string) (bool, bool) {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(name, ".bss"), strings.HasPrefix(name, ".sbss"),
+		strings.HasPrefix(name, "common"), strings.HasPrefix(name, ".noinit"),
+		strings.HasPrefix(name, ".dram0.bss"), strings.HasPrefix(name, ".tbss"):
+		return false, true
+	case strings.HasPrefix(name, ".data"), strings.HasPrefix(name, ".sdata"),
+		strings.HasPrefix(name, ".dram"), strings.HasPrefix(name, ".iram"),
+		strings.HasPrefix(name, ".ramfunc"), strings.HasPrefix(name, ".tdata"):
+		return true, true
+	case strings.HasPrefix(name, ".text"), strings.HasPrefix(name, ".rodata"),
+		strings.HasPrefix(name, ".literal"), strings.HasPrefix(name, ".flash"),
+		strings.HasPrefix(name, ".srodata"), strings.HasPrefix(name, ".init_array"),
+		strings.HasPrefix(name, ".fini_array"), strings.HasPrefix(name, ".ctors"),
+		strings.HasPrefix(name, ".dtors"), strings.HasPrefix(name, ".arm.ex"):
+		return true, false
+	}
+	return false, false
+}
+
+// Index the source files of ubxlib by name, giving the module
+// each belongs to: the top-level directory (e.g. "cell"), or the
+// directory under "common" (e.g. "common/at_client"), or "port",
+// with "/test" added for test code
+func indexSources(root string) map[string]string {
+	index := make(map[string]string)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		extension := filepath.Ext(path)
+		if extension != ".c" && extension != ".cpp" {
+			return nil
+		}
+		relative, _ := filepath.Rel(root, path)
+		parts := strings.Split(filepath.ToSlash(relative), "/")
+		module := parts[0]
+		if module == "common" && len(parts) > 2 {
+			module += "/" + parts[1]
+		}
+		for _, part := range parts[1 : len(parts)-1] {
+			if part == "test" || part == "example" {
+				module += "/" + part
+				break
+			}
+		}
+		index[strings.TrimSuffix(filepath.Base(path), extension)] = module
+		return nil
+	})
+	return index
+}
+
+// Get from the object file of a map line, e.g. "libubxlib.a(u_cell_pwr.o)",
+// "CMakeFiles/x.dir/ubxlib/cell/src/u_cell_pwr.c.obj" or "u_cell_pwr.o",
+// the name of the source file it came from, without extension
+func objectSource(object string) string {
+	object = strings.TrimSpace(object)
+	if x := strings.LastIndex(object, "("); x >= 0 && strings.HasSuffix(object, ")") {
+		object = object[x+1 : len(object)-1]
+	}
+	name := strings.ReplaceAll(object, "\\", "/")
+	if x := strings.LastIndex(name, "/"); x >= 0 {
+		name = name[x+1:]
+	}
+	for _, extension := range []string{".obj", ".o", ".c", ".cpp"} {
+		name = strings.TrimSuffix(name, extension)
+	}
+	return name
+}
+
+// Parse a GNU ld map file, attributing the size of every input
+// section to the ubxlib module its object file came from, or to
+// "other" for anything that isn't ubxlib
+func parseMap(fileName string, index map[string]string) (map[string]Size, Size, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, Size{}, err
+	}
+	defer file.Close()
+	modules := make(map[string]Size)
+	var total Size
+	inMap := false
+	pendingName := ""
+	add := func(name string, addressText string, sizeText string, object string) {
+		address, _ := strconv.ParseUint(addressText, 16, 64)
+		size, _ := strconv.ParseInt(sizeText, 16, 64)
+		if address == 0 || size == 0 {
+			return
+		}
+		flash, ram := sectionMemory(name)
+		if !flash && !ram {
+			return
+		}
+		module, ok := index[objectSource(object)]
+		if !ok {
+			module = "other"
+		}
+		s := modules[module]
+		if flash {
+			s.Flash += size
+			total.Flash += size
+		}
+		if ram {
+			s.Ram += size
+			total.Ram += size
+		}
+		modules[module] = s
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 65536), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if !inMap {
+			// Everything before this is discarded sections, etc.
+			inMap = strings.HasPrefix(line, "Linker script and memory map")
+			continue
+		}
+		if pendingName != "" {
+			if match := sectionContinued.FindStringSubmatch(line); match != nil {
+				add(pendingName, match[1], match[2], match[3])
+			}
+			pendingName = ""
+			continue
+		}
+		if match := sectionLine.FindStringSubmatch(line); match != nil {
+			add(match[1], match[2], match[3], match[4])
+		} else if match := sectionName.FindStringSubmatch(line); match != nil {
+			pendingName = match[1]
+		}
+	}
+	if err = scanner.Err(); err == nil && !inMap {
+		err = fmt.Errorf("%s doesn't look like a GNU ld map file", fileName)
+	}
+	return modules, total, err
+}
+
+func loadHistory(fileName string) ([]Record, error) {
+	var history []Record
+	contents, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(contents, &history)
+	}
+	return history, err
+}
+
+// Compare with the last record for the same platform, returning
+// the modules that have grown by more than both thresholds
+func regressions(history []Record, current Record, thresholdBytes int64, thresholdPercent float64) (*Record, []Regression) {
+	var previous *Record
+	for x := len(history) - 1; x >= 0; x-- {
+		if history[x].Platform == current.Platform {
+			previous = &history[x]
+			break
+		}
+	}
+	var found []Regression
+	if previous == nil {
+		return nil, found
+	}
+	check := func(module string, memory string, before int64, after int64) {
+		growth := after - before
+		if growth > thresholdBytes && (before == 0 || float64(growth)*100/float64(before) > thresholdPercent) {
+			found = append(found, Regression{Module: module, Memory: memory, Previous: before, Current: after})
+		}
+	}
+	names := sortedNames(current.Modules)
+	for _, name := range names {
+		check(name, "flash", previous.Modules[name].Flash, current.Modules[name].Flash)
+		check(name, "ram", previous.Modules[name].Ram, current.Modules[name].Ram)
+	}
+	return previous, found
+}
+
+func sortedNames(modules map[string]Size) []string {
+	var names []string
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func printReport(current Record, previous *Record, found []Regression) {
+	fmt.Printf("Footprint of %s (%s):\n", current.Platform, current.MapFile)
+	fmt.Printf("  %-28s %10s %10s", "module", "flash", "RAM")
+	if previous != nil {
+		fmt.Printf(" %10s %10s", "+/- flash", "+/- RAM")
+	}
+	fmt.Printf("\n")
+	line := func(name string, size Size, before Size) {
+		fmt.Printf("  %-28s %10d %10d", name, size.Flash, size.Ram)
+		if previous != nil {
+			fmt.Printf(" %+10d %+10d", size.Flash-before.Flash, size.Ram-before.Ram)
+		}
+		fmt.Printf("\n")
+	}
+	for _, name := range sortedNames(current.Modules) {
+		var before Size
+		if previous != nil {
+			before = previous.Modules[name]
+		}
+		line(name, current.Modules[name], before)
+	}
+	var before Size
+	if previous != nil {
+		before = previous.Total
+	}
+	line("total", current.Total, before)
+	if previous != nil {
+		fmt.Printf("Compared with %s", previous.Date.Format("2006-01-02 15:04"))
+		if previous.Label != "" {
+			fmt.Printf(" (%s)", previous.Label)
+		}
+		fmt.Printf(".\n")
+	}
+	for _, r := range found {
+		fmt.Printf("REGRESSION: %s %s has grown from %d to %d bytes.\n", r.Module, r.Memory, r.Previous, r.Current)
+	}
+}
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"gnu-ld", "history", "regression"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "footprint", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "footprint")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+func main() {
+	defer recoverPanic()
+
+	ubxlibDirectory := flag.String("ubxlib", "../../../../..", "The ubxlib directory, used to work out which module a source file belongs to.")
+	platform := flag.String("platform", "", "The name of the platform/build the map file is from, e.g. stm32f4, used to match history.")
+	label := flag.String("label", "", "A label to record with the history, e.g. a git commit or build number.")
+	historyFile := flag.String("history", "", "JSON file of footprint history to compare with.")
+	record := flag.Bool("record", false, "Add this footprint to the history file.")
+	thresholdBytes := flag.Int64("threshold_bytes", 256, "A module must grow by more than this many bytes to be a regression.")
+	thresholdPercent := flag.Float64("threshold_percent", 1, "...and by more than this percentage.")
+	jsonOutput := flag.Bool("json", false, "Write the footprint and any regressions as JSON rather than text.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] map_file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		exit(exitUsage)
+	}
+	if *platform == "" {
+		*platform = strings.TrimSuffix(filepath.Base(flag.Arg(0)), filepath.Ext(flag.Arg(0)))
+	}
+
+	index := indexSources(*ubxlibDirectory)
+	if len(index) == 0 {
+		logFatal("No source files found, is -ubxlib correct?", "directory", *ubxlibDirectory)
+	}
+	modules, total, err := parseMap(flag.Arg(0), index)
+	if err != nil {
+		logFatal("Unable to parse map file.", "error", err)
+	}
+	current := Record{Platform: *platform, Label: *label, Date: time.Now().UTC(),
+		MapFile: filepath.Base(flag.Arg(0)), Total: total, Modules: modules}
+
+	var history []Record
+	if *historyFile != "" {
+		history, err = loadHistory(*historyFile)
+		if err != nil {
+			logFatal("Unable to read history.", "error", err)
+		}
+	}
+	previous, found := regressions(history, current, *thresholdBytes, *thresholdPercent)
+
+	if *jsonOutput {
+		contents, _ := json.MarshalIndent(struct {
+			Footprint   Record       `json:"footprint"`
+			Previous    *Record      `json:"previous,omitempty"`
+			Regressions []Regression `json:"regressions"`
+		}{current, previous, found}, "", "    ")
+		fmt.Println(string(contents))
+	} else {
+		printReport(current, previous, found)
+	}
+
+	if *record && *historyFile != "" {
+		history = append(history, current)
+		contents, _ := json.MarshalIndent(history, "", "    ")
+		temporary := *historyFile + ".tmp"
+		err = ioutil.WriteFile(temporary, contents, 0644)
+		if err == nil {
+			err = os.Rename(temporary, *historyFile)
+		}
+		if err != nil {
+			logFatal("Unable to write history.", "error", err)
+		}
+	}
+	if len(found) > 0 {
+		logFatal("Footprint has regressed.", "regressions", len(found))
+	}
+}
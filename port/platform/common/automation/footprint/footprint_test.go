@@ -0,0 +1,206 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Run with: go test footprint.go footprint_test.go
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSectionMemory(t *testing.T) {
+	tests := []struct {
+		name  string
+		flash bool
+		ram   bool
+	}{
+		{".text.uCellPwrOn", true, false},
+		{".rodata.gCellPrivateModuleList", true, false},
+		{".literal.uAtClientAdd", true, false},
+		{".ARM.extab", true, false},
+		{".bss.gAtClientList", false, true},
+		{"COMMON", false, true},
+		{".dram0.bss", false, true},
+		{".data.gMutex", true, true},
+		{".iram1.5", true, true},
+		{".dram1.2", true, true},
+		{".debug_info", false, false},
+		{".comment", false, false},
+	}
+	for _, test := range tests {
+		flash, ram := sectionMemory(test.name)
+		if flash != test.flash || ram != test.ram {
+			t.Errorf("%s: flash %t, RAM %t, expected %t, %t", test.name, flash, ram, test.flash, test.ram)
+		}
+	}
+}
+
+func TestObjectSource(t *testing.T) {
+	tests := []struct {
+		object string
+		source string
+	}{
+		{"libubxlib.a(u_cell_pwr.o)", "u_cell_pwr"},
+		{"CMakeFiles/x.dir/ubxlib/cell/src/u_cell_pwr.c.obj", "u_cell_pwr"},
+		{"u_cell_pwr.o", "u_cell_pwr"},
+		{" C:\\build\\obj\\u_port_uart.o ", "u_port_uart"},
+		{"/opt/gcc/lib/libc_nano.a(lib_a-memcpy.o)", "lib_a-memcpy"},
+		{"esp-idf/main/libmain.a(u_cfg_app.cpp.obj)", "u_cfg_app"},
+	}
+	for _, test := range tests {
+		if source := objectSource(test.object); source != test.source {
+			t.Errorf("%q gives %q, expected %q", test.object, source, test.source)
+		}
+	}
+}
+
+// Make a ubxlib-like tree in a temporary directory
+func sourceTree(t *testing.T) string {
+	root := t.TempDir()
+	for _, path := range []string{
+		"cell/src/u_cell_pwr.c",
+		"cell/test/u_cell_pwr_test.c",
+		"common/at_client/src/u_at_client.c",
+		"common/at_client/test/u_at_client_test.c",
+		"port/platform/stm32cube/src/u_port_uart.c",
+		"port/platform/stm32cube/src/u_port_uart.h",
+		"example/sockets/main.cpp",
+	} {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestIndexSources(t *testing.T) {
+	expected := map[string]string{
+		"u_cell_pwr":       "cell",
+		"u_cell_pwr_test":  "cell/test",
+		"u_at_client":      "common/at_client",
+		"u_at_client_test": "common/at_client/test",
+		"u_port_uart":      "port",
+		"main":             "example",
+	}
+	if index := indexSources(sourceTree(t)); !reflect.DeepEqual(index, expected) {
+		t.Errorf("index is %v, expected %v", index, expected)
+	}
+}
+
+// A cut-down GNU ld map file
+const testMap = `Archive member included to satisfy reference by file (symbol)
+
+libubxlib.a(u_cell_pwr.o)     main.o (uCellPwrOn)
+
+Discarded input sections
+
+ .text.uCellPwrOff
+                0x00000000       0x40 libubxlib.a(u_cell_pwr.o)
+
+Linker script and memory map
+
+ .text.uCellPwrOn
+                0x08001000      0x120 libubxlib.a(u_cell_pwr.o)
+ .text.uAtClientAdd
+                0x08001120      0x200 libubxlib.a(u_at_client.o)
+ .rodata.str1.4
+                0x08001320       0x10 libubxlib.a(u_at_client.o)
+ .text          0x08001330       0x80 /opt/gcc/lib/libc_nano.a(lib_a-memcpy.o)
+ .data.gMutex   0x20000000        0x8 libubxlib.a(u_at_client.o)
+ .bss.gUartData
+                0x20000008       0x40 CMakeFiles/app.dir/ubxlib/port/u_port_uart.c.obj
+ .bss.unused    0x00000000       0x40 libubxlib.a(u_cell_pwr.o)
+ .debug_info    0x00000000     0x1000 libubxlib.a(u_cell_pwr.o)
+ .text.empty    0x08001400        0x0 libubxlib.a(u_cell_pwr.o)
+ *(.text*)
+`
+
+func TestParseMap(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "ubxlib.map")
+	if err := os.WriteFile(mapFile, []byte(testMap), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modules, total, err := parseMap(mapFile, indexSources(sourceTree(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Size{
+		"cell":             {Flash: 0x120},
+		"common/at_client": {Flash: 0x218, Ram: 0x8},
+		"port":             {Ram: 0x40},
+		"other":            {Flash: 0x80},
+	}
+	if !reflect.DeepEqual(modules, expected) {
+		t.Errorf("modules are %v, expected %v", modules, expected)
+	}
+	if total != (Size{Flash: 0x3b8, Ram: 0x48}) {
+		t.Errorf("total is %+v", total)
+	}
+
+	notMap := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(notMap, []byte(" .text 0x1 0x1 a.o\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseMap(notMap, nil); err == nil {
+		t.Error("no error for a file that isn't a map file")
+	}
+}
+
+func TestRegressions(t *testing.T) {
+	history := []Record{
+		{Platform: "esp32", Modules: map[string]Size{"cell": {Flash: 1000, Ram: 100}}},
+		{Platform: "stm32f4", Modules: map[string]Size{"cell": {Flash: 10000, Ram: 1000}}},
+		{Platform: "esp32", Modules: map[string]Size{"cell": {Flash: 20000, Ram: 2000}}},
+	}
+	tests := []struct {
+		name     string
+		platform string
+		modules  map[string]Size
+		previous int
+		found    []Regression
+	}{
+		{"no history", "nrf52", map[string]Size{"cell": {Flash: 1}}, -1, nil},
+		{"no growth", "stm32f4", map[string]Size{"cell": {Flash: 10000, Ram: 1000}}, 1, nil},
+		{"under bytes", "stm32f4", map[string]Size{"cell": {Flash: 10256, Ram: 1000}}, 1, nil},
+		{"under percent", "esp32", map[string]Size{"cell": {Flash: 20200, Ram: 2000}}, 2, nil},
+		{"flash", "stm32f4", map[string]Size{"cell": {Flash: 10257, Ram: 1000}}, 1,
+			[]Regression{{"cell", "flash", 10000, 10257}}},
+		{"both", "stm32f4", map[string]Size{"cell": {Flash: 11000, Ram: 1300}}, 1,
+			[]Regression{{"cell", "flash", 10000, 11000}, {"cell", "ram", 1000, 1300}}},
+		{"new module", "esp32", map[string]Size{"ble": {Flash: 300}, "cell": {Flash: 20000, Ram: 2000}}, 2,
+			[]Regression{{"ble", "flash", 0, 300}}},
+		{"shrink", "esp32", map[string]Size{"cell": {Flash: 100, Ram: 10}}, 2, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			previous, found := regressions(history, Record{Platform: test.platform, Modules: test.modules}, 256, 1)
+			if (test.previous < 0 && previous != nil) || (test.previous >= 0 && previous != &history[test.previous]) {
+				t.Errorf("wrong previous record %+v", previous)
+			}
+			if len(found) != len(test.found) || (len(found) > 0 && !reflect.DeepEqual(found, test.found)) {
+				t.Errorf("found %+v, expected %+v", found, test.found)
+			}
+		})
+	}
+}
@@ -0,0 +1,814 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const ioTimeoutSecond = 10
+const ioAttempts = 3
+const replyQuietMs = 300
+const stopTimeoutSecond = 10
+
+// Device struct for JSON configuration: one GNSS simulator
+type Device struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	// Command templates for the "labsat" and "tcp" types, defaults
+	// for "labsat" being those of a LabSat 3
+	PlayCommand        string `json:"play-command"`
+	StopCommand        string `json:"stop-command"`
+	StatusCommand      string `json:"status-command"`
+	AttenuationCommand string `json:"attenuation-command"`
+	// The program to run, for the "exec" type, "{file}" and
+	// "{attenuation}" being replaced in its arguments
+	Program []string `json:"program"`
+}
+
+// Scenario struct for JSON configuration: a recording to play back
+type Scenario struct {
+	Device        string  `json:"device"`
+	File          string  `json:"file"`
+	AttenuationDb float64 `json:"attenuation-db"`
+	DurationS     int     `json:"duration-s"`
+}
+
+// Argument struct for JSON configuration
+type Argument struct {
+	Devices   []Device            `json:"devices"`
+	Scenarios map[string]Scenario `json:"scenarios"`
+}
+
+// The interface that every GNSS simulator driver provides
+type gnssSimulator interface {
+	play(file string, attenuationDb float64) error
+	stop() error
+	status() (string, error)
+	close()
+}
+
+// Driver for simulators with a line-based command interface on a
+// TCP socket, e.g. the remote control interface of a LabSat 3; the
+// commands are Printf() templates from the configuration
+type tcpSimulator struct {
+	device     Device
+	connection net.Conn
+	reader     *bufio.Reader
+}
+
+// Send a command and collect whatever comes back until the
+// simulator goes quiet, which copes with those that send a
+// prompt rather than a terminated line
+func (s *tcpSimulator) command(cmd string) (string, error) {
+	s.connection.SetWriteDeadline(time.Now().Add(ioTimeoutSecond * time.Second))
+	_, err := s.connection.Write([]byte(cmd + "\r\n"))
+	if err != nil {
+		return "", err
+	}
+	var reply strings.Builder
+	deadline := time.Now().Add(ioTimeoutSecond * time.Second)
+	for time.Now().Before(deadline) {
+		s.connection.SetReadDeadline(time.Now().Add(replyQuietMs * time.Millisecond))
+		line, err := s.reader.ReadString('\n')
+		reply.WriteString(line)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			return "", err
+		}
+	}
+	text := strings.TrimSpace(reply.String())
+	// Lose any prompt
+	if x := strings.LastIndex(text, "\n"); x >= 0 && strings.HasSuffix(text, ">") {
+		text = strings.TrimSpace(text[:x])
+	} else if strings.HasSuffix(text, ">") {
+		text = ""
+	}
+	slog.Debug("Command.", "device", s.device.Name, "command", cmd, "reply", text)
+	if isErrorReply(text) {
+		return text, fmt.Errorf("%s was refused (reply \"%s\")", cmd, text)
+	}
+	return text, nil
+}
+
+// A reply is an error if any line of it begins with ERR, e.g. "ERR",
+// "ERROR" or "ERR: no such file"; the letters elsewhere, e.g. in a
+// file name echoed back, don't count
+func isErrorReply(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(line)), "ERR") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *tcpSimulator) play(file string, attenuationDb float64) error {
+	if s.device.AttenuationCommand != "" {
+		_, err := s.command(fmt.Sprintf(s.device.AttenuationCommand, attenuationDb))
+		if err != nil {
+			return err
+		}
+	}
+	if s.device.PlayCommand == "" {
+		return fmt.Errorf("no play-command configured for %s", s.device.Name)
+	}
+	_, err := s.command(fmt.Sprintf(s.device.PlayCommand, file))
+	return err
+}
+
+func (s *tcpSimulator) stop() error {
+	if s.device.StopCommand == "" {
+		return fmt.Errorf("no stop-command configured for %s", s.device.Name)
+	}
+	_, err := s.command(s.device.StopCommand)
+	return err
+}
+
+func (s *tcpSimulator) status() (string, error) {
+	if s.device.StatusCommand == "" {
+		return "", fmt.Errorf("no status-command configured for %s", s.device.Name)
+	}
+	return s.command(s.device.StatusCommand)
+}
+
+func (s *tcpSimulator) close() {
+	s.connection.Close()
+}
+
+// Driver for software simulators, e.g. an SDR transmitting the
+// output of gps-sdr-sim, where playback is a program that runs
+// until it is stopped; the program is stopped when this tool
+// exits, so it plays only while the tool is running
+type execSimulator struct {
+	device Device
+	cmd    *exec.Cmd
+	done   chan error
+}
+
+func (s *execSimulator) play(file string, attenuationDb float64) error {
+	if len(s.device.Program) == 0 {
+		return fmt.Errorf("no program configured for %s", s.device.Name)
+	}
+	if s.cmd != nil {
+		s.stop()
+	}
+	var args []string
+	for _, arg := range s.device.Program[1:] {
+		arg = strings.ReplaceAll(arg, "{file}", file)
+		arg = strings.ReplaceAll(arg, "{attenuation}", fmt.Sprint(attenuationDb))
+		args = append(args, arg)
+	}
+	s.cmd = exec.Command(s.device.Program[0], args...)
+	s.cmd.Stdout = os.Stderr
+	s.cmd.Stderr = os.Stderr
+	err := s.cmd.Start()
+	if err != nil {
+		s.cmd = nil
+		return err
+	}
+	s.done = make(chan error, 1)
+	go func(cmd *exec.Cmd, done chan error) {
+		done <- cmd.Wait()
+	}(s.cmd, s.done)
+	return nil
+}
+
+func (s *execSimulator) stop() error {
+	if s.cmd == nil {
+		return nil
+	}
+	s.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-s.done:
+	case <-time.After(stopTimeoutSecond * time.Second):
+		s.cmd.Process.Kill()
+		<-s.done
+	}
+	s.cmd = nil
+	return nil
+}
+
+func (s *execSimulator) status() (string, error) {
+	if s.cmd == nil {
+		return "stopped", nil
+	}
+	select {
+	case err := <-s.done:
+		s.cmd = nil
+		return fmt.Sprintf("finished (%v)", err), nil
+	default:
+	}
+	return "playing", nil
+}
+
+func (s *execSimulator) close() {
+	s.stop()
+}
+
+func openDevice(device Device) (gnssSimulator, error) {
+	switch device.Type {
+	case "labsat", "tcp":
+		if device.Type == "labsat" {
+			if device.PlayCommand == "" {
+				device.PlayCommand = "PLAY:FILE:%s"
+			}
+			if device.StopCommand == "" {
+				device.StopCommand = "PLAY:STOP"
+			}
+			if device.StatusCommand == "" {
+				device.StatusCommand = "MON:STATUS"
+			}
+			if device.AttenuationCommand == "" {
+				device.AttenuationCommand = "ATT:%.0f"
+			}
+		}
+		var connection net.Conn
+		err := retry("connect to "+device.Name, ioAttempts, ioTimeoutSecond*time.Second, func(ctx context.Context) error {
+			var err error
+			connection, err = (&net.Dialer{}).DialContext(ctx, "tcp", device.Address)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &tcpSimulator{device: device, connection: connection,
+			reader: bufio.NewReader(connection)}, nil
+	case "exec":
+		return &execSimulator{device: device}, nil
+	}
+	return nil, fmt.Errorf("unknown device type \"%s\" for %s", device.Type, device.Name)
+}
+
+func findDevice(config Argument, name string) (Device, error) {
+	for _, device := range config.Devices {
+		if device.Name == name || name == "" {
+			return device, nil
+		}
+	}
+	return Device{}, fmt.Errorf("no device named \"%s\" in the configuration", name)
+}
+
+// Play a scenario until its duration is up or, if it has no
+// duration, until this tool is told to stop, then stop the
+// simulator, so that a test script or the supervisor can keep
+// playback in step with a test run just by starting and stopping
+// this tool
+func runScenario(name string, scenario Scenario, simulator gnssSimulator) error {
+	ctx := runContext()
+	err := simulator.play(scenario.File, scenario.AttenuationDb)
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	slog.Info("Playback started.", "scenario", name, "file", scenario.File,
+		"attenuation-db", scenario.AttenuationDb, "started", started.UTC().Format("2006-01-02T15:04:05.000Z"))
+	var timer <-chan time.Time
+	if scenario.DurationS > 0 {
+		timer = time.After(time.Duration(scenario.DurationS) * time.Second)
+	}
+	select {
+	case <-timer:
+	case <-ctx.Done():
+	}
+	err = simulator.stop()
+	slog.Info("Playback stopped.", "scenario", name, "seconds", int(time.Since(started).Seconds()))
+	return err
+}
+
+// BEGIN SHARED BLOCK config, see port/platform/common/automation/go_shared
+// Overrides of fields of the configuration given with -set
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("must be of the form name=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// Add the line and column to an error from decoding the JSON
+// configuration, since a byte offset isn't much help to anyone
+func configError(contents []byte, err error) error {
+	var offset int64 = -1
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+		err = fmt.Errorf("%q must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	if offset < 0 || offset > int64(len(contents)) {
+		return err
+	}
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(contents[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// Set a field of the configuration from text, finding it by its
+// JSON name, with a "." between the names of nested fields; the
+// case of a name, and "_" rather than "-", don't matter, so that
+// the names can come from environment variables
+func configSet(config interface{}, name string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s: %q is not an object", name, part)
+		}
+		found := false
+		for x := 0; !found && x < field.NumField(); x++ {
+			tag := strings.Split(field.Type().Field(x).Tag.Get("json"), ",")[0]
+			if tag != "" && strings.EqualFold(strings.ReplaceAll(tag, "-", "_"), strings.ReplaceAll(part, "-", "_")) {
+				field = field.Field(x)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: there is no field %q in the configuration", name, part)
+		}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	// Anything else, numbers, booleans, lists or objects, as JSON,
+	// into a fresh value so that nothing of the old one is kept
+	fresh := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), fresh.Interface())
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(fresh.Elem())
+	return nil
+}
+
+// Load the JSON configuration and then apply overrides, first from
+// environment variables named UBXLIB_<TOOL>_<FIELD>, with "__" between
+// the names of nested fields, e.g. UBXLIB_DEVICE_TWIN_MQTT__BROKER,
+// then from -set name=value, so that a deployment need only record
+// how it differs from the checked-in configuration
+func configLoad(contents []byte, config interface{}, overrides []string) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		// Most likely a typo or a field from a newer version of the
+		// tool: worth knowing about but not worth stopping for
+		slog.Warn("Unknown field in the configuration, ignored.", "error", err)
+		err = json.Unmarshal(contents, config)
+	}
+	if err != nil {
+		return configError(contents, err)
+	}
+	prefix := "UBXLIB_" + strings.ToUpper(versionInfo().Tool) + "_"
+	var environment []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			environment = append(environment, strings.TrimPrefix(variable, prefix))
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		nameValue := strings.SplitN(variable, "=", 2)
+		// Only the name is logged since the value may be a secret
+		err = configSet(config, strings.ReplaceAll(nameValue[0], "__", "."), nameValue[1])
+		if err != nil {
+			// Could be meant for another tool with a longer name
+			slog.Warn("Environment variable not applied to the configuration.", "variable", prefix+nameValue[0], "error", err)
+		} else {
+			slog.Info("Configuration overridden from the environment.", "variable", prefix+nameValue[0])
+		}
+	}
+	for _, override := range overrides {
+		nameValue := strings.SplitN(override, "=", 2)
+		err = configSet(config, nameValue[0], nameValue[1])
+		if err != nil {
+			return fmt.Errorf("-set %w", err)
+		}
+		slog.Info("Configuration overridden.", "field", nameValue[0])
+	}
+	return nil
+}
+
+// END SHARED BLOCK config
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"labsat", "tcp", "exec"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "gnss_sim_control", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "gnss_sim_control")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+// BEGIN SHARED BLOCK retry, see port/platform/common/automation/go_shared
+// Retries, the same in all of the test tools, in place of fixed
+// sleeps: each delay is double the one before, up to a maximum, less
+// up to a half at random so that many clients don't retry in step
+const retryInitialMs = 500
+const retryMaxMs = 30000
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Start again from the initial delay, e.g. once a connection has
+// stayed up for a while
+func (b *backoff) reset() {
+	b.next = b.initial
+}
+
+// Wait for the next delay, returning false if the tool is asked to
+// stop in the meantime
+func (b *backoff) wait() bool {
+	timer := time.NewTimer(b.delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+// An error that trying again won't fix, e.g. a refusal rather than a
+// failure to connect
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// Call operation up to attempts times, backing off between attempts,
+// each attempt being given a context that is done after timeout or
+// when the tool is asked to stop; a permanent error isn't retried
+func retry(name string, attempts int, timeout time.Duration, operation func(ctx context.Context) error) error {
+	b := newBackoff(retryInitialMs*time.Millisecond, retryMaxMs*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(runContext(), timeout)
+		err := operation(ctx)
+		cancel()
+		var isPermanent permanentError
+		if err == nil || errors.As(err, &isPermanent) || attempt >= attempts {
+			return err
+		}
+		slog.Warn("Failed, trying again.", "operation", name, "attempt", attempt, "error", err)
+		if !b.wait() {
+			return err
+		}
+	}
+}
+
+// END SHARED BLOCK retry
+
+func main() {
+	defer recoverPanic()
+
+	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration.")
+	var overrides configOverrides
+	flag.Var(&overrides, "set", "Override a field of the configuration with name=value, name being the JSON name, with . between nested names; may be repeated.")
+	printConfig := flag.Bool("print_config", false, "Print the configuration, with any overrides applied, and exit.")
+	deviceName := flag.String("device", "", "Name of the simulator in the configuration to use, default the first.")
+	scenarioName := flag.String("scenario", "", "Name of a scenario in the configuration to play.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	byteValue, err := ioutil.ReadFile(*configLocation)
+	if err != nil {
+		logFatal("Failed to open file.", "error", err)
+	}
+
+	var config Argument
+	err = configLoad(byteValue, &config, overrides)
+	if err != nil {
+		logFatal("Invalid configuration.", "file", *configLocation, "error", err)
+	}
+	if *printConfig {
+		contents, _ := json.MarshalIndent(config, "", "    ")
+		fmt.Println(string(contents))
+		return
+	}
+
+	var scenario Scenario
+	if *scenarioName != "" {
+		var ok bool
+		scenario, ok = config.Scenarios[*scenarioName]
+		if !ok {
+			logFatal("No such scenario in the configuration.", "scenario", *scenarioName)
+		}
+		if *deviceName == "" {
+			*deviceName = scenario.Device
+		}
+	} else if flag.NArg() == 0 {
+		logFatal("Nothing to do: give either -scenario or a command.")
+	}
+
+	device, err := findDevice(config, *deviceName)
+	if err != nil {
+		logFatal("Bad device.", "error", err)
+	}
+	simulator, err := openDevice(device)
+	if err != nil {
+		logFatal("Unable to open simulator.", "device", device.Name, "error", err)
+	}
+	defer simulator.close()
+
+	if *scenarioName != "" {
+		err = runScenario(*scenarioName, scenario, simulator)
+	} else {
+		// A single command: "play <file> [<attenuation dB>]" plays
+		// until this tool is stopped, "stop" and "status" do what
+		// they say
+		args := flag.Args()
+		switch {
+		case args[0] == "play" && (len(args) == 2 || len(args) == 3):
+			scenario = Scenario{File: args[1]}
+			if len(args) == 3 {
+				_, err = fmt.Sscan(args[2], &scenario.AttenuationDb)
+			}
+			if err == nil {
+				err = runScenario(args[1], scenario, simulator)
+			}
+		case args[0] == "stop" && len(args) == 1:
+			err = simulator.stop()
+		case args[0] == "status" && len(args) == 1:
+			var status string
+			status, err = simulator.status()
+			if err == nil {
+				fmt.Printf("%s %s\n", device.Name, status)
+			}
+		default:
+			err = fmt.Errorf("usage: play <file> [<attenuation dB>] | stop | status")
+		}
+	}
+	if err != nil {
+		simulator.close()
+		logFatal("Command failed.", "device", device.Name, "error", err)
+	}
+}
@@ -0,0 +1,431 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Each of the go test tools is a single file, run with "go run", so
+// code that is the same in all of them, e.g. the shutdown handling or
+// the loading of the configuration, can't be a package that they
+// import; instead each tool has a copy of the block of code between a
+// BEGIN and an END marker line, and the canonical copy of a block
+// named NAME is NAME.go.txt in this directory
+const blockSuffix = ".go.txt"
+
+var beginMarker = regexp.MustCompile(`^// BEGIN SHARED BLOCK (\w+)`)
+var endMarker = regexp.MustCompile(`^// END SHARED BLOCK (\w+)`)
+
+// A copy of a block in a tool: the lines between the markers, less
+// the blank line that gofmt puts before the END marker; firstLine is
+// numbered from 1 and length includes the blank line
+type blockCopy struct {
+	name      string
+	firstLine int
+	length    int
+	lines     []string
+}
+
+// Read the canonical blocks from a directory, keyed by name
+func loadBlocks(directory string) (map[string][]string, error) {
+	blocks := make(map[string][]string)
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), blockSuffix) {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(directory, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		blocks[strings.TrimSuffix(entry.Name(), blockSuffix)] = strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	}
+	return blocks, nil
+}
+
+// Find the copies of blocks in the lines of a file
+func findCopies(lines []string) ([]blockCopy, error) {
+	var copies []blockCopy
+	var current *blockCopy
+	for x, line := range lines {
+		if match := beginMarker.FindStringSubmatch(line); match != nil {
+			if current != nil {
+				return nil, fmt.Errorf("line %d: block %s begins inside block %s", x+1, match[1], current.name)
+			}
+			current = &blockCopy{name: match[1], firstLine: x + 2}
+			continue
+		}
+		if match := endMarker.FindStringSubmatch(line); match != nil {
+			if current == nil || current.name != match[1] {
+				return nil, fmt.Errorf("line %d: end of block %s that hasn't begun", x+1, match[1])
+			}
+			current.length = len(current.lines)
+			if current.length > 0 && current.lines[current.length-1] == "" {
+				current.lines = current.lines[:current.length-1]
+			}
+			copies = append(copies, *current)
+			current = nil
+			continue
+		}
+		if current != nil {
+			current.lines = append(current.lines, line)
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("block %s has no end", current.name)
+	}
+	return copies, nil
+}
+
+// The index of the first line that differs, or -1 if there is none
+func firstDifference(a []string, b []string) int {
+	for x := 0; x < len(a) || x < len(b); x++ {
+		if x >= len(a) || x >= len(b) || a[x] != b[x] {
+			return x
+		}
+	}
+	return -1
+}
+
+// Check, and if update is true correct, the copies of the blocks in a
+// file, printing a line for each problem, returning the number of
+// copies and the number of problems
+func checkFile(fileName string, displayName string, blocks map[string][]string, update bool,
+	found map[string]int) (int, int, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	lines := strings.Split(string(contents), "\n")
+	copies, err := findCopies(lines)
+	if err != nil {
+		fmt.Printf("%s: %v\n", displayName, err)
+		return 0, 1, nil
+	}
+	problems := 0
+	changed := false
+	// Backwards, so that replacing a block doesn't move those before it
+	for x := len(copies) - 1; x >= 0; x-- {
+		c := copies[x]
+		found[c.name]++
+		canonical, ok := blocks[c.name]
+		if !ok {
+			fmt.Printf("%s:%d: unknown block %s\n", displayName, c.firstLine-1, c.name)
+			problems++
+			continue
+		}
+		difference := firstDifference(c.lines, canonical)
+		if difference < 0 {
+			continue
+		}
+		if update {
+			fmt.Printf("%s:%d: block %s updated\n", displayName, c.firstLine-1, c.name)
+			start := c.firstLine - 1
+			replacement := append(append([]string(nil), canonical...), "")
+			lines = append(lines[:start], append(replacement, lines[start+c.length:]...)...)
+			changed = true
+		} else {
+			fmt.Printf("%s:%d: block %s differs from %s%s\n", displayName, c.firstLine+difference, c.name, c.name, blockSuffix)
+			problems++
+		}
+	}
+	if changed {
+		temporary := fileName + ".tmp"
+		err = ioutil.WriteFile(temporary, []byte(strings.Join(lines, "\n")), 0644)
+		if err == nil {
+			err = os.Rename(temporary, fileName)
+		}
+	}
+	return len(copies), problems, err
+}
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"check", "update"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "go_shared", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "go_shared")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+func main() {
+	defer recoverPanic()
+
+	root := flag.String("root", "../../../../..", "The ubxlib directory, searched for go files with copies of the blocks.")
+	directory := flag.String("blocks", ".", "The directory containing the canonical blocks.")
+	update := flag.Bool("update", false, "Replace any copy that differs with the canonical block, rather than failing.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	blocks, err := loadBlocks(*directory)
+	if err != nil {
+		logFatal("Unable to read the blocks.", "directory", *directory, "error", err)
+	}
+	if len(blocks) == 0 {
+		logFatal("No blocks found.", "directory", *directory)
+	}
+
+	files := 0
+	copies := 0
+	problems := 0
+	found := make(map[string]int)
+	err = filepath.WalkDir(*root, func(fileName string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if entry.IsDir() || !strings.HasSuffix(fileName, ".go") {
+			return nil
+		}
+		displayName, _ := filepath.Rel(*root, fileName)
+		fileCopies, fileProblems, err := checkFile(fileName, filepath.ToSlash(displayName), blocks, *update, found)
+		if fileCopies > 0 {
+			files++
+		}
+		copies += fileCopies
+		problems += fileProblems
+		return err
+	})
+	if err != nil {
+		logFatal("Unable to check files.", "root", *root, "error", err)
+	}
+	var names []string
+	for name := range blocks {
+		names = append(names, name)
+		if found[name] == 0 {
+			slog.Warn("No copies of block.", "block", name)
+		}
+	}
+	sort.Strings(names)
+	slog.Info("Checked.", "blocks", strings.Join(names, ","), "files", files, "copies", copies, "problems", problems)
+	if problems > 0 {
+		exit(exitFailure)
+	}
+	exit(exitOk)
+}
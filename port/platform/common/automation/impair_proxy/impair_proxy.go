@@ -0,0 +1,2212 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const bufferLength = 4096
+const udpIdleTimeoutSecond = 60
+const dialTimeoutSecond = 10
+const vaultTimeoutSecond = 30
+const vaultAttempts = 3
+const rateLimitForgetSecond = 600
+const traceQueueSize = 4096
+const traceBatchSize = 256
+const traceFlushSecond = 5
+
+// The page served at / of the control port
+//
+//go:embed ui.html
+var uiAssets embed.FS
+
+// Impairment struct for JSON configuration: what is done to the
+// traffic in each direction of a route
+type Impairment struct {
+	LatencyMs       int     `json:"latency-ms"`
+	JitterMs        int     `json:"jitter-ms"`
+	LossPercent     float64 `json:"loss-percent"`
+	BandwidthBps    int     `json:"bandwidth-bps"`
+	ResetPercent    float64 `json:"reset-percent"`
+	ResetAfterBytes int     `json:"reset-after-bytes"`
+	CorruptPercent  float64 `json:"corrupt-percent"`
+	AfterMessages   int     `json:"after-messages"`
+}
+
+// Step struct for JSON configuration: a change of impairment
+// a given time after the proxy starts
+type Step struct {
+	AfterMs    int        `json:"after-ms"`
+	Impairment Impairment `json:"impairment"`
+}
+
+// Route struct for JSON configuration: a port to listen on and
+// the server that traffic to it is forwarded to
+type Route struct {
+	Name           string     `json:"name"`
+	Protocol       string     `json:"protocol"`
+	ListenPort     string     `json:"listen-port"`
+	Target         string     `json:"target"`
+	Impairment     Impairment `json:"impairment"`
+	Schedule       []Step     `json:"schedule"`
+	SchedulePeriod int        `json:"schedule-period-ms"`
+	Record         string     `json:"record"`
+	Replay         string     `json:"replay"`
+}
+
+// Argument struct for JSON configuration
+type Argument struct {
+	ControlPort      string      `json:"control-port"`
+	HttpOptions      HttpOptions `json:"http-options"`
+	HostBandwidthBps int         `json:"host-bandwidth-bps"`
+	Routes           []Route     `json:"routes"`
+}
+
+// HostStatus is what the control port reports for the link shared by
+// all routes
+type HostStatus struct {
+	BandwidthBps int   `json:"bandwidth-bps"`
+	Bytes        int64 `json:"bytes"`
+	BacklogMs    int64 `json:"backlog-ms"`
+}
+
+// The number of connections and sessions, of all routes, kept for
+// GET /connections
+const recentConnectionsLength = 50
+
+// RecentConnection is a connection or session, open or closed, as
+// reported by the control port; Bytes is only known for a TCP
+// connection once it has closed
+type RecentConnection struct {
+	Route    string     `json:"route"`
+	Protocol string     `json:"protocol"`
+	Remote   string     `json:"remote"`
+	Session  string     `json:"client-session,omitempty"`
+	Opened   time.Time  `json:"opened"`
+	Closed   *time.Time `json:"closed,omitempty"`
+	Bytes    int64      `json:"bytes,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// The most recent connections and sessions, oldest overwritten first
+type recentList struct {
+	mutex   sync.Mutex
+	entries []*RecentConnection
+	next    int
+}
+
+var recent recentList
+
+func (l *recentList) opened(route string, protocol string, remote string) *RecentConnection {
+	c := &RecentConnection{Route: route, Protocol: protocol, Remote: remote, Opened: time.Now().UTC()}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.entries) < recentConnectionsLength {
+		l.entries = append(l.entries, c)
+	} else {
+		l.entries[l.next] = c
+	}
+	l.next = (l.next + 1) % recentConnectionsLength
+	return c
+}
+
+func (l *recentList) closed(c *RecentConnection, bytes int64, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	closed := time.Now().UTC()
+	c.Closed = &closed
+	c.Bytes = bytes
+	if err != nil {
+		c.Error = err.Error()
+	}
+}
+
+// Set the client session of the open connection or session of a route
+// with the given remote address
+func (l *recentList) setSession(route string, remote string, session string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, c := range l.entries {
+		if c.Route == route && c.Remote == remote && c.Closed == nil {
+			c.Session = session
+		}
+	}
+}
+
+// The connections and sessions, newest first
+func (l *recentList) list() []RecentConnection {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	list := make([]RecentConnection, 0, len(l.entries))
+	for x := 1; x <= len(l.entries); x++ {
+		list = append(list, *l.entries[(l.next-x+len(l.entries))%len(l.entries)])
+	}
+	return list
+}
+
+// RouteStatus is what the control port reports for a route
+type RouteStatus struct {
+	Route       Route `json:"route"`
+	Connections int   `json:"connections"`
+	Bytes       int64 `json:"bytes"`
+	Dropped     int64 `json:"dropped"`
+	Resets      int64 `json:"resets"`
+	Corrupted   int64 `json:"corrupted"`
+}
+
+type proxy struct {
+	mutex       sync.Mutex
+	route       Route
+	connections int
+	bytes       int64
+	dropped     int64
+	resets      int64
+	corrupted   int64
+	// Chunks or datagrams since the impairment was set, for
+	// after-messages
+	messages int
+	// The open connections or sessions, so that they can be closed
+	// when stopping
+	open     map[io.Closer]bool
+	openDone sync.WaitGroup
+	// The capture played back, if the route replays one, and the
+	// number of captures recorded
+	replay     []Record
+	recordings int
+}
+
+// Keep track of an open connection or session, returning false if
+// the proxy is stopping and it should be closed straight away
+func (p *proxy) track(c io.Closer) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if runContext().Err() != nil {
+		return false
+	}
+	if p.open == nil {
+		p.open = make(map[io.Closer]bool)
+	}
+	p.open[c] = true
+	p.openDone.Add(1)
+	return true
+}
+
+func (p *proxy) untrack(c io.Closer) {
+	p.mutex.Lock()
+	delete(p.open, c)
+	p.mutex.Unlock()
+	p.openDone.Done()
+}
+
+// Stop listening, close whatever is open and wait for it to be done
+func (p *proxy) stop(ctx context.Context, listener io.Closer) {
+	listener.Close()
+	p.mutex.Lock()
+	for c := range p.open {
+		c.Close()
+	}
+	p.mutex.Unlock()
+	closed := make(chan struct{})
+	go func() {
+		p.openDone.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+	}
+}
+
+func (p *proxy) impairment() Impairment {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.route.Impairment
+}
+
+// The impairment for the next chunk of data or datagram: none until
+// after-messages of them have passed since the impairment was set
+func (p *proxy) nextImpairment() Impairment {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.messages++
+	if p.messages <= p.route.Impairment.AfterMessages {
+		return Impairment{}
+	}
+	return p.route.Impairment
+}
+
+func (p *proxy) setImpairment(impairment Impairment) {
+	changeSpan := traceStart("impairment change", spanKindInternal, nil)
+	changeSpan.set("route", p.route.Name)
+	changeSpan.set("impairment", fmt.Sprintf("%+v", impairment))
+	p.mutex.Lock()
+	p.route.Impairment = impairment
+	p.messages = 0
+	p.mutex.Unlock()
+	changeSpan.end(nil)
+	slog.Info("Impairment changed.", "route", p.route.Name, "impairment", fmt.Sprintf("%+v", impairment))
+	eventPublish("impairment-changed", "", "route", p.route.Name, "impairment", impairment)
+}
+
+func (p *proxy) count(connections int, bytes int, dropped int, resets int, corrupted int) {
+	p.mutex.Lock()
+	p.connections += connections
+	p.bytes += int64(bytes)
+	p.dropped += int64(dropped)
+	p.resets += int64(resets)
+	p.corrupted += int64(corrupted)
+	p.mutex.Unlock()
+}
+
+func (p *proxy) status() RouteStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return RouteStatus{Route: p.route, Connections: p.connections, Bytes: p.bytes,
+		Dropped: p.dropped, Resets: p.resets, Corrupted: p.corrupted}
+}
+
+// Reset all of the TCP connections of a route now, e.g. to see what a
+// device does when the server goes away part way through an exchange,
+// returning how many there were
+func (p *proxy) resetAll() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	resets := 0
+	for c := range p.open {
+		if connection, ok := c.(*net.TCPConn); ok {
+			reset(connection)
+			resets++
+		}
+	}
+	p.resets += int64(resets)
+	return resets
+}
+
+// Flip a bit at random, as a faulty link or buffer might, returning
+// true if the impairment says the data should be corrupted
+func corrupt(impairment Impairment, data []byte) bool {
+	if len(data) == 0 || impairment.CorruptPercent <= 0 || rand.Float64()*100 >= impairment.CorruptPercent {
+		return false
+	}
+	data[rand.Intn(len(data))] ^= 1 << rand.Intn(8)
+	return true
+}
+
+// Work out when a chunk of data may be delivered: after the latency
+// plus some jitter, not before the previous chunk if order matters,
+// and not before the link has finished sending the previous chunk at
+// the capped bandwidth
+type shaper struct {
+	lastDelivery time.Time
+	linkFree     time.Time
+	// True for data going towards the device, which also has to pass
+	// through the link of the host
+	egress bool
+}
+
+func (s *shaper) deliveryTime(impairment Impairment, length int, keepOrder bool) time.Time {
+	now := time.Now()
+	delay := time.Duration(impairment.LatencyMs) * time.Millisecond
+	if impairment.JitterMs > 0 {
+		delay += time.Duration(rand.Intn(impairment.JitterMs*2+1)-impairment.JitterMs) * time.Millisecond
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	at := now.Add(delay)
+	if impairment.BandwidthBps > 0 {
+		start := now
+		if s.linkFree.After(start) {
+			start = s.linkFree
+		}
+		s.linkFree = start.Add(time.Duration(int64(length) * 8 * int64(time.Second) / int64(impairment.BandwidthBps)))
+		if s.linkFree.After(at) {
+			at = s.linkFree
+		}
+	}
+	if s.egress {
+		// The host link takes the data once the link of the route
+		// has finished with it
+		start := now
+		if s.linkFree.After(start) {
+			start = s.linkFree
+		}
+		if sent := host.transmit(start, length); sent.After(at) {
+			at = sent
+		}
+	}
+	if keepOrder && s.lastDelivery.After(at) {
+		at = s.lastDelivery
+	}
+	s.lastDelivery = at
+	return at
+}
+
+// The link between the host and the devices, shared by all routes:
+// if it has a bandwidth, everything sent towards the devices queues
+// for it after the impairment of its own route, so that the combined
+// egress of the servers is capped, as it would be by a constrained
+// backhaul, and a route sending a lot delays the others
+type hostLink struct {
+	mutex        sync.Mutex
+	bandwidthBps int
+	free         time.Time
+	bytes        int64
+}
+
+var host hostLink
+
+// When data which is ready to go at the given time has been sent
+func (h *hostLink) transmit(ready time.Time, length int) time.Time {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.bytes += int64(length)
+	if h.bandwidthBps <= 0 {
+		return ready
+	}
+	if h.free.After(ready) {
+		ready = h.free
+	}
+	h.free = ready.Add(time.Duration(int64(length) * 8 * int64(time.Second) / int64(h.bandwidthBps)))
+	return h.free
+}
+
+func (h *hostLink) setBandwidth(bandwidthBps int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.bandwidthBps = bandwidthBps
+}
+
+func (h *hostLink) status() HostStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	status := HostStatus{BandwidthBps: h.bandwidthBps, Bytes: h.bytes}
+	if backlog := time.Until(h.free); backlog > 0 {
+		status.BacklogMs = backlog.Milliseconds()
+	}
+	return status
+}
+
+type chunk struct {
+	data []byte
+	at   time.Time
+}
+
+// BEGIN SHARED BLOCK session, see port/platform/common/automation/go_shared
+// A device may tag the data it sends with its test session ID, e.g.
+// "UBXLIB_SESSION=1234", so that what is logged here can be matched
+// up with the test that sent it, as X-Session-Id does for HTTP
+var sessionTag = regexp.MustCompile(`UBXLIB_SESSION=([A-Za-z0-9_.:-]{1,64})`)
+
+// The test session ID that the data is tagged with, empty if none
+func clientSession(data []byte) string {
+	match := sessionTag.FindSubmatch(data)
+	if match == nil {
+		return ""
+	}
+	return string(match[1])
+}
+
+// END SHARED BLOCK session
+
+// Reset a TCP connection, rather than closing it cleanly, so that the
+// other end sees an RST
+func reset(connection net.Conn) {
+	if tcpConnection, ok := connection.(*net.TCPConn); ok {
+		tcpConnection.SetLinger(0)
+	}
+	connection.Close()
+}
+
+// Copy one direction of a TCP connection, impaired; loss doesn't apply
+// since TCP would only retransmit, latency, jitter and bandwidth do and
+// the connection may be reset at random or after a number of bytes
+func (p *proxy) pipe(from net.Conn, to net.Conn, direction string, total *int64, totalMutex *sync.Mutex,
+	connectionSpan *span, rec *recorder, done chan<- struct{}) {
+	chunks := make(chan chunk, 1024)
+	failed := make(chan struct{})
+	go func() {
+		defer close(failed)
+		for c := range chunks {
+			time.Sleep(time.Until(c.at))
+			_, err := to.Write(c.data)
+			if err != nil {
+				return
+			}
+		}
+		if tcpConnection, ok := to.(*net.TCPConn); ok {
+			tcpConnection.CloseWrite()
+		}
+	}()
+	s := shaper{egress: direction == "down"}
+	var session string
+	buffer := make([]byte, bufferLength)
+	for {
+		length, err := from.Read(buffer)
+		if length > 0 {
+			if direction == "up" && session == "" {
+				session = clientSession(buffer[:length])
+				if session != "" {
+					slog.Info("Client session.", "route", p.route.Name, "remote", from.RemoteAddr().String(),
+						"client-session", session)
+					connectionSpan.set("client.session", session)
+					recent.setSession(p.route.Name, from.RemoteAddr().String(), session)
+				}
+			}
+			impairment := p.nextImpairment()
+			totalMutex.Lock()
+			*total += int64(length)
+			sent := *total
+			totalMutex.Unlock()
+			if (impairment.ResetPercent > 0 && rand.Float64()*100 < impairment.ResetPercent) ||
+				(impairment.ResetAfterBytes > 0 && sent >= int64(impairment.ResetAfterBytes)) {
+				slog.Info("Resetting connection.", "route", p.route.Name, "remote", from.RemoteAddr().String(),
+					"direction", direction, "bytes", sent)
+				p.count(0, 0, 0, 1, 0)
+				connectionSpan.event("reset " + direction)
+				eventPublish("fault-injected", session, "route", p.route.Name, "remote", from.RemoteAddr().String(),
+					"fault", "reset", "direction", direction)
+				reset(from)
+				reset(to)
+				break
+			}
+			data := make([]byte, length)
+			copy(data, buffer[:length])
+			rec.record(direction, data)
+			p.count(0, length, 0, 0, 0)
+			slog.Debug("Data.", "route", p.route.Name, "direction", direction, "length", length)
+			if corrupt(impairment, data) {
+				p.count(0, 0, 0, 0, 1)
+				connectionSpan.event("corrupted " + direction)
+				slog.Debug("Data corrupted.", "route", p.route.Name, "direction", direction, "length", length)
+				eventPublish("fault-injected", session, "route", p.route.Name, "remote", from.RemoteAddr().String(),
+					"fault", "corrupt", "direction", direction)
+			}
+			select {
+			case chunks <- chunk{data: data, at: s.deliveryTime(impairment, length, true)}:
+			case <-failed:
+				err = net.ErrClosed
+			}
+		}
+		if err != nil {
+			rec.record(direction, nil)
+			break
+		}
+	}
+	close(chunks)
+	<-failed
+	done <- struct{}{}
+}
+
+func (p *proxy) serveTcp(listener net.Listener) {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if runContext().Err() == nil {
+				slog.Error("Accept failed.", "route", p.route.Name, "error", err)
+			}
+			return
+		}
+		go func(client net.Conn) {
+			defer recoverPanic()
+			defer client.Close()
+			if !p.track(client) {
+				return
+			}
+			defer p.untrack(client)
+			connectionSpan := traceStart("connection", spanKindServer, nil)
+			connectionSpan.set("route", p.route.Name)
+			connectionSpan.set("network.peer.address", client.RemoteAddr().String())
+			connectionSpan.set("impairment", fmt.Sprintf("%+v", p.impairment()))
+			entry := recent.opened(p.route.Name, "tcp", client.RemoteAddr().String())
+			if p.replay != nil {
+				slog.Info("Connection opened, replaying.", "route", p.route.Name, "remote", client.RemoteAddr().String())
+				p.count(1, 0, 0, 0, 0)
+				total := p.replayTcp(client, connectionSpan)
+				p.count(-1, 0, 0, 0, 0)
+				recent.closed(entry, total, nil)
+				connectionSpan.set("bytes", total)
+				connectionSpan.end(nil)
+				slog.Info("Connection closed.", "route", p.route.Name, "remote", client.RemoteAddr().String(), "bytes", total)
+				return
+			}
+			connectSpan := traceStart("connect to target", spanKindInternal, connectionSpan)
+			connectSpan.set("target", p.route.Target)
+			server, err := net.DialTimeout("tcp", p.route.Target, dialTimeoutSecond*time.Second)
+			connectSpan.end(err)
+			if err != nil {
+				slog.Error("Unable to connect to target.", "route", p.route.Name, "target", p.route.Target, "error", err)
+				connectionSpan.end(err)
+				recent.closed(entry, 0, err)
+				return
+			}
+			defer server.Close()
+			slog.Info("Connection opened.", "route", p.route.Name, "remote", client.RemoteAddr().String())
+			eventPublish("connection-opened", "", "route", p.route.Name, "remote", client.RemoteAddr().String())
+			p.count(1, 0, 0, 0, 0)
+			var total int64
+			var totalMutex sync.Mutex
+			done := make(chan struct{}, 2)
+			rec := p.startRecording(client.RemoteAddr().String())
+			defer rec.close()
+			go p.pipe(client, server, "up", &total, &totalMutex, connectionSpan, rec, done)
+			go p.pipe(server, client, "down", &total, &totalMutex, connectionSpan, rec, done)
+			<-done
+			<-done
+			p.count(-1, 0, 0, 0, 0)
+			recent.closed(entry, total, nil)
+			connectionSpan.set("bytes", total)
+			connectionSpan.end(nil)
+			slog.Info("Connection closed.", "route", p.route.Name, "remote", client.RemoteAddr().String(), "bytes", total)
+			eventPublish("connection-closed", "", "route", p.route.Name, "remote", client.RemoteAddr().String(), "bytes", total)
+		}(client)
+	}
+}
+
+// Send a datagram impaired: it may be lost, is delayed and, as real
+// networks may, can be re-ordered by jitter
+func (p *proxy) sendDatagram(s *shaper, mutex *sync.Mutex, data []byte, send func([]byte)) bool {
+	impairment := p.nextImpairment()
+	if impairment.LossPercent > 0 && rand.Float64()*100 < impairment.LossPercent {
+		p.count(0, 0, 1, 0, 0)
+		slog.Debug("Datagram dropped.", "route", p.route.Name, "length", len(data))
+		eventPublish("fault-injected", "", "route", p.route.Name, "fault", "loss")
+		return false
+	}
+	p.count(0, len(data), 0, 0, 0)
+	if corrupt(impairment, data) {
+		p.count(0, 0, 0, 0, 1)
+		slog.Debug("Datagram corrupted.", "route", p.route.Name, "length", len(data))
+		eventPublish("fault-injected", "", "route", p.route.Name, "fault", "corrupt")
+	}
+	mutex.Lock()
+	at := s.deliveryTime(impairment, len(data), false)
+	mutex.Unlock()
+	time.AfterFunc(time.Until(at), func() { send(data) })
+	return true
+}
+
+type udpSession struct {
+	server   *net.UDPConn
+	recent   *RecentConnection
+	lastUsed time.Time
+	shaper   shaper
+	mutex    sync.Mutex
+	span     *span
+	dropped  int64
+	recorder *recorder
+	session  string
+}
+
+func (p *proxy) serveUdp(listener *net.UDPConn) {
+	target, err := net.ResolveUDPAddr("udp", p.route.Target)
+	if err != nil {
+		slog.Error("Unable to resolve target.", "route", p.route.Name, "target", p.route.Target, "error", err)
+		return
+	}
+	sessions := make(map[string]*udpSession)
+	var sessionsMutex sync.Mutex
+	var upShaper shaper
+	var upMutex sync.Mutex
+	buffer := make([]byte, 65536)
+	for {
+		length, client, err := listener.ReadFromUDP(buffer)
+		if err != nil {
+			if runContext().Err() == nil {
+				slog.Error("Read failed.", "route", p.route.Name, "error", err)
+			}
+			return
+		}
+		key := client.String()
+		sessionsMutex.Lock()
+		session := sessions[key]
+		if session == nil {
+			server, err := net.DialUDP("udp", nil, target)
+			if err != nil {
+				sessionsMutex.Unlock()
+				slog.Error("Unable to open socket to target.", "route", p.route.Name, "error", err)
+				continue
+			}
+			if !p.track(server) {
+				sessionsMutex.Unlock()
+				server.Close()
+				continue
+			}
+			session = &udpSession{server: server, span: traceStart("session", spanKindServer, nil),
+				recorder: p.startRecording(key), shaper: shaper{egress: true}}
+			session.span.set("route", p.route.Name)
+			session.span.set("network.peer.address", key)
+			session.span.set("impairment", fmt.Sprintf("%+v", p.impairment()))
+			sessions[key] = session
+			session.recent = recent.opened(p.route.Name, "udp", key)
+			p.count(1, 0, 0, 0, 0)
+			slog.Info("Session opened.", "route", p.route.Name, "remote", key)
+			eventPublish("session-opened", "", "route", p.route.Name, "remote", key)
+			// Relay whatever comes back until the session is idle
+			go func(session *udpSession, client *net.UDPAddr) {
+				defer recoverPanic()
+				buffer := make([]byte, 65536)
+				for {
+					session.server.SetReadDeadline(time.Now().Add(udpIdleTimeoutSecond * time.Second))
+					length, err := session.server.Read(buffer)
+					if err != nil {
+						sessionsMutex.Lock()
+						idle := time.Since(session.lastUsed) > udpIdleTimeoutSecond*time.Second
+						if idle || !isTimeout(err) {
+							delete(sessions, client.String())
+						}
+						sessionsMutex.Unlock()
+						if idle || !isTimeout(err) {
+							session.server.Close()
+							session.recorder.close()
+							p.untrack(session.server)
+							p.count(-1, 0, 0, 0, 0)
+							session.mutex.Lock()
+							session.span.set("dropped", session.dropped)
+							clientSession := session.session
+							session.mutex.Unlock()
+							session.span.end(nil)
+							recent.closed(session.recent, 0, nil)
+							slog.Info("Session closed.", "route", p.route.Name, "remote", client.String())
+							eventPublish("session-closed", clientSession, "route", p.route.Name, "remote", client.String())
+							return
+						}
+						continue
+					}
+					data := make([]byte, length)
+					copy(data, buffer[:length])
+					session.recorder.record("down", data)
+					if !p.sendDatagram(&session.shaper, &session.mutex, data, func(data []byte) {
+						listener.WriteToUDP(data, client)
+					}) {
+						session.mutex.Lock()
+						session.dropped++
+						session.mutex.Unlock()
+					}
+				}
+			}(session, client)
+		}
+		session.lastUsed = time.Now()
+		sessionsMutex.Unlock()
+		data := make([]byte, length)
+		copy(data, buffer[:length])
+		session.recorder.record("up", data)
+		// Only this loop sets session.session, but the relay reads it
+		if session.session == "" {
+			if found := clientSession(data); found != "" {
+				session.mutex.Lock()
+				session.session = found
+				session.mutex.Unlock()
+				slog.Info("Client session.", "route", p.route.Name, "remote", key, "client-session", found)
+				session.span.set("client.session", found)
+				recent.setSession(p.route.Name, key, found)
+			}
+		}
+		if !p.sendDatagram(&upShaper, &upMutex, data, func(data []byte) {
+			session.server.Write(data)
+		}) {
+			session.mutex.Lock()
+			session.dropped++
+			session.mutex.Unlock()
+		}
+	}
+}
+
+// Record struct for a capture file: a chunk of data, or a datagram,
+// seen on a connection or session, "up" being from the device and
+// "down" from the server; there is one line of JSON for each and a
+// TCP record with no data means that side closed the connection
+type Record struct {
+	OffsetMs  int64  `json:"offset-ms"`
+	Direction string `json:"direction"`
+	Data      []byte `json:"data"`
+}
+
+// Writes the records of one connection or session to a capture file
+type recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	start   time.Time
+}
+
+// Start a capture file for a connection or session, nil if the route
+// isn't recording
+func (p *proxy) startRecording(remote string) *recorder {
+	if p.route.Record == "" {
+		return nil
+	}
+	p.mutex.Lock()
+	p.recordings++
+	number := p.recordings
+	p.mutex.Unlock()
+	fileName := filepath.Join(p.route.Record, fmt.Sprintf("%s_%s_%d.jsonl", p.route.Name,
+		time.Now().UTC().Format("20060102T150405"), number))
+	err := os.MkdirAll(p.route.Record, 0755)
+	if err == nil {
+		var file *os.File
+		file, err = os.Create(fileName)
+		if err == nil {
+			slog.Info("Recording.", "route", p.route.Name, "remote", remote, "file", fileName)
+			return &recorder{file: file, encoder: json.NewEncoder(file), start: time.Now()}
+		}
+	}
+	slog.Error("Unable to start recording.", "route", p.route.Name, "file", fileName, "error", err)
+	return nil
+}
+
+// Add a record to the capture file, written straight away so that
+// nothing is lost if the proxy is stopped
+func (r *recorder) record(direction string, data []byte) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.encoder.Encode(Record{OffsetMs: time.Since(r.start).Milliseconds(), Direction: direction, Data: data})
+}
+
+func (r *recorder) close() {
+	if r != nil {
+		r.file.Close()
+	}
+}
+
+func captureLoad(location string) ([]Record, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []Record
+	decoder := json.NewDecoder(file)
+	for {
+		var record Record
+		err = decoder.Decode(&record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", len(records)+1, err)
+		}
+		if record.Direction != "up" && record.Direction != "down" {
+			return nil, fmt.Errorf("record %d: direction must be \"up\" or \"down\", not %q", len(records)+1, record.Direction)
+		}
+		records = append(records, record)
+	}
+}
+
+// Plays the server side of a capture back to one client: each "down"
+// record is sent once the client has sent all that came before it in
+// the capture, after the same gap as was recorded, so that an exchange
+// with a device, e.g. one that went wrong in the field, can be
+// repeated exactly without the server that took part in it
+type replayer struct {
+	route      string
+	remote     string
+	records    []Record
+	next       int
+	expected   []byte // Up data of the capture not yet matched
+	got        []byte // Data from the client not yet matched
+	received   int64
+	previousMs int64
+	at         time.Time
+	diverged   bool
+}
+
+// Given data received from the client, nil at the start, the data to
+// send back and when; a chunk with no data means close the connection
+func (r *replayer) advance(data []byte) []chunk {
+	if now := time.Now(); r.at.Before(now) {
+		r.at = now
+	}
+	r.got = append(r.got, data...)
+	r.received += int64(len(data))
+	var chunks []chunk
+	for r.next < len(r.records) && len(r.got) >= len(r.expected) {
+		record := r.records[r.next]
+		if record.Direction == "up" {
+			r.expected = append(r.expected, record.Data...)
+		} else {
+			r.at = r.at.Add(time.Duration(record.OffsetMs-r.previousMs) * time.Millisecond)
+			chunks = append(chunks, chunk{data: record.Data, at: r.at})
+		}
+		r.previousMs = record.OffsetMs
+		r.next++
+	}
+	common := min(len(r.got), len(r.expected))
+	if !r.diverged && (!bytes.Equal(r.got[:common], r.expected[:common]) ||
+		(r.next == len(r.records) && len(r.got) > len(r.expected))) {
+		// Worth knowing, since the replies may no longer make sense,
+		// but the replay carries on
+		r.diverged = true
+		slog.Warn("Client has sent something other than what was recorded.", "route", r.route,
+			"remote", r.remote, "bytes", r.received)
+	}
+	r.got = r.got[common:]
+	r.expected = r.expected[common:]
+	return chunks
+}
+
+func (p *proxy) replayTcp(client net.Conn, connectionSpan *span) int64 {
+	replay := &replayer{route: p.route.Name, remote: client.RemoteAddr().String(), records: p.replay}
+	chunks := make(chan chunk, 1024)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for c := range chunks {
+			select {
+			case <-time.After(time.Until(c.at)):
+			case <-stop:
+				return
+			}
+			if len(c.data) == 0 {
+				connectionSpan.event("closed by replay")
+				client.Close()
+				return
+			}
+			_, err := client.Write(c.data)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	s := shaper{egress: true}
+	var total int64
+	send := func(data []byte) bool {
+		for _, c := range replay.advance(data) {
+			// Impaired in the same way as data from a target,
+			// the capture itself being left as it is
+			impairment := p.nextImpairment()
+			c.data = append([]byte(nil), c.data...)
+			if corrupt(impairment, c.data) {
+				p.count(0, 0, 0, 0, 1)
+			}
+			c.at = c.at.Add(time.Until(s.deliveryTime(impairment, len(c.data), false)))
+			p.count(0, len(c.data), 0, 0, 0)
+			total += int64(len(c.data))
+			select {
+			case chunks <- c:
+			case <-done:
+				return false
+			}
+		}
+		return true
+	}
+	buffer := make([]byte, bufferLength)
+	for ok := send(nil); ok; {
+		length, err := client.Read(buffer)
+		if length > 0 {
+			p.count(0, length, 0, 0, 0)
+			total += int64(length)
+			slog.Debug("Data.", "route", p.route.Name, "direction", "up", "length", length)
+			ok = send(buffer[:length])
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(stop)
+	close(chunks)
+	<-done
+	return total
+}
+
+type replaySession struct {
+	replayer *replayer
+	recent   *RecentConnection
+	lastUsed time.Time
+	shaper   shaper
+	mutex    sync.Mutex
+}
+
+func (p *proxy) replayUdp(listener *net.UDPConn) {
+	sessions := make(map[string]*replaySession)
+	buffer := make([]byte, 65536)
+	for {
+		length, client, err := listener.ReadFromUDP(buffer)
+		if err != nil {
+			if runContext().Err() == nil {
+				slog.Error("Read failed.", "route", p.route.Name, "error", err)
+			}
+			return
+		}
+		for key, session := range sessions {
+			if time.Since(session.lastUsed) > udpIdleTimeoutSecond*time.Second {
+				delete(sessions, key)
+				recent.closed(session.recent, 0, nil)
+				p.count(-1, 0, 0, 0, 0)
+				slog.Info("Session closed.", "route", p.route.Name, "remote", key)
+			}
+		}
+		key := client.String()
+		session := sessions[key]
+		var chunks []chunk
+		if session == nil {
+			session = &replaySession{replayer: &replayer{route: p.route.Name, remote: key, records: p.replay},
+				shaper: shaper{egress: true}}
+			sessions[key] = session
+			session.recent = recent.opened(p.route.Name, "udp", key)
+			p.count(1, 0, 0, 0, 0)
+			slog.Info("Session opened.", "route", p.route.Name, "remote", key)
+			chunks = session.replayer.advance(nil)
+		}
+		session.lastUsed = time.Now()
+		p.count(0, length, 0, 0, 0)
+		chunks = append(chunks, session.replayer.advance(buffer[:length])...)
+		for _, c := range chunks {
+			if len(c.data) == 0 {
+				continue
+			}
+			data := append([]byte(nil), c.data...)
+			time.AfterFunc(time.Until(c.at), func() {
+				p.sendDatagram(&session.shaper, &session.mutex, data, func(data []byte) {
+					listener.WriteToUDP(data, client)
+				})
+			})
+		}
+	}
+}
+
+// BEGIN SHARED BLOCK event, see port/platform/common/automation/go_shared
+// Events, e.g. a connection being opened or a fault being injected,
+// are published to port/platform/common/automation/event_bus if the
+// environment variable UBXLIB_EVENT_BUS is set to its URL, so that a
+// test can wait for, or check the timing of, what a server saw; they
+// are sent straight away, batched if they come faster than they can
+// be sent
+const eventQueueSize = 4096
+const eventBatchSize = 256
+const eventTimeoutSecond = 5
+
+// Event is as published to the event bus
+type Event struct {
+	Time       time.Time              `json:"time"`
+	Source     string                 `json:"source"`
+	Type       string                 `json:"type"`
+	Session    string                 `json:"session,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+var eventBus = strings.TrimRight(os.Getenv("UBXLIB_EVENT_BUS"), "/")
+var eventSource string
+var eventQueue = make(chan Event, eventQueueSize)
+var eventFlushes = make(chan chan struct{})
+
+// Publish an event, the attributes given as name/value pairs, as for
+// slog; does nothing if there is no event bus and never blocks, the
+// event being dropped if the queue is full
+func eventPublish(eventType string, session string, args ...any) {
+	if eventBus == "" {
+		return
+	}
+	e := Event{Time: time.Now().UTC(), Source: eventSource, Type: eventType, Session: session}
+	if len(args) > 1 {
+		e.Attributes = make(map[string]interface{})
+		for x := 0; x+1 < len(args); x += 2 {
+			name, _ := args[x].(string)
+			e.Attributes[name] = args[x+1]
+		}
+	}
+	select {
+	case eventQueue <- e:
+	default:
+	}
+}
+
+func eventExport() {
+	if eventBus == "" {
+		return
+	}
+	// Where more than one instance of a tool runs, e.g. the plain
+	// and the secure echo servers, UBXLIB_EVENT_SOURCE tells them apart
+	eventSource = os.Getenv("UBXLIB_EVENT_SOURCE")
+	if eventSource == "" {
+		eventSource = versionInfo().Tool
+	}
+	onShutdown("event publishing", func(ctx context.Context) {
+		flushed := make(chan struct{})
+		select {
+		case eventFlushes <- flushed:
+			select {
+			case <-flushed:
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	})
+	go eventSend()
+}
+
+func eventSend() {
+	slog.Info("Publishing events.", "endpoint", eventBus, "source", eventSource)
+	client := &http.Client{Timeout: eventTimeoutSecond * time.Second}
+	token := os.Getenv("UBXLIB_HTTP_TOKEN")
+	for {
+		var batch []Event
+		var flushed chan struct{}
+		select {
+		case e := <-eventQueue:
+			batch = append(batch, e)
+		case flushed = <-eventFlushes:
+		}
+		for len(batch) < eventBatchSize && len(eventQueue) > 0 {
+			batch = append(batch, <-eventQueue)
+		}
+		if len(batch) > 0 {
+			body, _ := json.Marshal(batch)
+			request, err := http.NewRequest(http.MethodPost, eventBus+"/events", bytes.NewReader(body))
+			if err == nil {
+				request.Header.Set("Content-Type", "application/json")
+				if token != "" {
+					request.Header.Set("Authorization", "Bearer "+token)
+				}
+				var response *http.Response
+				response, err = client.Do(request)
+				if err == nil {
+					response.Body.Close()
+					if response.StatusCode/100 != 2 {
+						err = fmt.Errorf("event bus returned %s", response.Status)
+					}
+				}
+			}
+			if err != nil {
+				slog.Warn("Unable to publish events.", "endpoint", eventBus, "events", len(batch), "error", err)
+			}
+		}
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// END SHARED BLOCK event
+
+// BEGIN SHARED BLOCK trace, see port/platform/common/automation/go_shared
+// A minimal OpenTelemetry trace exporter, OTLP/HTTP with JSON encoding,
+// so that no third-party packages are needed: spans are sent to the
+// collector given by the standard environment variable
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (the full URL) or
+// OTEL_EXPORTER_OTLP_ENDPOINT (the base URL, to which /v1/traces is
+// added); if neither is set tracing is off and costs nothing
+type span struct {
+	traceId    string
+	spanId     string
+	parentId   string
+	name       string
+	kind       int
+	start      time.Time
+	attributes map[string]interface{}
+	events     []spanEvent
+	err        error
+	finish     time.Time
+	mutex      sync.Mutex
+}
+
+type spanEvent struct {
+	name string
+	time time.Time
+}
+
+// OpenTelemetry span kinds
+const spanKindInternal = 1
+const spanKindServer = 2
+
+var traceEndpoint = traceEndpointFromEnvironment()
+var traceSpans = make(chan *span, traceQueueSize)
+var traceFlushes = make(chan chan struct{})
+
+func traceEndpointFromEnvironment() string {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		endpoint = strings.TrimRight(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	}
+	return endpoint
+}
+
+func traceRandomId(size int) string {
+	id := make([]byte, size)
+	crand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Start a span, a child of parent if that isn't nil; returns nil,
+// which all of the span methods accept, if tracing is off
+func traceStart(name string, kind int, parent *span) *span {
+	if traceEndpoint == "" {
+		return nil
+	}
+	s := &span{spanId: traceRandomId(8), name: name, kind: kind, start: time.Now(),
+		attributes: make(map[string]interface{})}
+	if parent != nil {
+		s.traceId = parent.traceId
+		s.parentId = parent.spanId
+	} else {
+		s.traceId = traceRandomId(16)
+	}
+	return s
+}
+
+// Start a span as a child of the one given by a W3C traceparent header,
+// "00-<trace ID>-<parent span ID>-<flags>", so that the span joins the
+// trace of whoever made the request; a new trace if there is none
+func traceStartRemote(name string, kind int, traceparent string) *span {
+	s := traceStart(name, kind, nil)
+	parts := strings.Split(traceparent, "-")
+	if s != nil && len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		s.traceId = parts[1]
+		s.parentId = parts[2]
+	}
+	return s
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.mutex.Lock()
+		s.attributes[key] = value
+		s.mutex.Unlock()
+	}
+}
+
+func (s *span) event(name string) {
+	if s != nil {
+		s.mutex.Lock()
+		s.events = append(s.events, spanEvent{name, time.Now()})
+		s.mutex.Unlock()
+	}
+}
+
+// The trace ID, for log records, so that logs and traces can be matched
+func (s *span) trace() string {
+	if s == nil {
+		return ""
+	}
+	return s.traceId
+}
+
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.err = err
+	s.finish = time.Now()
+	s.mutex.Unlock()
+	select {
+	case traceSpans <- s:
+	default:
+		// Never hold up the server for the sake of tracing
+		slog.Debug("Trace queue full, span dropped.", "span", s.name)
+	}
+}
+
+func traceAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	var result []map[string]interface{}
+	for key, value := range attributes {
+		var typed map[string]interface{}
+		switch v := value.(type) {
+		case string:
+			typed = map[string]interface{}{"stringValue": v}
+		case bool:
+			typed = map[string]interface{}{"boolValue": v}
+		case int:
+			typed = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			typed = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			typed = map[string]interface{}{"doubleValue": v}
+		default:
+			typed = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]interface{}{"key": key, "value": typed})
+	}
+	return result
+}
+
+// A span in the form of OTLP/JSON
+func traceOtlp(s *span) map[string]interface{} {
+	otlp := map[string]interface{}{"traceId": s.traceId, "spanId": s.spanId, "name": s.name,
+		"kind": s.kind, "startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano": strconv.FormatInt(s.finish.UnixNano(), 10),
+		"attributes":      traceAttributes(s.attributes), "status": map[string]interface{}{"code": 1}}
+	if s.parentId != "" {
+		otlp["parentSpanId"] = s.parentId
+	}
+	if s.err != nil {
+		otlp["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+	}
+	var events []map[string]interface{}
+	for _, e := range s.events {
+		events = append(events, map[string]interface{}{"name": e.name,
+			"timeUnixNano": strconv.FormatInt(e.time.UnixNano(), 10)})
+	}
+	if events != nil {
+		otlp["events"] = events
+	}
+	return otlp
+}
+
+// Start sending spans to the collector in batches, every
+// traceFlushSecond or when a batch is full, for as long as the program
+// runs; whatever is left is sent when the program stops
+func traceExport() {
+	if traceEndpoint == "" {
+		return
+	}
+	onShutdown("trace export", func(ctx context.Context) {
+		flushed := make(chan struct{})
+		select {
+		case traceFlushes <- flushed:
+			select {
+			case <-flushed:
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	})
+	go traceSend()
+}
+
+func traceSend() {
+	slog.Info("Exporting traces.", "endpoint", traceEndpoint)
+	client := &http.Client{Timeout: traceFlushSecond * time.Second}
+	resource := map[string]interface{}{"attributes": traceAttributes(map[string]interface{}{
+		"service.name": versionInfo().Tool, "service.version": versionInfo().Version})}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		resource["attributes"] = traceAttributes(map[string]interface{}{
+			"service.name": name, "service.version": versionInfo().Version})
+	}
+	var batch []map[string]interface{}
+	ticker := time.NewTicker(traceFlushSecond * time.Second)
+	for {
+		var flushed chan struct{}
+		select {
+		case s := <-traceSpans:
+			batch = append(batch, traceOtlp(s))
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case flushed = <-traceFlushes:
+			for len(traceSpans) > 0 {
+				batch = append(batch, traceOtlp(<-traceSpans))
+			}
+			if len(batch) == 0 {
+				close(flushed)
+				continue
+			}
+		}
+		body, _ := json.Marshal(map[string]interface{}{"resourceSpans": []interface{}{
+			map[string]interface{}{"resource": resource, "scopeSpans": []interface{}{
+				map[string]interface{}{"scope": map[string]interface{}{"name": versionInfo().Tool,
+					"version": versionInfo().Version}, "spans": batch}}}}})
+		batch = nil
+		response, err := client.Post(traceEndpoint, "application/json", bytes.NewReader(body))
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode/100 != 2 {
+				err = fmt.Errorf("collector returned %s", response.Status)
+			}
+		}
+		if err != nil {
+			slog.Warn("Unable to export spans.", "endpoint", traceEndpoint, "error", err)
+		}
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// END SHARED BLOCK trace
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Apply the scheduled impairment changes of a route, starting the
+// schedule again every period if there is one
+func (p *proxy) runSchedule() {
+	if len(p.route.Schedule) == 0 {
+		return
+	}
+	for {
+		start := time.Now()
+		for _, step := range p.route.Schedule {
+			time.Sleep(time.Until(start.Add(time.Duration(step.AfterMs) * time.Millisecond)))
+			p.setImpairment(step.Impairment)
+		}
+		if p.route.SchedulePeriod <= 0 {
+			return
+		}
+		time.Sleep(time.Until(start.Add(time.Duration(p.route.SchedulePeriod) * time.Millisecond)))
+	}
+}
+
+// BEGIN SHARED BLOCK secret, see port/platform/common/automation/go_shared
+// Fetch a secret, e.g. a private key or a password, from where the
+// reference says it is, so that secrets need not be kept in files on
+// the machines of the test farm: "env:NAME" is the value of the
+// environment variable NAME, "vault:PATH#FIELD" is FIELD of the secret
+// at API path PATH (e.g. "secret/data/ubxlib/x" for a KV version 2
+// secrets engine mounted at "secret") in HashiCorp Vault, using
+// VAULT_ADDR, VAULT_TOKEN and, if set, VAULT_NAMESPACE from the
+// environment, and "file:PATH", or anything else, is a file
+func readSecret(reference string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(reference, "env:"):
+		value, ok := os.LookupEnv(reference[4:])
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", reference[4:])
+		}
+		return []byte(value), nil
+	case strings.HasPrefix(reference, "vault:"):
+		return readVaultSecret(reference[6:])
+	}
+	return ioutil.ReadFile(strings.TrimPrefix(reference, "file:"))
+}
+
+func readVaultSecret(reference string) ([]byte, error) {
+	x := strings.LastIndex(reference, "#")
+	if x < 0 {
+		return nil, fmt.Errorf("vault secret \"%s\" has no #field", reference)
+	}
+	secretPath, field := strings.Trim(reference[:x], "/"), reference[x+1:]
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	var value []byte
+	err := retry("vault "+secretPath, vaultAttempts, vaultTimeoutSecond*time.Second, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(address, "/")+"/v1/"+secretPath, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		request.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+		if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+			request.Header.Set("X-Vault-Namespace", namespace)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("vault returned HTTP status %d for %s", response.StatusCode, secretPath)
+			if response.StatusCode < http.StatusInternalServerError {
+				// e.g. a bad token or path, which won't get better
+				err = permanent(err)
+			}
+			return err
+		}
+		// KV version 1 has the fields in "data", version 2 in "data.data"
+		var secret struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&secret)
+		if err != nil {
+			return err
+		}
+		fields := secret.Data
+		if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+			if _, isV1Field := secret.Data[field]; !isV1Field {
+				fields = inner
+			}
+		}
+		text, ok := fields[field].(string)
+		if !ok {
+			return permanent(fmt.Errorf("vault secret %s has no string field \"%s\"", secretPath, field))
+		}
+		value = []byte(text)
+		return nil
+	})
+	return value, err
+}
+
+// END SHARED BLOCK secret
+
+// BEGIN SHARED BLOCK middleware, see port/platform/common/automation/go_shared
+// HttpOptions struct for JSON configuration: what the HTTP APIs of
+// the test tools have in common
+type HttpOptions struct {
+	// If present, the bearer token that every request must carry;
+	// may be env:NAME, vault:PATH#FIELD or file:PATH, see readSecret()
+	Token string `json:"token"`
+	// If non-zero, the requests per second allowed from any one
+	// client address, in bursts of up to Burst
+	RatePerSecond float64 `json:"rate-per-second"`
+	Burst         int     `json:"burst"`
+	// If true, every request is logged, otherwise only failed ones
+	AccessLog bool `json:"access-log"`
+}
+
+// Records the status of a response, for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+// A token bucket per client address
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Whether a request from the client is allowed now and, if not, how
+// long until it would be
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > rateLimitForgetSecond*time.Second {
+		for name, bucket := range l.clients {
+			if now.Sub(bucket.updated) > rateLimitForgetSecond*time.Second {
+				delete(l.clients, name)
+			}
+		}
+		l.swept = now
+	}
+	bucket, ok := l.clients[client]
+	if !ok {
+		bucket = &rateBucket{tokens: l.burst, updated: now}
+		l.clients[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Wrap the handler of an HTTP API in what the HTTP APIs of the test
+// tools have in common, outermost first: the access log, which
+// includes any test session ID given by the client in the header
+// X-Session-Id, then the rate limit, then the bearer token
+func httpMiddleware(handler http.Handler, options HttpOptions) (http.Handler, error) {
+	if options.Token != "" {
+		token, err := readSecret(options.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token: %w", err)
+		}
+		expected := []byte("Bearer " + strings.TrimSpace(string(token)))
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	if options.RatePerSecond > 0 {
+		limiter := &rateLimiter{rate: options.RatePerSecond, burst: float64(options.Burst),
+			clients: make(map[string]*rateBucket)}
+		if limiter.burst < 1 {
+			limiter.burst = 1
+		}
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			allowed, wait := limiter.allow(client)
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	inner := handler
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		inner.ServeHTTP(recorder, r)
+		level := slog.LevelDebug
+		if options.AccessLog {
+			level = slog.LevelInfo
+		}
+		if recorder.status >= 400 {
+			level = slog.LevelWarn
+		}
+		args := []any{"method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "status", recorder.status,
+			"bytes", recorder.bytes, "duration-ms", time.Since(started).Milliseconds()}
+		if session := r.Header.Get("X-Session-Id"); session != "" {
+			args = append(args, "client-session", session)
+		}
+		slog.Log(r.Context(), level, "Request.", args...)
+	})
+	return handler, nil
+}
+
+// END SHARED BLOCK middleware
+
+// Serve the control port: GET /routes gives the status of all routes,
+// PUT /routes/<name> with an impairment as JSON changes that of a route
+// and POST /routes/<name>/reset resets all of its TCP connections;
+// GET /host gives the status of the link shared by all routes and PUT
+// /host with a HostStatus changes its bandwidth; GET /connections gives
+// the most recent connections and sessions, newest first; GET / is a
+// page, for a browser, which does all of these
+func serveControl(port string, options HttpOptions, proxies map[string]*proxy, names []string) {
+	http.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		var statuses []RouteStatus
+		for _, name := range names {
+			statuses = append(statuses, proxies[name].status())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	})
+	http.HandleFunc("/routes/", func(w http.ResponseWriter, r *http.Request) {
+		name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/routes/"), "/")
+		p := proxies[name]
+		if p == nil || (action != "" && action != "reset") {
+			http.NotFound(w, r)
+			return
+		}
+		if action == "reset" {
+			if r.Method != http.MethodPost {
+				http.Error(w, "POST to reset the connections of a route", http.StatusMethodNotAllowed)
+				return
+			}
+			connections := p.resetAll()
+			slog.Info("Resetting all connections.", "route", p.route.Name, "connections", connections)
+			eventPublish("fault-injected", "", "route", p.route.Name, "fault", "reset-all", "connections", connections)
+		} else if r.Method == http.MethodPut || r.Method == http.MethodPost {
+			var impairment Impairment
+			err := json.NewDecoder(r.Body).Decode(&impairment)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p.setImpairment(impairment)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.status())
+	})
+	http.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recent.list())
+	})
+	http.HandleFunc("/host", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut || r.Method == http.MethodPost {
+			var status HostStatus
+			err := json.NewDecoder(r.Body).Decode(&status)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			host.setBandwidth(status.BandwidthBps)
+			slog.Info("Host bandwidth changed.", "bandwidth-bps", status.BandwidthBps)
+			eventPublish("host-bandwidth-changed", "", "bandwidth-bps", status.BandwidthBps)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(host.status())
+	})
+	handler, err := httpMiddleware(http.DefaultServeMux, options)
+	if err != nil {
+		logFatal("Control port failed.", "error", err)
+	}
+	// The page itself holds nothing that needs protecting, its
+	// requests carry the token, so it is served without one
+	page, _ := uiAssets.ReadFile("ui.html")
+	server := &http.Server{Addr: ":" + port, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" && r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(page)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})}
+	onShutdown("control port", func(ctx context.Context) {
+		server.Shutdown(ctx)
+	})
+	slog.Info("Control port listening.", "port", port)
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logFatal("Control port failed.", "error", err)
+	}
+}
+
+// BEGIN SHARED BLOCK config, see port/platform/common/automation/go_shared
+// Overrides of fields of the configuration given with -set
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("must be of the form name=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// Add the line and column to an error from decoding the JSON
+// configuration, since a byte offset isn't much help to anyone
+func configError(contents []byte, err error) error {
+	var offset int64 = -1
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+		err = fmt.Errorf("%q must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	if offset < 0 || offset > int64(len(contents)) {
+		return err
+	}
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(contents[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// Set a field of the configuration from text, finding it by its
+// JSON name, with a "." between the names of nested fields; the
+// case of a name, and "_" rather than "-", don't matter, so that
+// the names can come from environment variables
+func configSet(config interface{}, name string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s: %q is not an object", name, part)
+		}
+		found := false
+		for x := 0; !found && x < field.NumField(); x++ {
+			tag := strings.Split(field.Type().Field(x).Tag.Get("json"), ",")[0]
+			if tag != "" && strings.EqualFold(strings.ReplaceAll(tag, "-", "_"), strings.ReplaceAll(part, "-", "_")) {
+				field = field.Field(x)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: there is no field %q in the configuration", name, part)
+		}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	// Anything else, numbers, booleans, lists or objects, as JSON,
+	// into a fresh value so that nothing of the old one is kept
+	fresh := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), fresh.Interface())
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(fresh.Elem())
+	return nil
+}
+
+// Load the JSON configuration and then apply overrides, first from
+// environment variables named UBXLIB_<TOOL>_<FIELD>, with "__" between
+// the names of nested fields, e.g. UBXLIB_DEVICE_TWIN_MQTT__BROKER,
+// then from -set name=value, so that a deployment need only record
+// how it differs from the checked-in configuration
+func configLoad(contents []byte, config interface{}, overrides []string) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		// Most likely a typo or a field from a newer version of the
+		// tool: worth knowing about but not worth stopping for
+		slog.Warn("Unknown field in the configuration, ignored.", "error", err)
+		err = json.Unmarshal(contents, config)
+	}
+	if err != nil {
+		return configError(contents, err)
+	}
+	prefix := "UBXLIB_" + strings.ToUpper(versionInfo().Tool) + "_"
+	var environment []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			environment = append(environment, strings.TrimPrefix(variable, prefix))
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		nameValue := strings.SplitN(variable, "=", 2)
+		// Only the name is logged since the value may be a secret
+		err = configSet(config, strings.ReplaceAll(nameValue[0], "__", "."), nameValue[1])
+		if err != nil {
+			// Could be meant for another tool with a longer name
+			slog.Warn("Environment variable not applied to the configuration.", "variable", prefix+nameValue[0], "error", err)
+		} else {
+			slog.Info("Configuration overridden from the environment.", "variable", prefix+nameValue[0])
+		}
+	}
+	for _, override := range overrides {
+		nameValue := strings.SplitN(override, "=", 2)
+		err = configSet(config, nameValue[0], nameValue[1])
+		if err != nil {
+			return fmt.Errorf("-set %w", err)
+		}
+		slog.Info("Configuration overridden.", "field", nameValue[0])
+	}
+	return nil
+}
+
+// END SHARED BLOCK config
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"tcp", "udp", "schedule", "control-port", "record", "replay", "web-ui", "events"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "impair_proxy", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "impair_proxy")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+// BEGIN SHARED BLOCK retry, see port/platform/common/automation/go_shared
+// Retries, the same in all of the test tools, in place of fixed
+// sleeps: each delay is double the one before, up to a maximum, less
+// up to a half at random so that many clients don't retry in step
+const retryInitialMs = 500
+const retryMaxMs = 30000
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Start again from the initial delay, e.g. once a connection has
+// stayed up for a while
+func (b *backoff) reset() {
+	b.next = b.initial
+}
+
+// Wait for the next delay, returning false if the tool is asked to
+// stop in the meantime
+func (b *backoff) wait() bool {
+	timer := time.NewTimer(b.delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+// An error that trying again won't fix, e.g. a refusal rather than a
+// failure to connect
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// Call operation up to attempts times, backing off between attempts,
+// each attempt being given a context that is done after timeout or
+// when the tool is asked to stop; a permanent error isn't retried
+func retry(name string, attempts int, timeout time.Duration, operation func(ctx context.Context) error) error {
+	b := newBackoff(retryInitialMs*time.Millisecond, retryMaxMs*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(runContext(), timeout)
+		err := operation(ctx)
+		cancel()
+		var isPermanent permanentError
+		if err == nil || errors.As(err, &isPermanent) || attempt >= attempts {
+			return err
+		}
+		slog.Warn("Failed, trying again.", "operation", name, "attempt", attempt, "error", err)
+		if !b.wait() {
+			return err
+		}
+	}
+}
+
+// END SHARED BLOCK retry
+
+func main() {
+	defer recoverPanic()
+
+	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration.")
+	var overrides configOverrides
+	flag.Var(&overrides, "set", "Override a field of the configuration with name=value, name being the JSON name, with . between nested names; may be repeated.")
+	printConfig := flag.Bool("print_config", false, "Print the configuration, with any overrides applied, and exit.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	byteValue, err := ioutil.ReadFile(*configLocation)
+	if err != nil {
+		logFatal("Failed to open file.", "error", err)
+	}
+
+	var config Argument
+	err = configLoad(byteValue, &config, overrides)
+	if err != nil {
+		logFatal("Invalid configuration.", "file", *configLocation, "error", err)
+	}
+	if *printConfig {
+		contents, _ := json.MarshalIndent(config, "", "    ")
+		fmt.Println(string(contents))
+		return
+	}
+
+	traceExport()
+	eventExport()
+	host.setBandwidth(config.HostBandwidthBps)
+	proxies := make(map[string]*proxy)
+	var names []string
+	for x, route := range config.Routes {
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route%d", x)
+		}
+		if _, ok := proxies[route.Name]; ok {
+			logFatal("Route names must be unique.", "route", route.Name)
+		}
+		if route.Protocol == "" {
+			route.Protocol = "tcp"
+		}
+		p := &proxy{route: route}
+		if route.Replay != "" {
+			p.replay, err = captureLoad(route.Replay)
+			if err != nil {
+				logFatal("Unable to load capture.", "route", route.Name, "file", route.Replay, "error", err)
+			}
+			if p.replay == nil {
+				p.replay = []Record{}
+			}
+		}
+		switch route.Protocol {
+		case "tcp":
+			listener, err := net.Listen("tcp", ":"+route.ListenPort)
+			if err != nil {
+				logFatal("Unable to listen.", "route", route.Name, "error", err)
+			}
+			onShutdown("route "+route.Name, func(ctx context.Context) {
+				p.stop(ctx, listener)
+			})
+			go p.serveTcp(listener)
+		case "udp":
+			address, err := net.ResolveUDPAddr("udp", ":"+route.ListenPort)
+			if err != nil {
+				logFatal("Unable to resolve address.", "route", route.Name, "error", err)
+			}
+			listener, err := net.ListenUDP("udp", address)
+			if err != nil {
+				logFatal("Unable to listen.", "route", route.Name, "error", err)
+			}
+			onShutdown("route "+route.Name, func(ctx context.Context) {
+				p.stop(ctx, listener)
+			})
+			if p.replay != nil {
+				go p.replayUdp(listener)
+			} else {
+				go p.serveUdp(listener)
+			}
+		default:
+			logFatal("Unknown protocol.", "route", route.Name, "protocol", route.Protocol)
+		}
+		go p.runSchedule()
+		proxies[route.Name] = p
+		names = append(names, route.Name)
+		slog.Info("Route ready.", "route", route.Name, "protocol", route.Protocol,
+			"port", route.ListenPort, "target", route.Target)
+	}
+	if config.ControlPort != "" {
+		go serveControl(config.ControlPort, config.HttpOptions, proxies, names)
+	}
+
+	<-runContext().Done()
+	exit(exitOk)
+}
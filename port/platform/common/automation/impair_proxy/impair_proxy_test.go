@@ -0,0 +1,136 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Run with: go test impair_proxy.go impair_proxy_test.go
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayerAdvance(t *testing.T) {
+	// An SMTP-like exchange where the server speaks first and
+	// closes the connection at the end
+	exchange := []Record{
+		{OffsetMs: 0, Direction: "down", Data: []byte("220 hello\r\n")},
+		{OffsetMs: 100, Direction: "up", Data: []byte("HELO\r\n")},
+		{OffsetMs: 150, Direction: "down", Data: []byte("250 ok\r\n")},
+		{OffsetMs: 400, Direction: "up", Data: []byte("QUIT\r\n")},
+		{OffsetMs: 410, Direction: "down", Data: []byte("221 bye\r\n")},
+		{OffsetMs: 430, Direction: "down", Data: nil},
+	}
+	type sent struct {
+		data string
+		// When each chunk is expected relative to the time of
+		// the call, in milliseconds, in order
+		chunks   []string
+		atMs     []int64
+		diverged bool
+	}
+	tests := []struct {
+		name    string
+		records []Record
+		steps   []sent
+	}{
+		{"exact", exchange, []sent{
+			{"", []string{"220 hello\r\n"}, []int64{0}, false},
+			{"HELO\r\n", []string{"250 ok\r\n"}, []int64{50}, false},
+			{"QUIT\r\n", []string{"221 bye\r\n", ""}, []int64{10, 30}, false},
+		}},
+		{"split", exchange, []sent{
+			{"", []string{"220 hello\r\n"}, []int64{0}, false},
+			{"HE", nil, nil, false},
+			{"LO\r", nil, nil, false},
+			{"\nQU", []string{"250 ok\r\n"}, []int64{50}, false},
+			{"IT\r\n", []string{"221 bye\r\n", ""}, []int64{10, 30}, false},
+		}},
+		{"coalesced", exchange, []sent{
+			{"", []string{"220 hello\r\n"}, []int64{0}, false},
+			{"HELO\r\nQUIT\r\n", []string{"250 ok\r\n", "221 bye\r\n", ""}, []int64{50, 60, 80}, false},
+		}},
+		{"different", exchange, []sent{
+			{"", []string{"220 hello\r\n"}, []int64{0}, false},
+			{"EHLO\r\n", []string{"250 ok\r\n"}, []int64{50}, true},
+			{"QUIT\r\n", []string{"221 bye\r\n", ""}, []int64{10, 30}, true},
+		}},
+		{"extra", exchange, []sent{
+			{"", []string{"220 hello\r\n"}, []int64{0}, false},
+			{"HELO\r\n", []string{"250 ok\r\n"}, []int64{50}, false},
+			{"QUIT\r\n", []string{"221 bye\r\n", ""}, []int64{10, 30}, false},
+			{"NOOP\r\n", nil, nil, true},
+		}},
+		{"client first", []Record{
+			{OffsetMs: 1000, Direction: "up", Data: []byte("ping")},
+			{OffsetMs: 1250, Direction: "down", Data: []byte("pong")},
+			{OffsetMs: 1300, Direction: "down", Data: []byte("pong")},
+		}, []sent{
+			{"", nil, nil, false},
+			{"ping", []string{"pong", "pong"}, []int64{250, 300}, false},
+		}},
+		{"empty capture", nil, []sent{
+			{"", nil, nil, false},
+			{"anything", nil, nil, true},
+		}},
+	}
+	const slackMs = 50
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &replayer{route: "test", remote: "192.0.2.1:1000", records: test.records}
+			for x, step := range test.steps {
+				var data []byte
+				if step.data != "" {
+					data = []byte(step.data)
+				}
+				called := time.Now()
+				chunks := r.advance(data)
+				if len(chunks) != len(step.chunks) {
+					t.Fatalf("step %d: %d chunk(s), expected %d", x, len(chunks), len(step.chunks))
+				}
+				for y, c := range chunks {
+					atMs := c.at.Sub(called).Milliseconds()
+					if string(c.data) != step.chunks[y] || atMs < step.atMs[y] || atMs > step.atMs[y]+slackMs {
+						t.Errorf("step %d chunk %d: %q at %d ms, expected %q at %d ms", x, y, c.data, atMs,
+							step.chunks[y], step.atMs[y])
+					}
+				}
+				if r.diverged != step.diverged {
+					t.Errorf("step %d: diverged %t, expected %t", x, r.diverged, step.diverged)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayerAdvanceBacklog(t *testing.T) {
+	// A chunk is never scheduled before one already scheduled,
+	// however quickly the client sends
+	r := &replayer{records: []Record{
+		{OffsetMs: 0, Direction: "up", Data: []byte("a")},
+		{OffsetMs: 500, Direction: "down", Data: []byte("A")},
+		{OffsetMs: 500, Direction: "up", Data: []byte("b")},
+		{OffsetMs: 600, Direction: "down", Data: []byte("B")},
+	}}
+	first := r.advance([]byte("a"))
+	second := r.advance([]byte("b"))
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("%d and %d chunk(s)", len(first), len(second))
+	}
+	if gap := second[0].at.Sub(first[0].at); gap != 100*time.Millisecond {
+		t.Errorf("second chunk %v after the first, expected 100ms", gap)
+	}
+}
@@ -0,0 +1,640 @@
+//go:build integration
+
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Run with: go test -race -tags integration integration_test.go
+
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Each tool is a package main of its own, so the tools can't be
+// built into the test: they are built, with the race detector, and
+// run as the programs they are, talking to each other over localhost
+
+var root = flag.String("root", "../../../../..", "The ubxlib directory.")
+
+// How long a server may take to start listening or to stop
+const serverTimeoutSecond = 30
+
+// How long a client tool may take to do its work
+const clientTimeoutSecond = 120
+
+// The exit value of a tool built with -race that found a data race
+const exitRace = 66
+
+var toolDirectory string
+var toolsMutex sync.Mutex
+var tools = make(map[string]string)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	var err error
+	toolDirectory, err = os.MkdirTemp("", "ubxlib_integration")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(toolDirectory)
+	os.Exit(code)
+}
+
+// Build a tool, once, with the race detector, returning the path
+// of the binary
+func tool(t *testing.T, source string) string {
+	t.Helper()
+	toolsMutex.Lock()
+	defer toolsMutex.Unlock()
+	if binary, ok := tools[source]; ok {
+		return binary
+	}
+	binary := filepath.Join(toolDirectory, strings.TrimSuffix(filepath.Base(source), ".go"))
+	output, err := exec.Command("go", "build", "-race", "-o", binary,
+		filepath.Join(*root, filepath.FromSlash(source))).CombinedOutput()
+	if err != nil {
+		t.Fatalf("unable to build %s with -race (which needs cgo): %v\n%s", source, err, output)
+	}
+	tools[source] = binary
+	return binary
+}
+
+// A free port on localhost, as a string
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return fmt.Sprint(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// What a server writes to stderr, which is read while it runs
+type logBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (l *logBuffer) Write(data []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buffer.Write(data)
+}
+
+func (l *logBuffer) String() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buffer.String()
+}
+
+// A server tool running in the background
+type server struct {
+	name    string
+	command *exec.Cmd
+	log     logBuffer
+	exited  chan struct{}
+	err     error
+	stopped sync.Once
+}
+
+// Start a server tool in directory, which is its working directory,
+// waiting until address accepts connections; the server is stopped
+// when the test ends, if it hasn't been already, and the test fails
+// if it didn't stop cleanly or a data race was found
+func startServer(t *testing.T, binary string, directory string, address string, args ...string) *server {
+	t.Helper()
+	s := &server{name: filepath.Base(binary), exited: make(chan struct{})}
+	s.command = exec.Command(binary, args...)
+	s.command.Dir = directory
+	s.command.Env = append(os.Environ(), "GORACE=halt_on_error=1", "UBXLIB_EVENT_BUS=")
+	s.command.Stdout = &s.log
+	s.command.Stderr = &s.log
+	err := s.command.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s.err = s.command.Wait()
+		close(s.exited)
+	}()
+	t.Cleanup(func() { s.stop(t) })
+	deadline := time.Now().Add(serverTimeoutSecond * time.Second)
+	for {
+		connection, err := net.DialTimeout("tcp", address, time.Second)
+		if err == nil {
+			connection.Close()
+			return s
+		}
+		select {
+		case <-s.exited:
+			t.Fatalf("%s exited before listening: %v\n%s", s.name, s.err, s.log.String())
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not listening on %s after %d seconds\n%s", s.name, address, serverTimeoutSecond, s.log.String())
+		}
+	}
+}
+
+// Stop a server as systemd or the supervisor would, with SIGTERM,
+// failing the test unless it exits with 0
+func (s *server) stop(t *testing.T) {
+	t.Helper()
+	s.stopped.Do(func() { s.check(t) })
+}
+
+func (s *server) check(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.exited:
+	default:
+		err := s.command.Process.Signal(syscall.SIGTERM)
+		if err != nil {
+			s.command.Process.Kill()
+			t.Errorf("unable to stop %s: %v", s.name, err)
+		}
+		select {
+		case <-s.exited:
+		case <-time.After(serverTimeoutSecond * time.Second):
+			s.command.Process.Kill()
+			<-s.exited
+			t.Errorf("%s did not stop within %d seconds", s.name, serverTimeoutSecond)
+		}
+	}
+	log := s.log.String()
+	var exitError *exec.ExitError
+	if (errors.As(s.err, &exitError) && exitError.ExitCode() == exitRace) || strings.Contains(log, "WARNING: DATA RACE") {
+		t.Errorf("%s has a data race:\n%s", s.name, log)
+	} else if s.err != nil {
+		t.Errorf("%s exited with %v:\n%s", s.name, s.err, log)
+	}
+}
+
+// Run a client tool to completion, failing the test if it fails
+func runClient(t *testing.T, binary string, args ...string) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeoutSecond*time.Second)
+	defer cancel()
+	command := exec.CommandContext(ctx, binary, args...)
+	command.Env = append(os.Environ(), "GORACE=halt_on_error=1")
+	output, err := command.CombinedOutput()
+	if err != nil {
+		t.Errorf("%s %s: %v\n%s", filepath.Base(binary), strings.Join(args, " "), err, output)
+	}
+	return string(output)
+}
+
+// Send data to an echo server over a connection and check that the
+// same comes back
+func checkEcho(t *testing.T, connection net.Conn, data []byte) {
+	t.Helper()
+	connection.SetDeadline(time.Now().Add(clientTimeoutSecond * time.Second))
+	go connection.Write(data)
+	echoed := make([]byte, len(data))
+	_, err := io.ReadFull(connection, echoed)
+	if err != nil {
+		t.Fatalf("echo of %d bytes: %v", len(data), err)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Fatalf("echo of %d bytes differs", len(data))
+	}
+}
+
+const echoServer = "common/sock/test/echo_server/echo_server.go"
+const echoBench = "common/sock/test/echo_bench/echo_bench.go"
+const payloadGen = "common/sock/test/payload_gen/payload_gen.go"
+const deviceTwin = "common/mqtt_client/test/device_twin/device_twin.go"
+
+func TestEchoServerTcp(t *testing.T) {
+	port := freePort(t)
+	address := "127.0.0.1:" + port
+	directory := t.TempDir()
+	handlers := `[{"name": "ping", "match": "^PING ([0-9]+)$", "reply": "PONG $1"}]`
+	err := os.WriteFile(filepath.Join(directory, "handlers.json"), []byte(handlers), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No config.json in the directory, so the built-in one is used
+	startServer(t, tool(t, echoServer), directory, address, "-set", "server-port="+port,
+		"-set", "verbose=false", "-set", "handlers-location=handlers.json", "-log_level", "warn")
+
+	// Several clients at once, so that the race detector sees the
+	// connections of the server running side by side
+	generator := tool(t, payloadGen)
+	var clients sync.WaitGroup
+	for x, payloadType := range []string{"prbs15", "random", "json", "ubx", "counter"} {
+		clients.Add(1)
+		go func(payloadType string, seed int) {
+			defer clients.Done()
+			runClient(t, generator, "-type", payloadType, "-seed", fmt.Sprint(seed),
+				"-size", "500000", "-echo", address, "-log_level", "warn")
+		}(payloadType, x+1)
+	}
+	clients.Wait()
+
+	output := runClient(t, tool(t, echoBench), "-tcp", address, "-duration_s", "1", "-connections", "4",
+		"-log_level", "warn")
+	for _, result := range []string{"tcp-latency-p50", "tcp-latency-p99", "tcp-throughput"} {
+		if !strings.Contains(output, result) {
+			t.Errorf("no %s from echo_bench:\n%s", result, output)
+		}
+	}
+
+	connection, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(clientTimeoutSecond * time.Second))
+	_, err = connection.Write([]byte("PING 42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len("PONG 42"))
+	_, err = io.ReadFull(connection, reply)
+	if err != nil || string(reply) != "PONG 42" {
+		t.Errorf("handler replied %q, %v, expected \"PONG 42\"", reply, err)
+	}
+	checkEcho(t, connection, []byte("not a ping"))
+}
+
+func TestEchoServerTls(t *testing.T) {
+	port := freePort(t)
+	address := "127.0.0.1:" + port
+	// The built-in configuration and certificates
+	startServer(t, tool(t, echoServer), t.TempDir(), address, "-config", "config_secure.json",
+		"-set", "server-port="+port, "-set", "verbose=false", "-log_level", "warn")
+
+	output := runClient(t, tool(t, echoBench), "-tls", address, "-duration_s", "1", "-connections", "4",
+		"-log_level", "warn")
+	for _, result := range []string{"tls-latency-p50", "tls-latency-p99", "tls-throughput", "tls-handshakes"} {
+		if !strings.Contains(output, result) {
+			t.Errorf("no %s from echo_bench:\n%s", result, output)
+		}
+	}
+
+	// The test certificate is self-signed, it is the echo that counts
+	connection, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	data := make([]byte, 256*1024)
+	for x := range data {
+		data[x] = byte(x * 7)
+	}
+	checkEcho(t, connection, data)
+}
+
+// Make a REST request of device_twin, returning the HTTP status
+// and the body
+func send(method string, url string, body string) (int, []byte, error) {
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	result, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer result.Body.Close()
+	contents, err := io.ReadAll(result.Body)
+	return result.StatusCode, contents, err
+}
+
+// As send(), decoding any JSON response into response
+func request(t *testing.T, method string, url string, body string, response interface{}) int {
+	t.Helper()
+	status, contents, err := send(method, url, body)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	if response != nil && status/100 == 2 {
+		err = json.Unmarshal(contents, response)
+		if err != nil {
+			t.Fatalf("%s %s: %v\n%s", method, url, err, contents)
+		}
+	}
+	return status
+}
+
+// The parts of a twin that are checked
+type twin struct {
+	Desired         map[string]interface{} `json:"desired"`
+	DesiredVersion  int                    `json:"desired-version"`
+	Reported        map[string]interface{} `json:"reported"`
+	ReportedVersion int                    `json:"reported-version"`
+}
+
+// Start device_twin in directory with the given configuration,
+// returning the URL of its REST API
+func startDeviceTwin(t *testing.T, directory string, port string, configuration map[string]interface{}) (*server, string) {
+	t.Helper()
+	configuration["http-port"] = port
+	contents, _ := json.Marshal(configuration)
+	err := os.WriteFile(filepath.Join(directory, "config.json"), contents, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startServer(t, tool(t, deviceTwin), directory, "127.0.0.1:"+port, "-config", "config.json",
+		"-log_level", "warn")
+	return s, "http://127.0.0.1:" + port
+}
+
+func TestDeviceTwinRest(t *testing.T) {
+	port := freePort(t)
+	directory := t.TempDir()
+	configuration := map[string]interface{}{"state-file": "state.json"}
+	s, url := startDeviceTwin(t, directory, port, configuration)
+
+	// Changes from several clients at once must all be applied
+	const clients = 8
+	const changes = 20
+	var wait sync.WaitGroup
+	for x := 0; x < clients; x++ {
+		wait.Add(1)
+		go func(x int) {
+			defer wait.Done()
+			for y := 0; y < changes; y++ {
+				status, _, err := send(http.MethodPatch, url+"/devices/dev-1/desired",
+					fmt.Sprintf(`{"setting-%d": %d}`, x, y))
+				if err != nil || status != http.StatusOK {
+					t.Errorf("PATCH desired gave %d, %v", status, err)
+				}
+			}
+		}(x)
+	}
+	wait.Wait()
+	var got twin
+	if status := request(t, http.MethodGet, url+"/devices/dev-1", "", &got); status != http.StatusOK {
+		t.Fatalf("GET twin gave %d", status)
+	}
+	if got.DesiredVersion != clients*changes || len(got.Desired) != clients {
+		t.Errorf("desired version %d with %d settings, expected %d with %d", got.DesiredVersion,
+			len(got.Desired), clients*changes, clients)
+	}
+	for x := 0; x < clients; x++ {
+		if got.Desired[fmt.Sprintf("setting-%d", x)] != float64(changes-1) {
+			t.Errorf("desired %v, expected every setting to be %d", got.Desired, changes-1)
+			break
+		}
+	}
+
+	// The delta is whatever the device has yet to report
+	request(t, http.MethodPut, url+"/devices/dev-1/desired", `{"led": "on", "rate": 5}`, nil)
+	request(t, http.MethodPut, url+"/devices/dev-1/reported", `{"led": "off", "rate": 5}`, nil)
+	var delta map[string]interface{}
+	request(t, http.MethodGet, url+"/devices/dev-1/delta", "", &delta)
+	if !reflect.DeepEqual(delta, map[string]interface{}{"led": "on"}) {
+		t.Errorf("delta %v, expected led on", delta)
+	}
+	request(t, http.MethodPatch, url+"/devices/dev-1/reported", `{"led": "on"}`, nil)
+	delta = nil
+	request(t, http.MethodGet, url+"/devices/dev-1/delta", "", &delta)
+	if len(delta) != 0 {
+		t.Errorf("delta %v, expected none", delta)
+	}
+	if status := request(t, http.MethodGet, url+"/devices/a+b", "", nil); status != http.StatusBadRequest {
+		t.Errorf("device ID with + gave %d, expected %d", status, http.StatusBadRequest)
+	}
+	if status := request(t, http.MethodPost, url+"/devices/dev-1/desired", "{}", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST gave %d, expected %d", status, http.StatusMethodNotAllowed)
+	}
+
+	// The twins survive a restart
+	s.stop(t)
+	_, url = startDeviceTwin(t, directory, port, configuration)
+	got = twin{}
+	request(t, http.MethodGet, url+"/devices/dev-1", "", &got)
+	if got.Desired["led"] != "on" || got.Reported["led"] != "on" {
+		t.Errorf("after a restart the twin is %+v", got)
+	}
+	var devices []string
+	request(t, http.MethodGet, url+"/devices", "", &devices)
+	if !reflect.DeepEqual(devices, []string{"dev-1"}) {
+		t.Errorf("devices %v, expected dev-1", devices)
+	}
+	if status := request(t, http.MethodDelete, url+"/devices/dev-1", "", nil); status != http.StatusNoContent {
+		t.Errorf("DELETE gave %d", status)
+	}
+	if status := request(t, http.MethodGet, url+"/devices/dev-1", "", nil); status != http.StatusNotFound {
+		t.Errorf("GET of a deleted device gave %d", status)
+	}
+}
+
+// An MQTT packet as the broker sees it
+type mqttPacket struct {
+	packetType byte
+	body       []byte
+}
+
+func mqttWrite(writer io.Writer, packetType byte, body []byte) error {
+	packet := []byte{packetType}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := writer.Write(append(packet, body...))
+	return err
+}
+
+func mqttRead(reader *bufio.Reader) (mqttPacket, error) {
+	packetType, err := reader.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	length := 0
+	for multiplier := 1; multiplier <= 128*128*128; multiplier *= 128 {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader, body)
+	return mqttPacket{packetType, body}, err
+}
+
+func mqttPublish(writer io.Writer, topic string, payload string) error {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	return mqttWrite(writer, 0x30, append(append(body, topic...), payload...))
+}
+
+// The topic and payload of a PUBLISH
+func (p mqttPacket) publish() (string, string) {
+	length := int(binary.BigEndian.Uint16(p.body))
+	return string(p.body[2 : 2+length]), string(p.body[2+length:])
+}
+
+// Just enough of an MQTT broker for device_twin, which is its only
+// client: it answers CONNECT, SUBSCRIBE and PINGREQ and passes on
+// everything else it receives
+func fakeBroker(t *testing.T) (string, <-chan mqttPacket, <-chan net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	packets := make(chan mqttPacket, 100)
+	connections := make(chan net.Conn, 1)
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		reader := bufio.NewReader(connection)
+		for {
+			packet, err := mqttRead(reader)
+			if err != nil {
+				close(packets)
+				return
+			}
+			switch packet.packetType & 0xf0 {
+			case 0x10:
+				err = mqttWrite(connection, 0x20, []byte{0, 0})
+				connections <- connection
+			case 0x80:
+				err = mqttWrite(connection, 0x90, append(packet.body[:2:2], 0))
+			case 0xc0:
+				err = mqttWrite(connection, 0xd0, nil)
+			}
+			if err != nil {
+				close(packets)
+				return
+			}
+			packets <- packet
+		}
+	}()
+	return listener.Addr().String(), packets, connections
+}
+
+// The next packet the broker received, other than a PINGREQ
+func nextPacket(t *testing.T, packets <-chan mqttPacket) mqttPacket {
+	t.Helper()
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				t.Fatal("device_twin disconnected from the broker")
+			}
+			if packet.packetType&0xf0 != 0xc0 {
+				return packet
+			}
+		case <-time.After(serverTimeoutSecond * time.Second):
+			t.Fatal("nothing received by the broker")
+		}
+	}
+}
+
+func TestDeviceTwinMqtt(t *testing.T) {
+	broker, packets, connections := fakeBroker(t)
+	s, url := startDeviceTwin(t, t.TempDir(), freePort(t), map[string]interface{}{
+		"mqtt": map[string]interface{}{"broker": broker, "client-id": "integration", "topic-prefix": "test/twin"}})
+	if packet := nextPacket(t, packets); packet.packetType != 0x10 {
+		t.Fatalf("first packet %02x, expected CONNECT", packet.packetType)
+	}
+	connection := <-connections
+	packet := nextPacket(t, packets)
+	if packet.packetType != 0x82 || !bytes.Contains(packet.body, []byte("test/twin/+/reported")) {
+		t.Fatalf("packet %02x %q, expected SUBSCRIBE to test/twin/+/reported", packet.packetType, packet.body)
+	}
+
+	// A change of the desired state is published, retained
+	request(t, http.MethodPatch, url+"/devices/dev-2/desired", `{"led": "on"}`, nil)
+	packet = nextPacket(t, packets)
+	topic, payload := packet.publish()
+	var desired map[string]interface{}
+	json.Unmarshal([]byte(payload), &desired)
+	if packet.packetType != 0x31 || topic != "test/twin/dev-2/desired" || desired["led"] != "on" {
+		t.Errorf("packet %02x to %s of %s, expected retained PUBLISH of led on to test/twin/dev-2/desired",
+			packet.packetType, topic, payload)
+	}
+
+	// What the device reports is merged into its reported state
+	err := mqttPublish(connection, "test/twin/dev-2/reported", `{"led": "on", "battery": 80}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got twin
+	for deadline := time.Now().Add(serverTimeoutSecond * time.Second); time.Now().Before(deadline); {
+		request(t, http.MethodGet, url+"/devices/dev-2", "", &got)
+		if got.ReportedVersion > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(got.Reported, map[string]interface{}{"led": "on", "battery": float64(80)}) {
+		t.Errorf("reported %v, expected what was published", got.Reported)
+	}
+	var delta map[string]interface{}
+	request(t, http.MethodGet, url+"/devices/dev-2/delta", "", &delta)
+	if len(delta) != 0 {
+		t.Errorf("delta %v, expected none", delta)
+	}
+
+	// Removing a device clears its retained desired state
+	request(t, http.MethodDelete, url+"/devices/dev-2", "", nil)
+	packet = nextPacket(t, packets)
+	topic, payload = packet.publish()
+	if packet.packetType != 0x31 || topic != "test/twin/dev-2/desired" || payload != "" {
+		t.Errorf("packet %02x to %s of %q, expected an empty retained PUBLISH to test/twin/dev-2/desired",
+			packet.packetType, topic, payload)
+	}
+
+	// Stopping disconnects cleanly
+	s.stop(t)
+	if packet := nextPacket(t, packets); packet.packetType != 0xe0 {
+		t.Errorf("packet %02x on stopping, expected DISCONNECT", packet.packetType)
+	}
+}
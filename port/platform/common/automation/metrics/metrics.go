@@ -0,0 +1,1358 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const scrapeTimeoutSecond = 5
+const vaultTimeoutSecond = 30
+const vaultAttempts = 3
+const rateLimitForgetSecond = 600
+const maxPushBytes = 1048576
+
+// Target struct for JSON configuration: an endpoint serving metrics
+// in the Prometheus text format
+type Target struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+// Condition struct for JSON configuration: a test of the value of a
+// metric, or of its rate of increase per second over a window
+type Condition struct {
+	Metric      string            `json:"metric"`
+	Labels      map[string]string `json:"labels"`
+	Sum         bool              `json:"sum"`
+	RateWindowS int               `json:"rate-window-s"`
+	Op          string            `json:"op"`
+	Value       float64           `json:"value"`
+}
+
+// Rule struct for JSON configuration: an alert that fires when its
+// condition has held for ForS seconds, and only-if also holds
+type Rule struct {
+	Name string `json:"name"`
+	Condition
+	ForS   int        `json:"for-s"`
+	OnlyIf *Condition `json:"only-if"`
+}
+
+// Argument struct for JSON configuration
+type Argument struct {
+	HttpPort    string            `json:"http-port"`
+	HttpOptions HttpOptions       `json:"http-options"`
+	Manifest    string            `json:"manifest"`
+	IntervalS   int               `json:"interval-s"`
+	Disks       []string          `json:"disks"`
+	LogPatterns map[string]string `json:"log-patterns"`
+	Targets     []Target          `json:"targets"`
+	Webhook     string            `json:"webhook"`
+	Rules       []Rule            `json:"rules"`
+}
+
+// Port, Endpoint and Manifest are as written by ../supervisor
+type Port struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+type Endpoint struct {
+	Status   string          `json:"status"`
+	Restarts int             `json:"restarts"`
+	Log      string          `json:"log,omitempty"`
+	Ports    map[string]Port `json:"ports"`
+}
+
+type Manifest struct {
+	Services map[string]*Endpoint `json:"services"`
+}
+
+// RouteStatus is as returned by the control port of ../impair_proxy
+type RouteStatus struct {
+	Route struct {
+		Name string `json:"name"`
+	} `json:"route"`
+	Connections int   `json:"connections"`
+	Bytes       int64 `json:"bytes"`
+	Dropped     int64 `json:"dropped"`
+	Resets      int64 `json:"resets"`
+	Corrupted   int64 `json:"corrupted"`
+}
+
+// One value of a metric with a given set of labels
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+func (s sample) key() string {
+	var names []string
+	for name := range s.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var text strings.Builder
+	text.WriteString(s.name)
+	if len(names) > 0 {
+		text.WriteString("{")
+		for x, name := range names {
+			if x > 0 {
+				text.WriteString(",")
+			}
+			text.WriteString(name + "=" + strconv.Quote(s.labels[name]))
+		}
+		text.WriteString("}")
+	}
+	return text.String()
+}
+
+// Alert is the state of a rule, as reported on /alerts and to the webhook
+type Alert struct {
+	Name   string    `json:"name"`
+	Firing bool      `json:"firing"`
+	Since  time.Time `json:"since"`
+	Value  float64   `json:"value"`
+}
+
+type aggregator struct {
+	config Argument
+	mutex  sync.Mutex
+	// The samples from the last collection, including pushed ones
+	samples []sample
+	pushed  map[string][]sample
+	// Recent history of each sample, for rates
+	history map[string][]historyPoint
+	// Where each log file had been read up to and the counts so far
+	logOffsets map[string]int64
+	logCounts  map[string]float64
+	patterns   map[string]*regexp.Regexp
+	// When each rule's condition started to hold, and the alerts
+	pending map[string]time.Time
+	alerts  map[string]*Alert
+}
+
+type historyPoint struct {
+	at    time.Time
+	value float64
+}
+
+// Parse the Prometheus text exposition format; types, help and
+// timestamps are ignored, which is all an aggregator needs
+func parsePrometheus(reader io.Reader, extraLabels map[string]string) ([]sample, error) {
+	var samples []sample
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s := sample{labels: make(map[string]string)}
+		rest := line
+		if brace := strings.Index(line, "{"); brace >= 0 {
+			end := strings.LastIndex(line, "}")
+			if end < brace {
+				return nil, fmt.Errorf("bad line %q", line)
+			}
+			s.name = line[:brace]
+			labels := line[brace+1 : end]
+			rest = strings.TrimSpace(line[end+1:])
+			for labels != "" {
+				equals := strings.Index(labels, "=")
+				if equals < 0 || len(labels) < equals+2 || labels[equals+1] != '"' {
+					return nil, fmt.Errorf("bad labels in %q", line)
+				}
+				name := strings.TrimSpace(labels[:equals])
+				value, err := strconv.QuotedPrefix(labels[equals+1:])
+				if err != nil {
+					return nil, fmt.Errorf("bad label value in %q", line)
+				}
+				s.labels[name], _ = strconv.Unquote(value)
+				labels = strings.TrimLeft(strings.TrimSpace(labels[equals+1+len(value):]), ",")
+				labels = strings.TrimSpace(labels)
+			}
+		} else {
+			fields := strings.Fields(line)
+			s.name = fields[0]
+			rest = strings.Join(fields[1:], " ")
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("no value in %q", line)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad value in %q", line)
+		}
+		s.value = value
+		for name, value := range extraLabels {
+			s.labels[name] = value
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// The number of established TCP connections per local port, from
+// /proc/net, so only on Linux
+func connectionCounts() (map[int]int, bool) {
+	counts := make(map[int]int)
+	ok := false
+	for _, fileName := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		contents, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			continue
+		}
+		ok = true
+		for _, line := range strings.Split(string(contents), "\n")[1:] {
+			fields := strings.Fields(line)
+			// State 01 is ESTABLISHED
+			if len(fields) < 4 || fields[3] != "01" {
+				continue
+			}
+			local := strings.Split(fields[1], ":")
+			port, err := strconv.ParseInt(local[len(local)-1], 16, 32)
+			if err == nil {
+				counts[int(port)]++
+			}
+		}
+	}
+	return counts, ok
+}
+
+// The percentage used of the file system holding path, using df so
+// as to work on any platform that has it
+func diskUsedPercent(path string) (float64, error) {
+	output, err := exec.Command("df", "-Pk", path).Output()
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 5 {
+		return 0, fmt.Errorf("unexpected output from df: %q", lines[len(lines)-1])
+	}
+	return strconv.ParseFloat(strings.TrimSuffix(fields[4], "%"), 64)
+}
+
+// Count the lines matching each log pattern added to a log file since
+// the last time; a file that has shrunk has been rotated or truncated
+// and is read from the start
+func (a *aggregator) countLogMatches(service string, fileName string) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	offset := a.logOffsets[fileName]
+	if info.Size() < offset {
+		offset = 0
+	}
+	file.Seek(offset, io.SeekStart)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// Leave a partial line for next time
+			break
+		}
+		offset += int64(len(line))
+		for name, pattern := range a.patterns {
+			if pattern.MatchString(line) {
+				a.logCounts[service+"\x00"+name]++
+			}
+		}
+	}
+	a.logOffsets[fileName] = offset
+}
+
+// Collect all of the metrics once
+func (a *aggregator) collect() {
+	var samples []sample
+	add := func(name string, value float64, labels ...string) {
+		s := sample{name: name, labels: make(map[string]string), value: value}
+		for x := 0; x+1 < len(labels); x += 2 {
+			s.labels[labels[x]] = labels[x+1]
+		}
+		samples = append(samples, s)
+	}
+	client := &http.Client{Timeout: scrapeTimeoutSecond * time.Second}
+
+	if a.config.Manifest != "" {
+		var manifest Manifest
+		contents, err := ioutil.ReadFile(a.config.Manifest)
+		if err == nil {
+			err = json.Unmarshal(contents, &manifest)
+		}
+		if err != nil {
+			slog.Warn("Unable to read manifest.", "file", a.config.Manifest, "error", err)
+		}
+		counts, countsOk := connectionCounts()
+		for name, endpoint := range manifest.Services {
+			up := 0.0
+			if endpoint.Status == "running" {
+				up = 1
+			}
+			add("ubxlib_service_up", up, "service", name)
+			add("ubxlib_service_restarts_total", float64(endpoint.Restarts), "service", name)
+			for portName, port := range endpoint.Ports {
+				if countsOk && port.Protocol != "udp" {
+					add("ubxlib_service_connections", float64(counts[port.Port]), "service", name, "port", portName)
+				}
+			}
+			if endpoint.Log != "" && len(a.patterns) > 0 {
+				a.countLogMatches(name, endpoint.Log)
+				for pattern := range a.patterns {
+					add("ubxlib_log_matches_total", a.logCounts[name+"\x00"+pattern], "service", name, "pattern", pattern)
+				}
+			}
+			// An impairment proxy has a port named control
+			if control, ok := endpoint.Ports["control"]; ok && endpoint.Status == "running" {
+				request, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d/routes", control.Port), nil)
+				if token := os.Getenv("UBXLIB_HTTP_TOKEN"); token != "" {
+					request.Header.Set("Authorization", "Bearer "+token)
+				}
+				response, err := client.Do(request)
+				if err != nil {
+					slog.Debug("Unable to read routes.", "service", name, "error", err)
+					continue
+				}
+				var routes []RouteStatus
+				err = json.NewDecoder(response.Body).Decode(&routes)
+				response.Body.Close()
+				if err != nil {
+					continue
+				}
+				for _, route := range routes {
+					add("ubxlib_proxy_connections", float64(route.Connections), "service", name, "route", route.Route.Name)
+					add("ubxlib_proxy_bytes_total", float64(route.Bytes), "service", name, "route", route.Route.Name)
+					add("ubxlib_proxy_dropped_total", float64(route.Dropped), "service", name, "route", route.Route.Name)
+					add("ubxlib_proxy_resets_total", float64(route.Resets), "service", name, "route", route.Route.Name)
+					add("ubxlib_proxy_corrupted_total", float64(route.Corrupted), "service", name, "route", route.Route.Name)
+				}
+			}
+		}
+	}
+	for _, path := range a.config.Disks {
+		used, err := diskUsedPercent(path)
+		if err != nil {
+			slog.Warn("Unable to read disk usage.", "path", path, "error", err)
+			continue
+		}
+		add("ubxlib_disk_used_percent", used, "path", path)
+	}
+	for _, target := range a.config.Targets {
+		up := 0.0
+		response, err := client.Get(target.Url)
+		if err == nil {
+			var scraped []sample
+			scraped, err = parsePrometheus(response.Body, map[string]string{"job": target.Name})
+			response.Body.Close()
+			if err == nil {
+				samples = append(samples, scraped...)
+				up = 1
+			}
+		}
+		if err != nil {
+			slog.Warn("Unable to scrape target.", "target", target.Name, "url", target.Url, "error", err)
+		}
+		add("ubxlib_target_up", up, "job", target.Name)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, pushed := range a.pushed {
+		samples = append(samples, pushed...)
+	}
+	now := time.Now()
+	maxWindow := 0
+	for _, rule := range a.config.Rules {
+		if rule.RateWindowS > maxWindow {
+			maxWindow = rule.RateWindowS
+		}
+		if rule.OnlyIf != nil && rule.OnlyIf.RateWindowS > maxWindow {
+			maxWindow = rule.OnlyIf.RateWindowS
+		}
+	}
+	for _, s := range samples {
+		key := s.key()
+		history := append(a.history[key], historyPoint{now, s.value})
+		for len(history) > 1 && now.Sub(history[1].at) >= time.Duration(maxWindow)*time.Second {
+			history = history[1:]
+		}
+		a.history[key] = history
+	}
+	a.samples = samples
+	a.evaluate(now)
+}
+
+// The value of a condition's metric: the latest value or the rate
+// over the window, of each matching series or of their sum; returns
+// false if there is no matching series or not yet enough history
+func (a *aggregator) measure(c Condition, now time.Time) ([]float64, bool) {
+	var values []float64
+	total := 0.0
+	found := false
+	for _, s := range a.samples {
+		if s.name != c.Metric {
+			continue
+		}
+		match := true
+		for name, value := range c.Labels {
+			if s.labels[name] != value {
+				match = false
+			}
+		}
+		if !match {
+			continue
+		}
+		value := s.value
+		if c.RateWindowS > 0 {
+			history := a.history[s.key()]
+			if len(history) < 2 || now.Sub(history[0].at) < time.Duration(c.RateWindowS)*time.Second*9/10 {
+				continue
+			}
+			value = (history[len(history)-1].value - history[0].value) /
+				history[len(history)-1].at.Sub(history[0].at).Seconds()
+		}
+		found = true
+		total += value
+		values = append(values, value)
+	}
+	if c.Sum && found {
+		values = []float64{total}
+	}
+	return values, found
+}
+
+func compare(value float64, op string, threshold float64) bool {
+	switch op {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case "==":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	}
+	return false
+}
+
+// Whether a condition holds, for any series, and the value that made it so
+func (a *aggregator) holds(c Condition, now time.Time) (bool, float64) {
+	values, found := a.measure(c, now)
+	if !found {
+		return false, 0
+	}
+	for _, value := range values {
+		if compare(value, c.Op, c.Value) {
+			return true, value
+		}
+	}
+	return false, values[0]
+}
+
+// Evaluate the rules, with the lock held
+func (a *aggregator) evaluate(now time.Time) {
+	for _, rule := range a.config.Rules {
+		holds, value := a.holds(rule.Condition, now)
+		if holds && rule.OnlyIf != nil {
+			holds, _ = a.holds(*rule.OnlyIf, now)
+		}
+		alert := a.alerts[rule.Name]
+		if !holds {
+			delete(a.pending, rule.Name)
+			if alert.Firing {
+				alert.Firing = false
+				alert.Since = now.UTC()
+				alert.Value = value
+				slog.Info("Alert resolved.", "alert", rule.Name, "value", value)
+				go a.notify(*alert)
+			}
+			continue
+		}
+		started, ok := a.pending[rule.Name]
+		if !ok {
+			started = now
+			a.pending[rule.Name] = now
+		}
+		alert.Value = value
+		if !alert.Firing && now.Sub(started) >= time.Duration(rule.ForS)*time.Second {
+			alert.Firing = true
+			alert.Since = now.UTC()
+			slog.Warn("Alert firing.", "alert", rule.Name, "value", value)
+			go a.notify(*alert)
+		}
+	}
+}
+
+func (a *aggregator) notify(alert Alert) {
+	if a.config.Webhook == "" {
+		return
+	}
+	body, _ := json.Marshal(alert)
+	client := &http.Client{Timeout: scrapeTimeoutSecond * time.Second}
+	response, err := client.Post(a.config.Webhook, "application/json", bytes.NewReader(body))
+	if err == nil {
+		response.Body.Close()
+		if response.StatusCode/100 != 2 {
+			err = fmt.Errorf("webhook returned %s", response.Status)
+		}
+	}
+	if err != nil {
+		slog.Error("Unable to send alert to webhook.", "alert", alert.Name, "error", err)
+	}
+}
+
+// BEGIN SHARED BLOCK secret, see port/platform/common/automation/go_shared
+// Fetch a secret, e.g. a private key or a password, from where the
+// reference says it is, so that secrets need not be kept in files on
+// the machines of the test farm: "env:NAME" is the value of the
+// environment variable NAME, "vault:PATH#FIELD" is FIELD of the secret
+// at API path PATH (e.g. "secret/data/ubxlib/x" for a KV version 2
+// secrets engine mounted at "secret") in HashiCorp Vault, using
+// VAULT_ADDR, VAULT_TOKEN and, if set, VAULT_NAMESPACE from the
+// environment, and "file:PATH", or anything else, is a file
+func readSecret(reference string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(reference, "env:"):
+		value, ok := os.LookupEnv(reference[4:])
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", reference[4:])
+		}
+		return []byte(value), nil
+	case strings.HasPrefix(reference, "vault:"):
+		return readVaultSecret(reference[6:])
+	}
+	return ioutil.ReadFile(strings.TrimPrefix(reference, "file:"))
+}
+
+func readVaultSecret(reference string) ([]byte, error) {
+	x := strings.LastIndex(reference, "#")
+	if x < 0 {
+		return nil, fmt.Errorf("vault secret \"%s\" has no #field", reference)
+	}
+	secretPath, field := strings.Trim(reference[:x], "/"), reference[x+1:]
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	var value []byte
+	err := retry("vault "+secretPath, vaultAttempts, vaultTimeoutSecond*time.Second, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(address, "/")+"/v1/"+secretPath, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		request.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+		if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+			request.Header.Set("X-Vault-Namespace", namespace)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("vault returned HTTP status %d for %s", response.StatusCode, secretPath)
+			if response.StatusCode < http.StatusInternalServerError {
+				// e.g. a bad token or path, which won't get better
+				err = permanent(err)
+			}
+			return err
+		}
+		// KV version 1 has the fields in "data", version 2 in "data.data"
+		var secret struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&secret)
+		if err != nil {
+			return err
+		}
+		fields := secret.Data
+		if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+			if _, isV1Field := secret.Data[field]; !isV1Field {
+				fields = inner
+			}
+		}
+		text, ok := fields[field].(string)
+		if !ok {
+			return permanent(fmt.Errorf("vault secret %s has no string field \"%s\"", secretPath, field))
+		}
+		value = []byte(text)
+		return nil
+	})
+	return value, err
+}
+
+// END SHARED BLOCK secret
+
+// BEGIN SHARED BLOCK middleware, see port/platform/common/automation/go_shared
+// HttpOptions struct for JSON configuration: what the HTTP APIs of
+// the test tools have in common
+type HttpOptions struct {
+	// If present, the bearer token that every request must carry;
+	// may be env:NAME, vault:PATH#FIELD or file:PATH, see readSecret()
+	Token string `json:"token"`
+	// If non-zero, the requests per second allowed from any one
+	// client address, in bursts of up to Burst
+	RatePerSecond float64 `json:"rate-per-second"`
+	Burst         int     `json:"burst"`
+	// If true, every request is logged, otherwise only failed ones
+	AccessLog bool `json:"access-log"`
+}
+
+// Records the status of a response, for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+// A token bucket per client address
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Whether a request from the client is allowed now and, if not, how
+// long until it would be
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > rateLimitForgetSecond*time.Second {
+		for name, bucket := range l.clients {
+			if now.Sub(bucket.updated) > rateLimitForgetSecond*time.Second {
+				delete(l.clients, name)
+			}
+		}
+		l.swept = now
+	}
+	bucket, ok := l.clients[client]
+	if !ok {
+		bucket = &rateBucket{tokens: l.burst, updated: now}
+		l.clients[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Wrap the handler of an HTTP API in what the HTTP APIs of the test
+// tools have in common, outermost first: the access log, which
+// includes any test session ID given by the client in the header
+// X-Session-Id, then the rate limit, then the bearer token
+func httpMiddleware(handler http.Handler, options HttpOptions) (http.Handler, error) {
+	if options.Token != "" {
+		token, err := readSecret(options.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token: %w", err)
+		}
+		expected := []byte("Bearer " + strings.TrimSpace(string(token)))
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	if options.RatePerSecond > 0 {
+		limiter := &rateLimiter{rate: options.RatePerSecond, burst: float64(options.Burst),
+			clients: make(map[string]*rateBucket)}
+		if limiter.burst < 1 {
+			limiter.burst = 1
+		}
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			allowed, wait := limiter.allow(client)
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	inner := handler
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		inner.ServeHTTP(recorder, r)
+		level := slog.LevelDebug
+		if options.AccessLog {
+			level = slog.LevelInfo
+		}
+		if recorder.status >= 400 {
+			level = slog.LevelWarn
+		}
+		args := []any{"method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "status", recorder.status,
+			"bytes", recorder.bytes, "duration-ms", time.Since(started).Milliseconds()}
+		if session := r.Header.Get("X-Session-Id"); session != "" {
+			args = append(args, "client-session", session)
+		}
+		slog.Log(r.Context(), level, "Request.", args...)
+	})
+	return handler, nil
+}
+
+// END SHARED BLOCK middleware
+
+// Serve:
+//
+//	GET  /metrics      all of the metrics, Prometheus text format
+//	GET  /alerts       the state of each alert as JSON
+//	POST /push/<job>   metrics in Prometheus text format from a tool
+//	                   that can't be scraped, replacing those it sent last
+func (a *aggregator) serve() error {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		a.mutex.Lock()
+		var lines []string
+		for _, s := range a.samples {
+			lines = append(lines, s.key()+" "+strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+		for _, alert := range a.alerts {
+			firing := 0
+			if alert.Firing {
+				firing = 1
+			}
+			lines = append(lines, fmt.Sprintf("ubxlib_alert{name=%s} %d", strconv.Quote(alert.Name), firing))
+		}
+		a.mutex.Unlock()
+		sort.Strings(lines)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	})
+	http.HandleFunc("/alerts", func(w http.ResponseWriter, r *http.Request) {
+		a.mutex.Lock()
+		var alerts []Alert
+		for _, alert := range a.alerts {
+			alerts = append(alerts, *alert)
+		}
+		a.mutex.Unlock()
+		sort.Slice(alerts, func(i, j int) bool { return alerts[i].Name < alerts[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(alerts)
+	})
+	http.HandleFunc("/push/", func(w http.ResponseWriter, r *http.Request) {
+		job := strings.Trim(strings.TrimPrefix(r.URL.Path, "/push/"), "/")
+		if job == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			a.mutex.Lock()
+			delete(a.pushed, job)
+			a.mutex.Unlock()
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		samples, err := parsePrometheus(io.LimitReader(r.Body, maxPushBytes), map[string]string{"job": job})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.mutex.Lock()
+		a.pushed[job] = samples
+		a.mutex.Unlock()
+		slog.Debug("Metrics pushed.", "job", job, "samples", len(samples))
+	})
+	handler, err := httpMiddleware(http.DefaultServeMux, a.config.HttpOptions)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: ":" + a.config.HttpPort, Handler: handler}
+	onShutdown("http server", func(ctx context.Context) {
+		server.Shutdown(ctx)
+	})
+	slog.Info("HTTP listening.", "port", a.config.HttpPort)
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return err
+}
+
+// BEGIN SHARED BLOCK config, see port/platform/common/automation/go_shared
+// Overrides of fields of the configuration given with -set
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("must be of the form name=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// Add the line and column to an error from decoding the JSON
+// configuration, since a byte offset isn't much help to anyone
+func configError(contents []byte, err error) error {
+	var offset int64 = -1
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+		err = fmt.Errorf("%q must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	if offset < 0 || offset > int64(len(contents)) {
+		return err
+	}
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(contents[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// Set a field of the configuration from text, finding it by its
+// JSON name, with a "." between the names of nested fields; the
+// case of a name, and "_" rather than "-", don't matter, so that
+// the names can come from environment variables
+func configSet(config interface{}, name string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s: %q is not an object", name, part)
+		}
+		found := false
+		for x := 0; !found && x < field.NumField(); x++ {
+			tag := strings.Split(field.Type().Field(x).Tag.Get("json"), ",")[0]
+			if tag != "" && strings.EqualFold(strings.ReplaceAll(tag, "-", "_"), strings.ReplaceAll(part, "-", "_")) {
+				field = field.Field(x)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: there is no field %q in the configuration", name, part)
+		}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	// Anything else, numbers, booleans, lists or objects, as JSON,
+	// into a fresh value so that nothing of the old one is kept
+	fresh := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), fresh.Interface())
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(fresh.Elem())
+	return nil
+}
+
+// Load the JSON configuration and then apply overrides, first from
+// environment variables named UBXLIB_<TOOL>_<FIELD>, with "__" between
+// the names of nested fields, e.g. UBXLIB_DEVICE_TWIN_MQTT__BROKER,
+// then from -set name=value, so that a deployment need only record
+// how it differs from the checked-in configuration
+func configLoad(contents []byte, config interface{}, overrides []string) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		// Most likely a typo or a field from a newer version of the
+		// tool: worth knowing about but not worth stopping for
+		slog.Warn("Unknown field in the configuration, ignored.", "error", err)
+		err = json.Unmarshal(contents, config)
+	}
+	if err != nil {
+		return configError(contents, err)
+	}
+	prefix := "UBXLIB_" + strings.ToUpper(versionInfo().Tool) + "_"
+	var environment []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			environment = append(environment, strings.TrimPrefix(variable, prefix))
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		nameValue := strings.SplitN(variable, "=", 2)
+		// Only the name is logged since the value may be a secret
+		err = configSet(config, strings.ReplaceAll(nameValue[0], "__", "."), nameValue[1])
+		if err != nil {
+			// Could be meant for another tool with a longer name
+			slog.Warn("Environment variable not applied to the configuration.", "variable", prefix+nameValue[0], "error", err)
+		} else {
+			slog.Info("Configuration overridden from the environment.", "variable", prefix+nameValue[0])
+		}
+	}
+	for _, override := range overrides {
+		nameValue := strings.SplitN(override, "=", 2)
+		err = configSet(config, nameValue[0], nameValue[1])
+		if err != nil {
+			return fmt.Errorf("-set %w", err)
+		}
+		slog.Info("Configuration overridden.", "field", nameValue[0])
+	}
+	return nil
+}
+
+// END SHARED BLOCK config
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"manifest", "impair-proxy", "scrape", "push", "alerts"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "metrics", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "metrics")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+// BEGIN SHARED BLOCK retry, see port/platform/common/automation/go_shared
+// Retries, the same in all of the test tools, in place of fixed
+// sleeps: each delay is double the one before, up to a maximum, less
+// up to a half at random so that many clients don't retry in step
+const retryInitialMs = 500
+const retryMaxMs = 30000
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Start again from the initial delay, e.g. once a connection has
+// stayed up for a while
+func (b *backoff) reset() {
+	b.next = b.initial
+}
+
+// Wait for the next delay, returning false if the tool is asked to
+// stop in the meantime
+func (b *backoff) wait() bool {
+	timer := time.NewTimer(b.delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+// An error that trying again won't fix, e.g. a refusal rather than a
+// failure to connect
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// Call operation up to attempts times, backing off between attempts,
+// each attempt being given a context that is done after timeout or
+// when the tool is asked to stop; a permanent error isn't retried
+func retry(name string, attempts int, timeout time.Duration, operation func(ctx context.Context) error) error {
+	b := newBackoff(retryInitialMs*time.Millisecond, retryMaxMs*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(runContext(), timeout)
+		err := operation(ctx)
+		cancel()
+		var isPermanent permanentError
+		if err == nil || errors.As(err, &isPermanent) || attempt >= attempts {
+			return err
+		}
+		slog.Warn("Failed, trying again.", "operation", name, "attempt", attempt, "error", err)
+		if !b.wait() {
+			return err
+		}
+	}
+}
+
+// END SHARED BLOCK retry
+
+func main() {
+	defer recoverPanic()
+
+	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration.")
+	var overrides configOverrides
+	flag.Var(&overrides, "set", "Override a field of the configuration with name=value, name being the JSON name, with . between nested names; may be repeated.")
+	printConfig := flag.Bool("print_config", false, "Print the configuration, with any overrides applied, and exit.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	byteValue, err := ioutil.ReadFile(*configLocation)
+	if err != nil {
+		logFatal("Failed to open file.", "error", err)
+	}
+
+	var config Argument
+	err = configLoad(byteValue, &config, overrides)
+	if err != nil {
+		logFatal("Invalid configuration.", "file", *configLocation, "error", err)
+	}
+	if *printConfig {
+		contents, _ := json.MarshalIndent(config, "", "    ")
+		fmt.Println(string(contents))
+		return
+	}
+	if config.HttpPort == "" {
+		config.HttpPort = "8099"
+	}
+	if config.IntervalS <= 0 {
+		config.IntervalS = 15
+	}
+
+	a := &aggregator{config: config, pushed: make(map[string][]sample), history: make(map[string][]historyPoint),
+		logOffsets: make(map[string]int64), logCounts: make(map[string]float64),
+		patterns: make(map[string]*regexp.Regexp), pending: make(map[string]time.Time), alerts: make(map[string]*Alert)}
+	for name, pattern := range config.LogPatterns {
+		a.patterns[name], err = regexp.Compile(pattern)
+		if err != nil {
+			logFatal("Bad log pattern.", "pattern", name, "error", err)
+		}
+	}
+	for _, rule := range config.Rules {
+		for _, c := range []*Condition{&rule.Condition, rule.OnlyIf} {
+			if c != nil && !compare(0, c.Op, 0) && !compare(1, c.Op, 0) {
+				logFatal("Bad op in rule, must be one of >, >=, <, <=, == or !=.", "rule", rule.Name, "op", c.Op)
+			}
+		}
+		if _, ok := a.alerts[rule.Name]; ok || rule.Name == "" {
+			logFatal("Rule names must be present and unique.", "rule", rule.Name)
+		}
+		a.alerts[rule.Name] = &Alert{Name: rule.Name}
+	}
+	// Log files that already exist are counted from their end, so
+	// that old errors don't look like a spike
+	if config.Manifest != "" {
+		var manifest Manifest
+		contents, err := ioutil.ReadFile(config.Manifest)
+		if err == nil && json.Unmarshal(contents, &manifest) == nil {
+			for _, endpoint := range manifest.Services {
+				if info, err := os.Stat(endpoint.Log); err == nil {
+					a.logOffsets[endpoint.Log] = info.Size()
+				}
+			}
+		}
+	}
+
+	go func() {
+		defer recoverPanic()
+		err := a.serve()
+		if err != nil {
+			logFatal("HTTP server failed.", "error", err)
+		}
+	}()
+	go func() {
+		defer recoverPanic()
+		for {
+			a.collect()
+			time.Sleep(time.Duration(config.IntervalS) * time.Second)
+		}
+	}()
+
+	<-runContext().Done()
+	exit(exitOk)
+}
@@ -0,0 +1,859 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const ioTimeoutSecond = 10
+const ioAttempts = 3
+
+// Device struct for JSON configuration: one programmable
+// attenuator or RF switch on the network
+type Device struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Address  string  `json:"address"`
+	Channels int     `json:"channels"`
+	MaxDb    float64 `json:"max-attenuation-db"`
+	// Command templates, only used by the "scpi" type
+	SetCommand   string `json:"set-command"`
+	GetCommand   string `json:"get-command"`
+	RouteCommand string `json:"route-command"`
+}
+
+// Step struct for JSON configuration: one step of a scenario
+type Step struct {
+	Action  string  `json:"action"`
+	Device  string  `json:"device"`
+	Channel int     `json:"channel"`
+	Db      float64 `json:"db"`
+	ToDb    float64 `json:"to-db"`
+	StepDb  float64 `json:"step-db"`
+	Port    int     `json:"port"`
+	DwellMs int     `json:"dwell-ms"`
+}
+
+// Argument struct for JSON configuration
+type Argument struct {
+	Verbose   bool              `json:"verbose"`
+	Devices   []Device          `json:"devices"`
+	Scenarios map[string][]Step `json:"scenarios"`
+}
+
+// The interface that every attenuator/switch driver provides
+type rfDevice interface {
+	setAttenuation(channel int, db float64) error
+	attenuation(channel int) (float64, error)
+	route(port int) error
+	close()
+}
+
+// Driver for Mini-Circuits RCDAT/RC4DAT attenuators and
+// RC-style switches using their HTTP API
+type miniCircuitsDevice struct {
+	address string
+	client  *http.Client
+}
+
+// The commands only set or read a value, so trying one again is safe
+func (d *miniCircuitsDevice) command(cmd string) (string, error) {
+	var reply string
+	err := retry(d.address+" "+cmd, ioAttempts, ioTimeoutSecond*time.Second, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+d.address+"/"+cmd, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		response, err := d.client.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		if response.StatusCode != http.StatusOK {
+			return permanent(fmt.Errorf("%s returned HTTP status %d", cmd, response.StatusCode))
+		}
+		reply = strings.TrimSpace(string(body))
+		return nil
+	})
+	return reply, err
+}
+
+func (d *miniCircuitsDevice) setAttenuation(channel int, db float64) error {
+	var cmd string
+	if channel > 0 {
+		cmd = fmt.Sprintf(":CHAN:%d:SETATT:%.2f", channel, db)
+	} else {
+		cmd = fmt.Sprintf("SETATT=%.2f", db)
+	}
+	reply, err := d.command(cmd)
+	if err == nil && reply != "1" {
+		err = fmt.Errorf("%s was refused (reply \"%s\")", cmd, reply)
+	}
+	return err
+}
+
+func (d *miniCircuitsDevice) attenuation(channel int) (float64, error) {
+	cmd := "ATT?"
+	if channel > 0 {
+		cmd = fmt.Sprintf(":CHAN:%d:ATT?", channel)
+	}
+	reply, err := d.command(cmd)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(reply, 64)
+}
+
+func (d *miniCircuitsDevice) route(port int) error {
+	cmd := fmt.Sprintf("SETP=%d", port)
+	reply, err := d.command(cmd)
+	if err == nil && reply != "1" {
+		err = fmt.Errorf("%s was refused (reply \"%s\")", cmd, reply)
+	}
+	return err
+}
+
+func (d *miniCircuitsDevice) close() {
+}
+
+// Driver for any instrument that accepts line-based SCPI-style
+// commands on a raw TCP socket (e.g. port 5025); the commands are
+// Printf() templates from the configuration
+type scpiDevice struct {
+	device     Device
+	connection net.Conn
+	reader     *bufio.Reader
+}
+
+func (d *scpiDevice) command(cmd string, reply bool) (string, error) {
+	d.connection.SetDeadline(time.Now().Add(ioTimeoutSecond * time.Second))
+	_, err := d.connection.Write([]byte(cmd + "\n"))
+	if err != nil || !reply {
+		return "", err
+	}
+	line, err := d.reader.ReadString('\n')
+	return strings.TrimSpace(line), err
+}
+
+func (d *scpiDevice) setAttenuation(channel int, db float64) error {
+	if d.device.SetCommand == "" {
+		return fmt.Errorf("no set-command configured for %s", d.device.Name)
+	}
+	_, err := d.command(fmt.Sprintf(d.device.SetCommand, channel, db), false)
+	return err
+}
+
+func (d *scpiDevice) attenuation(channel int) (float64, error) {
+	if d.device.GetCommand == "" {
+		return 0, fmt.Errorf("no get-command configured for %s", d.device.Name)
+	}
+	reply, err := d.command(fmt.Sprintf(d.device.GetCommand, channel), true)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(reply, 64)
+}
+
+func (d *scpiDevice) route(port int) error {
+	if d.device.RouteCommand == "" {
+		return fmt.Errorf("no route-command configured for %s", d.device.Name)
+	}
+	_, err := d.command(fmt.Sprintf(d.device.RouteCommand, port), false)
+	return err
+}
+
+func (d *scpiDevice) close() {
+	d.connection.Close()
+}
+
+func openDevice(device Device) (rfDevice, error) {
+	switch device.Type {
+	case "minicircuits":
+		return &miniCircuitsDevice{address: device.Address,
+			client: &http.Client{Timeout: ioTimeoutSecond * time.Second}}, nil
+	case "scpi":
+		var connection net.Conn
+		err := retry("connect to "+device.Name, ioAttempts, ioTimeoutSecond*time.Second, func(ctx context.Context) error {
+			var err error
+			connection, err = (&net.Dialer{}).DialContext(ctx, "tcp", device.Address)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &scpiDevice{device: device, connection: connection,
+			reader: bufio.NewReader(connection)}, nil
+	}
+	return nil, fmt.Errorf("unknown device type \"%s\" for %s", device.Type, device.Name)
+}
+
+func findDevice(config Argument, name string) (Device, error) {
+	for _, device := range config.Devices {
+		if device.Name == name || name == "" {
+			return device, nil
+		}
+	}
+	return Device{}, fmt.Errorf("no device named \"%s\" in the configuration", name)
+}
+
+func setAttenuation(device Device, driver rfDevice, channel int, db float64, verbose bool) error {
+	if db < 0 || (device.MaxDb > 0 && db > device.MaxDb) {
+		return fmt.Errorf("%.2f dB is out of range for %s (0 to %.2f dB)", db, device.Name, device.MaxDb)
+	}
+	if device.Channels > 0 && channel > device.Channels {
+		return fmt.Errorf("%s has no channel %d", device.Name, channel)
+	}
+	err := driver.setAttenuation(channel, db)
+	if err == nil && verbose {
+		slog.Info("Attenuation set.", "device", device.Name, "channel", channel, "db", db)
+	}
+	return err
+}
+
+var errInterrupted = errors.New("interrupted")
+
+// Dwell for a number of milliseconds, unless told to stop
+func dwell(ms int) error {
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return nil
+	case <-runContext().Done():
+		return errInterrupted
+	}
+}
+
+// Sweep from one attenuation to another, which may be upwards
+// (coverage loss) or downwards (recovery), dwelling at each step
+func sweep(device Device, driver rfDevice, step Step, verbose bool) error {
+	increment := step.StepDb
+	if increment <= 0 {
+		increment = 1
+	}
+	if step.ToDb < step.Db {
+		increment = -increment
+	}
+	db := step.Db
+	for {
+		err := setAttenuation(device, driver, step.Channel, db, verbose)
+		if err != nil {
+			return err
+		}
+		err = dwell(step.DwellMs)
+		if err != nil {
+			return err
+		}
+		if db == step.ToDb {
+			break
+		}
+		db += increment
+		if (increment > 0 && db > step.ToDb) || (increment < 0 && db < step.ToDb) {
+			db = step.ToDb
+		}
+	}
+	return nil
+}
+
+func runStep(config Argument, drivers map[string]rfDevice, step Step) error {
+	device, err := findDevice(config, step.Device)
+	if err != nil {
+		return err
+	}
+	driver, ok := drivers[device.Name]
+	if !ok {
+		driver, err = openDevice(device)
+		if err != nil {
+			return err
+		}
+		drivers[device.Name] = driver
+	}
+	switch step.Action {
+	case "set":
+		err = setAttenuation(device, driver, step.Channel, step.Db, config.Verbose)
+		if err == nil {
+			err = dwell(step.DwellMs)
+		}
+	case "sweep":
+		err = sweep(device, driver, step, config.Verbose)
+	case "route":
+		err = driver.route(step.Port)
+		if err == nil && config.Verbose {
+			slog.Info("Switch routed.", "device", device.Name, "port", step.Port)
+		}
+		if err == nil {
+			err = dwell(step.DwellMs)
+		}
+	case "get":
+		var db float64
+		db, err = driver.attenuation(step.Channel)
+		if err == nil {
+			fmt.Printf("%s %d %.2f\n", device.Name, step.Channel, db)
+		}
+	case "wait":
+		err = dwell(step.DwellMs)
+	default:
+		err = fmt.Errorf("unknown action \"%s\"", step.Action)
+	}
+	return err
+}
+
+func runSteps(config Argument, steps []Step) error {
+	drivers := make(map[string]rfDevice)
+	defer func() {
+		for _, driver := range drivers {
+			driver.close()
+		}
+	}()
+	for _, step := range steps {
+		err := runStep(config, drivers, step)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Turn the command-line arguments after the flags into a step,
+// e.g. "set 1 30", "get 1", "sweep 1 0 60 2 1000", "route 2"
+func commandLineStep(device string, args []string) (Step, error) {
+	step := Step{Action: args[0], Device: device}
+	values := make([]float64, len(args)-1)
+	for x, arg := range args[1:] {
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return step, fmt.Errorf("\"%s\" is not a number", arg)
+		}
+		values[x] = value
+	}
+	need := map[string]int{"set": 2, "get": 1, "sweep": 5, "route": 1, "wait": 1}
+	count, ok := need[step.Action]
+	if !ok || len(values) != count {
+		return step, fmt.Errorf("usage: set <channel> <dB> | get <channel> | sweep <channel> <from dB> <to dB> <step dB> <dwell ms> | route <port> | wait <ms>")
+	}
+	switch step.Action {
+	case "set":
+		step.Channel, step.Db = int(values[0]), values[1]
+	case "get":
+		step.Channel = int(values[0])
+	case "sweep":
+		step.Channel, step.Db, step.ToDb, step.StepDb = int(values[0]), values[1], values[2], values[3]
+		step.DwellMs = int(values[4])
+	case "route":
+		step.Port = int(values[0])
+	case "wait":
+		step.DwellMs = int(values[0])
+	}
+	return step, nil
+}
+
+// BEGIN SHARED BLOCK config, see port/platform/common/automation/go_shared
+// Overrides of fields of the configuration given with -set
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("must be of the form name=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// Add the line and column to an error from decoding the JSON
+// configuration, since a byte offset isn't much help to anyone
+func configError(contents []byte, err error) error {
+	var offset int64 = -1
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+		err = fmt.Errorf("%q must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	if offset < 0 || offset > int64(len(contents)) {
+		return err
+	}
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(contents[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// Set a field of the configuration from text, finding it by its
+// JSON name, with a "." between the names of nested fields; the
+// case of a name, and "_" rather than "-", don't matter, so that
+// the names can come from environment variables
+func configSet(config interface{}, name string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s: %q is not an object", name, part)
+		}
+		found := false
+		for x := 0; !found && x < field.NumField(); x++ {
+			tag := strings.Split(field.Type().Field(x).Tag.Get("json"), ",")[0]
+			if tag != "" && strings.EqualFold(strings.ReplaceAll(tag, "-", "_"), strings.ReplaceAll(part, "-", "_")) {
+				field = field.Field(x)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: there is no field %q in the configuration", name, part)
+		}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	// Anything else, numbers, booleans, lists or objects, as JSON,
+	// into a fresh value so that nothing of the old one is kept
+	fresh := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), fresh.Interface())
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(fresh.Elem())
+	return nil
+}
+
+// Load the JSON configuration and then apply overrides, first from
+// environment variables named UBXLIB_<TOOL>_<FIELD>, with "__" between
+// the names of nested fields, e.g. UBXLIB_DEVICE_TWIN_MQTT__BROKER,
+// then from -set name=value, so that a deployment need only record
+// how it differs from the checked-in configuration
+func configLoad(contents []byte, config interface{}, overrides []string) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		// Most likely a typo or a field from a newer version of the
+		// tool: worth knowing about but not worth stopping for
+		slog.Warn("Unknown field in the configuration, ignored.", "error", err)
+		err = json.Unmarshal(contents, config)
+	}
+	if err != nil {
+		return configError(contents, err)
+	}
+	prefix := "UBXLIB_" + strings.ToUpper(versionInfo().Tool) + "_"
+	var environment []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			environment = append(environment, strings.TrimPrefix(variable, prefix))
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		nameValue := strings.SplitN(variable, "=", 2)
+		// Only the name is logged since the value may be a secret
+		err = configSet(config, strings.ReplaceAll(nameValue[0], "__", "."), nameValue[1])
+		if err != nil {
+			// Could be meant for another tool with a longer name
+			slog.Warn("Environment variable not applied to the configuration.", "variable", prefix+nameValue[0], "error", err)
+		} else {
+			slog.Info("Configuration overridden from the environment.", "variable", prefix+nameValue[0])
+		}
+	}
+	for _, override := range overrides {
+		nameValue := strings.SplitN(override, "=", 2)
+		err = configSet(config, nameValue[0], nameValue[1])
+		if err != nil {
+			return fmt.Errorf("-set %w", err)
+		}
+		slog.Info("Configuration overridden.", "field", nameValue[0])
+	}
+	return nil
+}
+
+// END SHARED BLOCK config
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"minicircuits", "scpi"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "rf_control", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "rf_control")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+// BEGIN SHARED BLOCK retry, see port/platform/common/automation/go_shared
+// Retries, the same in all of the test tools, in place of fixed
+// sleeps: each delay is double the one before, up to a maximum, less
+// up to a half at random so that many clients don't retry in step
+const retryInitialMs = 500
+const retryMaxMs = 30000
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Start again from the initial delay, e.g. once a connection has
+// stayed up for a while
+func (b *backoff) reset() {
+	b.next = b.initial
+}
+
+// Wait for the next delay, returning false if the tool is asked to
+// stop in the meantime
+func (b *backoff) wait() bool {
+	timer := time.NewTimer(b.delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+// An error that trying again won't fix, e.g. a refusal rather than a
+// failure to connect
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// Call operation up to attempts times, backing off between attempts,
+// each attempt being given a context that is done after timeout or
+// when the tool is asked to stop; a permanent error isn't retried
+func retry(name string, attempts int, timeout time.Duration, operation func(ctx context.Context) error) error {
+	b := newBackoff(retryInitialMs*time.Millisecond, retryMaxMs*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(runContext(), timeout)
+		err := operation(ctx)
+		cancel()
+		var isPermanent permanentError
+		if err == nil || errors.As(err, &isPermanent) || attempt >= attempts {
+			return err
+		}
+		slog.Warn("Failed, trying again.", "operation", name, "attempt", attempt, "error", err)
+		if !b.wait() {
+			return err
+		}
+	}
+}
+
+// END SHARED BLOCK retry
+
+func main() {
+	defer recoverPanic()
+
+	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration.")
+	var overrides configOverrides
+	flag.Var(&overrides, "set", "Override a field of the configuration with name=value, name being the JSON name, with . between nested names; may be repeated.")
+	printConfig := flag.Bool("print_config", false, "Print the configuration, with any overrides applied, and exit.")
+	deviceName := flag.String("device", "", "Name of the device to control, default the first in the configuration.")
+	scenario := flag.String("scenario", "", "Name of a scenario from the configuration to run.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+	jsonFile, err := os.Open(*configLocation)
+
+	if err != nil {
+		logFatal("Failed to open file.", "error", err)
+	}
+	defer jsonFile.Close()
+
+	byteValue, _ := ioutil.ReadAll(jsonFile)
+
+	var config Argument
+	err = configLoad(byteValue, &config, overrides)
+	if err != nil {
+		logFatal("Invalid configuration.", "file", *configLocation, "error", err)
+	}
+	if *printConfig {
+		contents, _ := json.MarshalIndent(config, "", "    ")
+		fmt.Println(string(contents))
+		return
+	}
+
+	var steps []Step
+	if *scenario != "" {
+		var ok bool
+		steps, ok = config.Scenarios[*scenario]
+		if !ok {
+			logFatal("No such scenario in the configuration.", "scenario", *scenario)
+		}
+	} else if flag.NArg() > 0 {
+		step, err := commandLineStep(*deviceName, flag.Args())
+		if err != nil {
+			logFatal("Bad command.", "error", err)
+		}
+		steps = append(steps, step)
+	} else {
+		logFatal("Nothing to do: give either -scenario or a command.")
+	}
+
+	err = runSteps(config, steps)
+	if errors.Is(err, errInterrupted) {
+		// The attenuators and switches are left as they were
+		slog.Warn("Interrupted.")
+		exit(exitInterrupted)
+	}
+	if err != nil {
+		logFatal("Step failed.", "error", err)
+	}
+}
@@ -0,0 +1,894 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const inventoryTimeoutSecond = 30
+const defaultDurationSecond = 600
+
+// The output of a shard goes straight to its log file; only this
+// much of the end of it is kept, to match board-failure-patterns
+const outputTailBytes = 1024 * 1024
+
+// Board struct for JSON configuration or from the inventory: one
+// physical board and the instances (from DATABASE.md) it can run
+type Board struct {
+	Name      string            `json:"name"`
+	Instances []string          `json:"instances"`
+	Available *bool             `json:"available"`
+	Env       map[string]string `json:"env"`
+}
+
+// Shard struct for JSON configuration: a test instance and filter
+// which together make up one unit of work for a board
+type Shard struct {
+	Instance string `json:"instance"`
+	Filter   string `json:"filter"`
+}
+
+// Argument struct for JSON configuration
+type Argument struct {
+	Inventory            string   `json:"inventory"`
+	Boards               []Board  `json:"boards"`
+	History              string   `json:"history"`
+	Command              []string `json:"command"`
+	WorkingDirectory     string   `json:"working-directory"`
+	TimeoutS             int      `json:"timeout-s"`
+	BoardFailureCodes    []int    `json:"board-failure-exit-codes"`
+	BoardFailurePatterns []string `json:"board-failure-patterns"`
+	MaxAttempts          int      `json:"max-attempts"`
+	Shards               []Shard  `json:"shards"`
+}
+
+// Result of running a shard
+type Result struct {
+	Instance  string  `json:"instance"`
+	Filter    string  `json:"filter"`
+	Board     string  `json:"board"`
+	Outcome   string  `json:"outcome"`
+	ExitCode  int     `json:"exit-code"`
+	Attempts  int     `json:"attempts"`
+	DurationS float64 `json:"duration-s"`
+}
+
+// History of how long each shard takes, a moving average
+type History map[string]float64
+
+func shardKey(shard Shard) string {
+	return shard.Instance + " " + shard.Filter
+}
+
+// Read the boards from the inventory, a URL or a file, which is
+// either a list of boards or an object with a "boards" field
+func loadInventory(location string) ([]Board, error) {
+	var contents []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		client := &http.Client{Timeout: inventoryTimeoutSecond * time.Second}
+		var response *http.Response
+		response, err = client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned HTTP status %d", location, response.StatusCode)
+		}
+		contents, err = ioutil.ReadAll(response.Body)
+	} else {
+		contents, err = ioutil.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var boards []Board
+	if json.Unmarshal(contents, &boards) != nil {
+		var wrapped struct {
+			Boards []Board `json:"boards"`
+		}
+		err = json.Unmarshal(contents, &wrapped)
+		boards = wrapped.Boards
+	}
+	return boards, err
+}
+
+func canRun(board Board, instance string) bool {
+	for _, x := range board.Instances {
+		if x == instance {
+			return true
+		}
+	}
+	return false
+}
+
+type scheduler struct {
+	config    Argument
+	history   History
+	patterns  []*regexp.Regexp
+	logDir    string
+	mutex     sync.Mutex
+	pending   []Shard
+	attempts  map[string]int
+	running   int
+	boards    map[string]bool
+	results   []Result
+	available *sync.Cond
+	ctx       context.Context
+}
+
+func (s *scheduler) expected(shard Shard) float64 {
+	duration, ok := s.history[shardKey(shard)]
+	if !ok {
+		return defaultDurationSecond
+	}
+	return duration
+}
+
+// Take the longest pending shard that a board can run, waiting
+// while other boards are still running shards that might come
+// back; returns false when there is nothing more for this board
+func (s *scheduler) take(board Board) (Shard, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		for x, shard := range s.pending {
+			if canRun(board, shard.Instance) {
+				s.pending = append(s.pending[:x], s.pending[x+1:]...)
+				s.running++
+				return shard, true
+			}
+		}
+		if s.running == 0 || s.ctx.Err() != nil {
+			return Shard{}, false
+		}
+		s.available.Wait()
+	}
+}
+
+// Put back a shard that failed because of its board, so that
+// another board can take it, unless it has run out of attempts
+// or no working board is left that could run it
+func (s *scheduler) requeue(shard Shard) bool {
+	key := shardKey(shard)
+	s.attempts[key]++
+	if s.attempts[key] >= s.config.MaxAttempts {
+		return false
+	}
+	s.pending = append(s.pending, shard)
+	sort.SliceStable(s.pending, func(a, b int) bool {
+		return s.expected(s.pending[a]) > s.expected(s.pending[b])
+	})
+	return true
+}
+
+func (s *scheduler) hasWorkingBoard(instance string, boards []Board) bool {
+	for _, board := range boards {
+		if s.boards[board.Name] && canRun(board, instance) {
+			return true
+		}
+	}
+	return false
+}
+
+// Where the output of a shard goes: its log file, of which the first
+// write error is kept, and the last outputTailBytes of it; the
+// command is never held up by a failure to write the log
+type shardOutput struct {
+	file *os.File
+	err  error
+	tail []byte
+}
+
+func (o *shardOutput) Write(data []byte) (int, error) {
+	if o.file != nil && o.err == nil {
+		_, o.err = o.file.Write(data)
+	}
+	o.tail = append(o.tail, data...)
+	if len(o.tail) > outputTailBytes {
+		o.tail = append(o.tail[:0], o.tail[len(o.tail)-outputTailBytes:]...)
+	}
+	return len(data), nil
+}
+
+func expand(text string, board Board, shard Shard) string {
+	text = strings.ReplaceAll(text, "{board}", board.Name)
+	text = strings.ReplaceAll(text, "{instance}", shard.Instance)
+	return strings.ReplaceAll(text, "{filter}", shard.Filter)
+}
+
+// Run one shard on a board, returning the exit code and whether
+// the failure, if any, was down to the board rather than the tests
+func (s *scheduler) runShard(board Board, shard Shard) (int, bool) {
+	var args []string
+	for _, arg := range s.config.Command[1:] {
+		args = append(args, expand(arg, board, shard))
+	}
+	cmd := exec.Command(expand(s.config.Command[0], board, shard), args...)
+	cmd.Dir = s.config.WorkingDirectory
+	cmd.Env = os.Environ()
+	for key, value := range board.Env {
+		cmd.Env = append(cmd.Env, key+"="+expand(value, board, shard))
+	}
+	logName := filepath.Join(s.logDir, fmt.Sprintf("%s_%s_%s.log", strings.ReplaceAll(shard.Instance, ".", "_"),
+		regexp.MustCompile(`[^A-Za-z0-9]+`).ReplaceAllString(shard.Filter, "_"), board.Name))
+	output := &shardOutput{}
+	file, err := os.Create(logName)
+	if err == nil {
+		output.file = file
+		defer func() {
+			err := file.Close()
+			if output.err == nil {
+				output.err = err
+			}
+			if output.err != nil {
+				slog.Error("Unable to write shard output.", "file", logName, "error", output.err)
+			}
+		}()
+	} else {
+		slog.Error("Unable to create shard output file.", "file", logName, "error", err)
+	}
+	// The same writer for both, so that exec copies them to it
+	// from one goroutine
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = cmd.Start()
+	if err != nil {
+		slog.Error("Unable to start command.", "board", board.Name, "error", err)
+		return -1, true
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-time.After(time.Duration(s.config.TimeoutS) * time.Second):
+		cmd.Process.Kill()
+		err = <-done
+		timedOut = true
+	case <-s.ctx.Done():
+		cmd.Process.Kill()
+		err = <-done
+	}
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		}
+	}
+	if timedOut {
+		slog.Error("Shard timed out.", "board", board.Name, "instance", shard.Instance, "filter", shard.Filter)
+		return exitCode, true
+	}
+	for _, code := range s.config.BoardFailureCodes {
+		if exitCode == code {
+			return exitCode, true
+		}
+	}
+	for _, pattern := range s.patterns {
+		if pattern.Match(output.tail) {
+			return exitCode, true
+		}
+	}
+	return exitCode, false
+}
+
+// Keep a board busy until there is nothing left that it can run
+// or it has failed
+func (s *scheduler) work(board Board, boards []Board) {
+	for {
+		shard, ok := s.take(board)
+		if !ok {
+			return
+		}
+		started := time.Now()
+		slog.Info("Shard started.", "board", board.Name, "instance", shard.Instance, "filter", shard.Filter,
+			"expected-s", int(s.expected(shard)))
+		exitCode, boardFailure := s.runShard(board, shard)
+		duration := time.Since(started).Seconds()
+
+		s.mutex.Lock()
+		s.running--
+		result := Result{Instance: shard.Instance, Filter: shard.Filter, Board: board.Name,
+			ExitCode: exitCode, Attempts: s.attempts[shardKey(shard)] + 1, DurationS: duration}
+		if s.ctx.Err() != nil {
+			result.Outcome = "interrupted"
+			s.results = append(s.results, result)
+			s.available.Broadcast()
+			s.mutex.Unlock()
+			return
+		}
+		if boardFailure {
+			s.boards[board.Name] = false
+			slog.Error("Board failed, taking it out of service.", "board", board.Name,
+				"instance", shard.Instance, "filter", shard.Filter, "exit-code", exitCode)
+			if !s.hasWorkingBoard(shard.Instance, boards) || !s.requeue(shard) {
+				result.Outcome = "board-failure"
+				s.results = append(s.results, result)
+			}
+		} else {
+			result.Outcome = "pass"
+			if exitCode != 0 {
+				result.Outcome = "fail"
+			}
+			// Only durations of complete runs are worth learning from
+			key := shardKey(shard)
+			if previous, ok := s.history[key]; ok {
+				s.history[key] = previous*0.7 + duration*0.3
+			} else {
+				s.history[key] = duration
+			}
+			s.results = append(s.results, result)
+			slog.Info("Shard finished.", "board", board.Name, "instance", shard.Instance, "filter", shard.Filter,
+				"outcome", result.Outcome, "exit-code", exitCode, "duration-s", int(duration))
+		}
+		s.available.Broadcast()
+		s.mutex.Unlock()
+		if boardFailure {
+			return
+		}
+	}
+}
+
+// Work out, without running anything, which board would run what,
+// using the expected durations
+func (s *scheduler) plan(boards []Board) map[string][]Shard {
+	plan := make(map[string][]Shard)
+	busyUntil := make(map[string]float64)
+	for _, shard := range s.pending {
+		best := ""
+		for _, board := range boards {
+			if canRun(board, shard.Instance) && (best == "" || busyUntil[board.Name] < busyUntil[best]) {
+				best = board.Name
+			}
+		}
+		if best != "" {
+			plan[best] = append(plan[best], shard)
+			busyUntil[best] += s.expected(shard)
+		}
+	}
+	return plan
+}
+
+// BEGIN SHARED BLOCK config, see port/platform/common/automation/go_shared
+// Overrides of fields of the configuration given with -set
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("must be of the form name=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// Add the line and column to an error from decoding the JSON
+// configuration, since a byte offset isn't much help to anyone
+func configError(contents []byte, err error) error {
+	var offset int64 = -1
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+		err = fmt.Errorf("%q must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	if offset < 0 || offset > int64(len(contents)) {
+		return err
+	}
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(contents[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// Set a field of the configuration from text, finding it by its
+// JSON name, with a "." between the names of nested fields; the
+// case of a name, and "_" rather than "-", don't matter, so that
+// the names can come from environment variables
+func configSet(config interface{}, name string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s: %q is not an object", name, part)
+		}
+		found := false
+		for x := 0; !found && x < field.NumField(); x++ {
+			tag := strings.Split(field.Type().Field(x).Tag.Get("json"), ",")[0]
+			if tag != "" && strings.EqualFold(strings.ReplaceAll(tag, "-", "_"), strings.ReplaceAll(part, "-", "_")) {
+				field = field.Field(x)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: there is no field %q in the configuration", name, part)
+		}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	// Anything else, numbers, booleans, lists or objects, as JSON,
+	// into a fresh value so that nothing of the old one is kept
+	fresh := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), fresh.Interface())
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(fresh.Elem())
+	return nil
+}
+
+// Load the JSON configuration and then apply overrides, first from
+// environment variables named UBXLIB_<TOOL>_<FIELD>, with "__" between
+// the names of nested fields, e.g. UBXLIB_DEVICE_TWIN_MQTT__BROKER,
+// then from -set name=value, so that a deployment need only record
+// how it differs from the checked-in configuration
+func configLoad(contents []byte, config interface{}, overrides []string) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		// Most likely a typo or a field from a newer version of the
+		// tool: worth knowing about but not worth stopping for
+		slog.Warn("Unknown field in the configuration, ignored.", "error", err)
+		err = json.Unmarshal(contents, config)
+	}
+	if err != nil {
+		return configError(contents, err)
+	}
+	prefix := "UBXLIB_" + strings.ToUpper(versionInfo().Tool) + "_"
+	var environment []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			environment = append(environment, strings.TrimPrefix(variable, prefix))
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		nameValue := strings.SplitN(variable, "=", 2)
+		// Only the name is logged since the value may be a secret
+		err = configSet(config, strings.ReplaceAll(nameValue[0], "__", "."), nameValue[1])
+		if err != nil {
+			// Could be meant for another tool with a longer name
+			slog.Warn("Environment variable not applied to the configuration.", "variable", prefix+nameValue[0], "error", err)
+		} else {
+			slog.Info("Configuration overridden from the environment.", "variable", prefix+nameValue[0])
+		}
+	}
+	for _, override := range overrides {
+		nameValue := strings.SplitN(override, "=", 2)
+		err = configSet(config, nameValue[0], nameValue[1])
+		if err != nil {
+			return fmt.Errorf("-set %w", err)
+		}
+		slog.Info("Configuration overridden.", "field", nameValue[0])
+	}
+	return nil
+}
+
+// END SHARED BLOCK config
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"inventory", "history", "reassign"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "shard_scheduler", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "shard_scheduler")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+func main() {
+	defer recoverPanic()
+
+	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration.")
+	var overrides configOverrides
+	flag.Var(&overrides, "set", "Override a field of the configuration with name=value, name being the JSON name, with . between nested names; may be repeated.")
+	printConfig := flag.Bool("print_config", false, "Print the configuration, with any overrides applied, and exit.")
+	logDir := flag.String("log_dir", ".", "Directory to write the output of each shard to.")
+	reportFile := flag.String("report", "", "File to write the results to as JSON.")
+	dryRun := flag.Bool("dry_run", false, "Print which board would run which shard, and the expected duration, without running anything.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	byteValue, err := ioutil.ReadFile(*configLocation)
+	if err != nil {
+		logFatal("Failed to open file.", "error", err)
+	}
+
+	var config Argument
+	err = configLoad(byteValue, &config, overrides)
+	if err != nil {
+		logFatal("Invalid configuration.", "file", *configLocation, "error", err)
+	}
+	if *printConfig {
+		contents, _ := json.MarshalIndent(config, "", "    ")
+		fmt.Println(string(contents))
+		return
+	}
+	if len(config.Command) == 0 {
+		logFatal("No command in the configuration.")
+	}
+	if config.TimeoutS <= 0 {
+		config.TimeoutS = 4 * 3600
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 3
+	}
+
+	allBoards := config.Boards
+	if config.Inventory != "" {
+		allBoards, err = loadInventory(config.Inventory)
+		if err != nil {
+			logFatal("Unable to read inventory.", "inventory", config.Inventory, "error", err)
+		}
+	}
+	var boards []Board
+	for _, board := range allBoards {
+		if board.Available == nil || *board.Available {
+			boards = append(boards, board)
+		}
+	}
+
+	s := &scheduler{config: config, history: make(History), logDir: *logDir,
+		attempts: make(map[string]int), boards: make(map[string]bool), ctx: runContext()}
+	s.available = sync.NewCond(&s.mutex)
+	for _, pattern := range config.BoardFailurePatterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			logFatal("Invalid board-failure-patterns.", "pattern", pattern, "error", err)
+		}
+		s.patterns = append(s.patterns, compiled)
+	}
+	if config.History != "" {
+		contents, err := ioutil.ReadFile(config.History)
+		if err == nil {
+			err = json.Unmarshal(contents, &s.history)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			slog.Warn("Unable to read history, assuming default durations.", "error", err)
+		}
+	}
+
+	// Longest first, so that the long shards don't end up
+	// being started last and holding everything up
+	for _, shard := range config.Shards {
+		if shard.Instance == "" {
+			continue
+		}
+		ok := false
+		for _, board := range boards {
+			ok = ok || canRun(board, shard.Instance)
+		}
+		if ok {
+			s.pending = append(s.pending, shard)
+		} else {
+			slog.Error("No available board can run instance.", "instance", shard.Instance, "filter", shard.Filter)
+			s.results = append(s.results, Result{Instance: shard.Instance, Filter: shard.Filter, Outcome: "no-board"})
+		}
+	}
+	sort.SliceStable(s.pending, func(a, b int) bool {
+		return s.expected(s.pending[a]) > s.expected(s.pending[b])
+	})
+
+	if *dryRun {
+		plan := s.plan(boards)
+		for _, board := range boards {
+			total := 0.0
+			fmt.Printf("%s:\n", board.Name)
+			for _, shard := range plan[board.Name] {
+				fmt.Printf("  %-8s %-24s %6d s\n", shard.Instance, shard.Filter, int(s.expected(shard)))
+				total += s.expected(shard)
+			}
+			fmt.Printf("  total %d s\n", int(total))
+		}
+		return
+	}
+
+	err = os.MkdirAll(*logDir, 0755)
+	if err != nil {
+		logFatal("Unable to create log directory.", "directory", *logDir, "error", err)
+	}
+
+	// When interrupted the running shards are stopped and the
+	// history and report written with what has been done so far
+	go func() {
+		<-s.ctx.Done()
+		s.mutex.Lock()
+		s.available.Broadcast()
+		s.mutex.Unlock()
+	}()
+	started := time.Now()
+	var finished sync.WaitGroup
+	for _, board := range boards {
+		s.boards[board.Name] = true
+		finished.Add(1)
+		go func(board Board) {
+			defer recoverPanic()
+			s.work(board, boards)
+			finished.Done()
+		}(board)
+	}
+	finished.Wait()
+	for _, shard := range s.pending {
+		// Left over because every board that could run them failed,
+		// or because the run was interrupted
+		outcome := "board-failure"
+		if s.ctx.Err() != nil {
+			outcome = "interrupted"
+		}
+		s.results = append(s.results, Result{Instance: shard.Instance, Filter: shard.Filter,
+			Outcome: outcome, Attempts: s.attempts[shardKey(shard)]})
+	}
+
+	if config.History != "" {
+		contents, _ := json.MarshalIndent(s.history, "", "    ")
+		err = ioutil.WriteFile(config.History, contents, 0644)
+		if err != nil {
+			slog.Error("Unable to write history.", "error", err)
+		}
+	}
+	if *reportFile != "" {
+		contents, _ := json.MarshalIndent(s.results, "", "    ")
+		err = ioutil.WriteFile(*reportFile, contents, 0644)
+		if err != nil {
+			slog.Error("Unable to write report.", "error", err)
+		}
+	}
+	failures := 0
+	for _, result := range s.results {
+		if result.Outcome != "pass" {
+			failures++
+			slog.Error("Shard did not pass.", "instance", result.Instance, "filter", result.Filter,
+				"board", result.Board, "outcome", result.Outcome, "exit-code", result.ExitCode)
+		}
+	}
+	slog.Info("All shards finished.", "shards", len(s.results), "failures", failures,
+		"duration-s", int(time.Since(started).Seconds()))
+	if s.ctx.Err() != nil {
+		exit(exitInterrupted)
+	}
+	if failures > 0 {
+		exit(exitFailure)
+	}
+}
@@ -0,0 +1,943 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const readyTimeoutSecond = 30
+const stopTimeoutSecond = 10
+const maxRestartDelaySecond = 60
+const versionTimeoutSecond = 10
+
+// Port struct for JSON configuration: a port that a service
+// listens on, allocated by the supervisor if Port is 0
+type Port struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+// Service struct for JSON configuration: one server to run
+type Service struct {
+	Name             string            `json:"name"`
+	Command          string            `json:"command"`
+	Args             []string          `json:"args"`
+	WorkingDirectory string            `json:"working-directory"`
+	Env              map[string]string `json:"env"`
+	Ports            map[string]Port   `json:"ports"`
+	Config           interface{}       `json:"config"`
+	RestartDelayMs   int               `json:"restart-delay-ms"`
+}
+
+// Argument struct for JSON configuration
+type Argument struct {
+	Host           string    `json:"host"`
+	Manifest       string    `json:"manifest"`
+	ManifestHeader string    `json:"manifest-header"`
+	LogDirectory   string    `json:"log-directory"`
+	Services       []Service `json:"services"`
+}
+
+// What is written to the manifest for each service
+type Endpoint struct {
+	Status   string          `json:"status"`
+	Pid      int             `json:"pid"`
+	Restarts int             `json:"restarts"`
+	Started  time.Time       `json:"started"`
+	Version  string          `json:"version,omitempty"`
+	Log      string          `json:"log,omitempty"`
+	Ports    map[string]Port `json:"ports"`
+}
+
+// Manifest is the machine-readable description of where
+// everything is running, for the test harness
+type Manifest struct {
+	Host       string               `json:"host"`
+	Supervisor string               `json:"supervisor"`
+	Updated    time.Time            `json:"updated"`
+	Services   map[string]*Endpoint `json:"services"`
+}
+
+type supervisor struct {
+	config    Argument
+	directory string
+	mutex     sync.Mutex
+	manifest  Manifest
+	processes map[string]*exec.Cmd
+	stopping  bool
+}
+
+// Find a free port by asking the OS for one
+func allocatePort(protocol string) (int, error) {
+	if protocol == "udp" {
+		connection, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return 0, err
+		}
+		defer connection.Close()
+		return connection.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+var placeholder = regexp.MustCompile(`\{(port:[A-Za-z0-9_.-]+|config|host|name)\}`)
+
+// Replace {port:xxx}, {port:service.xxx}, {config}, {host} and {name}
+// in a string; the second form, a port of another service, is how an
+// impairment proxy is put in front of a server
+func expand(text string, service Service, allPorts map[string]map[string]Port, host string, configFile string) string {
+	return placeholder.ReplaceAllStringFunc(text, func(match string) string {
+		key := match[1 : len(match)-1]
+		switch {
+		case key == "config":
+			return configFile
+		case key == "host":
+			return host
+		case key == "name":
+			return service.Name
+		case strings.HasPrefix(key, "port:"):
+			serviceName := service.Name
+			portName := key[5:]
+			if x := strings.LastIndex(portName, "."); x >= 0 {
+				serviceName = portName[:x]
+				portName = portName[x+1:]
+			}
+			port, ok := allPorts[serviceName][portName]
+			if ok {
+				return fmt.Sprint(port.Port)
+			}
+		}
+		return match
+	})
+}
+
+// Expand placeholders in every string of a decoded JSON value
+func expandJson(value interface{}, expandString func(string) string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return expandString(v)
+	case []interface{}:
+		for x := range v {
+			v[x] = expandJson(v[x], expandString)
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = expandJson(v[key], expandString)
+		}
+	}
+	return value
+}
+
+// Write the manifest, and the C header version of it if
+// required, replacing the files atomically
+func (s *supervisor) writeManifest() {
+	s.manifest.Updated = time.Now().UTC()
+	contents, _ := json.MarshalIndent(s.manifest, "", "    ")
+	writeAtomically(s.config.Manifest, contents)
+	if s.config.ManifestHeader == "" {
+		return
+	}
+	var header strings.Builder
+	header.WriteString("/* Generated by supervisor.go: the endpoints of the test servers. */\n\n")
+	header.WriteString("#ifndef _U_TEST_ENDPOINTS_H_\n#define _U_TEST_ENDPOINTS_H_\n\n")
+	header.WriteString(fmt.Sprintf("#define U_TEST_ENDPOINTS_HOST \"%s\"\n\n", s.manifest.Host))
+	var names []string
+	for name := range s.manifest.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nonAlphanumeric := regexp.MustCompile(`[^A-Z0-9]+`)
+	for _, name := range names {
+		var portNames []string
+		for portName := range s.manifest.Services[name].Ports {
+			portNames = append(portNames, portName)
+		}
+		sort.Strings(portNames)
+		for _, portName := range portNames {
+			macro := nonAlphanumeric.ReplaceAllString(strings.ToUpper(name+"_"+portName), "_")
+			header.WriteString(fmt.Sprintf("#define U_TEST_ENDPOINTS_%s_PORT %d\n", macro,
+				s.manifest.Services[name].Ports[portName].Port))
+		}
+	}
+	header.WriteString("\n#endif // _U_TEST_ENDPOINTS_H_\n")
+	writeAtomically(s.config.ManifestHeader, []byte(header.String()))
+}
+
+func writeAtomically(fileName string, contents []byte) {
+	temporary := fileName + ".tmp"
+	err := ioutil.WriteFile(temporary, contents, 0644)
+	if err == nil {
+		err = os.Rename(temporary, fileName)
+	}
+	if err != nil {
+		slog.Error("Unable to write file.", "file", fileName, "error", err)
+	}
+}
+
+func (s *supervisor) setStatus(name string, status string, pid int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	endpoint := s.manifest.Services[name]
+	endpoint.Status = status
+	endpoint.Pid = pid
+	if status == "running" {
+		endpoint.Started = time.Now().UTC()
+	}
+	s.writeManifest()
+}
+
+// Ask a service for its version, which all of the go test tools
+// report when run with -version, so that test reports can record
+// exactly which build of each server was running
+func serviceVersion(command string, directory string) string {
+	cmd := exec.Command(command, "-version")
+	cmd.Dir = directory
+	done := make(chan struct{})
+	var output []byte
+	go func() {
+		output, _ = cmd.Output()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(versionTimeoutSecond * time.Second):
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+		<-done
+	}
+	return strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+}
+
+// Wait until all of the TCP ports of a service accept connections
+func waitReady(ports map[string]Port, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for _, port := range ports {
+		if port.Protocol == "udp" {
+			continue
+		}
+		for {
+			connection, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port.Port), time.Second)
+			if err == nil {
+				connection.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+	}
+	return true
+}
+
+// Run a service, restarting it whenever it exits until the
+// supervisor is stopped
+func (s *supervisor) run(service Service, allPorts map[string]map[string]Port, configFile string, ready *sync.WaitGroup) {
+	ports := allPorts[service.Name]
+	expandString := func(text string) string {
+		return expand(text, service, allPorts, s.config.Host, configFile)
+	}
+	restartDelay := time.Duration(service.RestartDelayMs) * time.Millisecond
+	if restartDelay <= 0 {
+		restartDelay = time.Second
+	}
+	b := newBackoff(restartDelay, maxRestartDelaySecond*time.Second)
+	first := true
+	// If there is a log directory, keep a copy of what the service
+	// writes there, so that its log can be found per service
+	var logFile *os.File
+	if s.config.LogDirectory != "" {
+		fileName := filepath.Join(s.config.LogDirectory, service.Name+".log")
+		var err error
+		logFile, err = os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			slog.Error("Unable to open log file.", "service", service.Name, "file", fileName, "error", err)
+		} else {
+			defer logFile.Close()
+			s.mutex.Lock()
+			s.manifest.Services[service.Name].Log = fileName
+			s.mutex.Unlock()
+		}
+	}
+	for {
+		var args []string
+		for _, arg := range service.Args {
+			args = append(args, expandString(arg))
+		}
+		cmd := exec.Command(expandString(service.Command), args...)
+		cmd.Dir = service.WorkingDirectory
+		if cmd.Dir != "" && !filepath.IsAbs(cmd.Dir) {
+			cmd.Dir = filepath.Join(s.directory, cmd.Dir)
+		}
+		cmd.Env = os.Environ()
+		for key, value := range service.Env {
+			cmd.Env = append(cmd.Env, key+"="+expandString(value))
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if logFile != nil {
+			cmd.Stdout = io.MultiWriter(os.Stdout, logFile)
+			cmd.Stderr = io.MultiWriter(os.Stderr, logFile)
+		}
+		version := serviceVersion(cmd.Path, cmd.Dir)
+
+		s.mutex.Lock()
+		if s.stopping {
+			s.mutex.Unlock()
+			break
+		}
+		err := cmd.Start()
+		if err == nil {
+			s.processes[service.Name] = cmd
+		}
+		s.mutex.Unlock()
+
+		started := time.Now()
+		if err != nil {
+			slog.Error("Unable to start service.", "service", service.Name, "error", err)
+			s.setStatus(service.Name, "failed", 0)
+		} else {
+			slog.Info("Service started.", "service", service.Name, "pid", cmd.Process.Pid, "version", version)
+			s.mutex.Lock()
+			s.manifest.Services[service.Name].Version = version
+			s.mutex.Unlock()
+			if waitReady(ports, readyTimeoutSecond*time.Second) {
+				s.setStatus(service.Name, "running", cmd.Process.Pid)
+			} else {
+				slog.Error("Service is not accepting connections.", "service", service.Name)
+				s.setStatus(service.Name, "not ready", cmd.Process.Pid)
+			}
+		}
+		if first {
+			ready.Done()
+			first = false
+		}
+		if err == nil {
+			err = cmd.Wait()
+		}
+
+		s.mutex.Lock()
+		stopping := s.stopping
+		delete(s.processes, service.Name)
+		if !stopping {
+			s.manifest.Services[service.Name].Restarts++
+		}
+		s.mutex.Unlock()
+		if stopping {
+			break
+		}
+		// Back off if the service keeps falling over quickly
+		if time.Since(started) > time.Duration(maxRestartDelaySecond)*time.Second {
+			b.reset()
+		}
+		slog.Error("Service exited, restarting.", "service", service.Name, "error", err)
+		s.setStatus(service.Name, "restarting", 0)
+		if !b.wait() {
+			break
+		}
+	}
+	s.setStatus(service.Name, "stopped", 0)
+}
+
+// Stop all of the services: ask nicely, then insist
+func (s *supervisor) stop() {
+	s.mutex.Lock()
+	s.stopping = true
+	var processes []*exec.Cmd
+	for _, cmd := range s.processes {
+		processes = append(processes, cmd)
+	}
+	s.mutex.Unlock()
+	for _, cmd := range processes {
+		err := cmd.Process.Signal(os.Interrupt)
+		if err != nil {
+			cmd.Process.Kill()
+		}
+	}
+	deadline := time.Now().Add(stopTimeoutSecond * time.Second)
+	for time.Now().Before(deadline) {
+		s.mutex.Lock()
+		remaining := len(s.processes)
+		s.mutex.Unlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, cmd := range processes {
+		cmd.Process.Kill()
+	}
+}
+
+// BEGIN SHARED BLOCK config, see port/platform/common/automation/go_shared
+// Overrides of fields of the configuration given with -set
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("must be of the form name=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// Add the line and column to an error from decoding the JSON
+// configuration, since a byte offset isn't much help to anyone
+func configError(contents []byte, err error) error {
+	var offset int64 = -1
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+		err = fmt.Errorf("%q must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	if offset < 0 || offset > int64(len(contents)) {
+		return err
+	}
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(contents[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// Set a field of the configuration from text, finding it by its
+// JSON name, with a "." between the names of nested fields; the
+// case of a name, and "_" rather than "-", don't matter, so that
+// the names can come from environment variables
+func configSet(config interface{}, name string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s: %q is not an object", name, part)
+		}
+		found := false
+		for x := 0; !found && x < field.NumField(); x++ {
+			tag := strings.Split(field.Type().Field(x).Tag.Get("json"), ",")[0]
+			if tag != "" && strings.EqualFold(strings.ReplaceAll(tag, "-", "_"), strings.ReplaceAll(part, "-", "_")) {
+				field = field.Field(x)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: there is no field %q in the configuration", name, part)
+		}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	// Anything else, numbers, booleans, lists or objects, as JSON,
+	// into a fresh value so that nothing of the old one is kept
+	fresh := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), fresh.Interface())
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	field.Set(fresh.Elem())
+	return nil
+}
+
+// Load the JSON configuration and then apply overrides, first from
+// environment variables named UBXLIB_<TOOL>_<FIELD>, with "__" between
+// the names of nested fields, e.g. UBXLIB_DEVICE_TWIN_MQTT__BROKER,
+// then from -set name=value, so that a deployment need only record
+// how it differs from the checked-in configuration
+func configLoad(contents []byte, config interface{}, overrides []string) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		// Most likely a typo or a field from a newer version of the
+		// tool: worth knowing about but not worth stopping for
+		slog.Warn("Unknown field in the configuration, ignored.", "error", err)
+		err = json.Unmarshal(contents, config)
+	}
+	if err != nil {
+		return configError(contents, err)
+	}
+	prefix := "UBXLIB_" + strings.ToUpper(versionInfo().Tool) + "_"
+	var environment []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			environment = append(environment, strings.TrimPrefix(variable, prefix))
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		nameValue := strings.SplitN(variable, "=", 2)
+		// Only the name is logged since the value may be a secret
+		err = configSet(config, strings.ReplaceAll(nameValue[0], "__", "."), nameValue[1])
+		if err != nil {
+			// Could be meant for another tool with a longer name
+			slog.Warn("Environment variable not applied to the configuration.", "variable", prefix+nameValue[0], "error", err)
+		} else {
+			slog.Info("Configuration overridden from the environment.", "variable", prefix+nameValue[0])
+		}
+	}
+	for _, override := range overrides {
+		nameValue := strings.SplitN(override, "=", 2)
+		err = configSet(config, nameValue[0], nameValue[1])
+		if err != nil {
+			return fmt.Errorf("-set %w", err)
+		}
+		slog.Info("Configuration overridden.", "field", nameValue[0])
+	}
+	return nil
+}
+
+// END SHARED BLOCK config
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"manifest-json", "manifest-header", "service-logs"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "supervisor", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "supervisor")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish; long
+// enough for the services to be stopped
+const shutdownTimeoutSecond = stopTimeoutSecond + 5
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+// BEGIN SHARED BLOCK retry, see port/platform/common/automation/go_shared
+// Retries, the same in all of the test tools, in place of fixed
+// sleeps: each delay is double the one before, up to a maximum, less
+// up to a half at random so that many clients don't retry in step
+const retryInitialMs = 500
+const retryMaxMs = 30000
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Start again from the initial delay, e.g. once a connection has
+// stayed up for a while
+func (b *backoff) reset() {
+	b.next = b.initial
+}
+
+// Wait for the next delay, returning false if the tool is asked to
+// stop in the meantime
+func (b *backoff) wait() bool {
+	timer := time.NewTimer(b.delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+// An error that trying again won't fix, e.g. a refusal rather than a
+// failure to connect
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// Call operation up to attempts times, backing off between attempts,
+// each attempt being given a context that is done after timeout or
+// when the tool is asked to stop; a permanent error isn't retried
+func retry(name string, attempts int, timeout time.Duration, operation func(ctx context.Context) error) error {
+	b := newBackoff(retryInitialMs*time.Millisecond, retryMaxMs*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(runContext(), timeout)
+		err := operation(ctx)
+		cancel()
+		var isPermanent permanentError
+		if err == nil || errors.As(err, &isPermanent) || attempt >= attempts {
+			return err
+		}
+		slog.Warn("Failed, trying again.", "operation", name, "attempt", attempt, "error", err)
+		if !b.wait() {
+			return err
+		}
+	}
+}
+
+// END SHARED BLOCK retry
+
+func main() {
+	defer recoverPanic()
+
+	configLocation := flag.String("config", "./config.json", "Path to a JSON configuration.")
+	var overrides configOverrides
+	flag.Var(&overrides, "set", "Override a field of the configuration with name=value, name being the JSON name, with . between nested names; may be repeated.")
+	printConfig := flag.Bool("print_config", false, "Print the configuration, with any overrides applied, and exit.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	byteValue, err := ioutil.ReadFile(*configLocation)
+	if err != nil {
+		logFatal("Failed to open file.", "error", err)
+	}
+
+	var config Argument
+	err = configLoad(byteValue, &config, overrides)
+	if err != nil {
+		logFatal("Invalid configuration.", "file", *configLocation, "error", err)
+	}
+	if *printConfig {
+		contents, _ := json.MarshalIndent(config, "", "    ")
+		fmt.Println(string(contents))
+		return
+	}
+	if config.Host == "" {
+		config.Host, _ = os.Hostname()
+	}
+	if config.Manifest == "" {
+		config.Manifest = "endpoints.json"
+	}
+
+	directory, _ := filepath.Abs(filepath.Dir(*configLocation))
+	if config.LogDirectory != "" {
+		if !filepath.IsAbs(config.LogDirectory) {
+			config.LogDirectory = filepath.Join(directory, config.LogDirectory)
+		}
+		err = os.MkdirAll(config.LogDirectory, 0755)
+		if err != nil {
+			logFatal("Unable to create log directory.", "directory", config.LogDirectory, "error", err)
+		}
+	}
+	s := &supervisor{config: config, directory: directory, processes: make(map[string]*exec.Cmd),
+		manifest: Manifest{Host: config.Host, Supervisor: versionInfo().String(),
+			Services: make(map[string]*Endpoint)}}
+
+	// Allocate all of the ports before starting anything so that
+	// services can be told about each other's ports
+	allPorts := make(map[string]map[string]Port)
+	for _, service := range config.Services {
+		if _, ok := allPorts[service.Name]; ok || service.Name == "" {
+			logFatal("Service names must be present and unique.", "service", service.Name)
+		}
+		ports := make(map[string]Port)
+		for portName, port := range service.Ports {
+			if port.Protocol == "" {
+				port.Protocol = "tcp"
+			}
+			if port.Port == 0 {
+				port.Port, err = allocatePort(port.Protocol)
+				if err != nil {
+					logFatal("Unable to allocate a port.", "service", service.Name, "error", err)
+				}
+			}
+			ports[portName] = port
+		}
+		allPorts[service.Name] = ports
+		s.manifest.Services[service.Name] = &Endpoint{Status: "starting", Ports: ports}
+	}
+
+	configDirectory, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		logFatal("Unable to create a temporary directory.", "error", err)
+	}
+	onShutdown("configuration directory", func(ctx context.Context) {
+		os.RemoveAll(configDirectory)
+	})
+
+	var ready sync.WaitGroup
+	var finished sync.WaitGroup
+	onShutdown("services", func(ctx context.Context) {
+		slog.Info("Stopping all services.")
+		s.stop()
+		finished.Wait()
+	})
+	for _, service := range config.Services {
+		configFile := ""
+		if service.Config != nil {
+			// Write the service's own configuration file with the
+			// placeholders filled in
+			configFile = filepath.Join(configDirectory, service.Name+".json")
+			value := expandJson(service.Config, func(text string) string {
+				return expand(text, service, allPorts, config.Host, configFile)
+			})
+			contents, _ := json.MarshalIndent(value, "", "    ")
+			err = ioutil.WriteFile(configFile, contents, 0644)
+			if err != nil {
+				logFatal("Unable to write configuration.", "service", service.Name, "error", err)
+			}
+		}
+		ready.Add(1)
+		finished.Add(1)
+		go func(service Service) {
+			defer recoverPanic()
+			defer finished.Done()
+			s.run(service, allPorts, configFile, &ready)
+		}(service)
+	}
+	ready.Wait()
+	slog.Info("All services started.", "manifest", config.Manifest)
+
+	<-runContext().Done()
+	exit(exitOk)
+}
@@ -0,0 +1,867 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const requestTimeoutSecond = 30
+const vaultTimeoutSecond = 30
+const vaultAttempts = 3
+
+// Default control ports of the tools, as in their example configurations
+const defaultImpairUrl = "http://localhost:8095"
+const defaultMetricsUrl = "http://localhost:8099"
+const defaultTwinUrl = "http://localhost:8097"
+const defaultEventBusUrl = "http://localhost:8098"
+
+// The longest that one request waits for an event, which must be
+// well inside requestTimeoutSecond
+const eventPollMs = 20000
+
+// Impairment is that of a route of ../impair_proxy
+type Impairment struct {
+	LatencyMs       int     `json:"latency-ms"`
+	JitterMs        int     `json:"jitter-ms"`
+	LossPercent     float64 `json:"loss-percent"`
+	BandwidthBps    int     `json:"bandwidth-bps"`
+	ResetPercent    float64 `json:"reset-percent"`
+	ResetAfterBytes int     `json:"reset-after-bytes"`
+	CorruptPercent  float64 `json:"corrupt-percent"`
+	AfterMessages   int     `json:"after-messages"`
+}
+
+// RouteStatus is as returned by the control port of ../impair_proxy
+type RouteStatus struct {
+	Route struct {
+		Name       string     `json:"name"`
+		Protocol   string     `json:"protocol"`
+		ListenPort string     `json:"listen-port"`
+		Target     string     `json:"target"`
+		Impairment Impairment `json:"impairment"`
+		Record     string     `json:"record"`
+		Replay     string     `json:"replay"`
+	} `json:"route"`
+	Connections int   `json:"connections"`
+	Bytes       int64 `json:"bytes"`
+	Dropped     int64 `json:"dropped"`
+	Resets      int64 `json:"resets"`
+	Corrupted   int64 `json:"corrupted"`
+}
+
+// HostStatus is as returned by the control port of ../impair_proxy
+// for the link shared by all of its routes
+type HostStatus struct {
+	BandwidthBps int   `json:"bandwidth-bps"`
+	Bytes        int64 `json:"bytes"`
+	BacklogMs    int64 `json:"backlog-ms"`
+}
+
+// Alert is as returned by ../metrics
+type Alert struct {
+	Name   string    `json:"name"`
+	Firing bool      `json:"firing"`
+	Since  time.Time `json:"since"`
+	Value  float64   `json:"value"`
+}
+
+// Twin is as returned by common/mqtt_client/test/device_twin
+type Twin struct {
+	Desired         map[string]interface{} `json:"desired"`
+	DesiredVersion  int                    `json:"desired-version"`
+	Reported        map[string]interface{} `json:"reported"`
+	ReportedVersion int                    `json:"reported-version"`
+	Updated         time.Time              `json:"updated"`
+}
+
+// Event is as returned by ../event_bus
+type Event struct {
+	Sequence   int64                  `json:"sequence"`
+	Time       time.Time              `json:"time"`
+	Received   time.Time              `json:"received"`
+	Source     string                 `json:"source"`
+	Type       string                 `json:"type"`
+	Session    string                 `json:"session,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// EventFilter selects events from ../event_bus: those after the
+// sequence number After and, where given, of Type (which may be a
+// comma-separated list), from Source or of Session
+type EventFilter struct {
+	After   int64
+	Type    string
+	Source  string
+	Session string
+}
+
+// A client of the HTTP API of one of the test tools: typed calls,
+// so that a script, or a test, need not put together requests and
+// pick apart responses for itself
+type Client struct {
+	Url       string
+	Token     string
+	SessionId string
+	http      *http.Client
+}
+
+func NewClient(url string, token string, sessionId string) *Client {
+	return &Client{Url: strings.TrimSuffix(url, "/"), Token: token, SessionId: sessionId,
+		http: &http.Client{Timeout: requestTimeoutSecond * time.Second}}
+}
+
+// Make a request, sending body, if not nil, as JSON or, if it is
+// an io.Reader, as it is, and decoding the response into result, if
+// not nil; a response other than 2xx is an error, with what the tool
+// said
+func (c *Client) do(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		if r, ok := body.(io.Reader); ok {
+			reader = r
+		} else {
+			contents, err := json.Marshal(body)
+			if err != nil {
+				return err
+			}
+			reader = bytes.NewReader(contents)
+		}
+	}
+	request, err := http.NewRequestWithContext(runContext(), method, c.Url+path, reader)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.SessionId != "" {
+		request.Header.Set("X-Session-Id", c.SessionId)
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		text, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, response.Status, strings.TrimSpace(string(text)))
+	}
+	if result != nil {
+		err = json.NewDecoder(response.Body).Decode(result)
+	}
+	return err
+}
+
+func (c *Client) Routes() ([]RouteStatus, error) {
+	var routes []RouteStatus
+	err := c.do(http.MethodGet, "/routes", nil, &routes)
+	return routes, err
+}
+
+func (c *Client) SetImpairment(route string, impairment Impairment) (RouteStatus, error) {
+	var status RouteStatus
+	err := c.do(http.MethodPut, "/routes/"+url.PathEscape(route), impairment, &status)
+	return status, err
+}
+
+func (c *Client) ResetConnections(route string) (RouteStatus, error) {
+	var status RouteStatus
+	err := c.do(http.MethodPost, "/routes/"+url.PathEscape(route)+"/reset", nil, &status)
+	return status, err
+}
+
+func (c *Client) Host() (HostStatus, error) {
+	var status HostStatus
+	err := c.do(http.MethodGet, "/host", nil, &status)
+	return status, err
+}
+
+// Cap the combined bandwidth towards the devices of all of the routes,
+// zero for no cap
+func (c *Client) SetHostBandwidth(bandwidthBps int) (HostStatus, error) {
+	var status HostStatus
+	err := c.do(http.MethodPut, "/host", HostStatus{BandwidthBps: bandwidthBps}, &status)
+	return status, err
+}
+
+// The events that match the filter, oldest first, waiting up to
+// waitMs for there to be at least one
+func (c *Client) Events(f EventFilter, waitMs int) ([]Event, error) {
+	query := url.Values{}
+	query.Set("after", strconv.FormatInt(f.After, 10))
+	for name, value := range map[string]string{"type": f.Type, "source": f.Source, "session": f.Session} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if waitMs > 0 {
+		query.Set("wait-ms", strconv.Itoa(waitMs))
+	}
+	var events []Event
+	err := c.do(http.MethodGet, "/events?"+query.Encode(), nil, &events)
+	return events, err
+}
+
+// Wait for the first event that matches the filter, which may be one
+// that has already happened, until the deadline
+func (c *Client) WaitForEvent(f EventFilter, deadline time.Time) (Event, error) {
+	for {
+		waitMs := int(time.Until(deadline).Milliseconds())
+		if waitMs > eventPollMs {
+			waitMs = eventPollMs
+		}
+		if waitMs < 0 {
+			waitMs = 0
+		}
+		events, err := c.Events(f, waitMs)
+		if err != nil {
+			return Event{}, err
+		}
+		if len(events) > 0 {
+			return events[0], nil
+		}
+		if waitMs == 0 {
+			return Event{}, fmt.Errorf("no %s event by %s", f.Type, deadline.Format(time.RFC3339Nano))
+		}
+	}
+}
+
+func (c *Client) Alerts() ([]Alert, error) {
+	var alerts []Alert
+	err := c.do(http.MethodGet, "/alerts", nil, &alerts)
+	return alerts, err
+}
+
+// Push metrics, in Prometheus text format, replacing those last
+// pushed for the job
+func (c *Client) Push(job string, metrics io.Reader) error {
+	return c.do(http.MethodPost, "/push/"+url.PathEscape(job), metrics, nil)
+}
+
+func (c *Client) Devices() ([]string, error) {
+	var devices []string
+	err := c.do(http.MethodGet, "/devices", nil, &devices)
+	return devices, err
+}
+
+func (c *Client) Twin(device string) (Twin, error) {
+	var twin Twin
+	err := c.do(http.MethodGet, "/devices/"+url.PathEscape(device), nil, &twin)
+	return twin, err
+}
+
+func (c *Client) Delta(device string) (map[string]interface{}, error) {
+	var delta map[string]interface{}
+	err := c.do(http.MethodGet, "/devices/"+url.PathEscape(device)+"/delta", nil, &delta)
+	return delta, err
+}
+
+// Set the desired state of a device, merging it into what is there
+// already, as a JSON merge patch, if merge is true
+func (c *Client) SetDesired(device string, desired map[string]interface{}, merge bool) (Twin, error) {
+	method := http.MethodPut
+	if merge {
+		method = http.MethodPatch
+	}
+	var twin Twin
+	err := c.do(method, "/devices/"+url.PathEscape(device)+"/desired", desired, &twin)
+	return twin, err
+}
+
+// The command line: each command makes one call and prints the result
+// as JSON on stdout, so that it can be used from a shell script, or a
+// test harness, in place of curl
+
+type command struct {
+	usage      string
+	defaultUrl string
+	arguments  int
+	run        func(c *Client, flags *flag.FlagSet) (interface{}, error)
+}
+
+var commands = map[string]command{
+	"routes": {"routes", defaultImpairUrl, 0, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		return c.Routes()
+	}},
+	"impair": {"impair <route> <impairment as JSON>", defaultImpairUrl, 2, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		var impairment Impairment
+		err := jsonArgument(flags.Arg(1), &impairment)
+		if err != nil {
+			return nil, err
+		}
+		return c.SetImpairment(flags.Arg(0), impairment)
+	}},
+	"reset": {"reset <route>", defaultImpairUrl, 1, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		return c.ResetConnections(flags.Arg(0))
+	}},
+	"host": {"host", defaultImpairUrl, 0, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		return c.Host()
+	}},
+	"host-bandwidth": {"host-bandwidth <bits per second, 0 for no cap>", defaultImpairUrl, 1, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		bandwidthBps, err := strconv.Atoi(flags.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		return c.SetHostBandwidth(bandwidthBps)
+	}},
+	"alerts": {"alerts", defaultMetricsUrl, 0, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		return c.Alerts()
+	}},
+	"push": {"push <job> <file of metrics, - for stdin>", defaultMetricsUrl, 2, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		reader := io.Reader(os.Stdin)
+		if flags.Arg(1) != "-" {
+			file, err := os.Open(flags.Arg(1))
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			reader = file
+		}
+		return nil, c.Push(flags.Arg(0), reader)
+	}},
+	"events": {"events", defaultEventBusUrl, 0, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		return c.Events(eventFilter(flags, flags.Lookup("type").Value.String()), 0)
+	}},
+	"wait": {"wait <type>", defaultEventBusUrl, 1, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		f := eventFilter(flags, flags.Arg(0))
+		timeout, _ := strconv.Atoi(flags.Lookup("timeout_ms").Value.String())
+		deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+		following := flags.Lookup("following").Value.String()
+		if following == "" {
+			return c.WaitForEvent(f, deadline)
+		}
+		// The event must come within within_ms of the latest event
+		// of the type it is following, waiting for that too if need be
+		first := eventFilter(flags, following)
+		first.Source = ""
+		events, err := c.Events(first, 0)
+		if err != nil {
+			return nil, err
+		}
+		var previous Event
+		if len(events) > 0 {
+			previous = events[len(events)-1]
+		} else if previous, err = c.WaitForEvent(first, deadline); err != nil {
+			return nil, err
+		}
+		within, _ := strconv.Atoi(flags.Lookup("within_ms").Value.String())
+		f.After = previous.Sequence
+		e, err := c.WaitForEvent(f, previous.Time.Add(time.Duration(within)*time.Millisecond))
+		if err != nil {
+			return nil, fmt.Errorf("%w, %d ms after the %s event %d", err, within, following, previous.Sequence)
+		}
+		// It may have been there already, but too late
+		if late := e.Time.Sub(previous.Time); late > time.Duration(within)*time.Millisecond {
+			return nil, fmt.Errorf("%s event %d came %d ms after the %s event %d, more than %d ms",
+				e.Type, e.Sequence, late.Milliseconds(), following, previous.Sequence, within)
+		}
+		return e, nil
+	}},
+	"devices": {"devices", defaultTwinUrl, 0, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		return c.Devices()
+	}},
+	"twin": {"twin <device>", defaultTwinUrl, 1, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		return c.Twin(flags.Arg(0))
+	}},
+	"delta": {"delta <device>", defaultTwinUrl, 1, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		return c.Delta(flags.Arg(0))
+	}},
+	"desire": {"desire <device> <desired state as JSON>", defaultTwinUrl, 2, func(c *Client, flags *flag.FlagSet) (interface{}, error) {
+		var desired map[string]interface{}
+		err := jsonArgument(flags.Arg(1), &desired)
+		if err != nil {
+			return nil, err
+		}
+		return c.SetDesired(flags.Arg(0), desired, flags.Lookup("merge").Value.String() == "true")
+	}},
+}
+
+// The event filter given by the command-line flags, for events of
+// the given type
+func eventFilter(flags *flag.FlagSet, eventType string) EventFilter {
+	after, _ := strconv.ParseInt(flags.Lookup("after").Value.String(), 10, 64)
+	return EventFilter{After: after, Type: eventType, Source: flags.Lookup("source").Value.String(),
+		Session: flags.Lookup("session").Value.String()}
+}
+
+// Decode JSON given on the command line, @FILE meaning the contents
+// of FILE
+func jsonArgument(argument string, value interface{}) error {
+	contents := []byte(argument)
+	if strings.HasPrefix(argument, "@") {
+		var err error
+		contents, err = os.ReadFile(argument[1:])
+		if err != nil {
+			return err
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(value)
+	if err != nil {
+		return fmt.Errorf("%q: %w", argument, err)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] <command> [-url <url>] [command arguments], the commands being:\n", os.Args[0])
+	for _, name := range []string{"routes", "impair", "reset", "host", "host-bandwidth", "alerts", "push", "events", "wait", "devices", "twin", "delta", "desire"} {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-60s (default -url %s)\n", commands[name].usage, commands[name].defaultUrl)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "desire also takes -merge; events takes -type, -source, -session and -after; wait takes\n"+
+		"-source, -session, -after, -timeout_ms and, to require the event within -within_ms of another, -following <type>.  Options:\n")
+	flag.PrintDefaults()
+}
+
+// BEGIN SHARED BLOCK secret, see port/platform/common/automation/go_shared
+// Fetch a secret, e.g. a private key or a password, from where the
+// reference says it is, so that secrets need not be kept in files on
+// the machines of the test farm: "env:NAME" is the value of the
+// environment variable NAME, "vault:PATH#FIELD" is FIELD of the secret
+// at API path PATH (e.g. "secret/data/ubxlib/x" for a KV version 2
+// secrets engine mounted at "secret") in HashiCorp Vault, using
+// VAULT_ADDR, VAULT_TOKEN and, if set, VAULT_NAMESPACE from the
+// environment, and "file:PATH", or anything else, is a file
+func readSecret(reference string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(reference, "env:"):
+		value, ok := os.LookupEnv(reference[4:])
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", reference[4:])
+		}
+		return []byte(value), nil
+	case strings.HasPrefix(reference, "vault:"):
+		return readVaultSecret(reference[6:])
+	}
+	return ioutil.ReadFile(strings.TrimPrefix(reference, "file:"))
+}
+
+func readVaultSecret(reference string) ([]byte, error) {
+	x := strings.LastIndex(reference, "#")
+	if x < 0 {
+		return nil, fmt.Errorf("vault secret \"%s\" has no #field", reference)
+	}
+	secretPath, field := strings.Trim(reference[:x], "/"), reference[x+1:]
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	var value []byte
+	err := retry("vault "+secretPath, vaultAttempts, vaultTimeoutSecond*time.Second, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(address, "/")+"/v1/"+secretPath, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		request.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+		if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+			request.Header.Set("X-Vault-Namespace", namespace)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("vault returned HTTP status %d for %s", response.StatusCode, secretPath)
+			if response.StatusCode < http.StatusInternalServerError {
+				// e.g. a bad token or path, which won't get better
+				err = permanent(err)
+			}
+			return err
+		}
+		// KV version 1 has the fields in "data", version 2 in "data.data"
+		var secret struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&secret)
+		if err != nil {
+			return err
+		}
+		fields := secret.Data
+		if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+			if _, isV1Field := secret.Data[field]; !isV1Field {
+				fields = inner
+			}
+		}
+		text, ok := fields[field].(string)
+		if !ok {
+			return permanent(fmt.Errorf("vault secret %s has no string field \"%s\"", secretPath, field))
+		}
+		value = []byte(text)
+		return nil
+	})
+	return value, err
+}
+
+// END SHARED BLOCK secret
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"impair-proxy", "metrics", "device-twin"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "test_control", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "test_control")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+// BEGIN SHARED BLOCK retry, see port/platform/common/automation/go_shared
+// Retries, the same in all of the test tools, in place of fixed
+// sleeps: each delay is double the one before, up to a maximum, less
+// up to a half at random so that many clients don't retry in step
+const retryInitialMs = 500
+const retryMaxMs = 30000
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Start again from the initial delay, e.g. once a connection has
+// stayed up for a while
+func (b *backoff) reset() {
+	b.next = b.initial
+}
+
+// Wait for the next delay, returning false if the tool is asked to
+// stop in the meantime
+func (b *backoff) wait() bool {
+	timer := time.NewTimer(b.delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+// An error that trying again won't fix, e.g. a refusal rather than a
+// failure to connect
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// Call operation up to attempts times, backing off between attempts,
+// each attempt being given a context that is done after timeout or
+// when the tool is asked to stop; a permanent error isn't retried
+func retry(name string, attempts int, timeout time.Duration, operation func(ctx context.Context) error) error {
+	b := newBackoff(retryInitialMs*time.Millisecond, retryMaxMs*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(runContext(), timeout)
+		err := operation(ctx)
+		cancel()
+		var isPermanent permanentError
+		if err == nil || errors.As(err, &isPermanent) || attempt >= attempts {
+			return err
+		}
+		slog.Warn("Failed, trying again.", "operation", name, "attempt", attempt, "error", err)
+		if !b.wait() {
+			return err
+		}
+	}
+}
+
+// END SHARED BLOCK retry
+
+func main() {
+	defer recoverPanic()
+
+	tokenLocation := flag.String("token", "", "File containing the bearer token to send, or env:NAME or vault:PATH#FIELD; default the value of the environment variable UBXLIB_HTTP_TOKEN, if set.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "warn", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record and to send as X-Session-Id.")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		flag.Usage()
+		exit(exitUsage)
+	}
+	flags := flag.NewFlagSet(flag.Arg(0), flag.ExitOnError)
+	url := flags.String("url", command.defaultUrl, "URL of the tool.")
+	flags.Bool("merge", false, "desire: merge into the desired state rather than replacing it.")
+	flags.String("type", "", "events: only events of this type, or comma-separated types.")
+	flags.String("source", "", "events, wait: only events from this source.")
+	flags.String("session", "", "events, wait: only events of this test session.")
+	flags.Int64("after", 0, "events, wait: only events after this sequence number.")
+	flags.Int("timeout_ms", 10000, "wait: how long to wait for the event.")
+	flags.String("following", "", "wait: the event must follow the latest event of this type...")
+	flags.Int("within_ms", 2000, "wait: ...within this many milliseconds.")
+	flags.Parse(flag.Args()[1:])
+	if flags.NArg() != command.arguments {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s %s\n", os.Args[0], command.usage)
+		exit(exitUsage)
+	}
+	token := os.Getenv("UBXLIB_HTTP_TOKEN")
+	if *tokenLocation != "" {
+		contents, err := readSecret(*tokenLocation)
+		if err != nil {
+			logFatal("Unable to read token.", "token", *tokenLocation, "error", err)
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+
+	result, err := command.run(NewClient(*url, token, *sessionId), flags)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			exit(exitInterrupted)
+		}
+		logFatal("Command failed.", "command", flag.Arg(0), "url", *url, "error", err)
+	}
+	if result != nil {
+		output, _ := json.MarshalIndent(result, "", "    ")
+		fmt.Println(string(output))
+	}
+	exit(exitOk)
+}
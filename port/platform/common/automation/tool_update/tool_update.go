@@ -0,0 +1,1436 @@
+/*
+ * Copyright 2020 u-blox Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const manifestName = "manifest.json"
+const downloadTimeoutSecond = 300
+const downloadAttempts = 3
+const vaultTimeoutSecond = 30
+const vaultAttempts = 3
+const certificateCheckSecond = 10
+const certificateWarnDays = 30
+const traceQueueSize = 4096
+const traceBatchSize = 256
+const traceFlushSecond = 5
+const rateLimitForgetSecond = 600
+
+// What build makes by default: the farm controllers, which are mostly
+// Raspberry Pis, and the PCs
+const defaultPlatforms = "linux/amd64,linux/arm64,linux/arm,windows/amd64"
+
+// Artifact is one signed build of a tool for one platform
+type Artifact struct {
+	Version   string `json:"version"`
+	Serial    int64  `json:"serial"`
+	File      string `json:"file"`
+	Sha256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// ArtifactManifest lists the current artifacts, keyed by
+// "<tool>/<GOOS>/<GOARCH>"
+type ArtifactManifest struct {
+	Artifacts map[string]Artifact `json:"artifacts"`
+}
+
+func artifactKey(name string, goos string, goarch string) string {
+	return name + "/" + goos + "/" + goarch
+}
+
+// What is signed: the key, version, serial and digest together, so
+// that a different tool's artifact can't be substituted; the
+// signature alone doesn't stop an older artifact, still validly
+// signed, being replayed, which is why selfupdate also refuses one
+// whose serial is lower than that of what is installed
+func signedMessage(key string, artifact Artifact) []byte {
+	return []byte(key + "\n" + artifact.Version + "\n" + strconv.FormatInt(artifact.Serial, 10) + "\n" + artifact.Sha256)
+}
+
+// What selfupdate records next to the binary it installs: the
+// version and the serial, one per line; if there is no such file,
+// e.g. the binary was not installed by selfupdate, anything may
+// replace it and the serial is taken to be 0
+func readInstalled(versionFile string) (string, int64, error) {
+	contents, err := ioutil.ReadFile(versionFile)
+	if os.IsNotExist(err) {
+		slog.Info("No version file, taking the serial installed to be 0.", "file", versionFile)
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) < 2 {
+		return "", 0, fmt.Errorf("%s has no serial, delete it to install anyway", versionFile)
+	}
+	serial, err := strconv.ParseInt(strings.TrimSpace(lines[1]), 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("%s has an invalid serial, delete it to install anyway: %w", versionFile, err)
+	}
+	return strings.TrimSpace(lines[0]), serial, nil
+}
+
+func readKey(fileName string, size int) ([]byte, error) {
+	contents, err := readSecret(fileName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err == nil && len(key) != size {
+		err = fmt.Errorf("%s does not contain a %d byte key", fileName, size)
+	}
+	return key, err
+}
+
+// BEGIN SHARED BLOCK secret, see port/platform/common/automation/go_shared
+// Fetch a secret, e.g. a private key or a password, from where the
+// reference says it is, so that secrets need not be kept in files on
+// the machines of the test farm: "env:NAME" is the value of the
+// environment variable NAME, "vault:PATH#FIELD" is FIELD of the secret
+// at API path PATH (e.g. "secret/data/ubxlib/x" for a KV version 2
+// secrets engine mounted at "secret") in HashiCorp Vault, using
+// VAULT_ADDR, VAULT_TOKEN and, if set, VAULT_NAMESPACE from the
+// environment, and "file:PATH", or anything else, is a file
+func readSecret(reference string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(reference, "env:"):
+		value, ok := os.LookupEnv(reference[4:])
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", reference[4:])
+		}
+		return []byte(value), nil
+	case strings.HasPrefix(reference, "vault:"):
+		return readVaultSecret(reference[6:])
+	}
+	return ioutil.ReadFile(strings.TrimPrefix(reference, "file:"))
+}
+
+func readVaultSecret(reference string) ([]byte, error) {
+	x := strings.LastIndex(reference, "#")
+	if x < 0 {
+		return nil, fmt.Errorf("vault secret \"%s\" has no #field", reference)
+	}
+	secretPath, field := strings.Trim(reference[:x], "/"), reference[x+1:]
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	var value []byte
+	err := retry("vault "+secretPath, vaultAttempts, vaultTimeoutSecond*time.Second, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(address, "/")+"/v1/"+secretPath, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		request.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+		if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+			request.Header.Set("X-Vault-Namespace", namespace)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("vault returned HTTP status %d for %s", response.StatusCode, secretPath)
+			if response.StatusCode < http.StatusInternalServerError {
+				// e.g. a bad token or path, which won't get better
+				err = permanent(err)
+			}
+			return err
+		}
+		// KV version 1 has the fields in "data", version 2 in "data.data"
+		var secret struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&secret)
+		if err != nil {
+			return err
+		}
+		fields := secret.Data
+		if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+			if _, isV1Field := secret.Data[field]; !isV1Field {
+				fields = inner
+			}
+		}
+		text, ok := fields[field].(string)
+		if !ok {
+			return permanent(fmt.Errorf("vault secret %s has no string field \"%s\"", secretPath, field))
+		}
+		value = []byte(text)
+		return nil
+	})
+	return value, err
+}
+
+// END SHARED BLOCK secret
+
+func readManifest(directory string) (ArtifactManifest, error) {
+	manifest := ArtifactManifest{Artifacts: make(map[string]Artifact)}
+	contents, err := ioutil.ReadFile(filepath.Join(directory, manifestName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(contents, &manifest)
+	}
+	return manifest, err
+}
+
+func fileSha256(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	return hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// Write a file and then rename it into place so that nobody ever
+// sees a partial file
+func writeAtomically(fileName string, contents []byte, mode os.FileMode) error {
+	temporary := fileName + ".tmp"
+	err := ioutil.WriteFile(temporary, contents, mode)
+	if err == nil {
+		err = os.Rename(temporary, fileName)
+	}
+	return err
+}
+
+func keygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := flags.String("out", "update_key", "Base name of the key files to write (.private and .public).")
+	flags.Parse(args)
+	public, private, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*out+".private", []byte(hex.EncodeToString(private)+"\n"), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(*out+".public", []byte(hex.EncodeToString(public)+"\n"), 0644)
+	}
+	if err == nil {
+		slog.Info("Keys written.", "private", *out+".private", "public", hex.EncodeToString(public))
+	}
+	return err
+}
+
+// Add a binary to the artifact directory, signed, and make it the
+// current artifact for its tool and platform
+func addArtifact(private ed25519.PrivateKey, directory string, name string, version string,
+	goos string, goarch string, contents []byte) error {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+	manifest, err := readManifest(directory)
+	if err != nil {
+		return err
+	}
+	key := artifactKey(name, goos, goarch)
+	digest := sha256.Sum256(contents)
+	// The serial only ever goes up: it is the time of signing, or one
+	// more than that of the artifact being replaced if that is later,
+	// so that it still goes up if the artifact directory is lost
+	serial := time.Now().Unix()
+	if previous, ok := manifest.Artifacts[key]; ok && previous.Serial >= serial {
+		serial = previous.Serial + 1
+	}
+	artifact := Artifact{Version: version, Serial: serial, Sha256: hex.EncodeToString(digest[:]),
+		File: fmt.Sprintf("%s-%s-%s-%s", name, goos, goarch, version)}
+	if goos == "windows" {
+		artifact.File += ".exe"
+	}
+	artifact.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(private, signedMessage(key, artifact)))
+	err = writeAtomically(filepath.Join(directory, artifact.File), contents, 0644)
+	if err != nil {
+		return err
+	}
+	manifest.Artifacts[key] = artifact
+	manifestContents, _ := json.MarshalIndent(manifest, "", "    ")
+	err = writeAtomically(filepath.Join(directory, manifestName), manifestContents, 0644)
+	if err == nil {
+		slog.Info("Artifact added.", "artifact", key, "version", version, "serial", serial, "file", artifact.File)
+	}
+	return err
+}
+
+func sign(args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyFile := flags.String("key", "update_key.private", "File containing the private key, or env:NAME or vault:PATH#FIELD.")
+	directory := flags.String("dir", "artifacts", "Artifact directory to add the binary to.")
+	name := flags.String("name", "", "Name of the tool, e.g. echo_server.")
+	version := flags.String("version", "", "Version of this build of the tool.")
+	goos := flags.String("os", runtime.GOOS, "Operating system the binary is built for.")
+	goarch := flags.String("arch", runtime.GOARCH, "Architecture the binary is built for.")
+	flags.Parse(args)
+	if *name == "" || *version == "" || flags.NArg() != 1 {
+		return errors.New("usage: sign -name <tool> -version <version> [-os <os>] [-arch <arch>] <binary>")
+	}
+	private, err := readKey(*keyFile, ed25519.PrivateKeySize)
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return addArtifact(private, *directory, *name, *version, *goos, *goarch, contents)
+}
+
+// Build one tool for one platform: the tools use only the standard
+// library so, with cgo disabled, the result is a static binary that
+// needs nothing on the machine it is copied to, whatever the machine
+// doing the building
+func buildTool(source string, goos string, goarch string, ldflags string) ([]byte, error) {
+	output, err := ioutil.TempFile("", "tool_update_build")
+	if err != nil {
+		return nil, err
+	}
+	output.Close()
+	defer os.Remove(output.Name())
+	command := exec.CommandContext(runContext(), "go", "build", "-trimpath", "-ldflags", ldflags,
+		"-o", output.Name(), filepath.Base(source))
+	command.Dir = filepath.Dir(source)
+	command.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS="+goos, "GOARCH="+goarch)
+	if goarch == "arm" {
+		// Raspberry Pi 2 onwards
+		command.Env = append(command.Env, "GOARM=7")
+	}
+	messages, err := command.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("building %s for %s/%s: %w: %s", source, goos, goarch, err, strings.TrimSpace(string(messages)))
+	}
+	return ioutil.ReadFile(output.Name())
+}
+
+func build(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	keyFile := flags.String("key", "update_key.private", "File containing the private key, or env:NAME or vault:PATH#FIELD.")
+	directory := flags.String("dir", "artifacts", "Artifact directory to add the binaries to.")
+	version := flags.String("version", "", "Version of this build of the tools.")
+	platforms := flags.String("platforms", defaultPlatforms, "Comma-separated list of <os>/<arch> to build for.")
+	gitSha := flags.String("git_sha", "", "Git SHA to build into the binaries, e.g. $(git rev-parse --short HEAD).")
+	flags.Parse(args)
+	if *version == "" || flags.NArg() == 0 {
+		return errors.New("usage: build -version <version> [-platforms <os>/<arch>,...] <tool.go>...")
+	}
+	private, err := readKey(*keyFile, ed25519.PrivateKeySize)
+	if err != nil {
+		return err
+	}
+	ldflags := fmt.Sprintf("-s -w -X main.version=%s -X main.buildDate=%s", *version, time.Now().UTC().Format(time.RFC3339))
+	if *gitSha != "" {
+		ldflags += " -X main.gitSha=" + *gitSha
+	}
+	for _, source := range flags.Args() {
+		name := strings.TrimSuffix(filepath.Base(source), ".go")
+		for _, platform := range strings.Split(*platforms, ",") {
+			goos, goarch, ok := strings.Cut(strings.TrimSpace(platform), "/")
+			if !ok {
+				return fmt.Errorf("platform %q is not of the form <os>/<arch>", platform)
+			}
+			contents, err := buildTool(source, goos, goarch, ldflags)
+			if err == nil {
+				err = addArtifact(private, *directory, name, *version, goos, goarch, contents)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Keeps a server certificate and key up to date: when they come from
+// files, the files are checked for a change, at most every
+// certificateCheckSecond, when a client connects, so that renewed
+// credentials are picked up without restarting the server
+type certificateReloader struct {
+	certLocation string
+	keyLocation  string
+	read         func(location string) ([]byte, error)
+	mutex        sync.Mutex
+	certificate  *tls.Certificate
+	modified     time.Time
+	checked      time.Time
+}
+
+// The latest modification time of the certificate and key files,
+// zero if they aren't files
+func (c *certificateReloader) modTime() time.Time {
+	var latest time.Time
+	for _, location := range []string{c.certLocation, c.keyLocation} {
+		info, err := os.Stat(location)
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (c *certificateReloader) load() error {
+	modified := c.modTime()
+	certPem, err := c.read(c.certLocation)
+	if err != nil {
+		return err
+	}
+	keyPem, err := c.read(c.keyLocation)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		slog.Error("Server certificate has expired.", "subject", leaf.Subject.String(),
+			"not-after", leaf.NotAfter.Format(time.RFC3339))
+	} else if time.Now().Add(certificateWarnDays * 24 * time.Hour).After(leaf.NotAfter) {
+		slog.Warn("Server certificate expires soon.", "subject", leaf.Subject.String(),
+			"not-after", leaf.NotAfter.Format(time.RFC3339))
+	}
+	c.certificate = &certificate
+	c.modified = modified
+	return nil
+}
+
+func (c *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if time.Since(c.checked) > certificateCheckSecond*time.Second {
+		c.checked = time.Now()
+		modified := c.modTime()
+		if !modified.IsZero() && !modified.Equal(c.modified) {
+			err := c.load()
+			if err != nil {
+				// Keep going with what we had, the files may be
+				// part way through being replaced
+				slog.Error("Unable to reload server certificate, keeping the previous one.", "error", err)
+			} else {
+				slog.Info("Server certificate reloaded.", "certificate", c.certLocation)
+			}
+		}
+	}
+	return c.certificate, nil
+}
+
+// Make the TLS configuration for the server or client end of a
+// control-plane connection: with caFile the server insists on a client
+// certificate signed by that CA (mutual TLS) and the client only
+// trusts a server certificate signed by that CA
+func controlTlsConfig(certFile string, keyFile string, caFile string, server bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" && server {
+		reloader := &certificateReloader{certLocation: certFile, keyLocation: keyFile, read: readSecret}
+		err := reloader.load()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = reloader.getCertificate
+	} else if certFile != "" {
+		certPem, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, err
+		}
+		keyPem, err := readSecret(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		certificate, err := tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	} else if server {
+		return nil, errors.New("a certificate and key are needed for TLS")
+	}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		if server {
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.RootCAs = pool
+		}
+	}
+	return tlsConfig, nil
+}
+
+// BEGIN SHARED BLOCK trace, see port/platform/common/automation/go_shared
+// A minimal OpenTelemetry trace exporter, OTLP/HTTP with JSON encoding,
+// so that no third-party packages are needed: spans are sent to the
+// collector given by the standard environment variable
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (the full URL) or
+// OTEL_EXPORTER_OTLP_ENDPOINT (the base URL, to which /v1/traces is
+// added); if neither is set tracing is off and costs nothing
+type span struct {
+	traceId    string
+	spanId     string
+	parentId   string
+	name       string
+	kind       int
+	start      time.Time
+	attributes map[string]interface{}
+	events     []spanEvent
+	err        error
+	finish     time.Time
+	mutex      sync.Mutex
+}
+
+type spanEvent struct {
+	name string
+	time time.Time
+}
+
+// OpenTelemetry span kinds
+const spanKindInternal = 1
+const spanKindServer = 2
+
+var traceEndpoint = traceEndpointFromEnvironment()
+var traceSpans = make(chan *span, traceQueueSize)
+var traceFlushes = make(chan chan struct{})
+
+func traceEndpointFromEnvironment() string {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		endpoint = strings.TrimRight(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	}
+	return endpoint
+}
+
+func traceRandomId(size int) string {
+	id := make([]byte, size)
+	crand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Start a span, a child of parent if that isn't nil; returns nil,
+// which all of the span methods accept, if tracing is off
+func traceStart(name string, kind int, parent *span) *span {
+	if traceEndpoint == "" {
+		return nil
+	}
+	s := &span{spanId: traceRandomId(8), name: name, kind: kind, start: time.Now(),
+		attributes: make(map[string]interface{})}
+	if parent != nil {
+		s.traceId = parent.traceId
+		s.parentId = parent.spanId
+	} else {
+		s.traceId = traceRandomId(16)
+	}
+	return s
+}
+
+// Start a span as a child of the one given by a W3C traceparent header,
+// "00-<trace ID>-<parent span ID>-<flags>", so that the span joins the
+// trace of whoever made the request; a new trace if there is none
+func traceStartRemote(name string, kind int, traceparent string) *span {
+	s := traceStart(name, kind, nil)
+	parts := strings.Split(traceparent, "-")
+	if s != nil && len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		s.traceId = parts[1]
+		s.parentId = parts[2]
+	}
+	return s
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.mutex.Lock()
+		s.attributes[key] = value
+		s.mutex.Unlock()
+	}
+}
+
+func (s *span) event(name string) {
+	if s != nil {
+		s.mutex.Lock()
+		s.events = append(s.events, spanEvent{name, time.Now()})
+		s.mutex.Unlock()
+	}
+}
+
+// The trace ID, for log records, so that logs and traces can be matched
+func (s *span) trace() string {
+	if s == nil {
+		return ""
+	}
+	return s.traceId
+}
+
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.err = err
+	s.finish = time.Now()
+	s.mutex.Unlock()
+	select {
+	case traceSpans <- s:
+	default:
+		// Never hold up the server for the sake of tracing
+		slog.Debug("Trace queue full, span dropped.", "span", s.name)
+	}
+}
+
+func traceAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	var result []map[string]interface{}
+	for key, value := range attributes {
+		var typed map[string]interface{}
+		switch v := value.(type) {
+		case string:
+			typed = map[string]interface{}{"stringValue": v}
+		case bool:
+			typed = map[string]interface{}{"boolValue": v}
+		case int:
+			typed = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			typed = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			typed = map[string]interface{}{"doubleValue": v}
+		default:
+			typed = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]interface{}{"key": key, "value": typed})
+	}
+	return result
+}
+
+// A span in the form of OTLP/JSON
+func traceOtlp(s *span) map[string]interface{} {
+	otlp := map[string]interface{}{"traceId": s.traceId, "spanId": s.spanId, "name": s.name,
+		"kind": s.kind, "startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano": strconv.FormatInt(s.finish.UnixNano(), 10),
+		"attributes":      traceAttributes(s.attributes), "status": map[string]interface{}{"code": 1}}
+	if s.parentId != "" {
+		otlp["parentSpanId"] = s.parentId
+	}
+	if s.err != nil {
+		otlp["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+	}
+	var events []map[string]interface{}
+	for _, e := range s.events {
+		events = append(events, map[string]interface{}{"name": e.name,
+			"timeUnixNano": strconv.FormatInt(e.time.UnixNano(), 10)})
+	}
+	if events != nil {
+		otlp["events"] = events
+	}
+	return otlp
+}
+
+// Start sending spans to the collector in batches, every
+// traceFlushSecond or when a batch is full, for as long as the program
+// runs; whatever is left is sent when the program stops
+func traceExport() {
+	if traceEndpoint == "" {
+		return
+	}
+	onShutdown("trace export", func(ctx context.Context) {
+		flushed := make(chan struct{})
+		select {
+		case traceFlushes <- flushed:
+			select {
+			case <-flushed:
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	})
+	go traceSend()
+}
+
+func traceSend() {
+	slog.Info("Exporting traces.", "endpoint", traceEndpoint)
+	client := &http.Client{Timeout: traceFlushSecond * time.Second}
+	resource := map[string]interface{}{"attributes": traceAttributes(map[string]interface{}{
+		"service.name": versionInfo().Tool, "service.version": versionInfo().Version})}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		resource["attributes"] = traceAttributes(map[string]interface{}{
+			"service.name": name, "service.version": versionInfo().Version})
+	}
+	var batch []map[string]interface{}
+	ticker := time.NewTicker(traceFlushSecond * time.Second)
+	for {
+		var flushed chan struct{}
+		select {
+		case s := <-traceSpans:
+			batch = append(batch, traceOtlp(s))
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case flushed = <-traceFlushes:
+			for len(traceSpans) > 0 {
+				batch = append(batch, traceOtlp(<-traceSpans))
+			}
+			if len(batch) == 0 {
+				close(flushed)
+				continue
+			}
+		}
+		body, _ := json.Marshal(map[string]interface{}{"resourceSpans": []interface{}{
+			map[string]interface{}{"resource": resource, "scopeSpans": []interface{}{
+				map[string]interface{}{"scope": map[string]interface{}{"name": versionInfo().Tool,
+					"version": versionInfo().Version}, "spans": batch}}}}})
+		batch = nil
+		response, err := client.Post(traceEndpoint, "application/json", bytes.NewReader(body))
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode/100 != 2 {
+				err = fmt.Errorf("collector returned %s", response.Status)
+			}
+		}
+		if err != nil {
+			slog.Warn("Unable to export spans.", "endpoint", traceEndpoint, "error", err)
+		}
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// END SHARED BLOCK trace
+
+// BEGIN SHARED BLOCK middleware, see port/platform/common/automation/go_shared
+// HttpOptions struct for JSON configuration: what the HTTP APIs of
+// the test tools have in common
+type HttpOptions struct {
+	// If present, the bearer token that every request must carry;
+	// may be env:NAME, vault:PATH#FIELD or file:PATH, see readSecret()
+	Token string `json:"token"`
+	// If non-zero, the requests per second allowed from any one
+	// client address, in bursts of up to Burst
+	RatePerSecond float64 `json:"rate-per-second"`
+	Burst         int     `json:"burst"`
+	// If true, every request is logged, otherwise only failed ones
+	AccessLog bool `json:"access-log"`
+}
+
+// Records the status of a response, for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+// A token bucket per client address
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Whether a request from the client is allowed now and, if not, how
+// long until it would be
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > rateLimitForgetSecond*time.Second {
+		for name, bucket := range l.clients {
+			if now.Sub(bucket.updated) > rateLimitForgetSecond*time.Second {
+				delete(l.clients, name)
+			}
+		}
+		l.swept = now
+	}
+	bucket, ok := l.clients[client]
+	if !ok {
+		bucket = &rateBucket{tokens: l.burst, updated: now}
+		l.clients[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Wrap the handler of an HTTP API in what the HTTP APIs of the test
+// tools have in common, outermost first: the access log, which
+// includes any test session ID given by the client in the header
+// X-Session-Id, then the rate limit, then the bearer token
+func httpMiddleware(handler http.Handler, options HttpOptions) (http.Handler, error) {
+	if options.Token != "" {
+		token, err := readSecret(options.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token: %w", err)
+		}
+		expected := []byte("Bearer " + strings.TrimSpace(string(token)))
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	if options.RatePerSecond > 0 {
+		limiter := &rateLimiter{rate: options.RatePerSecond, burst: float64(options.Burst),
+			clients: make(map[string]*rateBucket)}
+		if limiter.burst < 1 {
+			limiter.burst = 1
+		}
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			allowed, wait := limiter.allow(client)
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	inner := handler
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		inner.ServeHTTP(recorder, r)
+		level := slog.LevelDebug
+		if options.AccessLog {
+			level = slog.LevelInfo
+		}
+		if recorder.status >= 400 {
+			level = slog.LevelWarn
+		}
+		args := []any{"method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "status", recorder.status,
+			"bytes", recorder.bytes, "duration-ms", time.Since(started).Milliseconds()}
+		if session := r.Header.Get("X-Session-Id"); session != "" {
+			args = append(args, "client-session", session)
+		}
+		slog.Log(r.Context(), level, "Request.", args...)
+	})
+	return handler, nil
+}
+
+// END SHARED BLOCK middleware
+
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	directory := flags.String("dir", "artifacts", "Artifact directory to serve.")
+	port := flags.String("port", "8090", "Port to listen on.")
+	certFile := flags.String("cert", "", "Server certificate file (PEM); if given, serve over TLS.")
+	keyFile := flags.String("key", "", "Server private key file (PEM), or env:NAME or vault:PATH#FIELD.")
+	clientCaFile := flags.String("client_ca", "", "CA certificate file (PEM); if given, clients must present a certificate signed by it.")
+	token := flags.String("token", "", "File containing a bearer token that clients must present, or env:NAME or vault:PATH#FIELD.")
+	ratePerSecond := flags.Float64("rate_per_second", 0, "Requests per second allowed from any one client address, 0 for no limit.")
+	burst := flags.Int("burst", 10, "Requests allowed in a burst from any one client address, if -rate_per_second is given.")
+	flags.Parse(args)
+	files := http.FileServer(http.Dir(*directory))
+	http.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versionInfo())
+	})
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/" {
+			http.NotFound(w, r)
+			return
+		}
+		requestSpan := traceStartRemote(r.Method+" "+r.URL.Path, spanKindServer, r.Header.Get("traceparent"))
+		requestSpan.set("network.peer.address", r.RemoteAddr)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		files.ServeHTTP(recorder, r)
+		requestSpan.set("http.response.status_code", recorder.status)
+		requestSpan.set("http.response.body.size", recorder.bytes)
+		var err error
+		if recorder.status >= 400 {
+			err = errors.New(http.StatusText(recorder.status))
+		}
+		requestSpan.end(err)
+	})
+	traceExport()
+	handler, err := httpMiddleware(http.DefaultServeMux, HttpOptions{Token: *token,
+		RatePerSecond: *ratePerSecond, Burst: *burst, AccessLog: true})
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: ":" + *port, Handler: handler}
+	if *certFile == "" && *clientCaFile == "" {
+		slog.Warn("Serving without TLS, anyone who can reach the port can use it.")
+		slog.Info("Serving artifacts.", "directory", *directory, "port", *port)
+	} else {
+		tlsConfig, err := controlTlsConfig(*certFile, *keyFile, *clientCaFile, true)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+		slog.Info("Serving artifacts over TLS.", "directory", *directory, "port", *port,
+			"mutual", *clientCaFile != "")
+	}
+	// Downloads in progress are allowed to finish when stopping
+	onShutdown("http server", func(ctx context.Context) {
+		server.Shutdown(ctx)
+	})
+	go func() {
+		defer recoverPanic()
+		var err error
+		if server.TLSConfig == nil {
+			err = server.ListenAndServe()
+		} else {
+			err = server.ListenAndServeTLS("", "")
+		}
+		if err != http.ErrServerClosed {
+			logFatal("HTTP server failed.", "error", err)
+		}
+	}()
+	<-runContext().Done()
+	exit(exitOk)
+	return nil
+}
+
+func download(client *http.Client, url string, token string) ([]byte, error) {
+	var contents []byte
+	err := retry("download "+url, downloadAttempts, downloadTimeoutSecond*time.Second, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("GET %s returned HTTP status %d", url, response.StatusCode)
+			if response.StatusCode < http.StatusInternalServerError && response.StatusCode != http.StatusTooManyRequests {
+				err = permanent(err)
+			}
+			return err
+		}
+		contents, err = ioutil.ReadAll(response.Body)
+		return err
+	})
+	return contents, err
+}
+
+// Replace a binary, keeping the previous one alongside as ".old";
+// on Windows a running executable can be renamed but not overwritten
+func replaceBinary(target string, contents []byte) error {
+	mode := os.FileMode(0755)
+	info, err := os.Stat(target)
+	if err == nil {
+		mode = info.Mode().Perm()
+	}
+	temporary := target + ".new"
+	err = ioutil.WriteFile(temporary, contents, mode)
+	if err != nil {
+		return err
+	}
+	os.Remove(target + ".old")
+	if info != nil {
+		err = os.Rename(target, target+".old")
+		if err != nil {
+			os.Remove(temporary)
+			return err
+		}
+	}
+	err = os.Rename(temporary, target)
+	if err != nil && info != nil {
+		// Put the old one back
+		os.Rename(target+".old", target)
+	}
+	return err
+}
+
+func selfupdate(args []string) error {
+	self, _ := os.Executable()
+	flags := flag.NewFlagSet("selfupdate", flag.ExitOnError)
+	url := flags.String("url", "", "URL of the artifact server, e.g. http://farm-server:8090.")
+	keyFile := flags.String("key", "update_key.public", "File containing the public key that artifacts must be signed with.")
+	name := flags.String("name", "tool_update", "Name of the tool to update.")
+	target := flags.String("target", self, "Path of the binary to update.")
+	check := flags.Bool("check", false, "Only report whether an update is available.")
+	allowDowngrade := flags.Bool("allow_downgrade", false, "Install the artifact even if it is older than the one installed.")
+	caFile := flags.String("ca", "", "CA certificate file (PEM) that the artifact server's certificate must be signed by.")
+	certFile := flags.String("cert", "", "Client certificate file (PEM) for an artifact server that requires one.")
+	clientKeyFile := flags.String("cert_key", "", "Client private key file (PEM), or env:NAME or vault:PATH#FIELD.")
+	tokenLocation := flags.String("token", "", "File containing the bearer token for an artifact server that requires one, or env:NAME or vault:PATH#FIELD.")
+	flags.Parse(args)
+	if *url == "" {
+		return errors.New("usage: selfupdate -url <artifact server URL> [-name <tool>] [-target <binary>] [-key <public key file>] [-check] [-allow_downgrade]")
+	}
+	public, err := readKey(*keyFile, ed25519.PublicKeySize)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := controlTlsConfig(*certFile, *clientKeyFile, *caFile, false)
+	if err != nil {
+		return err
+	}
+	token := ""
+	if *tokenLocation != "" {
+		contents, err := readSecret(*tokenLocation)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+	client := &http.Client{Timeout: downloadTimeoutSecond * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}}
+	baseUrl := strings.TrimSuffix(*url, "/")
+	contents, err := download(client, baseUrl+"/"+manifestName, token)
+	if err != nil {
+		return err
+	}
+	var manifest ArtifactManifest
+	err = json.Unmarshal(contents, &manifest)
+	if err != nil {
+		return err
+	}
+	key := artifactKey(*name, runtime.GOOS, runtime.GOARCH)
+	artifact, ok := manifest.Artifacts[key]
+	if !ok {
+		return fmt.Errorf("no artifact for %s on the server", key)
+	}
+	signature, err := base64.StdEncoding.DecodeString(artifact.Signature)
+	if err != nil {
+		return fmt.Errorf("signature of %s version %s is not valid base64: %w", key, artifact.Version, err)
+	}
+	if !ed25519.Verify(public, signedMessage(key, artifact), signature) {
+		return fmt.Errorf("signature of %s version %s is not valid", key, artifact.Version)
+	}
+	versionFile := *target + ".version"
+	installed, installedSerial, err := readInstalled(versionFile)
+	if err != nil {
+		return err
+	}
+	current, _ := fileSha256(*target)
+	if current == artifact.Sha256 {
+		slog.Info("Already up to date.", "target", *target, "version", artifact.Version)
+		return nil
+	}
+	if artifact.Serial < installedSerial && !*allowDowngrade {
+		return fmt.Errorf("%s version %s (serial %d) on the server is older than version %s (serial %d) installed, use -allow_downgrade to install it anyway",
+			key, artifact.Version, artifact.Serial, installed, installedSerial)
+	}
+	slog.Info("Update available.", "target", *target, "installed", installed,
+		"available", artifact.Version)
+	if *check {
+		return nil
+	}
+	contents, err = download(client, baseUrl+"/"+artifact.File, token)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(contents)
+	if hex.EncodeToString(digest[:]) != artifact.Sha256 {
+		return fmt.Errorf("downloaded %s does not match its signed digest", artifact.File)
+	}
+	err = replaceBinary(*target, contents)
+	if err == nil {
+		err = writeAtomically(versionFile, []byte(fmt.Sprintf("%s\n%d\n", artifact.Version, artifact.Serial)), 0644)
+	}
+	if err == nil {
+		slog.Info("Updated, restart the tool to use the new version.", "target", *target, "version", artifact.Version)
+	}
+	return err
+}
+
+// Set at build time with, for instance:
+// go build -ldflags "-X main.version=1.4 -X main.gitSha=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version = "development"
+var gitSha = ""
+var buildDate = ""
+
+// Features built into this tool, reported with the version
+var features = []string{"keygen", "sign", "build", "serve", "selfupdate", "mutual-tls"}
+
+// VersionInfo describes this build of the tool
+type VersionInfo struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git-sha"`
+	BuildDate string   `json:"build-date"`
+	GoVersion string   `json:"go-version"`
+	Features  []string `json:"features"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{Tool: "tool_update", Version: version, GitSha: gitSha, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Features: features}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			}
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%s %s (git %s, built %s, %s, features: %s)", v.Tool, v.Version,
+		v.GitSha, v.BuildDate, v.GoVersion, strings.Join(v.Features, ", "))
+}
+
+func logVersion() {
+	v := versionInfo()
+	slog.Info("Version.", "version", v.Version, "git-sha", v.GitSha, "build-date", v.BuildDate,
+		"go-version", v.GoVersion, "features", strings.Join(v.Features, ","))
+}
+
+// Set up structured logging to stderr; timestamps are UTC with
+// milliseconds and every record carries the tool name and any session
+// ID so that the logs of different tools can be merged onto one timeline
+func logSetup(level string, jsonFormat bool, sessionId string) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		logFatal("Unknown log level.", "level", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format("2006-01-02T15:04:05.000Z"))
+			}
+			return a
+		}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if jsonFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler).With("tool", "tool_update")
+	if sessionId != "" {
+		logger = logger.With("session", sessionId)
+	}
+	slog.SetDefault(logger)
+}
+
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	exit(exitFailure)
+}
+
+// How long the shutdown hooks, together, have to finish
+const shutdownTimeoutSecond = 10
+
+// BEGIN SHARED BLOCK lifecycle, see port/platform/common/automation/go_shared
+// Exit codes, the same for all of the test tools, so that whatever
+// runs a tool can tell why it stopped
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitPanic       = 3
+	exitInterrupted = 130
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context)
+}
+
+var shutdownMutex sync.Mutex
+var shutdownHooks []shutdownHook
+var shuttingDown bool
+var runCtx, runCancel = context.WithCancel(context.Background())
+var runSignals = make(chan os.Signal, 2)
+
+// Add a function to be called when the tool stops, however it stops
+// short of being killed: hooks are called in the reverse of the order
+// in which they were added, like defer, with a context that is done
+// when shutdownTimeoutSecond has passed
+func onShutdown(name string, hook func(ctx context.Context)) {
+	shutdownMutex.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+	shutdownMutex.Unlock()
+}
+
+// Return a context that is done when the tool is asked to stop by
+// SIGINT or SIGTERM; a second signal stops the tool immediately
+func runContext() context.Context {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if runSignals != nil {
+		signal.Notify(runSignals, os.Interrupt, syscall.SIGTERM)
+		go func(signals chan os.Signal) {
+			received := <-signals
+			slog.Info("Stopping.", "signal", received.String())
+			runCancel()
+			received = <-signals
+			slog.Warn("Stopping immediately.", "signal", received.String())
+			os.Exit(exitInterrupted)
+		}(runSignals)
+		runSignals = nil
+	}
+	return runCtx
+}
+
+// Run the shutdown hooks and exit with the given code; only the first
+// call does anything, any later one, e.g. from logFatal() in a hook,
+// waits for the first to exit
+func exit(code int) {
+	shutdownMutex.Lock()
+	if shuttingDown {
+		shutdownMutex.Unlock()
+		select {}
+	}
+	shuttingDown = true
+	hooks := shutdownHooks
+	shutdownMutex.Unlock()
+	runCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSecond*time.Second)
+	defer cancel()
+	for x := len(hooks) - 1; x >= 0; x-- {
+		done := make(chan struct{})
+		go func(hook shutdownHook) {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Panic in shutdown.", "hook", hook.name, "panic", r)
+				}
+			}()
+			hook.hook(ctx)
+		}(hooks[x])
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("Shutdown timed out.", "hook", hooks[x].name, "timeout-s", shutdownTimeoutSecond)
+			os.Exit(code)
+		}
+	}
+	os.Exit(code)
+}
+
+// Deferred at the top of main() and of each goroutine that does real
+// work, so that a panic is logged, with its stack, through the same
+// logger as everything else and still runs the shutdown hooks
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("Panic.", "panic", r, "stack", string(debug.Stack()))
+		exit(exitPanic)
+	}
+}
+
+// END SHARED BLOCK lifecycle
+
+// BEGIN SHARED BLOCK retry, see port/platform/common/automation/go_shared
+// Retries, the same in all of the test tools, in place of fixed
+// sleeps: each delay is double the one before, up to a maximum, less
+// up to a half at random so that many clients don't retry in step
+const retryInitialMs = 500
+const retryMaxMs = 30000
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Start again from the initial delay, e.g. once a connection has
+// stayed up for a while
+func (b *backoff) reset() {
+	b.next = b.initial
+}
+
+// Wait for the next delay, returning false if the tool is asked to
+// stop in the meantime
+func (b *backoff) wait() bool {
+	timer := time.NewTimer(b.delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runContext().Done():
+		return false
+	}
+}
+
+// An error that trying again won't fix, e.g. a refusal rather than a
+// failure to connect
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// Call operation up to attempts times, backing off between attempts,
+// each attempt being given a context that is done after timeout or
+// when the tool is asked to stop; a permanent error isn't retried
+func retry(name string, attempts int, timeout time.Duration, operation func(ctx context.Context) error) error {
+	b := newBackoff(retryInitialMs*time.Millisecond, retryMaxMs*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(runContext(), timeout)
+		err := operation(ctx)
+		cancel()
+		var isPermanent permanentError
+		if err == nil || errors.As(err, &isPermanent) || attempt >= attempts {
+			return err
+		}
+		slog.Warn("Failed, trying again.", "operation", name, "attempt", attempt, "error", err)
+		if !b.wait() {
+			return err
+		}
+	}
+}
+
+// END SHARED BLOCK retry
+
+func main() {
+	defer recoverPanic()
+
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	logLevel := flag.String("log_level", "info", "Log level: debug, info, warn or error.")
+	logJson := flag.Bool("log_json", false, "Write the log as JSON rather than text.")
+	sessionId := flag.String("session_id", os.Getenv("UBXLIB_SESSION_ID"), "Test session ID to include in every log record.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] keygen|sign|build|serve|selfupdate [command options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	logSetup(*logLevel, *logJson, *sessionId)
+	logVersion()
+
+	commands := map[string]func([]string) error{"keygen": keygen, "sign": sign, "build": build, "serve": serve, "selfupdate": selfupdate}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		flag.Usage()
+		exit(exitUsage)
+	}
+	err := command(flag.Args()[1:])
+	if err != nil {
+		logFatal("Command failed.", "command", flag.Arg(0), "error", err)
+	}
+}